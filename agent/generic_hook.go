@@ -0,0 +1,367 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/codepr/narwhal/backend"
+	"gopkg.in/yaml.v2"
+)
+
+// Name of the generic hook in the webhook log
+const genericHookService string = "generic"
+
+// Fields of the commit a generic hook payload can be mapped to
+var genericHookFields = []string{
+	"id",
+	"timestamp",
+	"language",
+	"message",
+	"author.name",
+	"author.email",
+	"author.username",
+	"repository.hosting_service",
+	"repository.name",
+	"repository.branch",
+}
+
+// GenericHookConfig maps the payloads of the webhooks of any tool to the
+// commit fields, so that forges without a dedicated integration can trigger
+// builds too. Every rule is either a path in the JSON payload, e.g.
+// $.head_commit.author.name or $.commits[0].id, or a literal value. The id
+// and the repository name are required, a branch in the refs/heads/ form is
+// shortened to its name, one in the refs/tags/ form triggers a tag build.
+//
+//	generic_hook:
+//	  token: s3cr3t
+//	  mapping:
+//	    id: $.after
+//	    message: $.commits[0].message
+//	    author.name: $.pusher.name
+//	    repository.hosting_service: gitlab
+//	    repository.name: $.project.path_with_namespace
+//	    repository.branch: $.ref
+type GenericHookConfig struct {
+	// Token expected in the X-Narwhal-Token header, required
+	Token   string            `yaml:"token"`
+	Mapping map[string]string `yaml:"mapping"`
+}
+
+// AgentConfig is the agent configuration, read from the -conf file, e.g.
+//
+//	secret: s3cr3t
+//	secrets:
+//	  octocat/hello-world: an0th3r-s3cr3t
+//	generic_hook:
+//	  mapping:
+//	    ...
+//	poll:
+//	  repositories:
+//	    ...
+type AgentConfig struct {
+	// Webhook secret of the repositories without one of their own
+	Secret string `yaml:"secret,omitempty"`
+	// Webhook secrets by repository full name
+	Secrets     map[string]string  `yaml:"secrets,omitempty"`
+	GenericHook *GenericHookConfig `yaml:"generic_hook,omitempty"`
+	Poll        *PollConfig        `yaml:"poll,omitempty"`
+	// Repositories whose webhooks are accepted, along with the onboarded
+	// ones, every repository if both are empty
+	Allowlist []string `yaml:"allowlist,omitempty"`
+}
+
+// LoadAgentConfig reads the agent configuration, checking the mapping rules
+// of the generic hook
+func LoadAgentConfig(path string) (*AgentConfig, error) {
+	yamlFile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &AgentConfig{}
+	if err := yaml.Unmarshal(yamlFile, config); err != nil {
+		return nil, err
+	}
+	if config.GenericHook != nil {
+		if err := config.GenericHook.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Poll != nil {
+		if err := config.Poll.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+func (c *GenericHookConfig) validate() error {
+	if c.Token == "" {
+		return fmt.Errorf("generic hook: missing the token")
+	}
+	known := map[string]bool{}
+	for _, field := range genericHookFields {
+		known[field] = true
+	}
+	fields := make([]string, 0, len(c.Mapping))
+	for field := range c.Mapping {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		if !known[field] {
+			return fmt.Errorf("generic hook: unknown field %s, expected one of %s",
+				field, strings.Join(genericHookFields, ", "))
+		}
+		if _, err := parseJSONPath(c.Mapping[field]); err != nil {
+			return fmt.Errorf("generic hook: invalid rule of %s: %v", field, err)
+		}
+	}
+	for _, field := range []string{"id", "repository.name"} {
+		if c.Mapping[field] == "" {
+			return fmt.Errorf("generic hook: missing the rule of %s", field)
+		}
+	}
+	return nil
+}
+
+// WithGenericHook enables the /hook/generic endpoint, mapping the payloads
+// to commits with the given rules
+func WithGenericHook(config GenericHookConfig) AgentOption {
+	return func(a *Agent) {
+		a.genericHook = &config
+	}
+}
+
+// A step of a path in a JSON document, either an object key or an array
+// index
+type jsonPathStep struct {
+	key   string
+	index int
+}
+
+// parseJSONPath splits a $.a.b[0] path in its steps, nil on literal values
+// not starting with $
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, nil
+	}
+	steps := []jsonPathStep{}
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[") + 1
+			if end == 0 {
+				end = len(rest)
+			}
+			if end == 1 {
+				return nil, fmt.Errorf("empty key in %s", path)
+			}
+			steps = append(steps, jsonPathStep{key: rest[1:end], index: -1})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated index in %s", path)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid index %s in %s", rest[1:end], path)
+			}
+			steps = append(steps, jsonPathStep{index: index})
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("unexpected %q in %s", rest[0], path)
+		}
+	}
+	return steps, nil
+}
+
+// resolve returns the value a rule maps to in the payload, as a string, and
+// whether it's set
+func resolve(payload interface{}, rule string) (string, bool) {
+	steps, err := parseJSONPath(rule)
+	if err != nil {
+		return "", false
+	}
+	if steps == nil {
+		return rule, rule != ""
+	}
+	value := payload
+	for _, step := range steps {
+		if step.index < 0 {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+			value = object[step.key]
+		} else {
+			array, ok := value.([]interface{})
+			if !ok || step.index >= len(array) {
+				return "", false
+			}
+			value = array[step.index]
+		}
+	}
+	switch v := value.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, v != ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		data, _ := json.Marshal(v)
+		return string(data), true
+	}
+}
+
+// commit maps a payload to a commit, failing if the required fields are
+// missing
+func (c *GenericHookConfig) commit(payload interface{}) (Commit, error) {
+	commit := Commit{
+		Timestamp:  time.Now(),
+		Repository: Repository{HostingService: GitHub},
+	}
+	for _, field := range genericHookFields {
+		value, ok := resolve(payload, c.Mapping[field])
+		if !ok {
+			continue
+		}
+		switch field {
+		case "id":
+			commit.Id = value
+		case "timestamp":
+			if t, err := time.Parse(time.RFC3339, value); err == nil {
+				commit.Timestamp = t
+			} else if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+				commit.Timestamp = time.Unix(seconds, 0)
+			} else {
+				return commit, fmt.Errorf("invalid timestamp %q, expected RFC 3339 or Unix seconds", value)
+			}
+		case "language":
+			commit.Language = value
+		case "message":
+			commit.Message = value
+		case "author.name":
+			commit.Author.Name = value
+		case "author.email":
+			commit.Author.Email = value
+		case "author.username":
+			commit.Author.Username = value
+		case "repository.hosting_service":
+			commit.Repository.HostingService = HostingService(value)
+		case "repository.name":
+			commit.Repository.Name = value
+		case "repository.branch":
+			commit.Repository.Branch = strings.TrimPrefix(value, "refs/heads/")
+			if tag := strings.TrimPrefix(value, "refs/tags/"); tag != value {
+				commit.Repository.Branch = ""
+				commit.Event, commit.Tag = TagTrigger, tag
+			}
+		}
+	}
+	if commit.Id == "" {
+		return commit, fmt.Errorf("no commit id at %s", c.Mapping["id"])
+	}
+	if commit.Repository.Name == "" {
+		return commit, fmt.Errorf("no repository name at %s", c.Mapping["repository.name"])
+	}
+	return commit, nil
+}
+
+// genericHookHandler triggers a build on any JSON webhook, authenticated by
+// the token of the hook in the X-Narwhal-Token header as the payload can't be
+// expected to be signed. Never in the query string, which ends up in the
+// access logs.
+func genericHookHandler(a *Agent, events chan<- Commit) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		delivery := WebhookDelivery{
+			ReceivedAt:     time.Now(),
+			HostingService: genericHookService,
+			Event:          "push",
+			DeliveryId:     r.Header.Get("X-Request-Id"),
+		}
+		reply := func(status int, message string, fields map[string]interface{}) {
+			delivery.Status, delivery.Message = status, message
+			a.webhooks.Record(delivery)
+			body := map[string]interface{}{"event": delivery.Event, "message": message}
+			for k, v := range fields {
+				body[k] = v
+			}
+			writeReply(w, a.replyKey, status, body)
+		}
+		if a.genericHook == nil {
+			reply(http.StatusNotFound, "generic hook not configured", nil)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		expected := a.genericHook.Token
+		token := r.Header.Get("X-Narwhal-Token")
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			reply(http.StatusUnauthorized, "invalid token, check the generic hook token", nil)
+			return
+		}
+		defer r.Body.Close()
+		var payload interface{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			reply(http.StatusBadRequest, "could not parse the payload", nil)
+			return
+		}
+		commit, err := a.genericHook.commit(payload)
+		delivery.Repository = commit.GetRepositoryName()
+		if err != nil {
+			reply(http.StatusBadRequest, "could not map the payload: "+err.Error(), nil)
+			return
+		}
+		if !a.allowlist.Allowed(commit.GetRepositoryName()) {
+			log.Printf("Ignored generic hook on %s, not in the allowlist\n", commit.GetRepositoryName())
+			reply(http.StatusForbidden, "repository not in the allowlist", nil)
+			return
+		}
+		events <- commit
+		reply(http.StatusAccepted, "build scheduled", map[string]interface{}{
+			"commit":     commit.Id,
+			"repository": commit.GetRepositoryName(),
+		})
+	}
+}
@@ -0,0 +1,107 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/codepr/narwhal/backend"
+)
+
+func TestGenericHookHandler(t *testing.T) {
+	a := NewAgent("commits", WithGenericHook(GenericHookConfig{
+		Token: "s3cr3t",
+		Mapping: map[string]string{
+			"id":                "$.after",
+			"timestamp":         "$.timestamp",
+			"repository.name":   "$.project",
+			"repository.branch": "$.ref",
+		},
+	}))
+	events := make(chan Commit, 1)
+	handler := genericHookHandler(a, events)
+	payload := `{"after":"abc","timestamp":"2020-10-18T10:00:00Z","project":"octocat/test","ref":"refs/heads/dev"}`
+	for _, test := range []struct {
+		name, url, token, body string
+		expected               int
+	}{
+		{"missing token", "/hook/generic", "", payload, http.StatusUnauthorized},
+		{"wrong token", "/hook/generic", "guess", payload, http.StatusUnauthorized},
+		// The webhook secret is not a fallback
+		{"webhook secret", "/hook/generic", defaultWebhookSecret, payload, http.StatusUnauthorized},
+		{"query token", "/hook/generic?token=s3cr3t", "", payload, http.StatusUnauthorized},
+		{"bad timestamp", "/hook/generic", "s3cr3t",
+			`{"after":"abc","timestamp":"yesterday","project":"octocat/test"}`, http.StatusBadRequest},
+		{"valid", "/hook/generic", "s3cr3t", payload, http.StatusAccepted},
+	} {
+		req := httptest.NewRequest(http.MethodPost, test.url, strings.NewReader(test.body))
+		if test.token != "" {
+			req.Header.Set("X-Narwhal-Token", test.token)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != test.expected {
+			t.Errorf("genericHookHandler failed: expected %d got %d for %s", test.expected, rec.Code, test.name)
+		}
+		if rec.Header().Get("X-Narwhal-Signature") != "" {
+			t.Errorf("genericHookHandler failed: expected an unsigned reply for %s", test.name)
+		}
+	}
+	select {
+	case commit := <-events:
+		if commit.Id != "abc" || commit.Repository.Branch != "dev" || commit.Timestamp.Year() != 2020 {
+			t.Errorf("genericHookHandler failed: unexpected commit %v", commit)
+		}
+	default:
+		t.Errorf("genericHookHandler failed: expected a scheduled commit")
+	}
+	if len(events) != 0 {
+		t.Errorf("genericHookHandler failed: expected a single commit")
+	}
+}
+
+func TestGenericHookConfigRequiresToken(t *testing.T) {
+	config := GenericHookConfig{Mapping: map[string]string{"id": "$.after", "repository.name": "$.project"}}
+	if err := config.validate(); err == nil {
+		t.Errorf("validate failed: expected an error without token")
+	}
+	config.Token = "s3cr3t"
+	if err := config.validate(); err != nil {
+		t.Errorf("validate failed: expected no error got %v", err)
+	}
+	// Without a token the endpoint stays closed even if not validated
+	a := NewAgent("commits", WithGenericHook(GenericHookConfig{Mapping: config.Mapping}))
+	rec := httptest.NewRecorder()
+	handler := genericHookHandler(a, make(chan Commit, 1))
+	handler(rec, httptest.NewRequest(http.MethodPost, "/hook/generic", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("genericHookHandler failed: expected 401 got %d", rec.Code)
+	}
+}
@@ -27,10 +27,17 @@
 package agent
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
 	. "github.com/codepr/narwhal/backend"
 	"github.com/google/go-github/v32/github"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
 func healthCheckHandler() http.HandlerFunc {
@@ -39,11 +46,37 @@ func healthCheckHandler() http.HandlerFunc {
 	}
 }
 
-func commitHandler(events chan<- Commit) http.HandlerFunc {
+// commitHandler receives the webhooks of the hosting services, every
+// delivery is recorded in the webhook log and answered with a JSON body
+func commitHandler(a *Agent, events chan<- Commit) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		payload, err := github.ValidatePayload(r, []byte("my-secret-key"))
+		if eventType := r.Header.Get("X-Gitlab-Event"); eventType != "" {
+			gitLabHook(a, events, w, r, eventType)
+			return
+		}
+		delivery := WebhookDelivery{
+			ReceivedAt:     time.Now(),
+			HostingService: string(GitHub),
+			Event:          github.WebHookType(r),
+			DeliveryId:     github.DeliveryID(r),
+		}
+		// The secret depends on the repository, read before the signature
+		// can be validated
+		delivery.Repository = peekGitHubRepository(r)
+		secret := a.secretFor(delivery.Repository)
+		reply := func(status int, message string, fields map[string]interface{}) {
+			delivery.Status, delivery.Message = status, message
+			a.webhooks.Record(delivery)
+			body := map[string]interface{}{"event": delivery.Event, "message": message}
+			for k, v := range fields {
+				body[k] = v
+			}
+			writeReply(w, a.replyKey, status, body)
+		}
+		payload, err := github.ValidatePayload(r, []byte(secret))
 		if err != nil {
 			log.Printf("error validating request body: err=%s\n", err)
+			reply(http.StatusUnauthorized, "invalid signature, check the webhook secret", nil)
 			return
 		}
 		defer r.Body.Close()
@@ -51,30 +84,197 @@ func commitHandler(events chan<- Commit) http.HandlerFunc {
 		event, err := github.ParseWebHook(github.WebHookType(r), payload)
 		if err != nil {
 			log.Printf("could not parse webhook: err=%s\n", err)
+			reply(http.StatusBadRequest, "could not parse the payload", nil)
 			return
 		}
 
 		switch e := event.(type) {
+		case *github.PingEvent:
+			// The ping event of the client library lacks the repository
+			var ping struct {
+				Repository github.Repository `json:"repository"`
+			}
+			json.Unmarshal(payload, &ping)
+			delivery.Repository = ping.Repository.GetFullName()
+			message := "webhook configured correctly"
+			if !a.allowlist.Allowed(delivery.Repository) {
+				message = "webhook configured correctly, but the repository is not in the allowlist"
+			}
+			reply(http.StatusOK, message, map[string]interface{}{
+				"hook_id": e.GetHookID(),
+				"zen":     e.GetZen(),
+			})
 		case *github.PushEvent:
 			// Push it into events channel
-			headCommit := e.GetHeadCommit()
 			repo := e.GetRepo()
-			id, timestamp := headCommit.GetID(), headCommit.Timestamp
-			lang, name, branch := repo.Language, repo.FullName, repo.DefaultBranch
-			commit := Commit{
-				Id:        id,
-				Timestamp: timestamp.Time,
-				Language:  *lang,
-				Repository: Repository{
-					HostingService: GitHub,
-					Name:           *name,
-					Branch:         *branch,
-				},
+			delivery.Repository = repo.GetFullName()
+			if !a.allowlist.Allowed(repo.GetFullName()) {
+				log.Printf("Ignored push on %s, not in the allowlist\n", repo.GetFullName())
+				reply(http.StatusForbidden, "repository not in the allowlist", nil)
+				return
 			}
+			if e.GetDeleted() {
+				reply(http.StatusOK, "event ignored, nothing to build on a deletion", nil)
+				return
+			}
+			commit := gitHubPushCommit(e)
 			events <- commit
+			reply(http.StatusAccepted, "build scheduled", map[string]interface{}{
+				"commit":     commit.Id,
+				"repository": commit.GetRepositoryName(),
+			})
+		case *github.ReleaseEvent:
+			delivery.Repository = e.GetRepo().GetFullName()
+			if !a.allowlist.Allowed(delivery.Repository) {
+				log.Printf("Ignored release on %s, not in the allowlist\n", delivery.Repository)
+				reply(http.StatusForbidden, "repository not in the allowlist", nil)
+				return
+			}
+			// Drafts are not published yet, released follows published
+			if e.GetAction() != "published" {
+				reply(http.StatusOK, "event ignored, only published releases trigger builds", nil)
+				return
+			}
+			commit, err := a.releaseCommit(e)
+			if err != nil {
+				log.Printf("Ignored release %s of %s: %v\n", commit.Tag, delivery.Repository, err)
+				reply(http.StatusBadGateway, "unable to resolve the commit of the release tag", nil)
+				return
+			}
+			events <- commit
+			reply(http.StatusAccepted, "build scheduled", map[string]interface{}{
+				"commit":     commit.Id,
+				"repository": commit.GetRepositoryName(),
+				"tag":        commit.Tag,
+			})
+		case *github.PullRequestEvent:
+			delivery.Repository = e.GetRepo().GetFullName()
+			if !a.allowlist.Allowed(delivery.Repository) {
+				log.Printf("Ignored pull request on %s, not in the allowlist\n", delivery.Repository)
+				reply(http.StatusForbidden, "repository not in the allowlist", nil)
+				return
+			}
+			if !gitHubBuildActions[e.GetAction()] {
+				reply(http.StatusOK, "event ignored, the pull request code did not change", nil)
+				return
+			}
+			commit := gitHubPullRequestCommit(e)
+			events <- commit
+			reply(http.StatusAccepted, "build scheduled", map[string]interface{}{
+				"commit":       commit.Id,
+				"repository":   commit.GetRepositoryName(),
+				"pull_request": commit.PullRequest.Number,
+			})
 		default:
 			log.Printf("Ignored event type %s\n", github.WebHookType(r))
-			return
+			reply(http.StatusOK, "event ignored, only push, release and pull request events trigger builds", nil)
+		}
+	}
+}
+
+// gitHubPushCommit returns the commit to build for a push, on the branch or
+// the tag pushed
+func gitHubPushCommit(e *github.PushEvent) Commit {
+	headCommit, repo := e.GetHeadCommit(), e.GetRepo()
+	author := headCommit.GetAuthor()
+	pushed := make([]string, 0, len(e.Commits))
+	for _, c := range e.Commits {
+		pushed = append(pushed, c.GetID())
+	}
+	commit := Commit{
+		Id:            headCommit.GetID(),
+		Timestamp:     headCommit.GetTimestamp().Time,
+		Language:      repo.GetLanguage(),
+		Message:       headCommit.GetMessage(),
+		PushedCommits: pushed,
+		Author: Author{
+			Name:     author.GetName(),
+			Email:    author.GetEmail(),
+			Username: author.GetLogin(),
+		},
+		Repository: Repository{
+			HostingService: GitHub,
+			Name:           repo.GetFullName(),
+			Branch:         strings.TrimPrefix(e.GetRef(), "refs/heads/"),
+		},
+	}
+	if tag := strings.TrimPrefix(e.GetRef(), "refs/tags/"); tag != e.GetRef() {
+		// Tags are not on a branch
+		commit.Repository.Branch = ""
+		commit.Event, commit.Tag = TagTrigger, tag
+	}
+	return commit
+}
+
+// gitLabHook answers the GitLab deliveries, authenticated by the secret token
+// sent in clear. Only merge requests trigger GitLab builds as of now, the
+// other deliveries, e.g. the tests from the GitLab UI, are acknowledged so the
+// setup can be checked.
+func gitLabHook(a *Agent, events chan<- Commit, w http.ResponseWriter, r *http.Request, eventType string) {
+	delivery := WebhookDelivery{
+		ReceivedAt:     time.Now(),
+		HostingService: GitLab,
+		Event:          eventType,
+		DeliveryId:     r.Header.Get("X-Gitlab-Event-UUID"),
+	}
+	var payload gitLabMergeRequestEvent
+	defer r.Body.Close()
+	json.NewDecoder(r.Body).Decode(&payload)
+	delivery.Repository = payload.Project.PathWithNamespace
+	secret := a.secretFor(delivery.Repository)
+	status, message := http.StatusOK, "webhook configured correctly, only merge requests trigger GitLab builds"
+	var fields map[string]interface{}
+	switch {
+	case subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(secret)) != 1:
+		status, message = http.StatusUnauthorized, "invalid token, check the webhook secret token"
+	case eventType != "Merge Request Hook":
+	case !a.allowlist.Allowed(delivery.Repository):
+		log.Printf("Ignored merge request on %s, not in the allowlist\n", delivery.Repository)
+		status, message = http.StatusForbidden, "repository not in the allowlist"
+	case !payload.changesCode():
+		message = "event ignored, the merge request code did not change"
+	default:
+		commit := payload.commit()
+		events <- commit
+		status, message = http.StatusAccepted, "build scheduled"
+		fields = map[string]interface{}{
+			"commit":        commit.Id,
+			"repository":    commit.GetRepositoryName(),
+			"merge_request": commit.PullRequest.Number,
 		}
 	}
+	delivery.Status, delivery.Message = status, message
+	a.webhooks.Record(delivery)
+	body := map[string]interface{}{"event": eventType, "message": message}
+	for k, v := range fields {
+		body[k] = v
+	}
+	writeReply(w, a.replyKey, status, body)
+}
+
+// peekGitHubRepository returns the full name of the repository of a GitHub
+// delivery, leaving the body untouched for the signature to be validated.
+// The name is not trusted until then, it only selects the secret.
+func peekGitHubRepository(r *http.Request) string {
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	payload := body
+	if r.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return ""
+		}
+		payload = []byte(form.Get("payload"))
+	}
+	var event struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	json.Unmarshal(payload, &event)
+	return event.Repository.FullName
 }
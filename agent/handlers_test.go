@@ -0,0 +1,205 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/codepr/narwhal/backend"
+	"github.com/google/go-github/v32/github"
+)
+
+func TestGitHubPushCommit(t *testing.T) {
+	for _, test := range []struct {
+		ref, branch, tag string
+	}{
+		{"refs/heads/feature/login", "feature/login", ""},
+		{"refs/heads/master", "master", ""},
+		{"refs/tags/v1.0", "", "v1.0"},
+	} {
+		payload := `{"ref":"` + test.ref + `","head_commit":{"id":"abc"},` +
+			`"repository":{"full_name":"octocat/test","default_branch":"master"}}`
+		var e github.PushEvent
+		if err := json.Unmarshal([]byte(payload), &e); err != nil {
+			t.Fatal(err)
+		}
+		commit := gitHubPushCommit(&e)
+		if commit.Repository.Branch != test.branch || commit.Tag != test.tag {
+			t.Errorf("gitHubPushCommit failed: expected branch %q tag %q got %q %q for %s",
+				test.branch, test.tag, commit.Repository.Branch, commit.Tag, test.ref)
+		}
+		if commit.Id != "abc" || commit.GetRepositoryName() != "octocat/test" {
+			t.Errorf("gitHubPushCommit failed: unexpected %+v", commit)
+		}
+	}
+	var e github.PushEvent
+	json.Unmarshal([]byte(`{"ref":"refs/tags/v1.0"}`), &e)
+	if commit := gitHubPushCommit(&e); commit.TriggeredBy() != TagTrigger {
+		t.Errorf("gitHubPushCommit failed: expected a tag trigger got %v", commit.TriggeredBy())
+	}
+}
+
+func TestSecretFor(t *testing.T) {
+	repositories := map[string]string{"octocat/private": "repository-secret"}
+	for _, test := range []struct {
+		name              string
+		config, env       string
+		private, expected string
+	}{
+		{"default", "", "", "repository-secret", defaultWebhookSecret},
+		{"config", "config-secret", "", "repository-secret", "config-secret"},
+		{"env over config", "config-secret", "env-secret", "repository-secret", "env-secret"},
+	} {
+		// Applied in the order of cmd/agent, the environment last
+		a := NewAgent("commits", WithWebhookSecret(test.config), WithRepositorySecrets(repositories),
+			WithWebhookSecret(test.env))
+		if secret := a.secretFor("octocat/test"); secret != test.expected {
+			t.Errorf("secretFor %s failed: expected %s got %s", test.name, test.expected, secret)
+		}
+		if secret := a.secretFor("octocat/private"); secret != test.private {
+			t.Errorf("secretFor %s failed: expected %s got %s", test.name, test.private, secret)
+		}
+	}
+}
+
+func TestCommitHandlerRepositorySecret(t *testing.T) {
+	a := NewAgent("commits", WithWebhookSecret("agent-secret"),
+		WithRepositorySecrets(map[string]string{"octocat/private": "repository-secret"}))
+	handler := commitHandler(a, make(chan Commit, 1))
+	ping := func(repository, secret string) int {
+		payload := `{"zen":"Keep it simple.","hook_id":1,"repository":{"full_name":"` + repository + `"}}`
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(payload))
+		req := httptest.NewRequest(http.MethodPost, "/commit", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-GitHub-Event", "ping")
+		req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+	for _, test := range []struct {
+		repository, secret string
+		expected           int
+	}{
+		{"octocat/private", "repository-secret", http.StatusOK},
+		{"octocat/private", "agent-secret", http.StatusUnauthorized},
+		{"octocat/test", "agent-secret", http.StatusOK},
+		{"octocat/test", "repository-secret", http.StatusUnauthorized},
+	} {
+		if code := ping(test.repository, test.secret); code != test.expected {
+			t.Errorf("commitHandler failed: expected %d got %d for %s signed with %s",
+				test.expected, code, test.repository, test.secret)
+		}
+	}
+}
+
+func TestCommitHandlerPingReply(t *testing.T) {
+	a := NewAgent("commits", WithWebhookSecret("secret"), WithReplySigningKey("reply-key"),
+		WithAllowlist("octocat/test"))
+	handler := commitHandler(a, make(chan Commit, 1))
+	ping := func(repository string) *httptest.ResponseRecorder {
+		payload := `{"zen":"Keep it simple.","hook_id":42,"repository":{"full_name":"` + repository + `"}}`
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(payload))
+		req := httptest.NewRequest(http.MethodPost, "/commit", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-GitHub-Event", "ping")
+		req.Header.Set("X-GitHub-Delivery", "d-"+repository)
+		req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	rec := ping("octocat/test")
+	mac := hmac.New(sha256.New, []byte("reply-key"))
+	mac.Write(rec.Body.Bytes())
+	if signature := rec.Header().Get("X-Narwhal-Signature"); signature != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("commitHandler failed: expected the reply signed with the reply key got %q", signature)
+	}
+	var body map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusOK || body["event"] != "ping" || body["message"] != "webhook configured correctly" ||
+		body["zen"] != "Keep it simple." || body["hook_id"] != float64(42) {
+		t.Errorf("commitHandler failed: expected the ping acknowledged got %d %v", rec.Code, body)
+	}
+	rec = ping("octocat/other")
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if body["message"] != "webhook configured correctly, but the repository is not in the allowlist" {
+		t.Errorf("commitHandler failed: expected the allowlist reported got %v", body["message"])
+	}
+
+	deliveries := a.webhooks.Deliveries()
+	if len(deliveries) != 2 || deliveries[0].Repository != "octocat/other" ||
+		deliveries[1].DeliveryId != "d-octocat/test" || deliveries[1].Event != "ping" ||
+		deliveries[1].Status != http.StatusOK || deliveries[1].HostingService != string(GitHub) {
+		t.Errorf("commitHandler failed: expected both pings logged got %+v", deliveries)
+	}
+}
+
+func TestGitLabTestDelivery(t *testing.T) {
+	a := NewAgent("commits", WithWebhookSecret("secret"))
+	events := make(chan Commit, 1)
+	handler := commitHandler(a, events)
+	deliver := func(token string) (int, map[string]interface{}) {
+		payload := `{"object_kind":"push","project":{"path_with_namespace":"octocat/test"}}`
+		req := httptest.NewRequest(http.MethodPost, "/commit", strings.NewReader(payload))
+		req.Header.Set("X-Gitlab-Event", "Push Hook")
+		req.Header.Set("X-Gitlab-Event-UUID", "uuid-1")
+		req.Header.Set("X-Gitlab-Token", token)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		var body map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body
+	}
+
+	code, body := deliver("secret")
+	if code != http.StatusOK || body["event"] != "Push Hook" ||
+		body["message"] != "webhook configured correctly, only merge requests trigger GitLab builds" {
+		t.Errorf("gitLabHook failed: expected the test delivery acknowledged got %d %v", code, body)
+	}
+	if len(events) != 0 {
+		t.Errorf("gitLabHook failed: expected no build scheduled for a test delivery")
+	}
+	if code, _ := deliver("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("gitLabHook failed: expected 401 with a wrong token got %d", code)
+	}
+	deliveries := a.webhooks.Deliveries()
+	if len(deliveries) != 2 || deliveries[1].DeliveryId != "uuid-1" || deliveries[1].Repository != "octocat/test" ||
+		deliveries[1].HostingService != string(GitLab) || deliveries[0].Status != http.StatusUnauthorized {
+		t.Errorf("gitLabHook failed: expected both deliveries logged got %+v", deliveries)
+	}
+}
@@ -27,8 +27,10 @@
 package agent
 
 import (
+	"crypto/subtle"
 	"log"
 	"net/http"
+	"strings"
 )
 
 func logging(logger *log.Logger) func(http.Handler) http.Handler {
@@ -41,3 +43,23 @@ func logging(logger *log.Logger) func(http.Handler) http.Handler {
 		})
 	}
 }
+
+// authenticated restricts the management endpoints to the bearer of the
+// management token, refusing every request while none is configured
+func authenticated(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				http.Error(w, "management token not configured, set NARWHAL_AGENT_TOKEN", http.StatusForbidden)
+				return
+			}
+			bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "invalid token", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,324 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/codepr/narwhal/backend"
+	"github.com/google/go-github/v32/github"
+)
+
+// Allowlist of the repositories whose webhooks are accepted by the agent.
+// While empty every repository is accepted, as it was before onboarding.
+type Allowlist struct {
+	mutex        sync.RWMutex
+	repositories map[string]bool
+	// File the allowlist is persisted to, kept in memory only if empty
+	path string
+}
+
+func NewAllowlist(repositories ...string) *Allowlist {
+	allowlist := &Allowlist{repositories: map[string]bool{}}
+	for _, repository := range repositories {
+		allowlist.repositories[repository] = true
+	}
+	return allowlist
+}
+
+// Add allows a repository. The first one added to an empty allowlist stops
+// every other repository from being accepted, the seed ones are allowed
+// along with it to keep accepting the repositories already in use.
+func (a *Allowlist) Add(repository string, seed ...string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.repositories) == 0 {
+		for _, name := range seed {
+			a.repositories[name] = true
+		}
+	}
+	a.repositories[repository] = true
+	return a.save()
+}
+
+// Repositories returns the allowed repositories sorted by name
+func (a *Allowlist) Repositories() []string {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	repositories := make([]string, 0, len(a.repositories))
+	for repository := range a.repositories {
+		repositories = append(repositories, repository)
+	}
+	sort.Strings(repositories)
+	return repositories
+}
+
+// open loads the repositories persisted at path, if any, persisting there
+// the ones added from now on
+func (a *Allowlist) open(path string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var repositories []string
+		if err := json.Unmarshal(data, &repositories); err != nil {
+			return fmt.Errorf("invalid allowlist %s: %v", path, err)
+		}
+		for _, repository := range repositories {
+			a.repositories[repository] = true
+		}
+	}
+	a.path = path
+	return a.save()
+}
+
+// save writes the allowlist to its file, replacing it atomically, must be
+// called holding the lock
+func (a *Allowlist) save() error {
+	if a.path == "" {
+		return nil
+	}
+	repositories := make([]string, 0, len(a.repositories))
+	for repository := range a.repositories {
+		repositories = append(repositories, repository)
+	}
+	sort.Strings(repositories)
+	data, err := json.Marshal(repositories)
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+func (a *Allowlist) Allowed(repository string) bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return len(a.repositories) == 0 || a.repositories[repository]
+}
+
+// HostingClient talks to the API of a hosting service on behalf of the
+// owner of the repository
+type HostingClient interface {
+	// CreateWebhook registers a webhook of the events triggering builds,
+	// delivered to url and signed with secret, returning its ID
+	CreateWebhook(repository Repository, url, secret string) (int64, error)
+	// HeadCommit returns the last commit of the default branch
+	HeadCommit(repository Repository) (Commit, error)
+}
+
+// tokenTransport authenticates every request with a bearer token
+type tokenTransport string
+
+func (t tokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "token "+string(t))
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// GitHub events handled by commitHandler, subscribed by the onboarded
+// repositories
+var gitHubWebhookEvents = []string{"push", "pull_request", "release"}
+
+type gitHubClient struct {
+	client *github.Client
+}
+
+func newGitHubClient(token string) *gitHubClient {
+	httpClient := &http.Client{Transport: tokenTransport(token), Timeout: 15 * time.Second}
+	return &gitHubClient{github.NewClient(httpClient)}
+}
+
+func splitName(name string) (string, string) {
+	parts := strings.SplitN(name, "/", 2)
+	return parts[0], parts[1]
+}
+
+func (g *gitHubClient) CreateWebhook(repository Repository, url, secret string) (int64, error) {
+	owner, repo := splitName(repository.Name)
+	active := true
+	hook, _, err := g.client.Repositories.CreateHook(context.Background(), owner, repo, &github.Hook{
+		Config: map[string]interface{}{
+			"url":          url,
+			"content_type": "json",
+			"secret":       secret,
+		},
+		Events: gitHubWebhookEvents,
+		Active: &active,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return hook.GetID(), nil
+}
+
+func (g *gitHubClient) HeadCommit(repository Repository) (Commit, error) {
+	ctx := context.Background()
+	owner, repo := splitName(repository.Name)
+	r, _, err := g.client.Repositories.Get(ctx, owner, repo)
+	if err != nil {
+		return Commit{}, err
+	}
+	branch, _, err := g.client.Repositories.GetBranch(ctx, owner, repo, r.GetDefaultBranch())
+	if err != nil {
+		return Commit{}, err
+	}
+	head := branch.GetCommit()
+	author := head.GetCommit().GetAuthor()
+	repository.Branch = r.GetDefaultBranch()
+	return Commit{
+		Id:        head.GetSHA(),
+		Timestamp: author.GetDate(),
+		Language:  r.GetLanguage(),
+		Message:   head.GetCommit().GetMessage(),
+		Author: Author{
+			Name:     author.GetName(),
+			Email:    author.GetEmail(),
+			Username: head.GetAuthor().GetLogin(),
+		},
+		Repository: repository,
+	}, nil
+}
+
+// newHostingClient returns the API client of the hosting service of the
+// repository, authenticated with token
+func newHostingClient(service HostingService, token string) (HostingClient, error) {
+	switch service {
+	case GitHub:
+		return newGitHubClient(token), nil
+	}
+	return nil, fmt.Errorf("onboarding on %s not supported", service)
+}
+
+// Onboarding request, token must be allowed to manage the webhooks of the
+// repository
+type onboardRequest struct {
+	URL   string `json:"url"`
+	Token string `json:"token"`
+}
+
+type onboardResponse struct {
+	Repository string `json:"repository"`
+	WebhookId  int64  `json:"webhook_id"`
+	Commit     string `json:"commit"`
+}
+
+// repositoriesInUse returns the repositories the agent is configured for or
+// accepted webhooks of, seeding the allowlist at the first onboarding
+func (a *Agent) repositoriesInUse() []string {
+	var repositories []string
+	for repository := range a.secrets {
+		repositories = append(repositories, repository)
+	}
+	if a.poll != nil {
+		for _, polled := range a.poll.Repositories {
+			if repository, err := ParseGitURL(polled.URL); err == nil {
+				repositories = append(repositories, repository.Name)
+			}
+		}
+	}
+	for _, delivery := range a.webhooks.Deliveries() {
+		if delivery.Repository != "" && delivery.Status < http.StatusBadRequest {
+			repositories = append(repositories, delivery.Repository)
+		}
+	}
+	return repositories
+}
+
+// onboardHandler onboards a project in one call: it creates the webhook
+// pointing to the agent, adds the repository to the allowlist and schedules
+// a verification build of the head of the default branch. It requires the
+// management token.
+func onboardHandler(a *Agent, events chan<- Commit) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if a.webhookURL == "" {
+			http.Error(w, "agent public URL not configured", http.StatusServiceUnavailable)
+			return
+		}
+		var req onboardRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URL == "" || req.Token == "" {
+			http.Error(w, "url and token are required", http.StatusBadRequest)
+			return
+		}
+		repository, err := ParseRepositoryURL(req.URL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		client, err := a.hostingClient(repository.HostingService, req.Token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hookId, err := client.CreateWebhook(repository, a.webhookURL, a.secretFor(repository.Name))
+		if err != nil {
+			log.Printf("Error creating webhook on %s: %v\n", repository.Name, err)
+			http.Error(w, "could not create webhook", http.StatusBadGateway)
+			return
+		}
+		if err := a.allowlist.Add(repository.Name, a.repositoriesInUse()...); err != nil {
+			log.Printf("Error persisting the allowlist: %v\n", err)
+			http.Error(w, "webhook created but the allowlist could not be saved", http.StatusInternalServerError)
+			return
+		}
+		commit, err := client.HeadCommit(repository)
+		if err != nil {
+			log.Printf("Error fetching head of %s: %v\n", repository.Name, err)
+			http.Error(w, "webhook created but verification build failed to start",
+				http.StatusBadGateway)
+			return
+		}
+		events <- commit
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(onboardResponse{
+			Repository: repository.Name,
+			WebhookId:  hookId,
+			Commit:     commit.Id,
+		})
+	}
+}
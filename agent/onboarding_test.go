@@ -0,0 +1,141 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/codepr/narwhal/backend"
+	"github.com/google/go-github/v32/github"
+)
+
+type fakeHostingClient struct {
+	webhooks []string
+}
+
+func (c *fakeHostingClient) CreateWebhook(repository Repository, url, secret string) (int64, error) {
+	c.webhooks = append(c.webhooks, repository.Name)
+	return int64(len(c.webhooks)), nil
+}
+
+func (c *fakeHostingClient) HeadCommit(repository Repository) (Commit, error) {
+	return Commit{Id: "abc", Repository: repository}, nil
+}
+
+func TestOnboardHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allowlist.json")
+	client := &fakeHostingClient{}
+	a := NewAgent("commits", WithWebhookURL("https://ci.example.com/commit"),
+		WithManagementToken("admin"), WithAllowlistFile(path),
+		WithRepositorySecrets(map[string]string{"octocat/configured": "s3cr3t"}))
+	a.hostingClient = func(HostingService, string) (HostingClient, error) { return client, nil }
+	a.webhooks.Record(WebhookDelivery{Repository: "octocat/pushing", Status: http.StatusAccepted})
+	a.webhooks.Record(WebhookDelivery{Repository: "hacker/forged", Status: http.StatusUnauthorized})
+	events := make(chan Commit, 1)
+	handler := authenticated(a.managementToken)(onboardHandler(a, events))
+	call := func(token string) *httptest.ResponseRecorder {
+		body := `{"url":"https://github.com/octocat/new","token":"ghp_x"}`
+		req := httptest.NewRequest(http.MethodPost, "/onboard", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, token := range []string{"", "wrong"} {
+		if rec := call(token); rec.Code != http.StatusUnauthorized {
+			t.Errorf("onboardHandler failed: expected 401 got %d for token %q", rec.Code, token)
+		}
+	}
+	if len(client.webhooks) != 0 || !a.allowlist.Allowed("hacker/forged") {
+		t.Errorf("onboardHandler failed: expected nothing onboarded without the token")
+	}
+	if rec := call("admin"); rec.Code != http.StatusCreated {
+		t.Fatalf("onboardHandler failed: expected 201 got %d", rec.Code)
+	}
+	if commit := <-events; commit.Id != "abc" {
+		t.Errorf("onboardHandler failed: expected the verification build of abc got %s", commit.Id)
+	}
+	// The repositories in use keep being accepted, the others no longer are
+	expected := []string{"octocat/configured", "octocat/new", "octocat/pushing"}
+	if repositories := a.allowlist.Repositories(); !reflect.DeepEqual(repositories, expected) {
+		t.Errorf("onboardHandler failed: expected %v allowed got %v", expected, repositories)
+	}
+	if a.allowlist.Allowed("hacker/forged") {
+		t.Errorf("onboardHandler failed: expected hacker/forged no longer allowed")
+	}
+	// The allowlist survives a restart
+	restarted := NewAgent("commits", WithAllowlistFile(path))
+	if repositories := restarted.allowlist.Repositories(); !reflect.DeepEqual(repositories, expected) {
+		t.Errorf("WithAllowlistFile failed: expected %v got %v", expected, repositories)
+	}
+}
+
+func TestOnboardUnconfigured(t *testing.T) {
+	a := NewAgent("commits", WithWebhookURL("https://ci.example.com/commit"))
+	handler := authenticated(a.managementToken)(onboardHandler(a, make(chan Commit, 1)))
+	req := httptest.NewRequest(http.MethodPost, "/onboard", strings.NewReader(`{}`))
+	req.Header.Set("Authorization", "Bearer ")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("onboardHandler failed: expected 403 without a management token got %d", rec.Code)
+	}
+}
+
+func TestGitHubClientCreateWebhook(t *testing.T) {
+	var hook github.Hook
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/repos/octocat/new/hooks" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&hook)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":7}`))
+	}))
+	defer server.Close()
+	client := newGitHubClient("ghp_x")
+	client.client.BaseURL, _ = url.Parse(server.URL + "/")
+
+	id, err := client.CreateWebhook(Repository{HostingService: GitHub, Name: "octocat/new", Branch: "main"}, "https://ci.example.com/commit", "s3cr3t")
+	if err != nil || id != 7 {
+		t.Fatalf("gitHubClient.CreateWebhook failed: expected hook 7 got %d %v", id, err)
+	}
+	expected := []string{"push", "pull_request", "release"}
+	if !reflect.DeepEqual(hook.Events, expected) || hook.Config["secret"] != "s3cr3t" {
+		t.Errorf("gitHubClient.CreateWebhook failed: expected the %v events got %v", expected, hook.Events)
+	}
+}
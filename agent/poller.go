@@ -0,0 +1,247 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	. "github.com/codepr/narwhal/backend"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// Default interval between two polls of the branch heads
+const defaultPollInterval = time.Minute
+
+// PollConfig lists the repositories whose branch heads are polled, for the
+// environments where the Git servers can't deliver webhooks, e.g.
+//
+//	poll:
+//	  interval: 1m
+//	  state: /var/lib/narwhal/heads.json
+//	  repositories:
+//	    - url: https://github.com/octocat/hello-world
+//	      branches: [main]
+//	    - url: ssh://git@git.example.com:2222/team/project.git
+//	      credentials:
+//	        ssh_key: /etc/narwhal/id_ed25519
+//
+// The heads are persisted at state, if set, so that the pushes made while the
+// agent is down are built once it's back.
+type PollConfig struct {
+	Interval     time.Duration      `yaml:"interval,omitempty"`
+	State        string             `yaml:"state,omitempty"`
+	Repositories []PolledRepository `yaml:"repositories"`
+}
+
+// PolledRepository is a repository to poll, every branch unless some are
+// given
+type PolledRepository struct {
+	URL         string      `yaml:"url"`
+	Branches    []string    `yaml:"branches,omitempty"`
+	Credentials Credentials `yaml:"credentials,omitempty"`
+}
+
+func (c *PollConfig) validate() error {
+	for _, repository := range c.Repositories {
+		if _, err := ParseGitURL(repository.URL); err != nil {
+			return fmt.Errorf("poll: %v", err)
+		}
+	}
+	return nil
+}
+
+// WithPolling polls the branch heads of the given repositories, emitting a
+// commit whenever one moves
+func WithPolling(config PollConfig) AgentOption {
+	return func(a *Agent) {
+		a.poll = &config
+	}
+}
+
+// Poller periodically lists the branch heads of the repositories, like git
+// ls-remote does, and emits a commit event for every head that changed or
+// appeared since the previous poll. The first poll of a repository only
+// records its heads, so that a new repository doesn't build every branch.
+type Poller struct {
+	config PollConfig
+	// Head commit of every polled branch by branch name, by repository URL,
+	// the repositories missing were never listed
+	heads map[string]map[string]string
+	// Lists the heads of the branches of a repository by branch name
+	listHeads func(PolledRepository) (map[string]string, error)
+}
+
+func NewPoller(config PollConfig) *Poller {
+	if config.Interval <= 0 {
+		config.Interval = defaultPollInterval
+	}
+	p := &Poller{
+		config:    config,
+		heads:     map[string]map[string]string{},
+		listHeads: lsRemote,
+	}
+	if err := p.load(); err != nil {
+		log.Printf("Error loading the polled heads: %v\n", err)
+	}
+	return p
+}
+
+// load reads the heads persisted at the state path, if any
+func (p *Poller) load() error {
+	if p.config.State == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(p.config.State)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &p.heads); err != nil {
+		return fmt.Errorf("invalid poll state %s: %v", p.config.State, err)
+	}
+	return nil
+}
+
+// save writes the heads to the state path, replacing it atomically
+func (p *Poller) save() error {
+	if p.config.State == "" {
+		return nil
+	}
+	data, err := json.Marshal(p.heads)
+	if err != nil {
+		return err
+	}
+	tmp := p.config.State + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.config.State)
+}
+
+// lsRemote lists the branch heads of a repository without cloning it
+func lsRemote(repository PolledRepository) (map[string]string, error) {
+	auth, err := repository.Credentials.AuthMethod()
+	if err != nil {
+		return nil, err
+	}
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{repository.URL},
+	})
+	refs, err := remote.List(&git.ListOptions{Auth: auth})
+	if err != nil {
+		return nil, err
+	}
+	heads := map[string]string{}
+	for _, ref := range refs {
+		if ref.Name().IsBranch() {
+			heads[ref.Name().Short()] = ref.Hash().String()
+		}
+	}
+	return heads, nil
+}
+
+// Poll lists the heads of every repository once, returning the commits of
+// the ones that moved. Repositories that can't be listed are logged and
+// retried on the next poll.
+func (p *Poller) Poll() []Commit {
+	commits := []Commit{}
+	for _, polled := range p.config.Repositories {
+		repository, err := ParseGitURL(polled.URL)
+		if err != nil {
+			log.Printf("Error polling %s: %v\n", polled.URL, err)
+			continue
+		}
+		heads, err := p.listHeads(polled)
+		if err != nil {
+			log.Printf("Error polling %s: %v\n", polled.URL, err)
+			continue
+		}
+		previous, polledBefore := p.heads[polled.URL]
+		p.heads[polled.URL] = heads
+		branches := polled.Branches
+		if len(branches) == 0 {
+			for branch := range heads {
+				branches = append(branches, branch)
+			}
+			sort.Strings(branches)
+		}
+		for _, branch := range branches {
+			head, ok := heads[branch]
+			if !ok {
+				continue
+			}
+			if !polledBefore || previous[branch] == head {
+				continue
+			}
+			repository.Branch = branch
+			commit := Commit{
+				Id:            head,
+				Timestamp:     time.Now(),
+				Repository:    repository,
+				PushedCommits: []string{head},
+			}
+			if repository.HostingService == Git {
+				commit.CloneURL = polled.URL
+			}
+			commits = append(commits, commit)
+		}
+	}
+	if err := p.save(); err != nil {
+		log.Printf("Error saving the polled heads: %v\n", err)
+	}
+	return commits
+}
+
+// Run polls the repositories at every interval until stop is closed, pushing
+// the commits of the moved heads to the events channel
+func (p *Poller) Run(events chan<- Commit, stop <-chan bool) {
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	for {
+		for _, commit := range p.Poll() {
+			log.Printf("Branch %s of %s moved to %s\n", commit.Repository.Branch,
+				commit.GetRepositoryName(), commit.Id)
+			events <- commit
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/codepr/narwhal/backend"
+)
+
+// fakeRemote serves the heads of the branches of a repository by URL
+type fakeRemote map[string]map[string]string
+
+func (f fakeRemote) listHeads(repository PolledRepository) (map[string]string, error) {
+	heads, ok := f[repository.URL]
+	if !ok {
+		return nil, errors.New("repository not found")
+	}
+	copied := map[string]string{}
+	for branch, head := range heads {
+		copied[branch] = head
+	}
+	return copied, nil
+}
+
+const selfHostedURL = "ssh://git@git.example.com:2222/team/project.git"
+
+func newTestPoller(remote fakeRemote, state string, branches ...string) *Poller {
+	p := NewPoller(PollConfig{
+		State: state,
+		Repositories: []PolledRepository{
+			{URL: selfHostedURL, Branches: branches},
+		},
+	})
+	p.listHeads = remote.listHeads
+	return p
+}
+
+func TestPollerPoll(t *testing.T) {
+	remote := fakeRemote{selfHostedURL: {"main": "a1", "dev": "b1"}}
+	p := newTestPoller(remote, "")
+	if commits := p.Poll(); len(commits) != 0 {
+		t.Errorf("Poller.Poll failed: expected no commits on the first poll got %v", commits)
+	}
+	remote[selfHostedURL]["dev"] = "b2"
+	remote[selfHostedURL]["feature"] = "c1"
+	commits := p.Poll()
+	if len(commits) != 2 {
+		t.Fatalf("Poller.Poll failed: expected 2 commits got %v", commits)
+	}
+	expected := Repository{HostingService: Git, Name: "team/project", Branch: "dev"}
+	if commits[0].Id != "b2" || commits[0].Repository != expected || commits[0].CloneURL != selfHostedURL {
+		t.Errorf("Poller.Poll failed: expected b2 on %v from %s got %s on %v from %s", expected,
+			selfHostedURL, commits[0].Id, commits[0].Repository, commits[0].CloneURL)
+	}
+	if commits[1].Id != "c1" || commits[1].Repository.Branch != "feature" {
+		t.Errorf("Poller.Poll failed: expected c1 on feature got %s on %s", commits[1].Id, commits[1].Repository.Branch)
+	}
+	if commits := p.Poll(); len(commits) != 0 {
+		t.Errorf("Poller.Poll failed: expected no commits for unmoved heads got %v", commits)
+	}
+}
+
+func TestPollerPollBranches(t *testing.T) {
+	remote := fakeRemote{selfHostedURL: {"main": "a1", "dev": "b1"}}
+	p := newTestPoller(remote, "", "main")
+	p.Poll()
+	remote[selfHostedURL]["main"] = "a2"
+	remote[selfHostedURL]["dev"] = "b2"
+	commits := p.Poll()
+	if len(commits) != 1 || commits[0].Id != "a2" {
+		t.Errorf("Poller.Poll failed: expected only a2 on main got %v", commits)
+	}
+}
+
+func TestPollerPollUnreachable(t *testing.T) {
+	remote := fakeRemote{}
+	p := newTestPoller(remote, "")
+	if commits := p.Poll(); len(commits) != 0 {
+		t.Errorf("Poller.Poll failed: expected no commits got %v", commits)
+	}
+	remote[selfHostedURL] = map[string]string{"main": "a1"}
+	if commits := p.Poll(); len(commits) != 0 {
+		t.Errorf("Poller.Poll failed: expected the first listing to be a baseline got %v", commits)
+	}
+}
+
+func TestPollerState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "narwhal-poller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state := filepath.Join(dir, "heads.json")
+	remote := fakeRemote{selfHostedURL: {"main": "a1"}}
+	newTestPoller(remote, state).Poll()
+
+	// Pushed while the agent was down
+	remote[selfHostedURL]["main"] = "a2"
+	commits := newTestPoller(remote, state).Poll()
+	if len(commits) != 1 || commits[0].Id != "a2" {
+		t.Errorf("Poller.Poll failed: expected a2 after a restart got %v", commits)
+	}
+}
+
+func TestPollConfigValidate(t *testing.T) {
+	config := PollConfig{Repositories: []PolledRepository{{URL: selfHostedURL}}}
+	if err := config.validate(); err != nil {
+		t.Errorf("PollConfig.validate failed: expected self-hosted URLs to be valid got %v", err)
+	}
+	config.Repositories = append(config.Repositories, PolledRepository{URL: "not a url"})
+	if err := config.validate(); err == nil {
+		t.Errorf("PollConfig.validate failed: expected error for an invalid URL")
+	}
+}
@@ -0,0 +1,161 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"time"
+
+	. "github.com/codepr/narwhal/backend"
+	"github.com/google/go-github/v32/github"
+)
+
+// Actions of the pull and merge requests changing the code to build
+var (
+	gitHubBuildActions = map[string]bool{"opened": true, "reopened": true, "synchronize": true}
+	gitLabBuildActions = map[string]bool{"open": true, "reopen": true, "update": true}
+)
+
+// gitHubPullRequestCommit returns the commit building a GitHub pull request,
+// its head commit on the base repository. Pull requests whose head repository
+// is another one, or deleted, are marked as coming from a fork.
+func gitHubPullRequestCommit(e *github.PullRequestEvent) Commit {
+	pr, repo := e.GetPullRequest(), e.GetRepo()
+	mergeRef, headRef := GitHubPullRequestRefs(pr.GetNumber())
+	// No merge ref is computed on conflicts
+	if pr.Mergeable != nil && !pr.GetMergeable() {
+		mergeRef = ""
+	}
+	timestamp := pr.GetUpdatedAt()
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	return Commit{
+		Id:        pr.GetHead().GetSHA(),
+		Timestamp: timestamp,
+		Language:  repo.GetLanguage(),
+		Message:   pr.GetTitle(),
+		Author: Author{
+			Name:     pr.GetUser().GetName(),
+			Email:    pr.GetUser().GetEmail(),
+			Username: pr.GetUser().GetLogin(),
+		},
+		Repository: Repository{
+			HostingService: GitHub,
+			Name:           repo.GetFullName(),
+			Branch:         pr.GetHead().GetRef(),
+		},
+		Event: PullRequestTrigger,
+		PullRequest: &PullRequest{
+			Number:     pr.GetNumber(),
+			Title:      pr.GetTitle(),
+			URL:        pr.GetHTMLURL(),
+			BaseBranch: pr.GetBase().GetRef(),
+			HeadBranch: pr.GetHead().GetRef(),
+			HeadSHA:    pr.GetHead().GetSHA(),
+			MergeRef:   mergeRef,
+			HeadRef:    headRef,
+			Fork:       pr.GetHead().GetRepo().GetFullName() != repo.GetFullName(),
+		},
+	}
+}
+
+// gitLabMergeRequestEvent is the part of a GitLab merge request hook payload
+// needed to build it
+type gitLabMergeRequestEvent struct {
+	User struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+	Attributes struct {
+		IID          int    `json:"iid"`
+		Title        string `json:"title"`
+		URL          string `json:"url"`
+		SourceBranch string `json:"source_branch"`
+		TargetBranch string `json:"target_branch"`
+		Action       string `json:"action"`
+		// Projects of the source and target branches, different on forks
+		SourceProjectId int `json:"source_project_id"`
+		TargetProjectId int `json:"target_project_id"`
+		// Set on updates pushing new commits only
+		OldRev     string `json:"oldrev"`
+		LastCommit struct {
+			Id        string    `json:"id"`
+			Message   string    `json:"message"`
+			Timestamp time.Time `json:"timestamp"`
+			Author    struct {
+				Name  string `json:"name"`
+				Email string `json:"email"`
+			} `json:"author"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+// changesCode tells if the merge request event brings code to build, updates
+// of the title, the labels and so on don't
+func (e *gitLabMergeRequestEvent) changesCode() bool {
+	action := e.Attributes.Action
+	return gitLabBuildActions[action] && (action != "update" || e.Attributes.OldRev != "")
+}
+
+// commit returns the commit building the merge request
+func (e *gitLabMergeRequestEvent) commit() Commit {
+	attributes, last := e.Attributes, e.Attributes.LastCommit
+	mergeRef, headRef := GitLabMergeRequestRefs(attributes.IID)
+	timestamp := last.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	return Commit{
+		Id:        last.Id,
+		Timestamp: timestamp,
+		Message:   last.Message,
+		Author: Author{
+			Name:     last.Author.Name,
+			Email:    last.Author.Email,
+			Username: e.User.Username,
+		},
+		Repository: Repository{
+			HostingService: GitLab,
+			Name:           e.Project.PathWithNamespace,
+			Branch:         attributes.SourceBranch,
+		},
+		Event: PullRequestTrigger,
+		PullRequest: &PullRequest{
+			Number:     attributes.IID,
+			Title:      attributes.Title,
+			URL:        attributes.URL,
+			BaseBranch: attributes.TargetBranch,
+			HeadBranch: attributes.SourceBranch,
+			HeadSHA:    last.Id,
+			MergeRef:   mergeRef,
+			HeadRef:    headRef,
+			Fork:       attributes.SourceProjectId != attributes.TargetProjectId,
+		},
+	}
+}
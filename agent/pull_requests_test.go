@@ -0,0 +1,74 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-github/v32/github"
+)
+
+func TestGitHubPullRequestFork(t *testing.T) {
+	for _, test := range []struct {
+		name, head string
+		fork       bool
+	}{
+		{"same repository", "octocat/test", false},
+		{"fork", "hacker/test", true},
+		// The fork was deleted
+		{"no head repository", "", true},
+	} {
+		payload := `{"action":"opened","repository":{"full_name":"octocat/test"},` +
+			`"pull_request":{"number":1,"head":{"sha":"abc","ref":"feature"`
+		if test.head != "" {
+			payload += `,"repo":{"full_name":"` + test.head + `"}`
+		}
+		payload += `},"base":{"ref":"master"}}}`
+		var e github.PullRequestEvent
+		if err := json.Unmarshal([]byte(payload), &e); err != nil {
+			t.Fatal(err)
+		}
+		commit := gitHubPullRequestCommit(&e)
+		if commit.PullRequest.Fork != test.fork {
+			t.Errorf("gitHubPullRequestCommit failed: expected fork %v got %v for %s",
+				test.fork, commit.PullRequest.Fork, test.name)
+		}
+	}
+}
+
+func TestGitLabMergeRequestFork(t *testing.T) {
+	var e gitLabMergeRequestEvent
+	e.Attributes.SourceProjectId, e.Attributes.TargetProjectId = 1, 1
+	if commit := e.commit(); commit.PullRequest.Fork {
+		t.Errorf("gitLabMergeRequestEvent.commit failed: expected no fork")
+	}
+	e.Attributes.SourceProjectId = 2
+	if commit := e.commit(); !commit.PullRequest.Fork {
+		t.Errorf("gitLabMergeRequestEvent.commit failed: expected a fork")
+	}
+}
@@ -0,0 +1,252 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/codepr/narwhal/backend"
+	. "github.com/codepr/narwhal/internal"
+)
+
+// Rounds of attempts over the dispatchers before spooling an event
+const directSubmitAttempts int = 3
+
+// Events waiting for the submitting worker, beyond them new events are
+// spooled right away
+const submitBacklog int = 1024
+
+// errBacklogFull is returned when an event finds the backlog full and there's
+// no spool to keep it
+var errBacklogFull = errors.New("submission backlog full")
+
+// errRejected is returned when a dispatcher refuses an event as invalid,
+// retrying it later would not help
+var errRejected = errors.New("event rejected by the dispatcher")
+
+// sealedQueue encrypts the payloads before producing them, the direct
+// submissions to the dispatchers go over HTTPS in the clear
+type sealedQueue struct {
+	ProducerConsumer
+	keyring *Keyring
+}
+
+func (q sealedQueue) Produce(payload []byte) error {
+	sealed, err := q.keyring.Seal(payload)
+	if err != nil {
+		return err
+	}
+	return q.ProducerConsumer.Produce(sealed)
+}
+
+// Submitter delivers the commit events to the dispatchers, through the
+// message queue when it's reachable and by posting them directly to the
+// dispatchers otherwise. Events that can't be delivered either way are
+// spooled on disk and delivered again later.
+type Submitter struct {
+	queue       ProducerConsumer
+	dispatchers []string
+	token       string
+	spoolDir    string
+	client      *http.Client
+	backlog     chan []byte
+	// Serializes the spool flushes
+	mutex sync.Mutex
+}
+
+func NewSubmitter(queue ProducerConsumer, dispatchers []string, token, spoolDir string) *Submitter {
+	urls := make([]string, len(dispatchers))
+	for i, url := range dispatchers {
+		urls[i] = strings.TrimRight(url, "/")
+	}
+	return &Submitter{
+		queue:       queue,
+		dispatchers: urls,
+		token:       token,
+		spoolDir:    spoolDir,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		backlog:     make(chan []byte, submitBacklog),
+	}
+}
+
+// Enqueue hands an event to the submitting worker without waiting for its
+// delivery, which may take a while with the queue down, spooling it if the
+// backlog is full
+func (s *Submitter) Enqueue(payload []byte) error {
+	select {
+	case s.backlog <- payload:
+		return nil
+	default:
+	}
+	if s.spoolDir == "" {
+		return errBacklogFull
+	}
+	log.Println("Spooling commit event, the submission backlog is full")
+	return s.spool(payload)
+}
+
+// work submits the enqueued events in order until stopped
+func (s *Submitter) work(stop <-chan bool) {
+	for {
+		select {
+		case payload := <-s.backlog:
+			if err := s.Submit(payload); err != nil {
+				log.Printf("Error submitting event: %v\n", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Submit delivers an event, spooling it if no route is available
+func (s *Submitter) Submit(payload []byte) error {
+	err := s.deliver(payload)
+	if err == nil || err == errRejected || s.spoolDir == "" {
+		return err
+	}
+	log.Printf("Spooling commit event, delivery failed: %v\n", err)
+	return s.spool(payload)
+}
+
+// deliver produces the event on the queue, falling back to the dispatchers
+func (s *Submitter) deliver(payload []byte) error {
+	err := s.queue.Produce(payload)
+	if err == nil || len(s.dispatchers) == 0 {
+		return err
+	}
+	log.Printf("Error producing event to queue, submitting it directly: %v\n", err)
+	for attempt := 1; attempt <= directSubmitAttempts; attempt++ {
+		for _, url := range s.dispatchers {
+			if err = s.post(url, payload); err == nil || err == errRejected {
+				return err
+			}
+			log.Printf("Error submitting event to %s: %v\n", url, err)
+		}
+		if attempt < directSubmitAttempts {
+			time.Sleep(time.Duration(attempt) * 500 * time.Millisecond)
+		}
+	}
+	return err
+}
+
+// post submits an event to POST /commits of a dispatcher, a commit already
+// submitted counts as delivered
+func (s *Submitter) post(url string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url+"/commits", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode < 300 || res.StatusCode == http.StatusConflict:
+		return nil
+	case res.StatusCode == http.StatusBadRequest:
+		return errRejected
+	}
+	return fmt.Errorf("dispatcher answered with status %d", res.StatusCode)
+}
+
+// spool writes an event to the spool directory, named after the time it was
+// received to preserve the order
+func (s *Submitter) spool(payload []byte) error {
+	if err := os.MkdirAll(s.spoolDir, 0700); err != nil {
+		return err
+	}
+	sum := sha1.Sum(payload)
+	name := fmt.Sprintf("%020d-%s.json", time.Now().UnixNano(), hex.EncodeToString(sum[:4]))
+	tmp := filepath.Join(s.spoolDir, "."+name)
+	if err := ioutil.WriteFile(tmp, payload, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.spoolDir, name))
+}
+
+// Flush delivers the spooled events in order, stopping at the first failure
+func (s *Submitter) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	files, err := filepath.Glob(filepath.Join(s.spoolDir, "*.json"))
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		payload, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := s.deliver(payload); err == errRejected {
+			log.Printf("Dropping spooled event %s: %v\n", file, err)
+		} else if err != nil {
+			return err
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	log.Printf("Delivered %d spooled commit events\n", len(files))
+	return nil
+}
+
+// flushSpool periodically delivers the spooled events until stopped
+func (s *Submitter) flushSpool(interval time.Duration, stop <-chan bool) {
+	if s.spoolDir == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Flush(); err != nil {
+			log.Printf("Error delivering spooled events: %v\n", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingQueue holds every produced event until released
+type blockingQueue struct {
+	release  chan struct{}
+	mutex    sync.Mutex
+	produced []string
+}
+
+func (q *blockingQueue) Produce(payload []byte) error {
+	<-q.release
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.produced = append(q.produced, string(payload))
+	return nil
+}
+
+func (q *blockingQueue) Consume(chan []byte) error {
+	return nil
+}
+
+func (q *blockingQueue) count() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.produced)
+}
+
+func TestSubmitterEnqueue(t *testing.T) {
+	queue := &blockingQueue{release: make(chan struct{})}
+	dir := t.TempDir()
+	submitter := NewSubmitter(queue, nil, "", dir)
+	stop := make(chan bool)
+	defer close(stop)
+	go submitter.work(stop)
+
+	// Enqueueing doesn't wait for the stuck queue, the events beyond the
+	// backlog are spooled
+	total := submitBacklog + 2
+	enqueued := make(chan struct{})
+	go func() {
+		for i := 0; i < total; i++ {
+			if err := submitter.Enqueue([]byte(strconv.Itoa(i))); err != nil {
+				t.Errorf("Submitter.Enqueue failed: unexpected %v", err)
+			}
+		}
+		close(enqueued)
+	}()
+	select {
+	case <-enqueued:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Submitter.Enqueue failed: blocked on the queue")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(files) == 0 {
+		t.Errorf("Submitter.Enqueue failed: expected the events beyond the backlog spooled")
+	}
+	close(queue.release)
+	if err := submitter.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for queue.count() < total && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := queue.count(); count != total {
+		t.Errorf("Submitter.work failed: expected %d events delivered got %d", total, count)
+	}
+	// The backlog is delivered in order, the spool whenever flushed
+	index := map[string]int{}
+	for i, payload := range queue.produced {
+		index[payload] = i
+	}
+	if index["0"] > index["1"] || index["1"] > index["2"] {
+		t.Errorf("Submitter.work failed: expected the backlog delivered in order got %v", queue.produced[:3])
+	}
+
+	// Without a spool the events beyond the backlog are refused
+	blocked := &blockingQueue{release: make(chan struct{})}
+	defer close(blocked.release)
+	unspooled := NewSubmitter(blocked, nil, "", "")
+	for i := 0; i < submitBacklog; i++ {
+		unspooled.Enqueue([]byte("event"))
+	}
+	if err := unspooled.Enqueue([]byte("event")); err != errBacklogFull {
+		t.Errorf("Submitter.Enqueue failed: expected errBacklogFull got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	. "github.com/codepr/narwhal/backend"
+	"github.com/google/go-github/v32/github"
+)
+
+var commitIdRegexp = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+var errNoTagResolver = errors.New("no GitHub token to resolve the tags with")
+
+// WithGitHubToken resolves the tags of the published releases through the
+// GitHub API, authenticated with token. Without it the releases not targeting
+// a commit are rejected.
+func WithGitHubToken(token string) AgentOption {
+	return func(a *Agent) {
+		if token != "" {
+			a.resolveTag = newGitHubClient(token).ResolveTag
+		}
+	}
+}
+
+// ResolveTag returns the commit a tag points to, dereferencing annotated
+// tags
+func (g *gitHubClient) ResolveTag(repository Repository, tag string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	owner, repo := splitName(repository.Name)
+	ref, _, err := g.client.Git.GetRef(ctx, owner, repo, "tags/"+tag)
+	if err != nil {
+		return "", err
+	}
+	object := ref.GetObject()
+	// Annotated tags may point to other tags
+	for object.GetType() == "tag" {
+		annotated, _, err := g.client.Git.GetTag(ctx, owner, repo, object.GetSHA())
+		if err != nil {
+			return "", err
+		}
+		object = annotated.GetObject()
+	}
+	if object.GetType() != "commit" || !commitIdRegexp.MatchString(object.GetSHA()) {
+		return "", fmt.Errorf("tag %s of %s points to a %s", tag, repository.Name, object.GetType())
+	}
+	return object.GetSHA(), nil
+}
+
+// releaseCommit returns the commit of a published GitHub release, built at
+// its tag. The commit is resolved through the tag as the webhook only carries
+// the target branch, unless the release targets a commit.
+func (a *Agent) releaseCommit(e *github.ReleaseEvent) (Commit, error) {
+	release, repo := e.GetRelease(), e.GetRepo()
+	commit := Commit{
+		Timestamp: release.GetPublishedAt().Time,
+		Language:  repo.GetLanguage(),
+		Message:   release.GetName(),
+		Author: Author{
+			Name:     release.GetAuthor().GetName(),
+			Email:    release.GetAuthor().GetEmail(),
+			Username: release.GetAuthor().GetLogin(),
+		},
+		Repository: Repository{
+			HostingService: GitHub,
+			Name:           repo.GetFullName(),
+		},
+		Event: ReleaseTrigger,
+		Tag:   release.GetTagName(),
+	}
+	if commit.Timestamp.IsZero() {
+		commit.Timestamp = time.Now()
+	}
+	if target := release.GetTargetCommitish(); commitIdRegexp.MatchString(target) {
+		commit.Id = target
+		return commit, nil
+	}
+	if a.resolveTag == nil {
+		return commit, errNoTagResolver
+	}
+	id, err := a.resolveTag(commit.Repository, commit.Tag)
+	if err != nil {
+		return commit, fmt.Errorf("resolving tag %s of %s: %v", commit.Tag, repo.GetFullName(), err)
+	}
+	commit.Id = id
+	return commit, nil
+}
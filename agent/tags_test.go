@@ -0,0 +1,98 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	. "github.com/codepr/narwhal/backend"
+	"github.com/google/go-github/v32/github"
+)
+
+func TestGitHubResolveTag(t *testing.T) {
+	commit, tag := strings.Repeat("c", 40), strings.Repeat("a", 40)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/repos/octocat/test/git/ref/tags/v1", "/repos/octocat/test/git/refs/tags/v1":
+			w.Write([]byte(`{"ref":"refs/tags/v1","object":{"type":"commit","sha":"` + commit + `"}}`))
+		case "/repos/octocat/test/git/ref/tags/v2", "/repos/octocat/test/git/refs/tags/v2":
+			w.Write([]byte(`{"ref":"refs/tags/v2","object":{"type":"tag","sha":"` + tag + `"}}`))
+		case "/repos/octocat/test/git/tags/" + tag:
+			w.Write([]byte(`{"sha":"` + tag + `","object":{"type":"commit","sha":"` + commit + `"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	client := newGitHubClient("s3cr3t")
+	client.client.BaseURL, _ = url.Parse(server.URL + "/")
+	repository := Repository{HostingService: GitHub, Name: "octocat/test"}
+	for _, name := range []string{"v1", "v2"} {
+		if id, err := client.ResolveTag(repository, name); err != nil || id != commit {
+			t.Errorf("gitHubClient.ResolveTag failed: expected %s got %s %v for %s", commit, id, err, name)
+		}
+	}
+	if _, err := client.ResolveTag(repository, "missing"); err == nil {
+		t.Errorf("gitHubClient.ResolveTag failed: expected an error on a missing tag got nil")
+	}
+}
+
+func TestReleaseCommit(t *testing.T) {
+	sha := strings.Repeat("c", 40)
+	release := func(target string) *github.ReleaseEvent {
+		var e github.ReleaseEvent
+		json.Unmarshal([]byte(`{"action":"published","release":{"tag_name":"v1","target_commitish":"`+
+			target+`"},"repository":{"full_name":"octocat/test"}}`), &e)
+		return &e
+	}
+	a := NewAgent("commits")
+	// Releases targeting a commit need no resolution
+	if commit, err := a.releaseCommit(release(sha)); err != nil || commit.Id != sha || commit.Tag != "v1" {
+		t.Errorf("releaseCommit failed: expected %s got %+v %v", sha, commit, err)
+	}
+	if _, err := a.releaseCommit(release("main")); err != errNoTagResolver {
+		t.Errorf("releaseCommit failed: expected %v got %v", errNoTagResolver, err)
+	}
+	a.resolveTag = func(Repository, string) (string, error) { return "", errors.New("rate limited") }
+	if _, err := a.releaseCommit(release("main")); err == nil {
+		t.Errorf("releaseCommit failed: expected an error got nil")
+	}
+	a.resolveTag = func(Repository, string) (string, error) { return sha, nil }
+	if commit, err := a.releaseCommit(release("main")); err != nil || commit.Id != sha {
+		t.Errorf("releaseCommit failed: expected %s got %+v %v", sha, commit, err)
+	}
+}
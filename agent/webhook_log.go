@@ -0,0 +1,113 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Number of deliveries kept by the webhook log
+const webhookLogSize int = 100
+
+// WebhookDelivery is a webhook received by the agent and its outcome, for
+// users to verify the setup of their hooks
+type WebhookDelivery struct {
+	ReceivedAt     time.Time `json:"received_at"`
+	HostingService string    `json:"hosting_service"`
+	Event          string    `json:"event"`
+	DeliveryId     string    `json:"delivery_id,omitempty"`
+	Repository     string    `json:"repository,omitempty"`
+	Status         int       `json:"status"`
+	Message        string    `json:"message"`
+}
+
+// WebhookLog keeps the last deliveries in memory
+type WebhookLog struct {
+	mutex      sync.Mutex
+	deliveries []WebhookDelivery
+}
+
+func NewWebhookLog() *WebhookLog {
+	return &WebhookLog{deliveries: []WebhookDelivery{}}
+}
+
+func (l *WebhookLog) Record(delivery WebhookDelivery) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.deliveries = append(l.deliveries, delivery)
+	if len(l.deliveries) > webhookLogSize {
+		l.deliveries = l.deliveries[len(l.deliveries)-webhookLogSize:]
+	}
+}
+
+// Deliveries returns the logged deliveries, most recent first
+func (l *WebhookLog) Deliveries() []WebhookDelivery {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	deliveries := make([]WebhookDelivery, len(l.deliveries))
+	for i, delivery := range l.deliveries {
+		deliveries[len(l.deliveries)-1-i] = delivery
+	}
+	return deliveries
+}
+
+func webhookLogHandler(l *WebhookLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(l.Deliveries())
+	}
+}
+
+// writeReply answers with a JSON body, signed in the X-Narwhal-Signature
+// header with the reply key if any, same scheme as the GitHub deliveries.
+// Never the webhook secret: the body echoes parts of the request, which would
+// make the agent sign payloads of the caller choosing.
+func writeReply(w http.ResponseWriter, key string, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if key != "" {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write(body)
+		w.Header().Set("X-Narwhal-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
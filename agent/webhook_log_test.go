@@ -0,0 +1,50 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agent
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestWebhookLog(t *testing.T) {
+	webhooks := NewWebhookLog()
+	if deliveries := webhooks.Deliveries(); deliveries == nil || len(deliveries) != 0 {
+		t.Errorf("WebhookLog.Deliveries failed: expected an empty list got %v", deliveries)
+	}
+	for i := 0; i < webhookLogSize+5; i++ {
+		webhooks.Record(WebhookDelivery{DeliveryId: fmt.Sprint(i)})
+	}
+	deliveries := webhooks.Deliveries()
+	if len(deliveries) != webhookLogSize {
+		t.Fatalf("WebhookLog.Record failed: expected %d deliveries kept got %d", webhookLogSize, len(deliveries))
+	}
+	// Most recent first, the oldest dropped
+	if first, last := deliveries[0].DeliveryId, deliveries[webhookLogSize-1].DeliveryId; first != fmt.Sprint(webhookLogSize+4) || last != "5" {
+		t.Errorf("WebhookLog.Deliveries failed: expected %d down to 5 got %s down to %s", webhookLogSize+4, first, last)
+	}
+}
@@ -0,0 +1,220 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Permission is an action on the repositories granted to the API tokens
+type Permission string
+
+const (
+	// Read the jobs, their logs and artifacts, the queue and the events
+	PermissionView Permission = "view"
+	// Build a commit, retry a job
+	PermissionTrigger Permission = "trigger"
+	// Cancel a pending or running job
+	PermissionCancel Permission = "cancel"
+	// Read and revoke the clone credentials
+	PermissionManageSecrets Permission = "manage_secrets"
+	// Drain the runners, resize the dispatching workers
+	PermissionManageRunners Permission = "manage_runners"
+	// Register, configure and unregister the repositories
+	PermissionManageRepositories Permission = "manage_repositories"
+)
+
+var permissions = map[Permission]bool{
+	PermissionView: true, PermissionTrigger: true, PermissionCancel: true,
+	PermissionManageSecrets: true, PermissionManageRunners: true, PermissionManageRepositories: true,
+}
+
+// Permissions granted to everyone without access control, the others require
+// the admin token
+var openPermissions = map[Permission]bool{
+	PermissionView: true, PermissionTrigger: true, PermissionCancel: true,
+}
+
+// AccessGrant gives permissions on the repositories matching any of the
+// patterns, e.g. org/*. The * pattern matches every repository and the
+// resources not tied to any, like the runners.
+type AccessGrant struct {
+	Repositories []string     `yaml:"repositories"`
+	Permissions  []Permission `yaml:"permissions"`
+}
+
+// AccessToken is the bearer token of a user or an automation with its
+// grants, e.g.
+//
+//	name: release-bot
+//	token: s3cr3t
+//	grants:
+//	  - repositories: [octocat/*]
+//	    permissions: [view, trigger]
+type AccessToken struct {
+	Name   string        `yaml:"name"`
+	Token  string        `yaml:"token"`
+	Grants []AccessGrant `yaml:"grants"`
+}
+
+// permits tells if any grant of the token gives the permission on the
+// repository, an empty repository stands for the resources not tied to any
+func (t AccessToken) permits(permission Permission, repository string) bool {
+	for _, grant := range t.Grants {
+		if !containsPermission(grant.Permissions, permission) {
+			continue
+		}
+		for _, pattern := range grant.Repositories {
+			if pattern == "*" {
+				return true
+			}
+			if ok, _ := path.Match(pattern, repository); ok && repository != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsPermission(permissions []Permission, permission Permission) bool {
+	for _, p := range permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// AccessControl restricts every API call to the tokens granted the permission
+// on the repository involved, the admin token keeps being allowed everything
+type AccessControl struct {
+	tokens []AccessToken
+}
+
+// NewAccessControl checks the tokens, their names and tokens must be unique
+// and their grants well formed
+func NewAccessControl(tokens ...AccessToken) (*AccessControl, error) {
+	names, secrets := map[string]bool{}, map[string]bool{}
+	for _, token := range tokens {
+		if token.Name == "" || token.Token == "" {
+			return nil, fmt.Errorf("access tokens require a name and a token")
+		}
+		if names[token.Name] || secrets[token.Token] {
+			return nil, fmt.Errorf("duplicate access token %s", token.Name)
+		}
+		names[token.Name], secrets[token.Token] = true, true
+		if err := validateGrants(token.Grants); err != nil {
+			return nil, fmt.Errorf("access token %s: %v", token.Name, err)
+		}
+	}
+	return &AccessControl{tokens: tokens}, nil
+}
+
+// validateGrants checks the permissions and the repository patterns of the
+// grants
+func validateGrants(grants []AccessGrant) error {
+	for _, grant := range grants {
+		for _, permission := range grant.Permissions {
+			if !permissions[permission] {
+				return fmt.Errorf("unknown permission %s", permission)
+			}
+		}
+		for _, pattern := range grant.Repositories {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid repository pattern %q: %v", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// lookup returns the access token presented as bearer, if any
+func (a *AccessControl) lookup(r *http.Request) (AccessToken, bool) {
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	for _, token := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(token.Token)) == 1 {
+			return token, true
+		}
+	}
+	return AccessToken{}, false
+}
+
+// WithAccessControl restricts the API to the given tokens, see AccessControl.
+// Without it nor sessions reading, building and cancelling are open to
+// everyone and the rest requires the admin token.
+func WithAccessControl(access *AccessControl) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.access = access
+	}
+}
+
+// permits tells if the caller of a request has the permission on the
+// repository, an empty one standing for the resources not tied to any
+func (d *Dispatcher) permits(r *http.Request, permission Permission, repository string) bool {
+	if authorized(r, d.adminToken) {
+		return true
+	}
+	if user, ok := d.sessions.lookup(r, d.clock.Now()); ok && user.permits(permission, repository) {
+		return true
+	}
+	if d.access == nil {
+		// Logging in restricts the permissions open to everyone to the users
+		return d.sessions == nil && openPermissions[permission]
+	}
+	token, ok := d.access.lookup(r)
+	return ok && token.permits(permission, repository)
+}
+
+// authorize answers forbidden unless the caller of a request has the
+// permission on the repository
+func (d *Dispatcher) authorize(w http.ResponseWriter, r *http.Request,
+	permission Permission, repository string) bool {
+	if d.permits(r, permission, repository) {
+		return true
+	}
+	target := "the dispatcher"
+	if repository != "" {
+		target = repository
+	}
+	http.Error(w, fmt.Sprintf("%s permission required on %s", permission, target), http.StatusForbidden)
+	return false
+}
+
+// visible returns the filter of the repositories the caller of a request can
+// view
+func (d *Dispatcher) visible(r *http.Request) func(string) bool {
+	if d.permits(r, PermissionView, "") {
+		return func(string) bool { return true }
+	}
+	return func(repository string) bool {
+		return d.permits(r, PermissionView, repository)
+	}
+}
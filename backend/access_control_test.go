@@ -0,0 +1,197 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewAccessControl(t *testing.T) {
+	valid := AccessToken{Name: "ci", Token: "a", Grants: []AccessGrant{
+		{Repositories: []string{"octocat/*"}, Permissions: []Permission{PermissionView}},
+	}}
+	if _, err := NewAccessControl(valid); err != nil {
+		t.Errorf("NewAccessControl failed: unexpected %v", err)
+	}
+	for _, tokens := range [][]AccessToken{
+		{{Name: "ci"}},
+		{valid, {Name: "ci", Token: "b"}},
+		{valid, {Name: "other", Token: "a"}},
+		{{Name: "ci", Token: "a", Grants: []AccessGrant{{Permissions: []Permission{"deploy"}}}}},
+		{{Name: "ci", Token: "a", Grants: []AccessGrant{{Repositories: []string{"["}}}}},
+	} {
+		if _, err := NewAccessControl(tokens...); err == nil {
+			t.Errorf("NewAccessControl failed: expected error for %v", tokens)
+		}
+	}
+}
+
+func TestAccessTokenPermits(t *testing.T) {
+	token := AccessToken{Grants: []AccessGrant{
+		{Repositories: []string{"octocat/*"}, Permissions: []Permission{PermissionView, PermissionTrigger}},
+		{Repositories: []string{"*"}, Permissions: []Permission{PermissionManageRunners}},
+	}}
+	cases := []struct {
+		permission Permission
+		repository string
+		expected   bool
+	}{
+		{PermissionView, "octocat/test", true},
+		{PermissionTrigger, "octocat/test", true},
+		{PermissionCancel, "octocat/test", false},
+		{PermissionView, "other/test", false},
+		{PermissionView, "", false},
+		{PermissionManageRunners, "", true},
+		{PermissionManageRunners, "other/test", true},
+	}
+	for _, c := range cases {
+		if token.permits(c.permission, c.repository) != c.expected {
+			t.Errorf("AccessToken.permits failed: expected %v for %s on %q", c.expected, c.permission, c.repository)
+		}
+	}
+}
+
+func TestAccessControlHandlers(t *testing.T) {
+	access, _ := NewAccessControl(
+		AccessToken{Name: "dev", Token: "dev-token", Grants: []AccessGrant{
+			{Repositories: []string{"octocat/*"}, Permissions: []Permission{PermissionView, PermissionTrigger}},
+		}},
+		AccessToken{Name: "ops", Token: "ops-token", Grants: []AccessGrant{
+			{Repositories: []string{"*"}, Permissions: []Permission{PermissionView, PermissionCancel,
+				PermissionManageSecrets, PermissionManageRunners}},
+		}},
+	)
+	runner := NewRunnerProxy("127.0.0.1:9898")
+	d := NewDispatcher("commits", time.Second, []*RunnerProxy{runner},
+		WithAdminToken("admin-token"), WithAccessControl(access),
+		WithRepositoryCredentials(map[string]Credentials{"octocat/test": {Token: "ghp"}}))
+	visibleJob := d.enqueue(Commit{Id: "a", Repository: Repository{GitHub, "octocat/test", "dev"}})
+	hiddenJob := d.enqueue(Commit{Id: "b", Repository: Repository{GitHub, "infra/deploy", "main"}})
+	jobToken := d.jobTokens.Issue(hiddenJob)
+	router := d.router()
+	call := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, c := range []struct {
+		method, path, token, body string
+		expected                  int
+	}{
+		{"GET", "/jobs/" + visibleJob, "", "", http.StatusForbidden},
+		{"GET", "/jobs/" + visibleJob, "dev-token", "", http.StatusOK},
+		{"GET", "/jobs/" + hiddenJob, "dev-token", "", http.StatusForbidden},
+		{"GET", "/jobs/" + hiddenJob, "admin-token", "", http.StatusOK},
+		{"POST", "/jobs/" + visibleJob + "/cancel", "dev-token", "", http.StatusForbidden},
+		{"GET", "/commit?repository=infra/deploy&id=b", "dev-token", "", http.StatusForbidden},
+		{"GET", "/repos/infra/deploy/stats", "dev-token", "", http.StatusForbidden},
+		{"GET", "/credentials/octocat/test", "dev-token", "", http.StatusForbidden},
+		{"GET", "/credentials/octocat/test", "ops-token", "", http.StatusOK},
+		{"GET", "/metrics", "dev-token", "", http.StatusForbidden},
+		{"GET", "/metrics", "ops-token", "", http.StatusOK},
+		{"POST", "/runners/" + runner.Id + "/drain", "dev-token", "", http.StatusForbidden},
+		{"POST", "/runners/" + runner.Id + "/drain", "ops-token", "", http.StatusOK},
+		{"POST", "/builds", "dev-token", `{"repository":{"name":"infra/deploy","branch":"main"},"commit_id":"c"}`,
+			http.StatusForbidden},
+		{"POST", "/builds", "dev-token", `{"repository":{"name":"octocat/test","branch":"dev"},"commit_id":"c"}`,
+			http.StatusAccepted},
+		{"POST", "/jobs/" + hiddenJob + "/retry", jobToken, "", http.StatusForbidden},
+		{"POST", "/jobs/" + hiddenJob + "/cancel", jobToken, "", http.StatusForbidden},
+		{"GET", "/jobs/" + hiddenJob, jobToken, "", http.StatusForbidden},
+		{"POST", "/jobs/" + hiddenJob + "/steps", jobToken, `{"name":"build"}`, http.StatusNoContent},
+		{"GET", "/badge/octocat/test", "", "", http.StatusForbidden},
+		{"GET", "/badge/octocat/test", "dev-token", "", http.StatusOK},
+		{"GET", "/badge/infra/deploy", "dev-token", "", http.StatusForbidden},
+		{"POST", "/jobs/" + hiddenJob + "/cancel", "ops-token", "", http.StatusOK},
+	} {
+		if rec := call(c.method, c.path, c.token, c.body); rec.Code != c.expected {
+			t.Errorf("%s %s with %q failed: expected %d got %d", c.method, c.path, c.token, c.expected, rec.Code)
+		}
+	}
+
+	// Listings only show what can be viewed
+	var jobs jobsResponse
+	json.NewDecoder(call("GET", "/jobs", "dev-token", "").Body).Decode(&jobs)
+	for _, job := range jobs.Jobs {
+		if job.Commit.GetRepositoryName() != "octocat/test" {
+			t.Errorf("jobsListHandler failed: unexpected job of %s", job.Commit.GetRepositoryName())
+		}
+	}
+	if len(jobs.Jobs) != 2 {
+		t.Errorf("jobsListHandler failed: expected 2 jobs got %d", len(jobs.Jobs))
+	}
+	var queue []queuedCommitResponse
+	json.NewDecoder(call("GET", "/queue", "dev-token", "").Body).Decode(&queue)
+	if len(queue) != 2 || queue[0].JobId != visibleJob {
+		t.Errorf("queueHandler failed: unexpected %v", queue)
+	}
+	var events eventsResponse
+	json.NewDecoder(call("GET", "/events", "dev-token", "").Body).Decode(&events)
+	for _, event := range events.Events {
+		if event.Commit.GetRepositoryName() != "octocat/test" {
+			t.Errorf("eventsHandler failed: unexpected event of %s", event.Commit.GetRepositoryName())
+		}
+	}
+	all, _ := d.events.Since(0, 100)
+	if last := all[len(all)-1].Cursor; events.NextCursor != last {
+		t.Errorf("eventsHandler failed: expected cursor %d got %d", last, events.NextCursor)
+	}
+}
+
+func TestAccessWithoutControl(t *testing.T) {
+	runner := NewRunnerProxy("127.0.0.1:9898")
+	d := NewDispatcher("commits", time.Second, []*RunnerProxy{runner}, WithAdminToken("admin-token"))
+	jobId := d.enqueue(Commit{Id: "a", Repository: Repository{GitHub, "octocat/test", "dev"}})
+	router := d.router()
+	for path, expected := range map[string]int{
+		"/jobs/" + jobId:                       http.StatusOK,
+		"/runners/" + runner.Id:                http.StatusOK,
+		"/credentials/octocat/test":            http.StatusForbidden,
+		"/jobs/" + jobId + "/annotations":      http.StatusOK,
+		"/commit?repository=octocat/test&id=a": http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != expected {
+			t.Errorf("GET %s failed: expected %d got %d", path, expected, rec.Code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("POST", "/runners/"+runner.Id+"/drain", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("POST /runners/%s/drain failed: expected the admin token required got %d", runner.Id, rec.Code)
+	}
+}
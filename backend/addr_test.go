@@ -0,0 +1,92 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeAddr(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"127.0.0.1:9898":          "127.0.0.1:9898",
+		"Runner-1.Example.com:80": "runner-1.example.com:80",
+		"[::1]:9898":              "[::1]:9898",
+		"[0:0:0::1]:9898":         "[::1]:9898",
+		"[2001:DB8::1]:9898":      "[2001:db8::1]:9898",
+		"[::ffff:10.0.0.1]:9898":  "10.0.0.1:9898",
+		"[fe80::1%eth0]:9898":     "[fe80::1%eth0]:9898",
+	} {
+		if normalized, err := normalizeAddr(addr); err != nil || normalized != expected {
+			t.Errorf("normalizeAddr failed: expected %s got %s %v for %s", expected, normalized, err, addr)
+		}
+	}
+	for _, addr := range []string{"::1:9898", "localhost", ":9898", "localhost:http", "localhost:70000"} {
+		if _, err := normalizeAddr(addr); err == nil {
+			t.Errorf("normalizeAddr failed: expected an error for %s", addr)
+		}
+	}
+}
+
+func TestRegisterRunnerIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	defer listener.Close()
+	server := rpc.NewServer()
+	server.RegisterName("Runner", &Runner{registrationSecret: "secret", advertiseAddr: listener.Addr().String()})
+	go server.Accept(listener)
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+
+	d := NewDispatcher("commits", time.Second, nil, WithRunnerRegistration("secret"))
+	handler := runnersHandler(d)
+	for _, test := range []struct {
+		addr     string
+		expected int
+	}{
+		{"::1:" + port, http.StatusBadRequest},
+		{"[0:0::1]:" + port, http.StatusCreated},
+		// Same runner, differently spelled
+		{"[::0:1]:" + port, http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/runners", strings.NewReader(`{"addr":"`+test.addr+`"}`)))
+		if rec.Code != test.expected {
+			t.Errorf("runnersHandler failed: expected %d got %d for %s", test.expected, rec.Code, test.addr)
+		}
+	}
+	if runners := d.runnerList(); len(runners) != 1 || runners[0].Addr != "[::1]:"+port {
+		t.Errorf("registerRunner failed: expected the runner at [::1]:%s", port)
+	}
+}
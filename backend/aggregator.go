@@ -0,0 +1,192 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"log"
+	"sync"
+)
+
+// Status of a job as reported to the hosting services
+type ResultStatus string
+
+const (
+	StatusPending ResultStatus = "pending"
+	StatusRunning ResultStatus = "running"
+	StatusSuccess ResultStatus = "success"
+	StatusFailure ResultStatus = "failure"
+)
+
+// How the statuses of the child jobs of a parent (matrix entries, shards,
+// stages) are combined into a single overall status:
+//   - AggregateAll succeeds only if every child succeeds, failing as soon as
+//     any of them fails
+//   - AggregateAny succeeds as soon as a child succeeds, failing only when all
+//     of them failed
+type AggregationPolicy string
+
+const (
+	AggregateAll AggregationPolicy = "all-success"
+	AggregateAny AggregationPolicy = "any-success"
+)
+
+// StatusReporter sends the overall status of a commit upstream, e.g. as a
+// commit status on the hosting service
+type StatusReporter interface {
+	ReportStatus(commit Commit, status ResultStatus) error
+}
+
+type logReporter struct{}
+
+func (logReporter) ReportStatus(commit Commit, status ResultStatus) error {
+	log.Printf("Commit %s of %s: %s\n", commit.Id, commit.GetRepositoryName(), status)
+	return nil
+}
+
+// HostingReporter routes the status of each commit to the reporter of its
+// hosting service, the ones of hosting services without a reporter are
+// logged
+type HostingReporter map[HostingService]StatusReporter
+
+func (h HostingReporter) ReportStatus(commit Commit, status ResultStatus) error {
+	if reporter, ok := h[commit.Repository.HostingService]; ok {
+		return reporter.ReportStatus(commit, status)
+	}
+	return logReporter{}.ReportStatus(commit, status)
+}
+
+type jobGroup struct {
+	parent   Commit
+	children map[string]ResultStatus
+	// Last progress status reported upstream
+	reported ResultStatus
+}
+
+// ResultAggregator tracks the child jobs of every parent commit and reports
+// a single status upstream once the overall outcome is known
+type ResultAggregator struct {
+	mutex    sync.Mutex
+	policy   AggregationPolicy
+	reporter StatusReporter
+	groups   map[string]*jobGroup
+}
+
+func NewResultAggregator(policy AggregationPolicy, reporter StatusReporter) *ResultAggregator {
+	if reporter == nil {
+		reporter = logReporter{}
+	}
+	return &ResultAggregator{
+		policy:   policy,
+		reporter: reporter,
+		groups:   map[string]*jobGroup{},
+	}
+}
+
+// Track registers a parent commit and the IDs of its child jobs, all of them
+// pending
+func (a *ResultAggregator) Track(parent Commit, childIds ...string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	group := &jobGroup{parent: parent, children: make(map[string]ResultStatus, len(childIds))}
+	for _, id := range childIds {
+		group.children[id] = StatusPending
+	}
+	a.groups[parent.Id] = group
+}
+
+// Progress reports upstream that a tracked parent is queued or running, once
+// for each status, before its overall outcome is known
+func (a *ResultAggregator) Progress(parentId string, status ResultStatus) {
+	a.mutex.Lock()
+	group, ok := a.groups[parentId]
+	if !ok || group.reported == status {
+		a.mutex.Unlock()
+		return
+	}
+	group.reported = status
+	a.mutex.Unlock()
+
+	if err := a.reporter.ReportStatus(group.parent, status); err != nil {
+		log.Printf("Error reporting status of commit %s: %v\n", parentId, err)
+	}
+}
+
+// Update records the status of a child job, returning the overall status of
+// the parent. As soon as the overall status is no longer pending it's
+// reported upstream and the parent stops being tracked.
+func (a *ResultAggregator) Update(parentId, childId string, status ResultStatus) ResultStatus {
+	a.mutex.Lock()
+	group, ok := a.groups[parentId]
+	if !ok {
+		a.mutex.Unlock()
+		return StatusPending
+	}
+	if _, ok := group.children[childId]; ok {
+		group.children[childId] = status
+	}
+	overall := aggregate(a.policy, group.children)
+	if overall != StatusPending {
+		delete(a.groups, parentId)
+	}
+	a.mutex.Unlock()
+
+	if overall != StatusPending {
+		if err := a.reporter.ReportStatus(group.parent, overall); err != nil {
+			log.Printf("Error reporting status of commit %s: %v\n", parentId, err)
+		}
+	}
+	return overall
+}
+
+func aggregate(policy AggregationPolicy, children map[string]ResultStatus) ResultStatus {
+	successes, failures := 0, 0
+	for _, status := range children {
+		switch status {
+		case StatusSuccess:
+			successes++
+		case StatusFailure:
+			failures++
+		}
+	}
+	switch policy {
+	case AggregateAny:
+		if successes > 0 {
+			return StatusSuccess
+		}
+		if failures == len(children) {
+			return StatusFailure
+		}
+	default:
+		if failures > 0 {
+			return StatusFailure
+		}
+		if successes == len(children) {
+			return StatusSuccess
+		}
+	}
+	return StatusPending
+}
@@ -0,0 +1,122 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type recordingReporter struct {
+	statuses []ResultStatus
+}
+
+func (r *recordingReporter) ReportStatus(commit Commit, status ResultStatus) error {
+	r.statuses = append(r.statuses, status)
+	return nil
+}
+
+func TestResultAggregatorAllSuccess(t *testing.T) {
+	reporter := &recordingReporter{}
+	aggregator := NewResultAggregator(AggregateAll, reporter)
+	aggregator.Track(Commit{Id: "abc"}, "shard-0", "shard-1")
+	if status := aggregator.Update("abc", "shard-0", StatusSuccess); status != StatusPending {
+		t.Errorf("ResultAggregator.Update failed: expected pending got %s", status)
+	}
+	if status := aggregator.Update("abc", "shard-1", StatusSuccess); status != StatusSuccess {
+		t.Errorf("ResultAggregator.Update failed: expected success got %s", status)
+	}
+	if len(reporter.statuses) != 1 || reporter.statuses[0] != StatusSuccess {
+		t.Errorf("ResultAggregator.Update failed: expected one success report got %v",
+			reporter.statuses)
+	}
+}
+
+func TestResultAggregatorFailFast(t *testing.T) {
+	reporter := &recordingReporter{}
+	aggregator := NewResultAggregator(AggregateAll, reporter)
+	aggregator.Track(Commit{Id: "abc"}, "shard-0", "shard-1")
+	if status := aggregator.Update("abc", "shard-1", StatusFailure); status != StatusFailure {
+		t.Errorf("ResultAggregator.Update failed: expected failure got %s", status)
+	}
+	// Late results of an already reported parent are ignored
+	aggregator.Update("abc", "shard-0", StatusSuccess)
+	if len(reporter.statuses) != 1 {
+		t.Errorf("ResultAggregator.Update failed: expected one report got %v", reporter.statuses)
+	}
+}
+
+func TestResultAggregatorAnySuccess(t *testing.T) {
+	aggregator := NewResultAggregator(AggregateAny, &recordingReporter{})
+	aggregator.Track(Commit{Id: "abc"}, "a", "b")
+	if status := aggregator.Update("abc", "a", StatusFailure); status != StatusPending {
+		t.Errorf("ResultAggregator.Update failed: expected pending got %s", status)
+	}
+	if status := aggregator.Update("abc", "b", StatusFailure); status != StatusFailure {
+		t.Errorf("ResultAggregator.Update failed: expected failure got %s", status)
+	}
+}
+
+func TestResultAggregatorProgress(t *testing.T) {
+	reporter := &recordingReporter{}
+	aggregator := NewResultAggregator(AggregateAll, reporter)
+	aggregator.Track(Commit{Id: "abc"}, "shard-0", "shard-1")
+	aggregator.Progress("abc", StatusPending)
+	aggregator.Progress("abc", StatusRunning)
+	// The second shard starting doesn't change the status of the parent
+	aggregator.Progress("abc", StatusRunning)
+	aggregator.Update("abc", "shard-0", StatusFailure)
+	// Untracked parents are not reported
+	aggregator.Progress("abc", StatusRunning)
+	expected := []ResultStatus{StatusPending, StatusRunning, StatusFailure}
+	if !reflect.DeepEqual(reporter.statuses, expected) {
+		t.Errorf("ResultAggregator.Progress failed: expected %v got %v", expected, reporter.statuses)
+	}
+}
+
+// queueCheckingReporter records the length of the queue when the statuses are
+// reported
+type queueCheckingReporter struct {
+	queue   func() int
+	lengths []int
+}
+
+func (r *queueCheckingReporter) ReportStatus(commit Commit, status ResultStatus) error {
+	r.lengths = append(r.lengths, r.queue())
+	return nil
+}
+
+func TestScheduleReportsPendingBeforePush(t *testing.T) {
+	reporter := &queueCheckingReporter{}
+	d := NewDispatcher("commits", time.Second, nil, WithAggregation(AggregateAll, reporter))
+	reporter.queue = d.queue.Len
+	d.enqueue(Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "master"}})
+	if !reflect.DeepEqual(reporter.lengths, []int{0}) || d.queue.Len() != 1 {
+		t.Errorf("Dispatcher.schedule failed: expected pending reported before the push got %v", reporter.lengths)
+	}
+}
@@ -0,0 +1,146 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+// JobTokens issues and verifies tokens scoped to a single job, handed to the
+// steps so they can call back the dispatcher API on behalf of their job only
+type JobTokens struct {
+	secret []byte
+}
+
+// NewJobTokens creates a token issuer with a random secret, tokens are valid
+// for the lifetime of the dispatcher process
+func NewJobTokens() *JobTokens {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &JobTokens{secret}
+}
+
+// Bucket and key of the secret of the job tokens
+const (
+	jobTokensBucket string = "job_tokens"
+	jobTokensKey    string = "secret"
+)
+
+// loadJobTokens returns a token issuer whose secret is kept in the store,
+// generated on the first start, so that the tokens of the running jobs stay
+// valid across the restarts of the dispatcher, e.g. for the runners
+// delivering their spooled reports, and between the dispatchers sharing the
+// store
+func loadJobTokens(store Store) (*JobTokens, error) {
+	secret, err := store.Get(jobTokensBucket, jobTokensKey)
+	if err == nil {
+		return &JobTokens{secret}, nil
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+	tokens := NewJobTokens()
+	if atomic, ok := store.(AtomicStore); ok {
+		stored, err := atomic.PutIfAbsent(jobTokensBucket, jobTokensKey, tokens.secret)
+		if err != nil {
+			return nil, err
+		}
+		if !stored {
+			// Another dispatcher was first
+			return loadJobTokens(store)
+		}
+	}
+	// Written again without the expiration of the claims of the atomic stores
+	return tokens, store.Put(jobTokensBucket, jobTokensKey, tokens.secret)
+}
+
+func (t *JobTokens) sign(jobId string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(jobId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns the token of a job in the `<job-id>.<signature>` form
+func (t *JobTokens) Issue(jobId string) string {
+	return jobId + "." + t.sign(jobId)
+}
+
+// Verify returns the job ID a token was issued for, and false if the token
+// is not valid
+func (t *JobTokens) Verify(token string) (string, bool) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "", false
+	}
+	jobId := token[:i]
+	return jobId, hmac.Equal([]byte(token[i+1:]), []byte(t.sign(jobId)))
+}
+
+// Annotation set by a step on its job, e.g. image_digest, coverage
+type Annotation struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// AnnotationStore keeps the key/value annotations of each job
+type AnnotationStore struct {
+	mutex       sync.RWMutex
+	annotations map[string]map[string]string
+}
+
+func NewAnnotationStore() *AnnotationStore {
+	return &AnnotationStore{annotations: map[string]map[string]string{}}
+}
+
+// Set adds or replaces annotations of a job
+func (s *AnnotationStore) Set(jobId string, annotations ...Annotation) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	job, ok := s.annotations[jobId]
+	if !ok {
+		job = map[string]string{}
+		s.annotations[jobId] = job
+	}
+	for _, a := range annotations {
+		job[a.Key] = a.Value
+	}
+}
+
+// Get returns a copy of the annotations of a job
+func (s *AnnotationStore) Get(jobId string) map[string]string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	annotations := make(map[string]string, len(s.annotations[jobId]))
+	for k, v := range s.annotations[jobId] {
+		annotations[k] = v
+	}
+	return annotations
+}
@@ -0,0 +1,90 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+// States of the ANSI escape sequences parser
+const (
+	ansiText = iota
+	// Right after an ESC
+	ansiEscape
+	// Within a control sequence, ESC [ ... final byte
+	ansiCSI
+	// Within an operating system command, ESC ] ... BEL or ESC \
+	ansiOSC
+	// Right after an ESC within an operating system command
+	ansiOSCEscape
+)
+
+// ansiStripper removes the ANSI escape sequences, colors and cursor moves,
+// from a log. Its state is kept between calls, so that a sequence split
+// across chunks of output is stripped all the same.
+type ansiStripper struct {
+	state int
+}
+
+// Strip returns the chunk of output without the escape sequences
+func (s *ansiStripper) Strip(data []byte) []byte {
+	plain := make([]byte, 0, len(data))
+	for _, c := range data {
+		switch s.state {
+		case ansiText:
+			if c == 0x1b {
+				s.state = ansiEscape
+			} else {
+				plain = append(plain, c)
+			}
+		case ansiEscape:
+			switch {
+			case c == '[':
+				s.state = ansiCSI
+			case c == ']':
+				s.state = ansiOSC
+			case c >= 0x20 && c <= 0x2f:
+				// Intermediate bytes, e.g. ESC ( B selecting a charset
+			default:
+				s.state = ansiText
+			}
+		case ansiCSI:
+			if c >= 0x40 && c <= 0x7e {
+				s.state = ansiText
+			}
+		case ansiOSC:
+			if c == 0x07 {
+				s.state = ansiText
+			} else if c == 0x1b {
+				s.state = ansiOSCEscape
+			}
+		case ansiOSCEscape:
+			if c == '\\' {
+				s.state = ansiText
+			} else {
+				s.state = ansiOSC
+			}
+		}
+	}
+	return plain
+}
@@ -0,0 +1,53 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import "testing"
+
+func TestAnsiStripper(t *testing.T) {
+	cases := []struct {
+		chunks   []string
+		expected string
+	}{
+		{[]string{"\x1b[1;32mPASS\x1b[0m ok\n"}, "PASS ok\n"},
+		{[]string{"\x1b]0;title\x07done\r\n"}, "done\r\n"},
+		{[]string{"\x1b]8;;http://x\x1b\\link\x1b]8;;\x1b\\"}, "link"},
+		{[]string{"\x1b(Bplain\x1b7saved\x1b8"}, "plainsaved"},
+		// Sequences split across chunks
+		{[]string{"red \x1b", "[3", "1mtext\x1b[", "0m"}, "red text"},
+	}
+	for _, c := range cases {
+		stripper := &ansiStripper{}
+		plain := ""
+		for _, chunk := range c.chunks {
+			plain += string(stripper.Strip([]byte(chunk)))
+		}
+		if plain != c.expected {
+			t.Errorf("ansiStripper.Strip failed: expected %q got %q", c.expected, plain)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	docker "github.com/docker/docker/client"
+)
+
+// Buckets of the artifacts contents and of their descriptions, by job
+const (
+	artifactsBucket     string = "artifacts"
+	jobArtifactsBucket  string = "job_artifacts"
+	maxArtifactSize     int64  = 64 * 1024 * 1024
+	artifactContentType string = "application/x-tar"
+)
+
+// Artifact is a file or directory produced by a step, collected from its
+// container as a tar archive
+type Artifact struct {
+	Name      string    `json:"name"`
+	Step      string    `json:"step"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// artifactName returns the name an artifact is downloaded by, e.g.
+// test-reports.tar for the reports/ path of the test step
+func artifactName(step, p string) string {
+	base := path.Base(path.Clean("/" + p))
+	if base == "/" {
+		base = "workspace"
+	}
+	return unsafeNameChars.ReplaceAllString(step+"-"+base, "_") + ".tar"
+}
+
+func artifactKey(jobId, name string) string {
+	return jobId + "/" + name
+}
+
+// collectArtifacts copies the artifacts of a step out of its container,
+// handing each archive to upload. Missing paths are logged and skipped, they
+// must not fail the step.
+func collectArtifacts(ctx context.Context, cli *docker.Client, containerId string, step Step,
+	upload func(p string, archive io.Reader) error) {
+	for _, p := range step.Artifacts {
+		src := p
+		if !path.IsAbs(src) {
+			src = path.Join(workspaceDir, src)
+		}
+		archive, _, err := cli.CopyFromContainer(ctx, containerId, src)
+		if err != nil {
+			log.Printf("Error collecting artifact %s of step %s: %v\n", p, step.Name, err)
+			continue
+		}
+		if err := upload(p, archive); err != nil {
+			log.Printf("Error uploading artifact %s of step %s: %v\n", p, step.Name, err)
+		}
+		archive.Close()
+	}
+}
+
+// uploadArtifact posts an artifact archive to the dispatcher, authenticated
+// with the job token
+func (r *Runner) uploadArtifact(req RunnerRequest, step, p string, archive io.Reader) error {
+	query := url.Values{"step": {step}, "path": {p}}
+	endpoint := strings.TrimRight(req.APIURL, "/") + "/jobs/" + req.JobId + "/artifacts?" + query.Encode()
+	httpReq, err := http.NewRequest(http.MethodPost, endpoint, archive)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", artifactContentType)
+	httpReq.Header.Set("Authorization", "Bearer "+req.JobToken)
+	res, err := (&http.Client{Timeout: 5 * time.Minute}).Do(httpReq)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("dispatcher answered with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// putArtifact stores the archive of an artifact along with its description
+func (d *Dispatcher) putArtifact(jobId string, artifact Artifact, content []byte) error {
+	key := artifactKey(jobId, artifact.Name)
+	if err := d.store.Put(artifactsBucket, key, content); err != nil {
+		return err
+	}
+	value, err := json.Marshal(artifact)
+	if err != nil {
+		return err
+	}
+	return d.store.Put(jobArtifactsBucket, key, value)
+}
+
+// listArtifacts returns the artifacts of a job sorted by name
+func (d *Dispatcher) listArtifacts(jobId string) ([]Artifact, error) {
+	values, err := d.store.List(jobArtifactsBucket, jobId+"/")
+	if err != nil {
+		return nil, err
+	}
+	artifacts := make([]Artifact, 0, len(values))
+	for _, value := range values {
+		var artifact Artifact
+		if err := json.Unmarshal(value, &artifact); err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, artifact)
+	}
+	sort.Slice(artifacts, func(i, j int) bool { return artifacts[i].Name < artifacts[j].Name })
+	return artifacts, nil
+}
+
+// jobArtifactsHandler serves /jobs/{id}/artifacts: the runners POST the
+// archives of the artifacts authenticated with the job token, GET lists them
+// and GET /jobs/{id}/artifacts/{name} downloads one
+func jobArtifactsHandler(d *Dispatcher, jobId, name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && name == "":
+			tokenJobId, ok := d.jobTokens.Verify(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+			if !ok || tokenJobId != jobId {
+				http.Error(w, "invalid job token", http.StatusForbidden)
+				return
+			}
+			query := r.URL.Query()
+			step, p := query.Get("step"), query.Get("path")
+			if step == "" || p == "" {
+				http.Error(w, "step and path are required", http.StatusBadRequest)
+				return
+			}
+			// Big archives take longer than the read timeout of the server
+			http.NewResponseController(w).SetReadDeadline(time.Now().Add(5 * time.Minute))
+			content, err := ioutil.ReadAll(io.LimitReader(r.Body, maxArtifactSize+1))
+			if err != nil {
+				http.Error(w, "invalid artifact", http.StatusBadRequest)
+				return
+			}
+			if int64(len(content)) > maxArtifactSize {
+				http.Error(w, "artifact too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			artifact := Artifact{
+				Name:      artifactName(step, p),
+				Step:      step,
+				Path:      p,
+				Size:      int64(len(content)),
+				CreatedAt: time.Now(),
+			}
+			if err := d.putArtifact(jobId, artifact, content); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusCreated, artifact)
+		case r.Method == http.MethodGet && name == "":
+			if _, err := d.jobs.Get(jobId); err == ErrNotFound {
+				http.Error(w, "job not found", http.StatusNotFound)
+				return
+			}
+			artifacts, err := d.listArtifacts(jobId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, artifacts)
+		case r.Method == http.MethodGet:
+			content, err := d.store.Get(artifactsBucket, artifactKey(jobId, name))
+			if err == ErrNotFound {
+				http.Error(w, "artifact not found", http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", artifactContentType)
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+			w.Write(content)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
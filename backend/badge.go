@@ -0,0 +1,136 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// Branches tried, in order, when a badge doesn't name one, as the dispatcher
+// doesn't know the default branch of the repositories
+var defaultBranches = []string{"main", "master"}
+
+// Label, message and color of a status badge
+type badge struct {
+	label, message, color string
+}
+
+var (
+	passingBadge = badge{"build", "passing", "#4c1"}
+	failingBadge = badge{"build", "failing", "#e05d44"}
+	unknownBadge = badge{"build", "unknown", "#9f9f9f"}
+)
+
+// Template of a flat badge, label and message are centered in their halves
+const badgeSVG = `<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[3]s: %[4]s">
+<title>%[3]s: %[4]s</title>
+<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)"><rect width="%[2]d" height="20" fill="#555"/><rect x="%[2]d" width="%[6]d" height="20" fill="%[5]s"/><rect width="%[1]d" height="20" fill="url(#s)"/></g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%[7]d" y="14">%[3]s</text><text x="%[8]d" y="14">%[4]s</text>
+</g>
+</svg>
+`
+
+// textWidth roughly estimates the width in pixels of a badge text
+func textWidth(text string) int {
+	return int(math.Ceil(float64(len(text))*6.5)) + 10
+}
+
+// render returns the SVG of the badge
+func (b badge) render() string {
+	labelWidth, messageWidth := textWidth(b.label), textWidth(b.message)
+	return fmt.Sprintf(badgeSVG, labelWidth+messageWidth, labelWidth, b.label, b.message,
+		b.color, messageWidth, labelWidth/2, labelWidth+messageWidth/2)
+}
+
+// branchBadge returns the badge of the last finished build of a branch,
+// bisect builds of older commits left out
+func branchBadge(jobs *JobStore, repository, branch string) (badge, bool, error) {
+	list, _, err := jobs.List(JobFilter{Repository: repository, Branch: branch}, "", math.MaxInt32)
+	if err != nil {
+		return unknownBadge, false, err
+	}
+	for _, job := range list {
+		if job.Commit.Bisect {
+			continue
+		}
+		switch job.State {
+		case JobSuccess:
+			return passingBadge, true, nil
+		case JobFailed:
+			return failingBadge, true, nil
+		}
+	}
+	return unknownBadge, false, nil
+}
+
+// badgeHandler serves GET /badge/{owner}/{name}?branch= the SVG status badge
+// of the last finished build of a branch of a repository, to be embedded in
+// READMEs. Without a branch the first one built among the defaultBranches is
+// used. Badges require the view permission like the rest of the API, so they
+// are public only while viewing is open to everyone.
+func badgeHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		repository := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/badge/"), ".svg")
+		if repository == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !d.authorize(w, r, PermissionView, repository) {
+			return
+		}
+		branches := defaultBranches
+		if branch := r.URL.Query().Get("branch"); branch != "" {
+			branches = []string{branch}
+		}
+		status := unknownBadge
+		for _, branch := range branches {
+			b, found, err := branchBadge(d.jobs, repository, branch)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if found {
+				status = b
+				break
+			}
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		// Hosting services proxy the images, they must not keep stale badges
+		w.Header().Set("Cache-Control", "no-cache, max-age=0")
+		fmt.Fprint(w, status.render())
+	}
+}
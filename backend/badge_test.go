@@ -0,0 +1,68 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBadgeHandler(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil)
+	jobs := d.jobs
+	commit := Commit{Repository: Repository{Name: "octocat/test", Branch: "master"}}
+	old := NewJob("job-1", commit)
+	old.State, old.CreatedAt = JobSuccess, time.Now().Add(-time.Hour)
+	latest := NewJob("job-2", commit)
+	latest.State = JobFailed
+	running := NewJob("job-3", commit)
+	running.State = JobRunning
+	for _, job := range []Job{old, latest, running} {
+		if err := jobs.Create(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := map[string]string{
+		"/badge/octocat/test":                   "failing",
+		"/badge/octocat/test.svg?branch=master": "failing",
+		"/badge/octocat/test?branch=dev":        "unknown",
+		"/badge/octocat/other":                  "unknown",
+	}
+	for url, expected := range cases {
+		rec := httptest.NewRecorder()
+		badgeHandler(d)(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/svg+xml" {
+			t.Errorf("GET %s expected an SVG got %d %s", url, rec.Code, rec.Header().Get("Content-Type"))
+		}
+		if !strings.Contains(rec.Body.String(), "build: "+expected) {
+			t.Errorf("GET %s expected a %s badge got %s", url, expected, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"log"
+	"sync"
+)
+
+// An ongoing bisect of a broken branch: candidates are the commits pushed
+// since the last green build, oldest first, good and bad are the indexes of
+// the latest known good and earliest known bad candidates, -1 standing for
+// the last green commit itself
+type bisection struct {
+	broken     Commit
+	candidates []string
+	good, bad  int
+	testing    string
+}
+
+// Bisector pinpoints the commit breaking a branch by building intermediate
+// commits between the last green one and the first failing one
+type Bisector struct {
+	mutex    sync.Mutex
+	sessions map[string]*bisection
+	enqueue  func(Commit) string
+}
+
+func NewBisector(enqueue func(Commit) string) *Bisector {
+	return &Bisector{sessions: map[string]*bisection{}, enqueue: enqueue}
+}
+
+// Start begins the bisect of a branch just broken by the given commit, the
+// culprit is returned right away if there's no intermediate commit to test
+func (b *Bisector) Start(commit Commit, branch BranchStatus) (string, bool) {
+	if b == nil || len(branch.pushed) == 0 {
+		return "", false
+	}
+	session := &bisection{
+		broken:     commit,
+		candidates: branch.pushed,
+		good:       -1,
+		bad:        len(branch.pushed) - 1,
+	}
+	if session.bad-session.good <= 1 {
+		return session.candidates[session.bad], true
+	}
+	b.mutex.Lock()
+	b.sessions[branchKey(commit)] = session
+	b.mutex.Unlock()
+	b.next(session)
+	return "", false
+}
+
+// next schedules the build of the candidate halfway through the range still
+// to be tested
+func (b *Bisector) next(session *bisection) {
+	mid := (session.good + session.bad) / 2
+	commit := session.broken
+	commit.Id = session.candidates[mid]
+	commit.PushedCommits = nil
+	commit.Bisect = true
+	session.testing = commit.Id
+	log.Printf("Bisecting %s: testing commit %s\n", branchKey(commit), commit.Id)
+	b.enqueue(commit)
+}
+
+// Record narrows the bisect range with the result of a bisect build,
+// returning the culprit once found
+func (b *Bisector) Record(commit Commit, status ResultStatus) (string, bool) {
+	if b == nil || status == StatusPending {
+		return "", false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	key := branchKey(commit)
+	session, ok := b.sessions[key]
+	if !ok || session.testing != commit.Id {
+		return "", false
+	}
+	for i, id := range session.candidates {
+		if id != commit.Id {
+			continue
+		}
+		if status == StatusSuccess {
+			session.good = i
+		} else {
+			session.bad = i
+		}
+		break
+	}
+	if session.bad-session.good <= 1 {
+		delete(b.sessions, key)
+		return session.candidates[session.bad], true
+	}
+	b.next(session)
+	return "", false
+}
@@ -0,0 +1,63 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import "testing"
+
+func TestBisectorFindsCulprit(t *testing.T) {
+	var scheduled []Commit
+	bisector := NewBisector(func(c Commit) string {
+		scheduled = append(scheduled, c)
+		return c.Id
+	})
+	repository := Repository{GitHub, "octocat/test", "master"}
+	broken := Commit{Id: "e", Repository: repository}
+	branch := BranchStatus{pushed: []string{"a", "b", "c", "d", "e"}}
+
+	if _, found := bisector.Start(broken, branch); found || len(scheduled) != 1 {
+		t.Fatalf("Bisector.Start failed: expected a bisect build to be scheduled")
+	}
+	// "c" is the first bad commit
+	bad := map[string]bool{"c": true, "d": true, "e": true}
+	for i := 0; i < len(branch.pushed); i++ {
+		commit := scheduled[len(scheduled)-1]
+		if !commit.Bisect {
+			t.Fatalf("Bisector failed: scheduled build not marked as bisect")
+		}
+		status := StatusSuccess
+		if bad[commit.Id] {
+			status = StatusFailure
+		}
+		if culprit, found := bisector.Record(commit, status); found {
+			if culprit != "c" {
+				t.Errorf("Bisector.Record failed: expected culprit c got %s", culprit)
+			}
+			return
+		}
+	}
+	t.Errorf("Bisector failed: culprit not found")
+}
@@ -0,0 +1,100 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// States of the Bitbucket build statuses, which have no queued state
+var bitbucketStates = map[ResultStatus]string{
+	StatusPending: "INPROGRESS",
+	StatusRunning: "INPROGRESS",
+	StatusSuccess: "SUCCESSFUL",
+	StatusFailure: "FAILED",
+}
+
+// BitbucketStatusReporter pushes the build status of the commits of the
+// Bitbucket Cloud repositories, authenticated by an access token
+type BitbucketStatusReporter struct {
+	baseURL   string
+	token     string
+	publicURL string
+	client    *http.Client
+}
+
+func NewBitbucketStatusReporter(token, publicURL string) *BitbucketStatusReporter {
+	return &BitbucketStatusReporter{
+		baseURL:   "https://api.bitbucket.org",
+		token:     token,
+		publicURL: strings.TrimRight(publicURL, "/"),
+		client:    &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+func (b *BitbucketStatusReporter) ReportStatus(commit Commit, status ResultStatus) error {
+	state, ok := bitbucketStates[status]
+	if commit.Repository.HostingService != BitBucket || !ok {
+		return logReporter{}.ReportStatus(commit, status)
+	}
+	// The URL is required, it links the dispatcher API answering about the
+	// commit
+	query := url.Values{"repository": {commit.GetRepositoryName()}, "id": {commit.Id}}
+	payload, err := json.Marshal(map[string]string{
+		"key":         statusContext,
+		"state":       state,
+		"name":        statusContext,
+		"description": "Build " + string(status),
+		"url":         b.publicURL + "/commit?" + query.Encode(),
+	})
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("%s/2.0/repositories/%s/commit/%s/statuses/build", b.baseURL,
+		commit.GetRepositoryName(), commit.Id)
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	res, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("Bitbucket answered with status %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Recipient of a notification targeted at a commit author
+type Recipient struct {
+	Email string `yaml:"email" json:"email,omitempty"`
+	Slack string `yaml:"slack" json:"slack,omitempty"`
+}
+
+// LoadAuthorsMapping reads the YAML mapping from commit author emails or
+// usernames to the recipients to notify, e.g.
+//
+//	jdoe@example.com:
+//	  email: john.doe@example.com
+//	  slack: U024BE7LH
+func LoadAuthorsMapping(path string) (map[string]Recipient, error) {
+	yamlFile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	authors := map[string]Recipient{}
+	if err := yaml.Unmarshal(yamlFile, &authors); err != nil {
+		return nil, err
+	}
+	return authors, nil
+}
+
+// Notification sent when a build breaks a previously green branch, targeted
+// at the authors of the commits built since the last green one
+type BranchBrokenEvent struct {
+	Event      string      `json:"event"`
+	Repository string      `json:"repository"`
+	Branch     string      `json:"branch"`
+	Commit     Commit      `json:"commit"`
+	LastGreen  string      `json:"last_green"`
+	Culprits   []Author    `json:"culprits"`
+	Recipients []Recipient `json:"recipients"`
+	Timestamp  time.Time   `json:"timestamp"`
+}
+
+// BlameNotifier notifies the authors of the offending commits when a green
+// branch gets broken
+type BlameNotifier struct {
+	authors  map[string]Recipient
+	notifier *WebhookNotifier
+}
+
+func NewBlameNotifier(authors map[string]Recipient, urls ...string) *BlameNotifier {
+	return &BlameNotifier{authors, NewWebhookNotifier(urls...)}
+}
+
+// authorRecipient maps a commit author to who should be notified, looking it
+// up by email first and by username then, falling back to the commit email
+func authorRecipient(authors map[string]Recipient, author Author) Recipient {
+	if r, ok := authors[author.Email]; ok {
+		return r
+	}
+	if r, ok := authors[author.Username]; ok && author.Username != "" {
+		return r
+	}
+	return Recipient{Email: author.Email}
+}
+
+// Notify sends the notification for a commit that broke the given branch,
+// targeting the authors of the commits built since the last green one
+func (b *BlameNotifier) Notify(commit Commit, branch BranchStatus) *BranchBrokenEvent {
+	if b == nil {
+		return nil
+	}
+	event := &BranchBrokenEvent{
+		Event:      "branch_broken",
+		Repository: branch.Repository,
+		Branch:     branch.Branch,
+		Commit:     commit,
+		LastGreen:  branch.LastGreen,
+		Culprits:   []Author{},
+		Recipients: []Recipient{},
+		Timestamp:  time.Now(),
+	}
+	seen := map[string]bool{}
+	for _, c := range branch.since {
+		if seen[c.Author.Email] {
+			continue
+		}
+		seen[c.Author.Email] = true
+		event.Culprits = append(event.Culprits, c.Author)
+		event.Recipients = append(event.Recipients, authorRecipient(b.authors, c.Author))
+	}
+	b.notifier.Notify(event)
+	return event
+}
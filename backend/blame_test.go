@@ -0,0 +1,56 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import "testing"
+
+func TestBlameNotifierBrokenBranch(t *testing.T) {
+	authors := map[string]Recipient{"jdoe@example.com": {Slack: "U024BE7LH"}}
+	blame := NewBlameNotifier(authors)
+	branches := NewBranchTracker()
+	repository := Repository{GitHub, "octocat/test", "master"}
+	green := Commit{Id: "a", Repository: repository, Author: Author{Email: "ann@example.com"}}
+	broken := Commit{Id: "b", Repository: repository, Author: Author{Email: "jdoe@example.com"}}
+
+	// Nothing is known about the branch before the first green build
+	if isBroken, _ := branches.Record(broken, StatusFailure); isBroken {
+		t.Errorf("BranchTracker.Record failed: unknown branch reported as broken")
+	}
+	branches.Record(green, StatusSuccess)
+	isBroken, branch := branches.Record(broken, StatusFailure)
+	if !isBroken || branch.BrokenSince != "b" {
+		t.Fatalf("BranchTracker.Record failed: unexpected branch status %v", branch)
+	}
+	event := blame.Notify(broken, branch)
+	if event.LastGreen != "a" || len(event.Recipients) != 1 ||
+		event.Recipients[0].Slack != "U024BE7LH" {
+		t.Errorf("BlameNotifier.Notify failed: unexpected event %v", event)
+	}
+	if isBroken, _ := branches.Record(broken, StatusFailure); isBroken {
+		t.Errorf("BranchTracker.Record failed: already broken branch reported again")
+	}
+}
@@ -0,0 +1,138 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"sort"
+	"sync"
+)
+
+// Health of a branch as derived from the results of its builds
+type BranchStatus struct {
+	Repository  string       `json:"repository"`
+	Branch      string       `json:"branch"`
+	Status      ResultStatus `json:"status"`
+	LastGreen   string       `json:"last_green,omitempty"`
+	BrokenSince string       `json:"broken_since,omitempty"`
+	// Commit found guilty by an automatic bisect, if any
+	Culprit string `json:"culprit,omitempty"`
+	// Commits built since the last green one
+	since []Commit
+	// IDs of every commit pushed since the last green one, built or not,
+	// oldest first
+	pushed []string
+}
+
+// BranchTracker follows the status of every branch, remembering the last
+// green commit and the first failing one after it
+type BranchTracker struct {
+	mutex    sync.Mutex
+	branches map[string]*BranchStatus
+}
+
+func NewBranchTracker() *BranchTracker {
+	return &BranchTracker{branches: map[string]*BranchStatus{}}
+}
+
+func branchKey(commit Commit) string {
+	return commit.GetRepositoryName() + "@" + commit.Repository.Branch
+}
+
+// Record updates the branch of the commit with the result of its build,
+// returning true if the commit broke a previously green branch along with a
+// snapshot of the branch status
+func (t *BranchTracker) Record(commit Commit, status ResultStatus) (bool, BranchStatus) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	key := branchKey(commit)
+	branch, ok := t.branches[key]
+	if !ok {
+		branch = &BranchStatus{
+			Repository: commit.GetRepositoryName(),
+			Branch:     commit.Repository.Branch,
+			Status:     StatusPending,
+		}
+		t.branches[key] = branch
+	}
+	if status == StatusPending {
+		return false, *branch
+	}
+	previous := branch.Status
+	branch.Status = status
+	if status == StatusSuccess {
+		branch.LastGreen, branch.BrokenSince, branch.Culprit = commit.Id, "", ""
+		branch.since, branch.pushed = nil, nil
+		return false, *branch
+	}
+	branch.since = append(branch.since, commit)
+	pushed := commit.PushedCommits
+	if len(pushed) == 0 {
+		pushed = []string{commit.Id}
+	}
+	branch.pushed = append(branch.pushed, pushed...)
+	broken := previous == StatusSuccess
+	if broken {
+		branch.BrokenSince = commit.Id
+	}
+	return broken, *branch
+}
+
+// SetCulprit records the commit found responsible of breaking a branch
+func (t *BranchTracker) SetCulprit(commit Commit, culprit string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if branch, ok := t.branches[branchKey(commit)]; ok {
+		branch.Culprit = culprit
+	}
+}
+
+// Status returns the status of the branch of a commit, pending if unknown
+func (t *BranchTracker) Status(commit Commit) ResultStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if branch, ok := t.branches[branchKey(commit)]; ok {
+		return branch.Status
+	}
+	return StatusPending
+}
+
+// List returns a snapshot of the status of every tracked branch
+func (t *BranchTracker) List() []BranchStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	branches := make([]BranchStatus, 0, len(t.branches))
+	for _, branch := range t.branches {
+		branches = append(branches, *branch)
+	}
+	sort.Slice(branches, func(i, j int) bool {
+		if branches[i].Repository == branches[j].Repository {
+			return branches[i].Branch < branches[j].Branch
+		}
+		return branches[i].Repository < branches[j].Repository
+	})
+	return branches
+}
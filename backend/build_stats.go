@@ -0,0 +1,222 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Window of the build statistics by default and at most, in days
+const (
+	defaultStatsDays int = 30
+	maxStatsDays     int = 365
+)
+
+// Layout of the day keys of the build trends
+const statsDayLayout string = "2006-01-02"
+
+// Distribution of the durations of a set of builds or steps, in seconds
+type DurationStats struct {
+	Count int     `json:"count"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P95   float64 `json:"p95"`
+	Max   float64 `json:"max"`
+}
+
+// Builds of a day and their median duration, in seconds
+type TrendPoint struct {
+	Day    string  `json:"day"`
+	Builds int     `json:"builds"`
+	P50    float64 `json:"p50"`
+}
+
+// Timing statistics of the successful builds of a repository over a window,
+// with the daily trend. Change is the relative difference of the median
+// duration of the second half of the window against the first one, e.g. 0.2
+// when the builds got 20% slower.
+type BuildStats struct {
+	Repository string                   `json:"repository"`
+	Branch     string                   `json:"branch,omitempty"`
+	Since      time.Time                `json:"since"`
+	Builds     DurationStats            `json:"builds"`
+	Steps      map[string]DurationStats `json:"steps"`
+	Trend      []TrendPoint             `json:"trend"`
+	Change     float64                  `json:"change"`
+}
+
+// percentile returns the nearest-rank percentile of sorted durations
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func durationStats(durations []float64) DurationStats {
+	if len(durations) == 0 {
+		return DurationStats{}
+	}
+	sorted := append([]float64{}, durations...)
+	sort.Float64s(sorted)
+	sum := 0.0
+	for _, d := range sorted {
+		sum += d
+	}
+	return DurationStats{
+		Count: len(sorted),
+		Mean:  sum / float64(len(sorted)),
+		P50:   percentile(sorted, 50),
+		P90:   percentile(sorted, 90),
+		P95:   percentile(sorted, 95),
+		Max:   sorted[len(sorted)-1],
+	}
+}
+
+// buildStats aggregates the durations of the successful builds of a
+// repository, and of their steps, started since the given time. Builds
+// reusing a cached result are left out as they didn't run.
+func (d *Dispatcher) buildStats(repository, branch string, since time.Time) (BuildStats, error) {
+	stats := BuildStats{Repository: repository, Branch: branch, Since: since,
+		Steps: map[string]DurationStats{}, Trend: []TrendPoint{}}
+	filter := JobFilter{Repository: repository, Branch: branch, State: JobSuccess, Since: since}
+	jobs, _, err := d.jobs.List(filter, "", math.MaxInt32)
+	if err != nil {
+		return stats, err
+	}
+	// Oldest first, to split the window in halves
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	var builds []float64
+	steps := map[string][]float64{}
+	days := map[string][]float64{}
+	for _, job := range jobs {
+		if job.CachedFrom != "" || job.StartedAt == nil || job.FinishedAt == nil {
+			continue
+		}
+		duration := job.FinishedAt.Sub(*job.StartedAt).Seconds()
+		builds = append(builds, duration)
+		day := job.StartedAt.UTC().Format(statsDayLayout)
+		days[day] = append(days[day], duration)
+		results, err := getStepResults(d.store, job.Id)
+		if err != nil {
+			continue
+		}
+		for _, step := range results {
+			if step.Status != StepSuccess || step.StartedAt.IsZero() || step.FinishedAt.IsZero() {
+				continue
+			}
+			steps[step.Name] = append(steps[step.Name], step.FinishedAt.Sub(step.StartedAt).Seconds())
+		}
+	}
+	stats.Builds = durationStats(builds)
+	for name, durations := range steps {
+		stats.Steps[name] = durationStats(durations)
+	}
+	for day, durations := range days {
+		s := durationStats(durations)
+		stats.Trend = append(stats.Trend, TrendPoint{Day: day, Builds: s.Count, P50: s.P50})
+	}
+	sort.Slice(stats.Trend, func(i, j int) bool { return stats.Trend[i].Day < stats.Trend[j].Day })
+	if len(builds) >= 2 {
+		before := durationStats(builds[:len(builds)/2]).P50
+		after := durationStats(builds[len(builds)/2:]).P50
+		if before > 0 {
+			stats.Change = (after - before) / before
+		}
+	}
+	return stats, nil
+}
+
+// reposHandler serves the per repository endpoints:
+//   - GET /repos/{owner}/{name}/stats?days=&branch= the timing statistics of
+//     the builds over the last days, 30 by default
+//   - /repos/{owner}/{name}/settings the settings, see
+//     repositorySettingsHandler
+//   - /repos/{owner}/{name}/env[/{NAME}] the variables injected into the
+//     jobs, see repositoryEnvHandler
+func reposHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/repos/")
+		if repository := strings.TrimSuffix(path, "/settings"); repository != path && repository != "" {
+			repositorySettingsHandler(d, repository)(w, r)
+			return
+		}
+		if repository := strings.TrimSuffix(path, "/env"); repository != path && strings.Contains(repository, "/") {
+			repositoryEnvHandler(d, repository, "")(w, r)
+			return
+		}
+		if i := strings.LastIndex(path, "/env/"); i > 0 {
+			if repository, name := path[:i], path[i+len("/env/"):]; strings.Contains(repository, "/") &&
+				!strings.Contains(name, "/") && name != "" {
+				repositoryEnvHandler(d, repository, name)(w, r)
+				return
+			}
+		}
+		if !strings.HasSuffix(path, "/stats") {
+			http.NotFound(w, r)
+			return
+		}
+		repository := strings.TrimSuffix(path, "/stats")
+		if repository == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !d.authorize(w, r, PermissionView, repository) {
+			return
+		}
+		days := defaultStatsDays
+		if value := r.URL.Query().Get("days"); value != "" {
+			var err error
+			if days, err = strconv.Atoi(value); err != nil || days < 1 || days > maxStatsDays {
+				http.Error(w, "days must be between 1 and "+strconv.Itoa(maxStatsDays),
+					http.StatusBadRequest)
+				return
+			}
+		}
+		since := time.Now().UTC().AddDate(0, 0, -days)
+		stats, err := d.buildStats(repository, r.URL.Query().Get("branch"), since)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, stats)
+	}
+}
@@ -0,0 +1,101 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	if p := percentile(sorted, 50); p != 5 {
+		t.Errorf("p50 expected 5 got %v", p)
+	}
+	if p := percentile(sorted, 95); p != 10 {
+		t.Errorf("p95 expected 10 got %v", p)
+	}
+	if p := percentile(nil, 50); p != 0 {
+		t.Errorf("p50 of no durations expected 0 got %v", p)
+	}
+}
+
+func TestReposHandlerStats(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil)
+	commit := Commit{Repository: Repository{Name: "octocat/test", Branch: "master"}}
+	start := time.Now().Add(-48 * time.Hour)
+	// Builds getting slower, from 60s to 120s
+	for i, seconds := range []int{60, 60, 120, 120} {
+		job := NewJob(string(rune('a'+i)), commit)
+		job.CreatedAt = start.Add(time.Duration(i) * time.Hour)
+		startedAt := job.CreatedAt
+		finishedAt := startedAt.Add(time.Duration(seconds) * time.Second)
+		job.State, job.StartedAt, job.FinishedAt = JobSuccess, &startedAt, &finishedAt
+		if err := d.jobs.Create(job); err != nil {
+			t.Fatal(err)
+		}
+		steps := []StepResult{{Name: "test", Status: StepSuccess, StartedAt: startedAt, FinishedAt: finishedAt}}
+		if err := putStepResults(d.store, job.Id, steps); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failed := NewJob("e", commit)
+	if err := d.jobs.Create(failed); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	reposHandler(d)(rec, httptest.NewRequest(http.MethodGet, "/repos/octocat/test/stats?days=7", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("reposHandler expected 200 got %d: %s", rec.Code, rec.Body.String())
+	}
+	var stats BuildStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Builds.Count != 4 || stats.Builds.P50 != 60 || stats.Builds.P95 != 120 || stats.Builds.Mean != 90 {
+		t.Errorf("Unexpected build stats %+v", stats.Builds)
+	}
+	if stats.Steps["test"].Count != 4 {
+		t.Errorf("Unexpected step stats %+v", stats.Steps)
+	}
+	if stats.Change != 1 {
+		t.Errorf("Builds expected to be 100%% slower, got %v", stats.Change)
+	}
+	if len(stats.Trend) == 0 {
+		t.Errorf("Expected a daily trend")
+	}
+
+	rec = httptest.NewRecorder()
+	reposHandler(d)(rec, httptest.NewRequest(http.MethodGet, "/repos/octocat/test/stats?days=0", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("reposHandler expected 400 on an invalid window got %d", rec.Code)
+	}
+}
@@ -0,0 +1,226 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Bucket of the builds deferred to the window of their branch
+const deferredBuildsBucket string = "deferred_builds"
+
+// BuildWindow restricts the pushes to the branches matching any of its
+// patterns to be built at the minutes matching a cron schedule, the ones
+// pushed outside are deferred to the next matching minute and batched,
+// building only the latest commit of each branch, e.g. dependency updates
+// built only nightly
+//
+//	{"branches": ["dependabot/*"], "schedule": "0 2 * * *", "timezone": "Europe/Rome"}
+//
+// or outside working hours
+//
+//	{"branches": ["*"], "schedule": "* 0-8,18-23 * * *"}
+type BuildWindow struct {
+	Branches []string `json:"branches"`
+	Schedule string   `json:"schedule"`
+	// Location of the schedule, UTC if empty
+	Timezone string `json:"timezone,omitempty"`
+}
+
+func (w BuildWindow) parse() (*CronSchedule, *time.Location, error) {
+	cron, err := ParseCronSchedule(w.Schedule)
+	if err != nil {
+		return nil, nil, err
+	}
+	location := time.UTC
+	if w.Timezone != "" {
+		if location, err = time.LoadLocation(w.Timezone); err != nil {
+			return nil, nil, err
+		}
+	}
+	return cron, location, nil
+}
+
+func (w BuildWindow) validate() error {
+	if len(w.Branches) == 0 {
+		return fmt.Errorf("%w: build windows require branches", ErrInvalidSettings)
+	}
+	if err := validateBranchPatterns(w.Branches); err != nil {
+		return err
+	}
+	if _, _, err := w.parse(); err != nil {
+		return fmt.Errorf("%w: invalid build window: %v", ErrInvalidSettings, err)
+	}
+	return nil
+}
+
+// DeferredBuild is a push waiting for the build window of its branch
+type DeferredBuild struct {
+	Commit Commit    `json:"commit"`
+	Until  time.Time `json:"until"`
+}
+
+// deferredKey identifies the deferred build of the ref of a commit
+func deferredKey(commit Commit) string {
+	return commit.GetRepositoryName() + "@" + commit.ref()
+}
+
+// deferral returns when the push of a commit can be built if it's outside the
+// build window of its branch, the first window matching the branch applies
+func (d *Dispatcher) deferral(commit Commit) (time.Time, bool) {
+	if commit.TriggeredBy() != PushTrigger || commit.Repository.Branch == "" {
+		return time.Time{}, false
+	}
+	settings, err := d.repositorySettings(commit.GetRepositoryName())
+	if err != nil {
+		log.Printf("Error reading the settings of %s: %v\n", commit.GetRepositoryName(), err)
+		return time.Time{}, false
+	}
+	for _, window := range settings.Windows {
+		if !matchesAny(window.Branches, commit.Repository.Branch) {
+			continue
+		}
+		cron, location, err := window.parse()
+		if err != nil {
+			return time.Time{}, false
+		}
+		now := d.clock.Now().In(location)
+		if cron.Matches(now) {
+			return time.Time{}, false
+		}
+		until := cron.Next(now)
+		return until, !until.IsZero()
+	}
+	return time.Time{}, false
+}
+
+// defers stores the push of a commit outside the build window of its branch
+// until the window opens, replacing the one of the branch already waiting,
+// returns when it's going to be built
+func (d *Dispatcher) defers(commit Commit) (time.Time, bool) {
+	until, ok := d.deferral(commit)
+	if !ok {
+		return until, false
+	}
+	key := deferredKey(commit)
+	d.deferredLocks.Lock(key)
+	defer d.deferredLocks.Unlock(key)
+	if value, err := d.store.Get(deferredBuildsBucket, key); err == nil {
+		var waiting DeferredBuild
+		if json.Unmarshal(value, &waiting) == nil {
+			// The batch includes the commits of the replaced push, once
+			// even if the push is delivered again
+			commit.PushedCommits = mergeCommits(pushedCommits(waiting.Commit), pushedCommits(commit))
+		}
+	}
+	value, err := json.Marshal(DeferredBuild{commit, until})
+	if err == nil {
+		err = d.store.Put(deferredBuildsBucket, key, value)
+	}
+	if err != nil {
+		// Better built now than lost
+		log.Printf("Error deferring commit %s of %s: %v\n", commit.Id, commit.GetRepositoryName(), err)
+		return until, false
+	}
+	log.Printf("Deferred commit %s of %s@%s until %s\n",
+		commit.Id, commit.GetRepositoryName(), commit.Repository.Branch, until)
+	d.metrics.Inc("narwhal_deferred_builds_total")
+	return until, true
+}
+
+// pushedCommits returns the commits included in the push of a commit, the
+// commit alone if not known
+func pushedCommits(commit Commit) []string {
+	if len(commit.PushedCommits) == 0 {
+		return []string{commit.Id}
+	}
+	return append([]string{}, commit.PushedCommits...)
+}
+
+// mergeCommits appends to a list of commits the ones of another missing from
+// it
+func mergeCommits(commits, others []string) []string {
+	seen := map[string]bool{}
+	for _, id := range commits {
+		seen[id] = true
+	}
+	for _, id := range others {
+		if !seen[id] {
+			seen[id] = true
+			commits = append(commits, id)
+		}
+	}
+	return commits
+}
+
+// releaseDeferred submits the deferred builds every minute once their window
+// opened, until stop is closed
+func (d *Dispatcher) releaseDeferred(stop <-chan interface{}) {
+	for {
+		select {
+		case <-d.clock.After(time.Minute):
+		case <-stop:
+			return
+		}
+		values, err := d.store.List(deferredBuildsBucket, "")
+		if err != nil {
+			log.Printf("Error listing the deferred builds: %v\n", err)
+			continue
+		}
+		now := d.clock.Now()
+		for _, value := range values {
+			var build DeferredBuild
+			if err := json.Unmarshal(value, &build); err != nil || build.Until.After(now) {
+				continue
+			}
+			d.release(deferredKey(build.Commit), now)
+		}
+	}
+}
+
+// release submits the build deferred under a key if its window opened, read
+// again under the lock of the key as a push may have replaced it meanwhile
+func (d *Dispatcher) release(key string, now time.Time) {
+	d.deferredLocks.Lock(key)
+	defer d.deferredLocks.Unlock(key)
+	value, err := d.store.Get(deferredBuildsBucket, key)
+	if err != nil {
+		return
+	}
+	var build DeferredBuild
+	if err := json.Unmarshal(value, &build); err != nil || build.Until.After(now) {
+		return
+	}
+	if err := d.store.Delete(deferredBuildsBucket, key); err != nil {
+		log.Printf("Error releasing the deferred build of %s: %v\n", key, err)
+		return
+	}
+	d.submit(build.Commit)
+}
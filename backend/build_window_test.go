@@ -0,0 +1,99 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBuildWindowValidate(t *testing.T) {
+	for _, window := range []BuildWindow{
+		{Schedule: "0 2 * * *"},
+		{Branches: []string{"["}, Schedule: "0 2 * * *"},
+		{Branches: []string{"*"}, Schedule: "0 25 * * *"},
+		{Branches: []string{"*"}, Schedule: "0 2 * * *", Timezone: "Mars/Olympus"},
+	} {
+		if err := window.validate(); err == nil {
+			t.Errorf("BuildWindow.validate failed: expected an error for %+v", window)
+		}
+	}
+}
+
+func TestDeferredBuilds(t *testing.T) {
+	clock := newFakeClock()
+	d := NewDispatcher("commits", time.Second, nil, WithClock(clock))
+	d.putRepositorySettings(RepositorySettings{Repository: "octocat/test", Windows: []BuildWindow{
+		{Branches: []string{"dependabot/*"}, Schedule: "0 2 * * *"},
+	}})
+	bump := Repository{GitHub, "octocat/test", "dependabot/npm"}
+	for _, commit := range []Commit{
+		{Id: "main", Repository: Repository{GitHub, "octocat/test", "main"}},
+		{Id: "tag", Event: TagTrigger, Tag: "v1", Repository: bump},
+	} {
+		if _, ok := d.defers(commit); ok {
+			t.Errorf("Dispatcher.defers failed: expected %s built right away", commit.Id)
+		}
+	}
+	until, ok := d.defers(Commit{Id: "a", Repository: bump})
+	if !ok || !until.Equal(time.Date(2020, 1, 1, 2, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Dispatcher.defers failed: expected a deferral until 2am got %v %v", until, ok)
+	}
+	d.defers(Commit{Id: "b", Repository: bump})
+	// Delivered again by the message queue
+	d.defers(Commit{Id: "b", Repository: bump})
+	value, _ := d.store.Get(deferredBuildsBucket, deferredKey(Commit{Repository: bump}))
+	var waiting DeferredBuild
+	json.Unmarshal(value, &waiting)
+	if waiting.Commit.Id != "b" || !reflect.DeepEqual(waiting.Commit.PushedCommits, []string{"a", "b"}) {
+		t.Errorf("Dispatcher.defers failed: expected a and b batched got %+v", waiting.Commit)
+	}
+
+	stop := make(chan interface{})
+	defer close(stop)
+	go d.releaseDeferred(stop)
+	<-clock.requested
+	clock.Advance(time.Hour)
+	<-clock.requested
+	if d.queue.Len() != 0 {
+		t.Errorf("Dispatcher.releaseDeferred failed: expected nothing released before 2am")
+	}
+	clock.Advance(time.Hour)
+	<-clock.requested
+	if d.queue.Len() != 1 {
+		t.Errorf("Dispatcher.releaseDeferred failed: expected the batch released at 2am")
+	}
+	if _, err := d.store.Get(deferredBuildsBucket, deferredKey(Commit{Repository: bump})); err != ErrNotFound {
+		t.Errorf("Dispatcher.releaseDeferred failed: expected the deferred build removed")
+	}
+	// Within the window pushes are built right away
+	if _, ok := d.defers(Commit{Id: "c", Repository: bump}); ok {
+		t.Errorf("Dispatcher.defers failed: expected c built within the window")
+	}
+}
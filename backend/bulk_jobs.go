@@ -0,0 +1,273 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type BulkAction string
+
+const (
+	BulkCancel  BulkAction = "cancel"
+	BulkRebuild BulkAction = "rebuild"
+	BulkDelete  BulkAction = "delete"
+)
+
+// States of the jobs each bulk action applies to, the other jobs matching
+// the query are left alone
+var bulkActionStates = map[BulkAction][]JobState{
+	BulkCancel:  {JobPending, JobRunning},
+	BulkRebuild: {JobFailed, JobCancelled},
+	BulkDelete:  {JobSuccess, JobFailed, JobCancelled, JobSkipped},
+}
+
+// Limits of the bulk operations, a bigger selection has to be processed in
+// several rounds
+const (
+	maxBulkJobs         int           = 10000
+	bulkConfirmationTTL time.Duration = 5 * time.Minute
+)
+
+var (
+	ErrJobNotDone           = errors.New("job not done yet")
+	ErrInvalidConfirmation  = errors.New("invalid or expired confirmation token")
+	ErrUnknownBulkAction    = errors.New("unknown bulk action")
+	ErrConfirmationMismatch = errors.New("confirmation token issued for another request")
+)
+
+// BulkRequest applies an action to every job matching a query, see
+// ParseJobQuery. Without a token the request is only previewed, returning
+// the token to send back to confirm it.
+type BulkRequest struct {
+	Action BulkAction `json:"action"`
+	Query  string     `json:"query"`
+	Token  string     `json:"token,omitempty"`
+}
+
+// BulkPreview lists the jobs a bulk request would affect
+type BulkPreview struct {
+	Action BulkAction `json:"action"`
+	Query  string     `json:"query"`
+	Jobs   []string   `json:"jobs"`
+	// Set if more jobs match than maxBulkJobs
+	Truncated bool      `json:"truncated,omitempty"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// BulkResult reports the outcome of a confirmed bulk request
+type BulkResult struct {
+	Action BulkAction `json:"action"`
+	Done   []string   `json:"done"`
+	// IDs of the new jobs, by rebuilt job
+	Rebuilt map[string]string `json:"rebuilt,omitempty"`
+	// Errors of the jobs the action failed on, by job
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// bulkConfirmations holds the previewed bulk requests until confirmed or
+// expired, each token can be used once
+type bulkConfirmations struct {
+	mutex   sync.Mutex
+	pending map[string]BulkPreview
+}
+
+func newBulkConfirmations() *bulkConfirmations {
+	return &bulkConfirmations{pending: map[string]BulkPreview{}}
+}
+
+func (c *bulkConfirmations) add(preview BulkPreview, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for token, p := range c.pending {
+		if now.After(p.ExpiresAt) {
+			delete(c.pending, token)
+		}
+	}
+	c.pending[preview.Token] = preview
+}
+
+// confirm returns the preview issued for the request, consuming its token
+func (c *bulkConfirmations) confirm(req BulkRequest, now time.Time) (BulkPreview, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	preview, ok := c.pending[req.Token]
+	if !ok || now.After(preview.ExpiresAt) {
+		return preview, ErrInvalidConfirmation
+	}
+	if preview.Action != req.Action || preview.Query != req.Query {
+		return preview, ErrConfirmationMismatch
+	}
+	delete(c.pending, req.Token)
+	return preview, nil
+}
+
+// previewBulk selects the jobs a bulk request applies to
+func (d *Dispatcher) previewBulk(req BulkRequest) (BulkPreview, error) {
+	states, ok := bulkActionStates[req.Action]
+	if !ok {
+		return BulkPreview{}, ErrUnknownBulkAction
+	}
+	query, err := ParseJobQuery(req.Query)
+	if err != nil {
+		return BulkPreview{}, err
+	}
+	query.states = states
+	jobs, next, err := d.jobs.Search(query, "", maxBulkJobs)
+	if err != nil {
+		return BulkPreview{}, err
+	}
+	preview := BulkPreview{
+		Action:    req.Action,
+		Query:     req.Query,
+		Jobs:      make([]string, len(jobs)),
+		Truncated: next != "",
+		Token:     d.newId(),
+		ExpiresAt: d.clock.Now().Add(bulkConfirmationTTL),
+	}
+	for i, job := range jobs {
+		preview.Jobs[i] = job.Id
+	}
+	return preview, nil
+}
+
+// applyBulk runs the action of a confirmed request on the previewed jobs,
+// the ones whose state changed since are reported failed
+func (d *Dispatcher) applyBulk(preview BulkPreview) BulkResult {
+	res := BulkResult{Action: preview.Action, Done: []string{},
+		Rebuilt: map[string]string{}, Failed: map[string]string{}}
+	for _, jobId := range preview.Jobs {
+		var err error
+		switch preview.Action {
+		case BulkCancel:
+			_, err = d.cancelJob(jobId)
+		case BulkRebuild:
+			var job Job
+			if job, err = d.retryJob(jobId); err == nil {
+				res.Rebuilt[jobId] = job.Id
+			}
+		case BulkDelete:
+			err = d.deleteJob(jobId)
+		}
+		if err != nil {
+			res.Failed[jobId] = err.Error()
+			continue
+		}
+		res.Done = append(res.Done, jobId)
+	}
+	log.Printf("Bulk %s of %q applied to %d jobs, %d failed\n",
+		preview.Action, preview.Query, len(res.Done), len(res.Failed))
+	return res
+}
+
+// deleteJob removes a finished job along with its logs, steps, artifacts
+// and cached result
+func (d *Dispatcher) deleteJob(jobId string) error {
+	job, err := d.jobs.Get(jobId)
+	if err != nil {
+		return err
+	}
+	if !job.Done() {
+		return ErrJobNotDone
+	}
+	artifacts, err := d.listArtifacts(jobId)
+	if err != nil {
+		return err
+	}
+	for _, artifact := range artifacts {
+		key := artifactKey(jobId, artifact.Name)
+		if err := d.store.Delete(artifactsBucket, key); err != nil {
+			return err
+		}
+		if err := d.store.Delete(jobArtifactsBucket, key); err != nil {
+			return err
+		}
+	}
+	for _, bucket := range []string{stepsBucket, jobLogsBucket} {
+		if err := d.store.Delete(bucket, jobId); err != nil {
+			return err
+		}
+	}
+	if cached, ok := d.cachedResult(job); ok && cached.JobId == jobId {
+		if err := d.store.Delete(resultCacheBucket, resultCacheKey(job.Commit)); err != nil {
+			return err
+		}
+	}
+	d.logs.Remove(jobId)
+	return d.jobs.Delete(job)
+}
+
+// bulkJobsHandler serves POST /jobs/bulk, admin token required. A request
+// without token answers with the preview of the jobs affected and the token
+// confirming it, valid for bulkConfirmationTTL, e.g.
+//
+//	{"action": "cancel", "query": "repo:octocat/hello status:pending"}
+//
+// Sending it back along with the same action and query applies the action.
+func bulkJobsHandler(d *Dispatcher, confirmations *bulkConfirmations) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, d.adminToken) {
+			http.Error(w, "admin token required", http.StatusForbidden)
+			return
+		}
+		var req BulkRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid bulk request", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+		if req.Token != "" {
+			preview, err := confirmations.confirm(req, d.clock.Now())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			writeJSON(w, http.StatusOK, d.applyBulk(preview))
+			return
+		}
+		preview, err := d.previewBulk(req)
+		if errors.Is(err, ErrInvalidQuery) || err == ErrUnknownBulkAction {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		confirmations.add(preview, d.clock.Now())
+		writeJSON(w, http.StatusOK, preview)
+	}
+}
@@ -0,0 +1,150 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func bulkRequest(handler http.HandlerFunc, token string, req BulkRequest, res interface{}) int {
+	body, _ := json.Marshal(req)
+	httpReq := httptest.NewRequest(http.MethodPost, "/jobs/bulk", bytes.NewReader(body))
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler(rec, httpReq)
+	if res != nil {
+		json.NewDecoder(rec.Body).Decode(res)
+	}
+	return rec.Code
+}
+
+func TestBulkJobsHandlerCancel(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil, WithAdminToken("secret"))
+	flooded := Repository{GitHub, "octocat/flooded", "master"}
+	var ids []string
+	for _, id := range []string{"a", "b", "c"} {
+		ids = append(ids, d.enqueue(Commit{Id: id, Repository: flooded}))
+	}
+	other := d.enqueue(Commit{Id: "d", Repository: Repository{GitHub, "octocat/other", "master"}})
+	d.cancelJob(ids[0])
+	handler := bulkJobsHandler(d, newBulkConfirmations())
+	req := BulkRequest{Action: BulkCancel, Query: "repo:octocat/flooded"}
+
+	if code := bulkRequest(handler, "wrong", req, nil); code != http.StatusForbidden {
+		t.Errorf("bulkJobsHandler failed: expected 403 without admin token got %d", code)
+	}
+	var preview BulkPreview
+	if code := bulkRequest(handler, "secret", req, &preview); code != http.StatusOK ||
+		len(preview.Jobs) != 2 || preview.Token == "" {
+		t.Fatalf("bulkJobsHandler failed: unexpected preview %d %+v", code, preview)
+	}
+	if d.queue.Len() != 3 {
+		t.Fatalf("bulkJobsHandler failed: expected no job cancelled by the preview")
+	}
+
+	mismatch := BulkRequest{Action: BulkCancel, Query: "repo:octocat/other", Token: preview.Token}
+	if code := bulkRequest(handler, "secret", mismatch, nil); code != http.StatusConflict {
+		t.Errorf("bulkJobsHandler failed: expected 409 confirming another query got %d", code)
+	}
+	req.Token = preview.Token
+	var res BulkResult
+	if code := bulkRequest(handler, "secret", req, &res); code != http.StatusOK || len(res.Done) != 2 {
+		t.Fatalf("bulkJobsHandler failed: unexpected result %d %+v", code, res)
+	}
+	for _, id := range ids {
+		if job, _ := d.jobs.Get(id); job.State != JobCancelled {
+			t.Errorf("bulkJobsHandler failed: expected job %s CANCELLED got %s", id, job.State)
+		}
+	}
+	if job, _ := d.jobs.Get(other); job.State != JobPending || d.queue.Len() != 1 {
+		t.Errorf("bulkJobsHandler failed: expected job %s left PENDING got %s", other, job.State)
+	}
+	if code := bulkRequest(handler, "secret", req, nil); code != http.StatusConflict {
+		t.Errorf("bulkJobsHandler failed: expected 409 reusing a token got %d", code)
+	}
+}
+
+func TestBulkConfirmationExpiry(t *testing.T) {
+	clock := newFakeClock()
+	d := NewDispatcher("commits", time.Second, nil, WithClock(clock))
+	confirmations := newBulkConfirmations()
+	preview, err := d.previewBulk(BulkRequest{Action: BulkRebuild, Query: "status:failed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	confirmations.add(preview, clock.Now())
+	clock.Advance(bulkConfirmationTTL + time.Second)
+	req := BulkRequest{Action: BulkRebuild, Query: "status:failed", Token: preview.Token}
+	if _, err := confirmations.confirm(req, clock.Now()); err != ErrInvalidConfirmation {
+		t.Errorf("bulkConfirmations.confirm failed: expected ErrInvalidConfirmation got %v", err)
+	}
+	if _, err := d.previewBulk(BulkRequest{Action: "explode"}); err != ErrUnknownBulkAction {
+		t.Errorf("Dispatcher.previewBulk failed: expected ErrUnknownBulkAction got %v", err)
+	}
+}
+
+func TestBulkRebuildAndDelete(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil)
+	commit := Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "master"}}
+	first := d.enqueue(commit)
+	d.cancelJob(first)
+
+	res := d.applyBulk(BulkPreview{Action: BulkRebuild, Jobs: []string{first}})
+	second := res.Rebuilt[first]
+	if len(res.Done) != 1 || second == "" {
+		t.Fatalf("Dispatcher.applyBulk failed: unexpected rebuild %+v", res)
+	}
+	d.cancelJob(second)
+	d.logs.Append(second, []byte("output"))
+	d.closeLogs(second)
+	putStepResults(d.store, second, []StepResult{{Name: "test"}})
+
+	res = d.applyBulk(BulkPreview{Action: BulkDelete, Jobs: []string{second, "missing"}})
+	if len(res.Done) != 1 || res.Failed["missing"] == "" {
+		t.Fatalf("Dispatcher.applyBulk failed: unexpected delete %+v", res)
+	}
+	if _, err := d.jobs.Get(second); err != ErrNotFound {
+		t.Errorf("Dispatcher.deleteJob failed: expected job %s deleted got %v", second, err)
+	}
+	if _, err := d.store.Get(jobLogsBucket, second); err != ErrNotFound || d.logs.Has(second) {
+		t.Errorf("Dispatcher.deleteJob failed: expected logs of %s deleted", second)
+	}
+	if _, err := getStepResults(d.store, second); err != ErrNotFound {
+		t.Errorf("Dispatcher.deleteJob failed: expected steps of %s deleted got %v", second, err)
+	}
+	if job, err := d.jobs.GetByCommit("octocat/test", "abc"); err != nil || job.Id != first {
+		t.Errorf("JobStore.Delete failed: expected %s as last job of the commit got %s %v", first, job.Id, err)
+	}
+	if ids := searchIds(t, d.jobs, "sha:abc"); len(ids) != 1 || ids[0] != first {
+		t.Errorf("JobStore.Delete failed: expected %s only indexed got %v", first, ids)
+	}
+}
@@ -0,0 +1,121 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"log"
+	"net/rpc"
+	"time"
+)
+
+// How long the cancel of a job not running on the runner is remembered, in
+// case the job reaches the runner after it
+const cancelRetention = 10 * time.Minute
+
+type CancelJobRequest struct {
+	JobId string
+}
+
+type CancelJobResponse struct {
+	Removed int
+}
+
+// CancelJob stops a running job, the remaining steps are skipped and the
+// containers of the job killed, failing the current step
+func (r *Runner) CancelJob(req CancelJobRequest, res *CancelJobResponse) error {
+	r.jobsMutex.Lock()
+	if r.cancelled == nil {
+		r.cancelled = map[string]bool{}
+	}
+	r.cancelled[req.JobId] = true
+	if !r.active[req.JobId] {
+		jobId := req.JobId
+		time.AfterFunc(cancelRetention, func() { r.forgetCancel(jobId) })
+	}
+	r.jobsMutex.Unlock()
+	r.chaos.release(req.JobId)
+	removed, err := removeJobContainers(req.JobId)
+	res.Removed = removed
+	return err
+}
+
+func (r *Runner) isCancelled(jobId string) bool {
+	r.jobsMutex.Lock()
+	defer r.jobsMutex.Unlock()
+	return r.cancelled[jobId]
+}
+
+// forgetCancel drops the cancel of a job unless it's running, the cancels of
+// running jobs are dropped once they finish
+func (r *Runner) forgetCancel(jobId string) {
+	r.jobsMutex.Lock()
+	defer r.jobsMutex.Unlock()
+	if !r.active[jobId] {
+		delete(r.cancelled, jobId)
+	}
+}
+
+// cancelJob marks a job cancelled, dropping it from the queue if still
+// pending or telling its runner to stop it otherwise. The runner is not
+// waited for, its answer for the job is discarded.
+func (d *Dispatcher) cancelJob(jobId string) (Job, error) {
+	var previous JobState
+	job, err := d.jobs.Update(jobId, func(job *Job) error {
+		previous = job.State
+		return job.TransitionAt(JobCancelled, d.clock.Now())
+	})
+	if err != nil {
+		return job, err
+	}
+	d.completeClaim(job.Commit)
+	d.closeLogs(jobId)
+	d.reportJob(jobId)
+	d.notifySlack(jobId)
+	d.events.Append(JobEvent{Type: JobCancelledEvent, JobId: jobId, Commit: job.Commit,
+		Runner: job.Runner})
+	if previous == JobPending {
+		d.queue.Remove(jobId)
+		return job, nil
+	}
+	for _, runner := range d.runnerList() {
+		if runner.Id != job.Runner {
+			continue
+		}
+		if client := runner.client(); client != nil {
+			call := client.Go("Runner.CancelJob", CancelJobRequest{jobId},
+				&CancelJobResponse{}, make(chan *rpc.Call, 1))
+			go func() {
+				if c := <-call.Done; c.Error != nil {
+					log.Printf("Error cancelling job %s on runner %s: %v\n",
+						jobId, runner.Addr, c.Error)
+				}
+			}()
+		}
+		break
+	}
+	return job, nil
+}
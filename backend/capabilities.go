@@ -0,0 +1,166 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	docker "github.com/docker/docker/client"
+	"log"
+	"time"
+)
+
+// Capabilities of a runner, reported when registering to the dispatcher and
+// used to route the jobs
+type RunnerCapabilities struct {
+	// Jobs run at once, 0 for no limit
+	MaxJobs int `json:"max_jobs"`
+	// Whether the Docker daemon answered, every executor requires it
+	Docker bool `json:"docker"`
+	// Modes of execution of the steps supported, see the modes of execution
+	Executors []string `json:"executors"`
+	Version   string   `json:"version"`
+	// Features of the runner protocol supported, see runnerCapabilities
+	Features []string `json:"features"`
+}
+
+var ErrIncompatibleRunner = errors.New("runner not compatible with the dispatcher")
+
+// WithMaxJobs limits the jobs the dispatcher routes to the runner at once
+func WithMaxJobs(max int) RunnerOption {
+	return func(r *Runner) {
+		r.maxJobs = max
+	}
+}
+
+// WithExecutors restricts the modes of execution of the pipelines run, the
+// pipelines in another mode are handed back to the dispatcher
+func WithExecutors(executors ...string) RunnerOption {
+	return func(r *Runner) {
+		r.executors = executors
+	}
+}
+
+// validateExecutors checks that every executor is a known mode of execution
+func validateExecutors(executors []string) error {
+	for _, executor := range executors {
+		if executor != containerMode && executor != execMode {
+			return fmt.Errorf("unknown executor %q, expected %s or %s", executor, containerMode, execMode)
+		}
+	}
+	return nil
+}
+
+// dockerAvailable tells if the Docker daemon answers within a few seconds
+func dockerAvailable() bool {
+	cli, err := docker.NewEnvClient()
+	if err != nil {
+		return false
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = cli.Ping(ctx)
+	return err == nil
+}
+
+// supportedExecutors returns the modes of execution the runner accepts, all
+// of them unless restricted
+func (r *Runner) supportedExecutors() []string {
+	if len(r.executors) == 0 {
+		return []string{containerMode, execMode}
+	}
+	return r.executors
+}
+
+// capabilities returns what the runner reports of itself on registration
+func (r *Runner) capabilities() *RunnerCapabilities {
+	return &RunnerCapabilities{
+		MaxJobs:   r.maxJobs,
+		Docker:    dockerAvailable(),
+		Executors: r.supportedExecutors(),
+		Version:   Version,
+		Features:  runnerCapabilities,
+	}
+}
+
+// runs tells if the steps of a pipeline in the given mode can be executed,
+// unknown capabilities, e.g. of the runners from the configuration, put no
+// restriction
+func (c *RunnerCapabilities) runs(executor string) bool {
+	if c == nil {
+		return true
+	}
+	if executor == "" {
+		executor = containerMode
+	}
+	return c.Docker && containsString(c.Executors, executor)
+}
+
+// compatible returns an error wrapping ErrIncompatibleRunner if the runner
+// lacks any of the features the dispatcher relies on
+func (c *RunnerCapabilities) compatible() error {
+	if c == nil {
+		return nil
+	}
+	for _, required := range runnerCapabilities {
+		if !containsString(c.Features, required) {
+			return fmt.Errorf("%w: runner %s missing the %s feature", ErrIncompatibleRunner, c.Version, required)
+		}
+	}
+	if c.Version != Version {
+		log.Printf("Runner version %s differs from the dispatcher version %s\n", c.Version, Version)
+	}
+	return nil
+}
+
+// setCapabilities records the capabilities reported by the runner on its
+// last registration
+func (p *RunnerProxy) setCapabilities(capabilities *RunnerCapabilities) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if capabilities != nil {
+		p.capabilities = capabilities
+	}
+}
+
+// hasCapacity tells if the runner can take one more job
+func (p *RunnerProxy) hasCapacity() bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.capabilities == nil || p.capabilities.MaxJobs <= 0 || len(p.currentJobs) < p.capabilities.MaxJobs
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
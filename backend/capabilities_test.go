@@ -0,0 +1,134 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisterRunnerCapabilities(t *testing.T) {
+	addr := serveRunner(t, &Runner{registrationSecret: "secret"})
+	d := NewDispatcher("commits", time.Second, nil, WithRunnerRegistration("secret"))
+	handler := runnersHandler(d)
+	register := func(body string) int {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/runners", strings.NewReader(body)))
+		return rec.Code
+	}
+	if code := register(`{"addr":"` + addr + `","capabilities":{"features":["challenge"]}}`); code != http.StatusConflict {
+		t.Errorf("runnersHandler failed: expected 409 on a runner missing features got %d", code)
+	}
+	capabilities := `{"max_jobs":2,"docker":true,"executors":["container"],"version":"old","features":["challenge","labels","hand_back","secrets"]}`
+	if code := register(`{"addr":"` + addr + `","capabilities":` + capabilities + `}`); code != http.StatusCreated {
+		t.Fatalf("runnersHandler failed: expected 201 got %d", code)
+	}
+	info := d.runnerList()[0].Info(false)
+	if info.Capabilities == nil || info.Capabilities.MaxJobs != 2 || info.Capabilities.Version != "old" {
+		t.Errorf("registerRunner failed: unexpected capabilities %v", info.Capabilities)
+	}
+}
+
+func TestPickRunnerCapabilities(t *testing.T) {
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	full := &RunnerProxy{Id: "full", Alive: true, RpcClient: rpc.NewClient(conn),
+		currentJobs:  map[string]Commit{"a": {}},
+		capabilities: &RunnerCapabilities{MaxJobs: 1, Docker: true, Executors: []string{containerMode, execMode}}}
+	container := &RunnerProxy{Id: "container", Alive: true, RpcClient: rpc.NewClient(conn),
+		currentJobs:  map[string]Commit{"b": {}, "c": {}},
+		capabilities: &RunnerCapabilities{Docker: true, Executors: []string{containerMode}}}
+	noDocker := &RunnerProxy{Id: "no-docker", Alive: true, RpcClient: rpc.NewClient(conn),
+		capabilities: &RunnerCapabilities{Executors: []string{containerMode, execMode}}}
+	d := NewDispatcher("commits", time.Second, []*RunnerProxy{full, container, noDocker})
+	if runner := d.pickRunner("octocat/test", pipelineRequirements{}); runner != container {
+		t.Errorf("pickRunner expected the runner below its max jobs with docker")
+	}
+	exec := pipelineRequirements{Executor: execMode}
+	if runner := d.pickRunner("octocat/test", exec); runner != nil {
+		t.Errorf("pickRunner expected no runner for exec, got %s", runner.Id)
+	}
+	// The full runner supports exec, the job just waits for it
+	if reason := d.waitingReason(exec); reason != "" {
+		t.Errorf("waitingReason failed: unexpected %q", reason)
+	}
+	full.capabilities.Executors = []string{containerMode}
+	if reason := d.waitingReason(exec); reason != "no matching runner for executor exec" {
+		t.Errorf("waitingReason failed: unexpected %q", reason)
+	}
+}
+
+func TestDispatchWorkerCapacity(t *testing.T) {
+	runner := &recordingRunner{make(chan RunnerRequest, 1)}
+	server := rpc.NewServer()
+	server.RegisterName("Runner", runner)
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go server.ServeConn(serverConn)
+	busy := Commit{Id: "busy"}
+	proxy := &RunnerProxy{Id: "r1", Alive: true, RpcClient: rpc.NewClient(clientConn),
+		currentJobs:  map[string]Commit{"busy": busy},
+		capabilities: &RunnerCapabilities{MaxJobs: 1, Docker: true, Executors: []string{containerMode}}}
+	clock := newFakeClock()
+	d := NewDispatcher("commits", time.Second, []*RunnerProxy{proxy}, WithClock(clock))
+	d.enqueue(Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "master"}})
+	stop := make(chan struct{})
+	go d.dispatchWorker(stop)
+
+	// The worker parks while the runner is full, until its job finishes
+	<-clock.requested
+	d.finishJob(proxy, busy, "OK")
+	select {
+	case req := <-runner.requests:
+		if req.CommitJob.Id != "abc" {
+			t.Errorf("dispatchWorker failed: expected abc dispatched got %s", req.CommitJob.Id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatchWorker failed: expected the commit dispatched once the runner had capacity")
+	}
+	close(stop)
+	// Wake the worker up to see it's stopped
+	d.queue.Push("stop", Commit{})
+}
+
+func TestRunnerSatisfies(t *testing.T) {
+	r := &Runner{executors: []string{execMode}, labels: map[string]string{"gpu": "true"}}
+	if err := r.satisfies(pipelineRequirements{Executor: execMode}); err != nil {
+		t.Errorf("satisfies failed: %v", err)
+	}
+	if err := r.satisfies(pipelineRequirements{}); err == nil {
+		t.Errorf("satisfies failed: expected an error on the container executor")
+	}
+	if err := validateExecutors([]string{"vm"}); err == nil {
+		t.Errorf("validateExecutors failed: expected an error on an unknown executor")
+	}
+}
@@ -0,0 +1,138 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ChaosConfig sets the rates, between 0 and 1, at which a runner injects
+// faults in the jobs it receives, to exercise the retries, the zombie reaper
+// and the rescheduling of the dispatcher:
+//   - FailureRate fails the job before running it, as an infrastructure error
+//   - LatencyRate delays the job by up to MaxLatency before running it
+//   - DropRate runs the job but withholds its result, the call hangs until the
+//     job is cancelled or cleaned up, e.g. by the zombie reaper
+//
+// The faults are drawn from a generator seeded with Seed, so that a run can
+// be reproduced.
+type ChaosConfig struct {
+	FailureRate float64
+	LatencyRate float64
+	MaxLatency  time.Duration
+	DropRate    float64
+	Seed        int64
+}
+
+var (
+	ErrChaosFailure = errors.New("chaos: injected runner failure")
+	ErrChaosDropped = errors.New("chaos: job result dropped")
+)
+
+// chaos injects the faults of a ChaosConfig
+type chaos struct {
+	mutex  sync.Mutex
+	config ChaosConfig
+	rand   *rand.Rand
+	// Jobs whose result is withheld, released on cancel or cleanup
+	held map[string]chan struct{}
+}
+
+// WithChaos makes the runner inject random failures, latencies and dropped
+// results in the jobs, never to be enabled in production
+func WithChaos(config ChaosConfig) RunnerOption {
+	return func(r *Runner) {
+		r.chaos = &chaos{
+			config: config,
+			rand:   rand.New(rand.NewSource(config.Seed)),
+			held:   map[string]chan struct{}{},
+		}
+	}
+}
+
+// roll returns true with the given probability
+func (c *chaos) roll(rate float64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return rate > 0 && c.rand.Float64() < rate
+}
+
+// latency returns a random delay up to the max latency
+func (c *chaos) latency() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.config.MaxLatency <= 0 {
+		return 0
+	}
+	return time.Duration(c.rand.Int63n(int64(c.config.MaxLatency)))
+}
+
+// before delays the job or fails it before it runs
+func (c *chaos) before(jobId string) error {
+	if c.roll(c.config.LatencyRate) {
+		delay := c.latency()
+		log.Printf("Chaos: delaying job %s by %s\n", jobId, delay)
+		time.Sleep(delay)
+	}
+	if c.roll(c.config.FailureRate) {
+		log.Printf("Chaos: failing job %s\n", jobId)
+		return ErrChaosFailure
+	}
+	return nil
+}
+
+// hold withholds the result of a job if the drop rate says so, blocking
+// until the job is released, returns false if the result is to be delivered
+func (c *chaos) hold(jobId string) bool {
+	if !c.roll(c.config.DropRate) {
+		return false
+	}
+	log.Printf("Chaos: dropping the result of job %s\n", jobId)
+	released := make(chan struct{})
+	c.mutex.Lock()
+	c.held[jobId] = released
+	c.mutex.Unlock()
+	<-released
+	return true
+}
+
+// release unblocks the call of a job whose result is withheld, if any
+func (c *chaos) release(jobId string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if released, ok := c.held[jobId]; ok {
+		close(released)
+		delete(c.held, jobId)
+	}
+}
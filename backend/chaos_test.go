@@ -0,0 +1,90 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChaosFailure(t *testing.T) {
+	r := &Runner{}
+	WithChaos(ChaosConfig{FailureRate: 1})(r)
+	var res RunnerResponse
+	if err := r.RunCommitJob(RunnerRequest{JobId: "job-1"}, &res); err != ErrChaosFailure {
+		t.Errorf("Expected an injected failure got %v", err)
+	}
+	if res.Response != "NOK" {
+		t.Errorf("Expected a NOK response got %q", res.Response)
+	}
+}
+
+func TestChaosSeed(t *testing.T) {
+	draw := func() []bool {
+		r := &Runner{}
+		WithChaos(ChaosConfig{FailureRate: 0.5, Seed: 42})(r)
+		rolls := make([]bool, 20)
+		for i := range rolls {
+			rolls[i] = r.chaos.roll(r.chaos.config.FailureRate)
+		}
+		return rolls
+	}
+	first, second := draw(), draw()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Expected the same faults with the same seed")
+		}
+	}
+}
+
+func TestChaosDropRelease(t *testing.T) {
+	r := &Runner{}
+	WithChaos(ChaosConfig{DropRate: 1})(r)
+	held := make(chan bool)
+	go func() {
+		held <- r.chaos.hold("job-1")
+	}()
+	// Wait for the result to be withheld before releasing it
+	for i := 0; i < 100; i++ {
+		r.chaos.mutex.Lock()
+		_, ok := r.chaos.held["job-1"]
+		r.chaos.mutex.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.chaos.release("job-1")
+	select {
+	case dropped := <-held:
+		if !dropped {
+			t.Errorf("Expected the result to be dropped")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the held job to be released")
+	}
+}
@@ -27,41 +27,184 @@
 package backend
 
 import (
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"regexp"
 )
 
+// Name of the CI configuration file expected at the root of the repository
+const CIConfigFile string = ".narwhal.yml"
+
 // CI configuration to be read from the file system on the cloned repository.
 // For now it's queit simple:
 // - A name
 // - An image for the container to be used
 // - Some environments variables
+// - Some pipeline variables, substituted wherever ${VAR} appears in the
+//   configuration when it's loaded
+// - The uid[:gid] to run the steps as, overriding the runner default, note
+//   that dependencies can only be installed by a privileged user
+// - The coverage report to read once the steps are over, with the minimum
+//   percentage covered required
+// - Whether the pipeline may be interrupted, or cancelled while pending, when
+//   a newer commit of its ref supersedes it, true by default
+// - The execution mode of the steps, container (default) running each one in
+//   a new container, exec running them all inside a single job container
+// - The release of a Go project, adding the steps cross-compiling it, see
+//   ReleaseConfig
+// - The labels a runner must advertise to run the pipeline, e.g. gpu: "true"
+// - A warm-up command checking the environment before the steps, e.g.
+//   go version, failing the job as environment broken
 // - A list of steps to execute
 //		- A name of the step
 //		- Dependencies needed by the execution to be installed
 //		- The command to execute
+//		- Failure categories of given exit codes of the command, e.g. 3: lint
+//		- Paths of the artifacts to collect once the command is over, relative
+//		  to the workspace
+//		- The format of the test results printed by the command, parsed by the
+//		  runner, only go-json (go test -json) as of now
+//		- Whether the job may still be interrupted once the step started
+//		- The events the step runs on, push, tag, release or pull_request, all
+//		  of them by default, e.g. a publishing step only running on tags
 type CIConfig struct {
 	Name      string            `yaml:"name"`
 	ImageName string            `yaml:"image"`
 	Env       map[string]string `yaml:"env,omitempty"`
-	Steps     []struct {
-		Name         string   `yaml:"name"`
-		Dependencies []string `yaml:"dependencies,omitempty"`
-		Cmd          string   `yaml:"command"`
-	} `yaml:"steps"`
+	Variables map[string]string `yaml:"variables,omitempty"`
+	User      string            `yaml:"user,omitempty"`
+	Steps     []Step            `yaml:"steps"`
+	Coverage  *CoverageConfig   `yaml:"coverage,omitempty"`
+	// False to always run the pipeline to completion once started
+	Interruptible *bool `yaml:"interruptible,omitempty"`
+	// Either container or exec, see the modes of execution
+	Mode string `yaml:"mode,omitempty"`
+	// Cross-compiled binaries of a Go project, built after the steps
+	Release *ReleaseConfig `yaml:"release,omitempty"`
+	// Labels of the runners the pipeline is routed to, e.g. os: linux
+	RunsOn map[string]string `yaml:"runs_on,omitempty"`
+	// Command run before the steps, in their environment, to fail fast on a
+	// broken image or toolchain
+	Warmup string `yaml:"warmup,omitempty"`
+}
+
+// A single step of the CI pipeline, the command is executed as-is by a shell
+// inside the container, dependencies are installed right before it.
+type Step struct {
+	Name         string   `yaml:"name"`
+	Dependencies []string `yaml:"dependencies,omitempty"`
+	Cmd          string   `yaml:"command"`
+	// Categories of failure reported for given exit codes of the command
+	Failures map[int]string `yaml:"failures,omitempty"`
+	// Files or directories uploaded to the dispatcher after the command
+	Artifacts []string `yaml:"artifacts,omitempty"`
+	// Format of the test results in the output of the command, if any
+	TestFormat string `yaml:"test_format,omitempty"`
+	// False to run the job to completion once the step started, e.g. a
+	// deployment
+	Interruptible *bool `yaml:"interruptible,omitempty"`
+	// Events triggering the step, it's skipped on the others
+	Events []TriggerEvent `yaml:"events,omitempty"`
 }
 
 func LoadCIConfigFromFile(path string) (*CIConfig, error) {
-	// XXX hardcoded
-	// Set a default image `ubuntu`
-	ciConfig := &CIConfig{ImageName: "ubuntu"}
 	yamlFile, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	err = yaml.Unmarshal(yamlFile, ciConfig)
+	return ParseCIConfig(yamlFile)
+}
+
+// ParseCIConfig reads a CI configuration from its YAML definition
+func ParseCIConfig(data []byte) (*CIConfig, error) {
+	ciConfig := &CIConfig{}
+	err := yaml.Unmarshal(data, ciConfig)
 	if err != nil {
 		return nil, err
 	}
+	if err := ciConfig.validateMode(); err != nil {
+		return nil, err
+	}
+	if err := ciConfig.validateEvents(); err != nil {
+		return nil, err
+	}
+	if err := ciConfig.expandRelease(); err != nil {
+		return nil, err
+	}
+	// XXX hardcoded
+	// Set a default image `ubuntu`
+	if ciConfig.ImageName == "" {
+		ciConfig.ImageName = "ubuntu"
+	}
+	ciConfig.expandVariables()
 	return ciConfig, nil
 }
+
+// validateEvents checks the events the steps run on
+func (c *CIConfig) validateEvents() error {
+	for _, step := range c.Steps {
+		for _, event := range step.Events {
+			if !event.valid() {
+				return fmt.Errorf("unknown event %q of step %s, expected %s, %s, %s or %s",
+					event, step.Name, PushTrigger, TagTrigger, ReleaseTrigger, PullRequestTrigger)
+			}
+		}
+	}
+	return nil
+}
+
+// runsOn tells if the step runs on the given event
+func (s *Step) runsOn(event TriggerEvent) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Effective returns the configuration as it's executed, with the variables
+// expanded, in a canonical YAML form
+func (c *CIConfig) Effective() ([]byte, error) {
+	return yaml.Marshal(c)
+}
+
+var variableRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expand replaces every ${VAR} occurrence with the value of the declared
+// pipeline variable, unknown ones are left untouched so they can still be
+// resolved by the shell at run time
+func (c *CIConfig) expand(s string) string {
+	return variableRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		if v, ok := c.Variables[m[2:len(m)-1]]; ok {
+			return v
+		}
+		return m
+	})
+}
+
+func (c *CIConfig) expandVariables() {
+	if len(c.Variables) == 0 {
+		return
+	}
+	c.Name = c.expand(c.Name)
+	c.ImageName = c.expand(c.ImageName)
+	for k, v := range c.Env {
+		c.Env[k] = c.expand(v)
+	}
+	for i := range c.Steps {
+		step := &c.Steps[i]
+		step.Name = c.expand(step.Name)
+		step.Cmd = c.expand(step.Cmd)
+		for j, dep := range step.Dependencies {
+			step.Dependencies[j] = c.expand(dep)
+		}
+		for j, artifact := range step.Artifacts {
+			step.Artifacts[j] = c.expand(artifact)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+const testCIConfig = `
+name: ${PROJECT}
+image: golang:${GO_VERSION}
+variables:
+  PROJECT: narwhal
+  GO_VERSION: "1.15"
+env:
+  BIN: ${PROJECT}-bin
+steps:
+  - &build
+    name: build
+    command: go build -o $HOME/${PROJECT} ${UNKNOWN} ./...
+  - <<: *build
+    name: build-again
+`
+
+func TestLoadCIConfigVariables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "narwhal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, CIConfigFile)
+	if err := ioutil.WriteFile(file, []byte(testCIConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ciConfig, err := LoadCIConfigFromFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ciConfig.Name != "narwhal" || ciConfig.ImageName != "golang:1.15" {
+		t.Errorf("LoadCIConfigFromFile failed: unexpected name %s and image %s",
+			ciConfig.Name, ciConfig.ImageName)
+	}
+	if ciConfig.Env["BIN"] != "narwhal-bin" {
+		t.Errorf("LoadCIConfigFromFile failed: expected narwhal-bin got %s", ciConfig.Env["BIN"])
+	}
+	expected := "go build -o $HOME/narwhal ${UNKNOWN} ./..."
+	if ciConfig.Steps[0].Cmd != expected {
+		t.Errorf("LoadCIConfigFromFile failed: expected %s got %s", expected, ciConfig.Steps[0].Cmd)
+	}
+	if len(ciConfig.Steps) != 2 || ciConfig.Steps[1].Cmd != expected {
+		t.Errorf("LoadCIConfigFromFile failed: anchored step not merged %v", ciConfig.Steps)
+	}
+}
+
+func TestParseCIConfigMode(t *testing.T) {
+	ciConfig, err := ParseCIConfig([]byte("name: narwhal\nsteps: []\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ciConfig.execSteps() {
+		t.Errorf("ParseCIConfig failed: expected steps in their own container by default")
+	}
+	ciConfig, err = ParseCIConfig([]byte("name: narwhal\nmode: exec\nsteps: []\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ciConfig.execSteps() {
+		t.Errorf("ParseCIConfig failed: expected steps executed in the job container")
+	}
+	if _, err := ParseCIConfig([]byte("name: narwhal\nmode: vm\nsteps: []\n")); err == nil {
+		t.Errorf("ParseCIConfig failed: expected an error on an unknown mode")
+	}
+}
+
+func TestParseCIConfigRelease(t *testing.T) {
+	ciConfig, err := ParseCIConfig([]byte(`name: narwhal
+variables:
+  VERSION: 1.0.0
+steps:
+  - name: test
+    command: go test ./...
+release:
+  packages: [./cmd/agent, ./cmd/runner]
+  targets: [linux/amd64, windows/amd64]
+  ldflags: -X main.version=${VERSION} -X main.job=$NARWHAL_JOB_ID
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ciConfig.ImageName != "golang:"+defaultReleaseGoVersion || ciConfig.Release != nil {
+		t.Errorf("ParseCIConfig failed: unexpected release pipeline %+v", ciConfig)
+	}
+	var names []string
+	for _, step := range ciConfig.Steps {
+		names = append(names, step.Name)
+	}
+	expected := []string{"test", "build-linux-amd64", "build-windows-amd64", "checksums"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("ParseCIConfig failed: expected steps %v got %v", expected, names)
+	}
+	build := ciConfig.Steps[2]
+	cmd := `mkdir -p dist/windows_amd64 && CGO_ENABLED=0 GOOS=windows GOARCH=amd64 go build -trimpath ` +
+		`-ldflags "-s -w -X main.version=1.0.0 -X main.job=$NARWHAL_JOB_ID" -o dist/windows_amd64/ './cmd/agent' './cmd/runner'`
+	if build.Cmd != cmd {
+		t.Errorf("ParseCIConfig failed: expected command\n%s\ngot\n%s", cmd, build.Cmd)
+	}
+	if !reflect.DeepEqual(build.Artifacts, []string{"dist/windows_amd64"}) {
+		t.Errorf("ParseCIConfig failed: unexpected artifacts %v", build.Artifacts)
+	}
+
+	// The image of the pipeline takes precedence, every target by default
+	ciConfig, err = ParseCIConfig([]byte("name: narwhal\nimage: golang:alpine\nrelease: {}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ciConfig.ImageName != "golang:alpine" || len(ciConfig.Steps) != len(defaultReleaseTargets)+1 {
+		t.Errorf("ParseCIConfig failed: unexpected release pipeline %+v", ciConfig)
+	}
+	for _, targets := range []string{"[linux]", "[linux/amd64, linux/amd64]", "['linux/amd64; rm -rf /']"} {
+		if _, err := ParseCIConfig([]byte("release:\n  targets: " + targets + "\n")); err == nil {
+			t.Errorf("ParseCIConfig failed: expected an error on targets %s", targets)
+		}
+	}
+}
+
+func TestParseCIConfigEvents(t *testing.T) {
+	ciConfig, err := ParseCIConfig([]byte(`name: narwhal
+steps:
+  - name: test
+    command: make test
+  - name: publish
+    command: make publish
+    events: [tag, release]
+  - name: lint
+    command: make lint
+    events: [pull_request]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test, publish, lint := ciConfig.Steps[0], ciConfig.Steps[1], ciConfig.Steps[2]
+	if !test.runsOn(PushTrigger) || !test.runsOn(TagTrigger) {
+		t.Errorf("ParseCIConfig failed: expected the test step to run on every event")
+	}
+	if publish.runsOn(PushTrigger) || !publish.runsOn(TagTrigger) || !publish.runsOn(ReleaseTrigger) {
+		t.Errorf("ParseCIConfig failed: expected the publish step to run on tags and releases only")
+	}
+	if lint.runsOn(PushTrigger) || !lint.runsOn(PullRequestTrigger) {
+		t.Errorf("ParseCIConfig failed: expected the lint step to run on pull requests only")
+	}
+	if _, err := ParseCIConfig([]byte("steps:\n  - name: a\n    events: [merge]\n")); err == nil {
+		t.Errorf("ParseCIConfig failed: expected an error on an unknown event")
+	}
+}
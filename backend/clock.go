@@ -0,0 +1,105 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Clock is the source of time of the dispatcher, replaceable so that the
+// timing dependent behaviors, like the runner health, the backoffs and the
+// aging of the jobs, can be tested deterministically
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SystemClock follows the wall clock
+var SystemClock Clock = systemClock{}
+
+// WithClock sets the clock of the dispatcher, shared with its queue and its
+// runners
+func WithClock(clock Clock) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.clock = clock
+	}
+}
+
+// Source of the randomness of the dispatcher by default
+var defaultRandomness io.Reader = rand.Reader
+
+// WithRandomness sets the source of the random job IDs, registration nonces
+// and backoff jitter of the dispatcher, crypto/rand by default
+func WithRandomness(random io.Reader) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.random = random
+	}
+}
+
+// randomId returns 8 random bytes, hex encoded. It panics if the source of
+// randomness fails, as crypto/rand only does when the system is broken and
+// the IDs would collide otherwise.
+func randomId(random io.Reader) string {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(random, b); err != nil {
+		panic(fmt.Sprintf("reading random ID: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// jitter returns a random duration in [d/2, 3d/2), so that workers backing
+// off at the same time don't retry in lockstep
+func jitter(random io.Reader, d time.Duration) time.Duration {
+	var n uint64
+	if err := binary.Read(random, binary.BigEndian, &n); err != nil || d <= 0 {
+		return d
+	}
+	return d/2 + time.Duration(n%uint64(d))
+}
+
+// newId returns a random ID read from the randomness of the dispatcher
+func (d *Dispatcher) newId() string {
+	return randomId(d.random)
+}
+
+// clockOrSystem returns the given clock, the system one if nil
+func clockOrSystem(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock
+	}
+	return clock
+}
@@ -0,0 +1,162 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves forward when advanced, firing the timers expired,
+// every timer requested is reported on the requested channel
+type fakeClock struct {
+	mutex     sync.Mutex
+	now       time.Time
+	timers    []fakeTimer
+	requested chan time.Duration
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:       time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		requested: make(chan time.Duration, 16),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	timer := fakeTimer{c.now.Add(d), make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+	c.requested <- d
+	return timer.c
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.deadline.After(c.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+func TestJitter(t *testing.T) {
+	if d := jitter(bytes.NewReader(make([]byte, 8)), time.Second); d != 500*time.Millisecond {
+		t.Errorf("Expected the shortest jitter, got %v", d)
+	}
+	max := bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	if d := jitter(max, time.Second); d < time.Second || d >= 1500*time.Millisecond {
+		t.Errorf("Expected a jitter within [1s, 1.5s), got %v", d)
+	}
+	// An exhausted source falls back to the plain duration
+	if d := jitter(bytes.NewReader(nil), time.Second); d != time.Second {
+		t.Errorf("Expected no jitter got %v", d)
+	}
+}
+
+func TestDispatcherClock(t *testing.T) {
+	clock := newFakeClock()
+	runner := NewRunnerProxy("127.0.0.1:0")
+	d := NewDispatcher("commits", time.Second, []*RunnerProxy{runner}, WithClock(clock),
+		WithRandomness(bytes.NewReader(make([]byte, 64))))
+
+	// Job IDs come from the randomness source
+	if id := d.enqueue(Commit{Id: "abc"}); id != "0000000000000000" {
+		t.Errorf("Expected a deterministic job ID got %s", id)
+	}
+	// So do the timestamps of the jobs
+	if job, _ := d.jobs.Get("0000000000000000"); !job.CreatedAt.Equal(clock.Now()) {
+		t.Errorf("Expected the job created at %v got %v", clock.Now(), job.CreatedAt)
+	}
+	clock.Advance(90 * time.Second)
+	rec := httptest.NewRecorder()
+	queueHandler(d)(rec, httptest.NewRequest(http.MethodGet, "/queue", nil))
+	var queued []queuedCommitResponse
+	json.Unmarshal(rec.Body.Bytes(), &queued)
+	if len(queued) != 1 || queued[0].WaitTime != "1m30s" {
+		t.Errorf("Expected the commit waiting for 1m30s got %v", queued)
+	}
+
+	runner.SetAlive(true)
+	if !runner.LastHeartbeat.Equal(clock.Now()) {
+		t.Errorf("Expected the heartbeat at %v got %v", clock.Now(), runner.LastHeartbeat)
+	}
+
+	// With no runner connected the worker backs off, the jitter is the
+	// shortest with zeroed randomness
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		d.dispatchWorker(stop)
+		close(done)
+	}()
+	if backoff := <-clock.requested; backoff != noRunnerBackoff/2 {
+		t.Errorf("Expected a backoff of %v got %v", noRunnerBackoff/2, backoff)
+	}
+	close(stop)
+	clock.Advance(noRunnerBackoff)
+	<-done
+	if d.queue.Len() != 1 {
+		t.Errorf("Expected the commit back in the queue")
+	}
+	job, err := d.cancelJob("0000000000000000")
+	if err != nil || job.FinishedAt == nil || !job.FinishedAt.Equal(clock.Now()) {
+		t.Errorf("Expected the job cancelled at %v got %v %v", clock.Now(), job.FinishedAt, err)
+	}
+}
+
+func TestRandomIdExhausted(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("randomId failed: expected a panic on an exhausted source")
+		}
+	}()
+	randomId(bytes.NewReader(make([]byte, 4)))
+}
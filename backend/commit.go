@@ -26,15 +26,104 @@
 
 package backend
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
+
+// Kinds of the events triggering a build
+type TriggerEvent string
+
+const (
+	PushTrigger    TriggerEvent = "push"
+	TagTrigger     TriggerEvent = "tag"
+	ReleaseTrigger TriggerEvent = "release"
+	// A pull request opened or updated, see PullRequest
+	PullRequestTrigger TriggerEvent = "pull_request"
+)
+
+// Author of a commit as reported by the hosting service
+type Author struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Username string `json:"username,omitempty"`
+}
 
 type Commit struct {
 	Id         string     `json:"id"`
 	Timestamp  time.Time  `json:"timestamp"`
 	Language   string     `json:"language"`
+	Message    string     `json:"message,omitempty"`
+	Author     Author     `json:"author"`
 	Repository Repository `json:"repository"`
+	// IDs of all the commits included in the push, oldest first
+	PushedCommits []string `json:"pushed_commits,omitempty"`
+	// Set on builds of intermediate commits scheduled by an automatic bisect
+	Bisect bool `json:"bisect,omitempty"`
+	// Inline CI configuration overriding the one in the repository, only
+	// set on builds explicitly requested through the API
+	Pipeline string `json:"pipeline,omitempty"`
+	// Version of the event schema, see CommitSchemaVersion
+	SchemaVersion int `json:"schema_version,omitempty"`
+	// Event triggering the build, a push if empty
+	Event TriggerEvent `json:"event,omitempty"`
+	// Tag pushed or released, checked out in place of the default branch
+	Tag string `json:"tag,omitempty"`
+	// Pull request validated by the build, checked out merged into its base
+	PullRequest *PullRequest `json:"pull_request,omitempty"`
+	// URL the repository is cloned from when it's not on one of the known
+	// hosting services, e.g. a self-hosted Git server
+	CloneURL string `json:"clone_url,omitempty"`
 }
 
 func (c *Commit) GetRepositoryName() string {
 	return c.Repository.Name
 }
+
+// cloneURL returns the URL the repository of the commit is cloned from, over
+// SSH if asked for unless the URL is given
+func (c *Commit) cloneURL(ssh bool) string {
+	if c.CloneURL != "" {
+		return c.CloneURL
+	}
+	return c.Repository.CloneURL(ssh)
+}
+
+// valid tells if the event is a known one
+func (e TriggerEvent) valid() bool {
+	return e == PushTrigger || e == TagTrigger || e == ReleaseTrigger || e == PullRequestTrigger
+}
+
+// TriggeredBy returns the event triggering the build of the commit
+func (c *Commit) TriggeredBy() TriggerEvent {
+	if c.Event == "" {
+		return PushTrigger
+	}
+	return c.Event
+}
+
+// ref returns the ref the commit is built for, e.g. refs/heads/main,
+// refs/tags/v1.0.0 or refs/pull/42/head, empty if unknown
+func (c *Commit) ref() string {
+	switch {
+	case c.PullRequest != nil:
+		return c.PullRequest.HeadRef
+	case c.Tag != "":
+		return "refs/tags/" + c.Tag
+	case c.Repository.Branch != "":
+		return "refs/heads/" + c.Repository.Branch
+	}
+	return ""
+}
+
+// buildKey identifies a build of the commit, the same commit is built once
+// per push and once more for every tag, release and pull request of it
+func (c *Commit) buildKey() string {
+	switch c.TriggeredBy() {
+	case PushTrigger:
+		return c.Id
+	case PullRequestTrigger:
+		return fmt.Sprintf("%s@%s:%d", c.Id, c.Event, c.PullRequest.Number)
+	}
+	return c.Id + "@" + string(c.Event) + ":" + c.Tag
+}
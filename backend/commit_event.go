@@ -0,0 +1,73 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Version of the commit events schema produced by the agent, events without
+// version predate it and are read as version 1
+const CommitSchemaVersion int = 1
+
+// Default max size in bytes of a commit event read from the queue
+const DefaultMaxEventSize int = 64 * 1024
+
+// DecodeCommitEvent validates a commit event consumed from the queue, the
+// size, the schema version and the fields required to create a job, tags and
+// releases carry a tag in place of a branch, pull requests their details
+func DecodeCommitEvent(payload []byte, maxSize int) (Commit, error) {
+	var commit Commit
+	if maxSize > 0 && len(payload) > maxSize {
+		return commit, fmt.Errorf("event of %d bytes exceeds the limit of %d", len(payload), maxSize)
+	}
+	if err := json.Unmarshal(payload, &commit); err != nil {
+		return commit, fmt.Errorf("malformed event: %v", err)
+	}
+	if commit.SchemaVersion > CommitSchemaVersion {
+		return commit, fmt.Errorf("unsupported schema version %d", commit.SchemaVersion)
+	}
+	switch {
+	case commit.Id == "":
+		return commit, errors.New("missing commit id")
+	case commit.Repository.Name == "":
+		return commit, errors.New("missing repository name")
+	case !commit.TriggeredBy().valid():
+		return commit, fmt.Errorf("unknown event %s", commit.Event)
+	case commit.Repository.Branch == "" && commit.TriggeredBy() == PushTrigger:
+		return commit, errors.New("missing repository branch")
+	case commit.Tag == "" && (commit.Event == TagTrigger || commit.Event == ReleaseTrigger):
+		return commit, fmt.Errorf("missing tag of %s event", commit.Event)
+	case commit.PullRequest == nil && commit.Event == PullRequestTrigger:
+		return commit, errors.New("missing pull request")
+	case commit.Repository.HostingService == "":
+		return commit, errors.New("missing repository hosting service")
+	}
+	return commit, nil
+}
@@ -0,0 +1,62 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import "testing"
+
+func TestDecodeCommitEvent(t *testing.T) {
+	valid := `{"id":"a","repository":{"hosting_service":"github","name":"octocat/test","branch":"master"}}`
+	if commit, err := DecodeCommitEvent([]byte(valid), DefaultMaxEventSize); err != nil || commit.Id != "a" {
+		t.Errorf("DecodeCommitEvent failed: unexpected %v %v", commit, err)
+	}
+	tag := `{"id":"a","event":"tag","tag":"v1.0.0","repository":{"hosting_service":"github","name":"octocat/test"}}`
+	if commit, err := DecodeCommitEvent([]byte(tag), DefaultMaxEventSize); err != nil ||
+		commit.TriggeredBy() != TagTrigger || commit.Tag != "v1.0.0" {
+		t.Errorf("DecodeCommitEvent failed: unexpected %v %v", commit, err)
+	}
+	pr := `{"id":"a","event":"pull_request","pull_request":{"number":42,"head_ref":"refs/pull/42/head"},` +
+		`"repository":{"hosting_service":"github","name":"octocat/test","branch":"fix"}}`
+	if commit, err := DecodeCommitEvent([]byte(pr), DefaultMaxEventSize); err != nil ||
+		commit.TriggeredBy() != PullRequestTrigger || commit.PullRequest.Number != 42 {
+		t.Errorf("DecodeCommitEvent failed: unexpected %v %v", commit, err)
+	}
+	for _, event := range []string{
+		`{"id":"a"`,
+		`{"id":"a","event":"pull_request","repository":{"hosting_service":"github","name":"octocat/test","branch":"fix"}}`,
+		`{"id":"a","repository":{"hosting_service":"github","name":"octocat/test"}}`,
+		`{"id":"a","event":"release","repository":{"hosting_service":"github","name":"octocat/test"}}`,
+		`{"id":"a","event":"merge","tag":"v1","repository":{"hosting_service":"github","name":"octocat/test"}}`,
+		`{"id":"a","schema_version":2,"repository":{"hosting_service":"github","name":"octocat/test","branch":"master"}}`,
+	} {
+		if _, err := DecodeCommitEvent([]byte(event), DefaultMaxEventSize); err == nil {
+			t.Errorf("DecodeCommitEvent failed: expected error for %s", event)
+		}
+	}
+	if _, err := DecodeCommitEvent([]byte(valid), 16); err == nil {
+		t.Errorf("DecodeCommitEvent failed: expected error for oversized event")
+	}
+}
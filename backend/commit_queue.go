@@ -0,0 +1,143 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"sync"
+	"time"
+)
+
+// A commit waiting in the dispatcher queue for a runner to pick it up
+type QueuedCommit struct {
+	JobId      string    `json:"job_id"`
+	Commit     Commit    `json:"commit"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+}
+
+// CommitQueue is the in-memory FIFO of commits received from the message
+// queue and not yet dispatched to any runner. Pop blocks until a commit is
+// available, so it can be shared by all the dispatching workers.
+type CommitQueue struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	commits []QueuedCommit
+	// Source of the enqueue times, the system clock if nil
+	clock Clock
+}
+
+func NewCommitQueue() *CommitQueue {
+	q := &CommitQueue{commits: []QueuedCommit{}}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+func (q *CommitQueue) Push(jobId string, commit Commit) {
+	q.mutex.Lock()
+	q.commits = append(q.commits, QueuedCommit{jobId, commit, clockOrSystem(q.clock).Now()})
+	q.mutex.Unlock()
+	q.cond.Signal()
+}
+
+// Requeue puts back an already popped commit at the head of the queue,
+// keeping its original enqueue time
+func (q *CommitQueue) Requeue(item QueuedCommit) {
+	q.mutex.Lock()
+	q.commits = append([]QueuedCommit{item}, q.commits...)
+	q.mutex.Unlock()
+	q.cond.Signal()
+}
+
+func (q *CommitQueue) Pop() QueuedCommit {
+	item, _ := q.PopUntil(nil)
+	return item
+}
+
+// PopUntil blocks until a commit is available or stop is closed, returning
+// false in the latter case without taking any commit out of the queue
+func (q *CommitQueue) PopUntil(stop <-chan struct{}) (QueuedCommit, bool) {
+	if stop != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-stop:
+				// Under the lock, not to wake up a waiter that didn't see
+				// stop closed before waiting
+				q.mutex.Lock()
+				q.cond.Broadcast()
+				q.mutex.Unlock()
+			case <-done:
+			}
+		}()
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for {
+		select {
+		case <-stop:
+			return QueuedCommit{}, false
+		default:
+		}
+		if len(q.commits) > 0 {
+			break
+		}
+		q.cond.Wait()
+	}
+	item := q.commits[0]
+	q.commits = q.commits[1:]
+	return item, true
+}
+
+// Remove drops the commit of a job from the queue, returning false if it was
+// not waiting
+func (q *CommitQueue) Remove(jobId string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for i, item := range q.commits {
+		if item.JobId == jobId {
+			q.commits = append(q.commits[:i], q.commits[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (q *CommitQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.commits)
+}
+
+// Snapshot returns a copy of the commits currently waiting, ordered by
+// position in the queue
+func (q *CommitQueue) Snapshot() []QueuedCommit {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	snapshot := make([]QueuedCommit, len(q.commits))
+	copy(snapshot, q.commits)
+	return snapshot
+}
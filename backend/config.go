@@ -0,0 +1,181 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Transport settings of the RPC connections from the dispatcher to a runner:
+//   - DialTimeout bounds the connection establishment
+//   - CallTimeout bounds heartbeat calls, a runner not answering in time is
+//     considered dead
+//   - KeepAlive is the TCP keepalive period of the connection
+type TransportConfig struct {
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+	CallTimeout time.Duration `yaml:"call_timeout"`
+	KeepAlive   time.Duration `yaml:"keepalive"`
+}
+
+// DefaultTransportConfig is generous enough to tolerate slow networks
+var DefaultTransportConfig = TransportConfig{
+	DialTimeout: 5 * time.Second,
+	CallTimeout: 10 * time.Second,
+	KeepAlive:   30 * time.Second,
+}
+
+// merge fills the unset fields with the ones of the given defaults
+func (t TransportConfig) merge(defaults TransportConfig) TransportConfig {
+	if t.DialTimeout == 0 {
+		t.DialTimeout = defaults.DialTimeout
+	}
+	if t.CallTimeout == 0 {
+		t.CallTimeout = defaults.CallTimeout
+	}
+	if t.KeepAlive == 0 {
+		t.KeepAlive = defaults.KeepAlive
+	}
+	return t
+}
+
+type RunnerConfig struct {
+	Addr      string          `yaml:"addr"`
+	Transport TransportConfig `yaml:"transport,omitempty"`
+}
+
+// Dispatcher configuration, e.g.
+//
+//	heartbeat_interval: 5s
+//	transport:
+//	  dial_timeout: 5s
+//	  call_timeout: 10s
+//	  keepalive: 30s
+//	runners:
+//	  - addr: 127.0.0.1:9898
+//	  - addr: 10.0.0.2:9898
+//	    transport:
+//	      call_timeout: 30s
+//	credentials:
+//	  octocat/private:
+//	    token: ghp_xxxxxxxx
+//	store:
+//	  backend: sqlite
+//	  path: /var/lib/narwhal/narwhal.db
+//	result_cache:
+//	  - octocat/hello-world
+//	slack:
+//	  webhook: https://hooks.slack.com/services/T000/B000/XXXX
+//	schedules:
+//	  - name: nightly
+//	    url: https://github.com/octocat/hello-world
+//	    branch: main
+//	    cron: "0 2 * * *"
+//	access:
+//	  - name: release-bot
+//	    token: s3cr3t
+//	    grants:
+//	      - repositories: [octocat/*]
+//	        permissions: [view, trigger]
+//	login:
+//	  github:
+//	    client_id: Iv1.abc
+//	    client_secret: s3cr3t
+//	  users:
+//	    - name: alice
+//	      password: $2a$10$...
+//	      identities:
+//	        github: alice-gh
+//	      grants:
+//	        - repositories: ["*"]
+//	          permissions: [view, trigger, cancel]
+type DispatcherConfig struct {
+	HeartbeatInterval time.Duration          `yaml:"heartbeat_interval"`
+	Transport         TransportConfig        `yaml:"transport,omitempty"`
+	Runners           []RunnerConfig         `yaml:"runners"`
+	Credentials       map[string]Credentials `yaml:"credentials,omitempty"`
+	Store             StoreConfig            `yaml:"store,omitempty"`
+	// Repositories reusing the successful builds of a commit, * for all
+	ResultCache []string `yaml:"result_cache,omitempty"`
+	// Slack webhooks notified of the job results
+	Slack SlackConfig `yaml:"slack,omitempty"`
+	// SMTP notifications of the failures, see EmailConfig
+	Email *EmailConfig `yaml:"email,omitempty"`
+	// Builds triggered on a cron schedule, see ScheduledBuild
+	Schedules []ScheduledBuild `yaml:"schedules,omitempty"`
+	// Tokens restricting the API, see AccessControl
+	Access []AccessToken `yaml:"access,omitempty"`
+	// Users of the dashboard, see LoginConfig
+	Login LoginConfig `yaml:"login,omitempty"`
+}
+
+// LoadDispatcherConfig reads the dispatcher configuration, each runner
+// transport inherits the unset settings from the global one, which in turn
+// falls back to DefaultTransportConfig
+func LoadDispatcherConfig(path string) (*DispatcherConfig, error) {
+	yamlFile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &DispatcherConfig{HeartbeatInterval: 5 * time.Second}
+	if err := yaml.Unmarshal(yamlFile, config); err != nil {
+		return nil, err
+	}
+	config.Transport = config.Transport.merge(DefaultTransportConfig)
+	for i := range config.Runners {
+		config.Runners[i].Transport = config.Runners[i].Transport.merge(config.Transport)
+		if config.Runners[i].Addr, err = normalizeAddr(config.Runners[i].Addr); err != nil {
+			return nil, fmt.Errorf("runner %d: %v", i, err)
+		}
+	}
+	for _, build := range config.Schedules {
+		if _, err := build.parse(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := NewAccessControl(config.Access...); err != nil {
+		return nil, err
+	}
+	// Checked with a placeholder, the secret is set at startup
+	if _, err := NewSessions(config.Login, []byte("-")); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// RunnerProxies creates the proxies of the configured runners
+func (c *DispatcherConfig) RunnerProxies() []*RunnerProxy {
+	proxies := make([]*RunnerProxy, len(c.Runners))
+	for i, runner := range c.Runners {
+		proxies[i] = NewRunnerProxy(runner.Addr)
+		proxies[i].Transport = runner.Transport
+	}
+	return proxies
+}
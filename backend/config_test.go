@@ -0,0 +1,79 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+const testDispatcherConfig = `
+heartbeat_interval: 2s
+transport:
+  call_timeout: 20s
+runners:
+  - addr: 127.0.0.1:9898
+  - addr: 10.0.0.2:9898
+    transport:
+      dial_timeout: 1m
+`
+
+func TestLoadDispatcherConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "narwhal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "dispatcher.yml")
+	if err := ioutil.WriteFile(file, []byte(testDispatcherConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadDispatcherConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.HeartbeatInterval != 2*time.Second || len(config.Runners) != 2 {
+		t.Fatalf("LoadDispatcherConfig failed: unexpected config %v", config)
+	}
+	expected := TransportConfig{
+		DialTimeout: DefaultTransportConfig.DialTimeout,
+		CallTimeout: 20 * time.Second,
+		KeepAlive:   DefaultTransportConfig.KeepAlive,
+	}
+	if config.Runners[0].Transport != expected {
+		t.Errorf("LoadDispatcherConfig failed: expected %v got %v",
+			expected, config.Runners[0].Transport)
+	}
+	expected.DialTimeout = time.Minute
+	if config.Runners[1].Transport != expected {
+		t.Errorf("LoadDispatcherConfig failed: expected %v got %v",
+			expected, config.Runners[1].Transport)
+	}
+}
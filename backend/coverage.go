@@ -0,0 +1,143 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FailureCoverage is the category of the jobs failed for a coverage below
+// the minimum required
+const FailureCoverage FailureCategory = "coverage"
+
+// Formats of the coverage reports the runner reads
+const (
+	goCoverageFormat        string = "go"
+	lcovCoverageFormat      string = "lcov"
+	coberturaCoverageFormat string = "cobertura"
+)
+
+// CoverageConfig tells where the steps write the coverage report, relative
+// to the workspace, and the minimum percentage required for the job to
+// succeed, 0 to only record it
+type CoverageConfig struct {
+	Report  string  `yaml:"report"`
+	Format  string  `yaml:"format,omitempty"`
+	Minimum float64 `yaml:"minimum,omitempty"`
+}
+
+// parseCoverage returns the percentage of statements, or lines, covered
+// according to a report
+func parseCoverage(format string, report []byte) (float64, error) {
+	var covered, total int64
+	switch format {
+	case goCoverageFormat, "":
+		// mode: set
+		// example.com/calc/calc.go:3.24,5.2 1 1
+		scanner := bufio.NewScanner(bytes.NewReader(report))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 3 || strings.HasPrefix(fields[0], "mode:") {
+				continue
+			}
+			statements, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid coverage profile line %q", scanner.Text())
+			}
+			total += statements
+			if fields[2] != "0" {
+				covered += statements
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return 0, err
+		}
+	case lcovCoverageFormat:
+		// LF:<lines found> and LH:<lines hit> of every source file
+		scanner := bufio.NewScanner(bytes.NewReader(report))
+		for scanner.Scan() {
+			line := scanner.Text()
+			var count *int64
+			switch {
+			case strings.HasPrefix(line, "LF:"):
+				count = &total
+			case strings.HasPrefix(line, "LH:"):
+				count = &covered
+			default:
+				continue
+			}
+			n, err := strconv.ParseInt(line[3:], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid lcov line %q", line)
+			}
+			*count += n
+		}
+		if err := scanner.Err(); err != nil {
+			return 0, err
+		}
+	case coberturaCoverageFormat:
+		var root struct {
+			LinesValid   int64 `xml:"lines-valid,attr"`
+			LinesCovered int64 `xml:"lines-covered,attr"`
+		}
+		if err := xml.Unmarshal(report, &root); err != nil {
+			return 0, fmt.Errorf("invalid cobertura report: %v", err)
+		}
+		covered, total = root.LinesCovered, root.LinesValid
+	default:
+		return 0, fmt.Errorf("coverage format %s not supported", format)
+	}
+	if total == 0 {
+		return 0, errors.New("empty coverage report")
+	}
+	return float64(covered) * 100 / float64(total), nil
+}
+
+// checkCoverage reads the coverage report of a job out of its workspace,
+// returning the percentage covered and an error if below the minimum
+func checkCoverage(dir string, config *CoverageConfig) (*float64, error) {
+	report, err := ioutil.ReadFile(filepath.Join(dir, filepath.Clean("/"+config.Report)))
+	if err != nil {
+		return nil, fmt.Errorf("coverage report not found: %v", err)
+	}
+	percent, err := parseCoverage(config.Format, report)
+	if err != nil {
+		return nil, err
+	}
+	if percent < config.Minimum {
+		return &percent, fmt.Errorf("coverage %.2f%% below the minimum of %.2f%%", percent, config.Minimum)
+	}
+	return &percent, nil
+}
@@ -0,0 +1,82 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseCoverage(t *testing.T) {
+	reports := []struct {
+		format, report string
+		percent        float64
+	}{
+		{"go", "mode: set\nexample.com/calc/calc.go:3.24,5.2 3 1\nexample.com/calc/calc.go:7.24,9.2 1 0\n", 75},
+		{"lcov", "SF:a.js\nLF:10\nLH:5\nend_of_record\nSF:b.js\nLF:10\nLH:10\nend_of_record\n", 75},
+		{"cobertura", `<?xml version="1.0" ?><coverage lines-valid="8" lines-covered="2"></coverage>`, 25},
+	}
+	for _, r := range reports {
+		percent, err := parseCoverage(r.format, []byte(r.report))
+		if err != nil {
+			t.Errorf("parseCoverage(%s) failed: %v", r.format, err)
+		} else if percent != r.percent {
+			t.Errorf("parseCoverage(%s) expected %v got %v", r.format, r.percent, percent)
+		}
+	}
+	if _, err := parseCoverage("go", []byte("mode: set\n")); err == nil {
+		t.Errorf("parseCoverage expected an error on an empty report")
+	}
+	if _, err := parseCoverage("jacoco", nil); err == nil {
+		t.Errorf("parseCoverage expected an error on an unknown format")
+	}
+}
+
+func TestCheckCoverage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "narwhal-coverage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	report := "mode: set\nexample.com/calc/calc.go:3.24,5.2 1 1\nexample.com/calc/calc.go:7.24,9.2 1 0\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "cover.out"), []byte(report), 0644); err != nil {
+		t.Fatal(err)
+	}
+	percent, err := checkCoverage(dir, &CoverageConfig{Report: "cover.out", Minimum: 50})
+	if err != nil || *percent != 50 {
+		t.Errorf("checkCoverage expected 50%% got %v %v", percent, err)
+	}
+	percent, err = checkCoverage(dir, &CoverageConfig{Report: "cover.out", Minimum: 80})
+	if err == nil || *percent != 50 {
+		t.Errorf("checkCoverage expected an error below the minimum")
+	}
+	if _, err := checkCoverage(dir, &CoverageConfig{Report: "missing.out"}); err == nil {
+		t.Errorf("checkCoverage expected an error on a missing report")
+	}
+}
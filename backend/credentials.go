@@ -0,0 +1,175 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+// Credentials used to clone a repository, either a token for HTTPS clones or
+// a deploy key for SSH ones
+type Credentials struct {
+	Username string `json:"username,omitempty" yaml:"username,omitempty"`
+	Token    string `json:"token,omitempty" yaml:"token,omitempty"`
+	SSHKey   string `json:"ssh_key,omitempty" yaml:"ssh_key,omitempty"`
+}
+
+// AuthMethod returns the go-git authentication of the credentials, nil for
+// anonymous clones
+func (c Credentials) AuthMethod() (transport.AuthMethod, error) {
+	switch {
+	case c.SSHKey != "":
+		return gitssh.NewPublicKeys("git", []byte(c.SSHKey), "")
+	case c.Token != "":
+		username := c.Username
+		if username == "" {
+			username = "x-access-token"
+		}
+		return &githttp.BasicAuth{Username: username, Password: c.Token}, nil
+	}
+	return nil, nil
+}
+
+// CredentialsProvider resolves the credentials to clone a repository, the
+// token of the job cloning it authorizes the fetch when needed
+type CredentialsProvider interface {
+	Credentials(repository, jobToken string) (Credentials, error)
+}
+
+// TokenHelper runs an external command with the repository full name as
+// argument, its trimmed output is used as token
+type TokenHelper string
+
+func (h TokenHelper) Credentials(repository, jobToken string) (Credentials, error) {
+	out, err := exec.Command(string(h), repository).Output()
+	if err != nil {
+		return Credentials{}, err
+	}
+	return Credentials{Token: strings.TrimSpace(string(out))}, nil
+}
+
+// DispatcherCredentials fetches the credentials from the dispatcher API,
+// authenticating with the job token, which grants access to the credentials
+// of the repository of the job only while it's running
+type DispatcherCredentials struct {
+	URL    string
+	client *http.Client
+}
+
+func NewDispatcherCredentials(url string) *DispatcherCredentials {
+	return &DispatcherCredentials{
+		URL:    strings.TrimRight(url, "/"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (d *DispatcherCredentials) Credentials(repository, jobToken string) (Credentials, error) {
+	var credentials Credentials
+	req, err := http.NewRequest(http.MethodGet, d.URL+"/credentials/"+repository, nil)
+	if err != nil {
+		return credentials, err
+	}
+	req.Header.Set("Authorization", "Bearer "+jobToken)
+	res, err := d.client.Do(req)
+	if err != nil {
+		return credentials, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		err = json.NewDecoder(res.Body).Decode(&credentials)
+	case http.StatusNotFound:
+		// No credentials, anonymous clone
+	default:
+		err = fmt.Errorf("dispatcher answered with status %d", res.StatusCode)
+	}
+	return credentials, err
+}
+
+type cachedCredentials struct {
+	credentials Credentials
+	expires     time.Time
+}
+
+// CredentialsCache keeps the credentials resolved by a provider for each
+// repository for a limited time. Revoked credentials stop being used at most
+// after the TTL, or right away when explicitly invalidated.
+type CredentialsCache struct {
+	mutex    sync.Mutex
+	provider CredentialsProvider
+	ttl      time.Duration
+	entries  map[string]cachedCredentials
+}
+
+func NewCredentialsCache(provider CredentialsProvider, ttl time.Duration) *CredentialsCache {
+	return &CredentialsCache{
+		provider: provider,
+		ttl:      ttl,
+		entries:  map[string]cachedCredentials{},
+	}
+}
+
+func (c *CredentialsCache) Credentials(repository, jobToken string) (Credentials, error) {
+	c.mutex.Lock()
+	entry, ok := c.entries[repository]
+	c.mutex.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.credentials, nil
+	}
+	credentials, err := c.provider.Credentials(repository, jobToken)
+	if err != nil {
+		return credentials, err
+	}
+	c.mutex.Lock()
+	c.entries[repository] = cachedCredentials{credentials, time.Now().Add(c.ttl)}
+	c.mutex.Unlock()
+	return credentials, nil
+}
+
+// Invalidate drops the cached credentials of the given repositories, all of
+// them if none is given
+func (c *CredentialsCache) Invalidate(repositories ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(repositories) == 0 {
+		c.entries = map[string]cachedCredentials{}
+		return
+	}
+	for _, repository := range repositories {
+		delete(c.entries, repository)
+	}
+}
@@ -0,0 +1,91 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type countingProvider struct {
+	calls int
+}
+
+func (p *countingProvider) Credentials(repository, jobToken string) (Credentials, error) {
+	p.calls++
+	return Credentials{Token: repository}, nil
+}
+
+func TestCredentialsCache(t *testing.T) {
+	provider := &countingProvider{}
+	cache := NewCredentialsCache(provider, time.Minute)
+	for i := 0; i < 3; i++ {
+		if credentials, _ := cache.Credentials("octocat/test", "job-a.token"); credentials.Token != "octocat/test" {
+			t.Errorf("CredentialsCache.Credentials failed: unexpected %v", credentials)
+		}
+	}
+	if provider.calls != 1 {
+		t.Errorf("CredentialsCache.Credentials failed: expected 1 fetch got %d", provider.calls)
+	}
+	cache.Invalidate("octocat/test")
+	cache.Credentials("octocat/test", "job-a.token")
+	if provider.calls != 2 {
+		t.Errorf("CredentialsCache.Invalidate failed: expected 2 fetches got %d", provider.calls)
+	}
+}
+
+func TestCredentialsScopedToJob(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil, WithRepositoryCredentials(map[string]Credentials{
+		"octocat/test": {Token: "ghp"},
+		"infra/deploy": {Token: "secret"},
+	}))
+	jobId := d.enqueue(Commit{Id: "a", Repository: Repository{GitHub, "octocat/test", "dev"}})
+	server := httptest.NewServer(d.router())
+	defer server.Close()
+	provider := NewDispatcherCredentials(server.URL)
+	token := d.jobTokens.Issue(jobId)
+
+	if _, err := provider.Credentials("octocat/test", token); err == nil {
+		t.Errorf("DispatcherCredentials.Credentials failed: expected the token of a pending job refused")
+	}
+	d.jobs.Update(jobId, func(job *Job) error { return job.TransitionAt(JobRunning, time.Now()) })
+	if credentials, err := provider.Credentials("octocat/test", token); err != nil || credentials.Token != "ghp" {
+		t.Errorf("DispatcherCredentials.Credentials failed: expected ghp got %v %v", credentials, err)
+	}
+	if _, err := provider.Credentials("infra/deploy", token); err == nil {
+		t.Errorf("DispatcherCredentials.Credentials failed: expected another repository refused")
+	}
+	req := httptest.NewRequest(http.MethodDelete, "/credentials/octocat/test", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	d.router().ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("credentialsHandler failed: expected 403 revoking with a job token got %d", rec.Code)
+	}
+}
@@ -0,0 +1,73 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSuppressionWindowAdmit(t *testing.T) {
+	window := NewSuppressionWindow(time.Minute)
+	clock := newFakeClock()
+	window.clock = clock
+	commit := Commit{Id: "a", Repository: Repository{GitHub, "octocat/test", "master"}}
+	if !window.Admit(commit) {
+		t.Errorf("SuppressionWindow.Admit failed: expected the first submission admitted")
+	}
+	clock.Advance(30 * time.Second)
+	if window.Admit(commit) {
+		t.Errorf("SuppressionWindow.Admit failed: expected the duplicate within the window suppressed")
+	}
+	other := Commit{Id: "a", Repository: Repository{GitHub, "octocat/other", "master"}}
+	if !window.Admit(other) {
+		t.Errorf("SuppressionWindow.Admit failed: expected the same commit of another repository admitted")
+	}
+	clock.Advance(2 * time.Minute)
+	if !window.Admit(commit) {
+		t.Errorf("SuppressionWindow.Admit failed: expected the commit admitted again past the window")
+	}
+	var disabled *SuppressionWindow
+	zero := NewSuppressionWindow(0)
+	if !disabled.Admit(commit) || !zero.Admit(commit) || !zero.Admit(commit) {
+		t.Errorf("SuppressionWindow.Admit failed: expected everything admitted without a window")
+	}
+}
+
+func TestSubmitSuppressesDuplicates(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil, WithSuppressionWindow(time.Minute), WithClock(newFakeClock()))
+	commit := Commit{Id: "a", Repository: Repository{GitHub, "octocat/test", "master"}}
+	if _, ok := d.submit(commit); !ok {
+		t.Fatalf("Dispatcher.submit failed: expected the commit enqueued")
+	}
+	if _, ok := d.submit(commit); ok || d.queue.Len() != 1 {
+		t.Errorf("Dispatcher.submit failed: expected the duplicate rejected got %d queued", d.queue.Len())
+	}
+	if suppressed := d.metrics.Get("narwhal_suppressed_submissions_total"); suppressed != 1 {
+		t.Errorf("Dispatcher.submit failed: expected 1 suppressed submission got %v", suppressed)
+	}
+}
@@ -0,0 +1,210 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// Repository of the images with the dependencies of the steps installed
+const dependencyImageRepository string = "narwhal-deps"
+
+// Age after which a cached dependency image is pruned, to be built again on
+// its next use, so that the ones of outdated base images or dependencies
+// don't pile up
+const dependencyImageMaxAge = 7 * 24 * time.Hour
+
+// Interval between two prunes of the cached dependency images
+const dependencyPruneInterval = time.Hour
+
+// WithDependencyCache installs the dependencies of a step once per base image,
+// committing the result as an image the following steps with the same
+// dependencies run in, skipping the install. In exec mode the dependencies of
+// every step are installed at once in the image of the job container.
+func WithDependencyCache() RunnerOption {
+	return func(r *Runner) {
+		r.dependencyCache = true
+	}
+}
+
+// dependencyImageTag returns the tag of the image with a set of dependencies
+// installed on top of a base image, given its ID so that an updated base
+// image invalidates it
+func dependencyImageTag(baseImageId string, dependencies []string) string {
+	sorted := append([]string(nil), dependencies...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(baseImageId + "\n" + strings.Join(sorted, "\n")))
+	return dependencyImageRepository + ":" + hex.EncodeToString(sum[:])[:24]
+}
+
+// dependencyImage returns the image with the dependencies of the step
+// installed on top of the pulled base image, building it on the first use
+// with the output of the install written to logs, and whether it was just
+// built. Installing takes root, the step still runs as its user.
+func dependencyImage(ctx context.Context, cli *docker.Client, baseImage string, step Step,
+	logs io.Writer) (string, bool, error) {
+	base, _, err := cli.ImageInspectWithRaw(ctx, baseImage)
+	if err != nil {
+		return "", false, err
+	}
+	tag := dependencyImageTag(base.ID, step.Dependencies)
+	if _, _, err := cli.ImageInspectWithRaw(ctx, tag); err == nil {
+		return tag, false, nil
+	} else if !docker.IsErrImageNotFound(err) {
+		return "", false, err
+	}
+
+	resp, err := cli.ContainerCreate(ctx, &container.Config{
+		Image:  baseImage,
+		Cmd:    installCommand(step),
+		User:   rootUser,
+		Labels: map[string]string{cacheLabel: "true", versionLabel: Version},
+	}, nil, nil, "")
+	if err != nil {
+		return "", false, err
+	}
+	defer cli.ContainerRemove(ctx, resp.ID, types.ContainerRemoveOptions{Force: true})
+	if err := cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		return "", false, err
+	}
+	out, err := cli.ContainerLogs(ctx, resp.ID,
+		types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
+	if err != nil {
+		return "", false, err
+	}
+	defer out.Close()
+	stdcopy.StdCopy(logs, logs, out)
+	exitCode, err := cli.ContainerWait(ctx, resp.ID)
+	if err != nil {
+		return "", false, err
+	}
+	if exitCode != 0 {
+		return "", false, &ExitError{Step: step.Name, Code: int(exitCode)}
+	}
+	// Keep the configuration of the base image rather than the install one,
+	// labelled so that the cached images can be told apart and pruned
+	config := container.Config{}
+	if base.Config != nil {
+		config = *base.Config
+	}
+	labels := map[string]string{}
+	for k, v := range config.Labels {
+		labels[k] = v
+	}
+	labels[cacheLabel], labels[versionLabel] = "true", Version
+	config.Labels = labels
+	_, err = cli.ContainerCommit(ctx, resp.ID, types.ContainerCommitOptions{
+		Reference: tag,
+		Comment:   "narwhal dependencies: " + strings.Join(step.Dependencies, " "),
+		Config:    &config,
+	})
+	if err != nil {
+		return "", false, err
+	}
+	log.Printf("Installed the dependencies of step %s in %s\n", step.Name, tag)
+	return tag, true, nil
+}
+
+// removeDependencyImage drops an image with the dependencies of a step built
+// for a single run, it's kept while other containers use it
+func removeDependencyImage(ctx context.Context, cli *docker.Client, image string) {
+	if _, err := cli.ImageRemove(ctx, image, types.ImageRemoveOptions{PruneChildren: true}); err != nil {
+		log.Printf("Error removing the dependencies image %s: %v\n", image, err)
+	}
+}
+
+// imagesClient is the part of the Docker client pruning the dependency images
+type imagesClient interface {
+	ImageList(ctx context.Context, options types.ImageListOptions) ([]types.ImageSummary, error)
+	ImageRemove(ctx context.Context, imageID string, options types.ImageRemoveOptions) ([]types.ImageDelete, error)
+}
+
+// pruneDependencyImages removes the cached dependency images built more than
+// dependencyImageMaxAge before now, the ones still used by a container are
+// kept as the daemon refuses to remove them
+func (r *Runner) pruneDependencyImages(ctx context.Context, cli imagesClient, now time.Time) {
+	args := filters.NewArgs()
+	args.Add("label", cacheLabel+"=true")
+	args.Add("reference", dependencyImageRepository)
+	images, err := cli.ImageList(ctx, types.ImageListOptions{Filters: args})
+	if err != nil {
+		log.Printf("Error listing the dependency images: %v\n", err)
+		return
+	}
+	for _, image := range images {
+		if now.Sub(time.Unix(image.Created, 0)) < dependencyImageMaxAge {
+			continue
+		}
+		if _, err := cli.ImageRemove(ctx, image.ID, types.ImageRemoveOptions{PruneChildren: true}); err != nil {
+			log.Printf("Error pruning the dependency image %s: %v\n", image.ID, err)
+			continue
+		}
+		r.count("narwhal_runner_pruned_dependency_images_total", 1)
+	}
+}
+
+// pruneDependencyImagesLoop prunes the cached dependency images right away
+// and then periodically
+func (r *Runner) pruneDependencyImagesLoop() {
+	for {
+		if cli, err := docker.NewEnvClient(); err != nil {
+			log.Printf("Error pruning the dependency images: %v\n", err)
+		} else {
+			r.pruneDependencyImages(context.Background(), cli, time.Now())
+		}
+		time.Sleep(dependencyPruneInterval)
+	}
+}
+
+// dependencies returns the dependencies of every step of the pipeline,
+// installed at once in the job container in exec mode
+func (c *CIConfig) dependencies() []string {
+	seen := map[string]bool{}
+	var dependencies []string
+	for _, step := range c.Steps {
+		for _, dependency := range step.Dependencies {
+			if !seen[dependency] {
+				seen[dependency] = true
+				dependencies = append(dependencies, dependency)
+			}
+		}
+	}
+	return dependencies
+}
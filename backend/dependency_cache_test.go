@@ -0,0 +1,113 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestDependencyImageTag(t *testing.T) {
+	tag := dependencyImageTag("sha256:abc", []string{"make", "gcc"})
+	if !strings.HasPrefix(tag, dependencyImageRepository+":") {
+		t.Errorf("dependencyImageTag failed: unexpected tag %s", tag)
+	}
+	if other := dependencyImageTag("sha256:abc", []string{"gcc", "make"}); other != tag {
+		t.Errorf("dependencyImageTag failed: expected the order not to matter, got %s and %s", tag, other)
+	}
+	for _, other := range []string{
+		dependencyImageTag("sha256:def", []string{"make", "gcc"}),
+		dependencyImageTag("sha256:abc", []string{"make"}),
+	} {
+		if other == tag {
+			t.Errorf("dependencyImageTag failed: expected a different tag than %s", tag)
+		}
+	}
+}
+
+// fakeImages filters its images by label like the daemon does, refusing to
+// remove the ones used by containers
+type fakeImages struct {
+	images  []types.ImageSummary
+	removed []string
+}
+
+func (f *fakeImages) ImageList(ctx context.Context, options types.ImageListOptions) ([]types.ImageSummary, error) {
+	var images []types.ImageSummary
+	for _, image := range f.images {
+		if options.Filters.MatchKVList("label", image.Labels) {
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
+
+func (f *fakeImages) ImageRemove(ctx context.Context, imageID string,
+	options types.ImageRemoveOptions) ([]types.ImageDelete, error) {
+	for _, image := range f.images {
+		if image.ID == imageID && image.Containers > 0 {
+			return nil, errors.New("image is being used by a container")
+		}
+	}
+	f.removed = append(f.removed, imageID)
+	return nil, nil
+}
+
+func TestPruneDependencyImages(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-dependencyImageMaxAge - time.Hour).Unix()
+	cached := map[string]string{cacheLabel: "true"}
+	cli := &fakeImages{images: []types.ImageSummary{
+		{ID: "outdated", Created: old, Labels: cached},
+		{ID: "recent", Created: now.Add(-time.Hour).Unix(), Labels: cached},
+		{ID: "in-use", Created: old, Labels: cached, Containers: 1},
+		{ID: "not-cached", Created: old, Labels: map[string]string{}},
+	}}
+	r := &Runner{metrics: newRunnerMetrics()}
+	r.pruneDependencyImages(context.Background(), cli, now)
+	if expected := []string{"outdated"}; !reflect.DeepEqual(cli.removed, expected) {
+		t.Errorf("pruneDependencyImages failed: expected %v got %v", expected, cli.removed)
+	}
+}
+
+func TestCIConfigDependencies(t *testing.T) {
+	config := &CIConfig{Steps: []Step{
+		{Name: "build", Dependencies: []string{"make", "gcc"}},
+		{Name: "test"},
+		{Name: "lint", Dependencies: []string{"make", "shellcheck"}},
+	}}
+	expected := []string{"make", "gcc", "shellcheck"}
+	if dependencies := config.dependencies(); !reflect.DeepEqual(dependencies, expected) {
+		t.Errorf("CIConfig.dependencies failed: expected %v got %v", expected, dependencies)
+	}
+}
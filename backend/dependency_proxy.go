@@ -0,0 +1,233 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	volumetypes "github.com/docker/docker/api/types/volume"
+	docker "github.com/docker/docker/client"
+)
+
+// Label of the dependency proxy containers, set to their kind
+const proxyLabel string = "narwhal.proxy"
+
+// dependencyProxy is a caching proxy of a package registry run as a sidecar
+// of the runner, shared by every job. Jobs reach it on their network through
+// the proxy container name, the env tells the package managers to use it.
+type dependencyProxy struct {
+	kind  string
+	image string
+	port  int
+	// Path of the cache inside the container, backed by a named volume
+	cacheDir string
+	// Environment of the proxy container
+	config []string
+	// Environment injected into the steps, given the proxy URL
+	env func(url string) map[string]string
+}
+
+// Caching proxies known to the runner
+var dependencyProxies = map[string]dependencyProxy{
+	"go": {
+		kind:     "go",
+		image:    "gomods/athens:latest",
+		port:     3000,
+		cacheDir: "/var/lib/athens",
+		config:   []string{"ATHENS_STORAGE_TYPE=disk", "ATHENS_DISK_STORAGE_ROOT=/var/lib/athens"},
+		env: func(url string) map[string]string {
+			// Modules the proxy can't serve are fetched directly
+			return map[string]string{"GOPROXY": url + ",direct"}
+		},
+	},
+	"npm": {
+		kind:     "npm",
+		image:    "verdaccio/verdaccio:latest",
+		port:     4873,
+		cacheDir: "/verdaccio/storage",
+		env: func(url string) map[string]string {
+			return map[string]string{
+				"npm_config_registry": url + "/",
+				"YARN_REGISTRY":       url + "/",
+			}
+		},
+	},
+}
+
+// containerName returns the name of the proxy container, which is its host
+// name on the job networks too
+func (p dependencyProxy) containerName() string {
+	return "narwhal-" + p.kind + "-proxy"
+}
+
+// url returns the address of the proxy as seen by the steps
+func (p dependencyProxy) url() string {
+	return "http://" + net.JoinHostPort(p.containerName(), strconv.Itoa(p.port))
+}
+
+// WithDependencyProxies runs a caching proxy of the given kinds, go and npm,
+// next to the runner, pointing the steps to them
+func WithDependencyProxies(kinds ...string) RunnerOption {
+	return func(r *Runner) {
+		for _, kind := range kinds {
+			proxy, ok := dependencyProxies[kind]
+			if !ok {
+				known := make([]string, 0, len(dependencyProxies))
+				for k := range dependencyProxies {
+					known = append(known, k)
+				}
+				sort.Strings(known)
+				log.Fatalf("Unknown dependency proxy %s, expected one of %s",
+					kind, strings.Join(known, ", "))
+			}
+			r.proxies = append(r.proxies, proxy)
+		}
+	}
+}
+
+// proxyEnv adds the environment pointing the steps to the proxies, the
+// variables set by the pipeline take precedence
+func proxyEnv(env map[string]string, proxies []dependencyProxy) {
+	for _, proxy := range proxies {
+		for k, v := range proxy.env(proxy.url()) {
+			if _, ok := env[k]; !ok {
+				env[k] = v
+			}
+		}
+	}
+}
+
+// startProxy makes sure the container of a proxy is running, creating it
+// along with its cache volume if missing
+func startProxy(ctx context.Context, cli *docker.Client, proxy dependencyProxy) error {
+	info, err := cli.ContainerInspect(ctx, proxy.containerName())
+	if err == nil {
+		if info.State != nil && info.State.Running {
+			return nil
+		}
+		return cli.ContainerStart(ctx, info.ID, types.ContainerStartOptions{})
+	}
+	if !docker.IsErrContainerNotFound(err) {
+		return err
+	}
+
+	cache := proxy.containerName() + "-cache"
+	labels := map[string]string{proxyLabel: proxy.kind, versionLabel: Version}
+	_, err = cli.VolumeCreate(ctx, volumetypes.VolumesCreateBody{
+		Name:   cache,
+		Labels: map[string]string{proxyLabel: proxy.kind, cacheLabel: "true"},
+	})
+	if err != nil {
+		return err
+	}
+	reader, err := cli.ImagePull(ctx, proxy.image, types.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, reader)
+	reader.Close()
+
+	resp, err := cli.ContainerCreate(ctx, &container.Config{
+		Image:  proxy.image,
+		Env:    proxy.config,
+		Labels: labels,
+	}, &container.HostConfig{
+		Binds:         []string{cache + ":" + proxy.cacheDir},
+		RestartPolicy: container.RestartPolicy{Name: "unless-stopped"},
+	}, nil, proxy.containerName())
+	if err != nil {
+		return err
+	}
+	return cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{})
+}
+
+// startProxies starts the proxies not running, logging the failures
+func (r *Runner) startProxies() {
+	if len(r.proxies) == 0 {
+		return
+	}
+	cli, err := docker.NewEnvClient()
+	if err != nil {
+		log.Printf("Error starting the dependency proxies: %v\n", err)
+		return
+	}
+	r.proxiesMutex.Lock()
+	defer r.proxiesMutex.Unlock()
+	for _, proxy := range r.proxies {
+		if err := startProxy(context.Background(), cli, proxy); err != nil {
+			log.Printf("Error starting the %s proxy: %v\n", proxy.kind, err)
+		}
+	}
+}
+
+// attachProxies connects the running proxies to the network of a job,
+// returning the ones reachable by its steps. Jobs without a network of their
+// own build without proxies.
+func (r *Runner) attachProxies(jobNetwork string) []dependencyProxy {
+	if len(r.proxies) == 0 || jobNetwork == "" {
+		return nil
+	}
+	cli, err := docker.NewEnvClient()
+	if err != nil {
+		log.Printf("Error attaching the dependency proxies: %v\n", err)
+		return nil
+	}
+	r.proxiesMutex.Lock()
+	defer r.proxiesMutex.Unlock()
+	ctx := context.Background()
+	var attached []dependencyProxy
+	for _, proxy := range r.proxies {
+		err := startProxy(ctx, cli, proxy)
+		if err == nil {
+			err = cli.NetworkConnect(ctx, jobNetwork, proxy.containerName(), &network.EndpointSettings{})
+		}
+		if err != nil {
+			log.Printf("Error attaching the %s proxy to %s: %v\n", proxy.kind, jobNetwork, err)
+			continue
+		}
+		attached = append(attached, proxy)
+	}
+	return attached
+}
+
+// detachProxies disconnects the proxies from a job network, which can't be
+// removed otherwise
+func (r *Runner) detachProxies(ctx context.Context, cli resourcesClient, jobNetwork string) {
+	for _, proxy := range r.proxies {
+		cli.NetworkDisconnect(ctx, jobNetwork, proxy.containerName(), true)
+	}
+}
@@ -0,0 +1,53 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProxyEnv(t *testing.T) {
+	env := map[string]string{"GOPROXY": "https://proxy.example.com", "CGO_ENABLED": "0"}
+	proxyEnv(env, []dependencyProxy{dependencyProxies["go"], dependencyProxies["npm"]})
+	expected := map[string]string{
+		// The pipeline env takes precedence
+		"GOPROXY":             "https://proxy.example.com",
+		"CGO_ENABLED":         "0",
+		"npm_config_registry": "http://narwhal-npm-proxy:4873/",
+		"YARN_REGISTRY":       "http://narwhal-npm-proxy:4873/",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Expected %v got %v", expected, env)
+	}
+
+	env = map[string]string{}
+	proxyEnv(env, []dependencyProxy{dependencyProxies["go"]})
+	if env["GOPROXY"] != "http://narwhal-go-proxy:3000,direct" {
+		t.Errorf("Expected GOPROXY pointing to the proxy, got %v", env)
+	}
+}
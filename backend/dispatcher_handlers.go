@@ -0,0 +1,820 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type queuedCommitResponse struct {
+	Position   int       `json:"position"`
+	JobId      string    `json:"job_id"`
+	Commit     Commit    `json:"commit"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	WaitTime   string    `json:"wait_time"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(payload)
+}
+
+// queueHandler returns the commits waiting to be dispatched, with their
+// position in the queue and the time they've been waiting so far, only the
+// ones of the repositories the caller can view are listed
+func queueHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		now := clockOrSystem(d.queue.clock).Now()
+		visible := d.visible(r)
+		res := []queuedCommitResponse{}
+		for i, item := range d.queue.Snapshot() {
+			if !visible(item.Commit.GetRepositoryName()) {
+				continue
+			}
+			res = append(res, queuedCommitResponse{
+				Position:   i,
+				JobId:      item.JobId,
+				Commit:     item.Commit,
+				EnqueuedAt: item.EnqueuedAt,
+				WaitTime:   now.Sub(item.EnqueuedAt).Round(time.Second).String(),
+			})
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// runnersHandler serves both the list of runners on /runners and the detail
+// of a single runner, including its dispatch history, on /runners/{id}.
+// POST /runners/{id}/drain stops a runner from accepting new commits, it
+// requires the manage_runners permission, as DELETE /runners/{id} removing a
+// runner from the pool does. POST /runners registers a runner, challenged on
+// its advertised address, answering a RegistrationResponse.
+func runnersHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/runners"), "/")
+		id, action := path, ""
+		if i := strings.Index(path, "/"); i >= 0 {
+			id, action = path[:i], path[i+1:]
+		}
+		runners, notifier := d.runnerList(), d.runnerNotifier
+		switch {
+		case r.Method == http.MethodPost && id == "":
+			var req registrationRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Addr == "" {
+				http.Error(w, "addr is required", http.StatusBadRequest)
+				return
+			}
+			addr, err := normalizeAddr(req.Addr)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			runner, created, err := d.registerRunner(addr, req.Capabilities)
+			if errors.Is(err, ErrIncompatibleRunner) {
+				log.Printf("Refused registration of runner %s: %v\n", req.Addr, err)
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				log.Printf("Refused registration of runner %s: %v\n", req.Addr, err)
+				http.Error(w, "registration refused", http.StatusForbidden)
+				return
+			}
+			status := http.StatusOK
+			if created {
+				status = http.StatusCreated
+			}
+			writeJSON(w, status, d.registrationResponse(runner))
+			return
+		case r.Method == http.MethodGet && id == "":
+			if !d.authorize(w, r, PermissionView, "") {
+				return
+			}
+			res := make([]RunnerInfo, len(runners))
+			for i, runner := range runners {
+				res[i] = runner.Info(false)
+			}
+			writeJSON(w, http.StatusOK, res)
+			return
+		case r.Method == http.MethodGet && action == "":
+			if !d.authorize(w, r, PermissionView, "") {
+				return
+			}
+		case r.Method == http.MethodPost && action == "drain":
+			if !d.authorize(w, r, PermissionManageRunners, "") {
+				return
+			}
+		case r.Method == http.MethodDelete && id != "" && action == "":
+			if !d.authorize(w, r, PermissionManageRunners, "") {
+				return
+			}
+			runner, err := d.deregisterRunner(id)
+			switch err {
+			case nil:
+				notifier.notifyRunnerEvent(RunnerRemoved, runner)
+				w.WriteHeader(http.StatusNoContent)
+			case ErrNotFound:
+				http.Error(w, "runner not found", http.StatusNotFound)
+			default:
+				http.Error(w, err.Error(), http.StatusConflict)
+			}
+			return
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		for _, runner := range runners {
+			if runner.Id != id {
+				continue
+			}
+			if action == "drain" && !runner.IsDraining() {
+				runner.Drain()
+				notifier.notifyRunnerEvent(RunnerDraining, runner)
+			}
+			writeJSON(w, http.StatusOK, runner.Info(true))
+			return
+		}
+		http.Error(w, "runner not found", http.StatusNotFound)
+	}
+}
+
+// Body of a build explicitly requested through the API
+type buildRequest struct {
+	Repository Repository `json:"repository"`
+	CommitId   string     `json:"commit_id"`
+	Pipeline   string     `json:"pipeline,omitempty"`
+}
+
+// authorized checks the bearer token of the request against the expected
+// one, an empty expected token never authorizes anything
+func authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1
+}
+
+// cloning tells whether the request carries the token of a running job of
+// the repository, pull requests from forks are never given the credentials
+func (d *Dispatcher) cloning(r *http.Request, repository string) bool {
+	jobId, ok := d.jobTokens.Verify(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if !ok {
+		return false
+	}
+	job, err := d.jobs.Get(jobId)
+	return err == nil && job.State == JobRunning && !job.Commit.fromFork() &&
+		job.Commit.GetRepositoryName() == repository
+}
+
+// buildsHandler enqueues a build of a repository, it requires the trigger
+// permission. Without a branch the default one of the registered repository
+// is built. The request can carry an inline pipeline overriding the CI
+// configuration of the repository for that run only, allowed just to admin
+// token holders.
+func buildsHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var req buildRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid build request", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+		if req.Repository.Name == "" {
+			http.Error(w, "repository name is required", http.StatusBadRequest)
+			return
+		}
+		if req.CommitId == "" {
+			http.Error(w, "commit id is required", http.StatusBadRequest)
+			return
+		}
+		if !d.authorize(w, r, PermissionTrigger, req.Repository.Name) {
+			return
+		}
+		if d.requireRegistration && !d.registered(req.Repository.Name) {
+			http.Error(w, "repository not registered", http.StatusNotFound)
+			return
+		}
+		if req.Repository.Branch == "" {
+			if settings, err := d.repositorySettings(req.Repository.Name); err == nil {
+				req.Repository.Branch = settings.DefaultBranch
+			}
+		}
+		if req.Repository.Branch == "" {
+			http.Error(w, "branch is required, the repository has no default branch", http.StatusBadRequest)
+			return
+		}
+		if req.Pipeline != "" {
+			if !authorized(r, d.adminToken) {
+				http.Error(w, "pipeline override not allowed", http.StatusForbidden)
+				return
+			}
+			if _, err := ParseCIConfig([]byte(req.Pipeline)); err != nil {
+				http.Error(w, "invalid pipeline: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Repository.HostingService == "" {
+			req.Repository.HostingService = GitHub
+		}
+		commit := Commit{
+			Id:         req.CommitId,
+			Timestamp:  d.clock.Now(),
+			Repository: req.Repository,
+			Pipeline:   req.Pipeline,
+		}
+		jobId, ok := d.submit(commit)
+		if !ok {
+			http.Error(w, "commit already submitted", http.StatusConflict)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, QueuedCommit{jobId, commit, commit.Timestamp})
+	}
+}
+
+// commitsHandler enqueues a commit event posted by an agent that could not
+// reach the message queue, authenticated with the submit token. Commits
+// already submitted are answered with a conflict, meaning delivered, the
+// ones filtered out by the repository settings with no content and the ones
+// deferred to a build window with the time they're going to be built.
+func commitsHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, d.submitToken) {
+			http.Error(w, "submit token required", http.StatusForbidden)
+			return
+		}
+		limit := d.maxEventSize
+		if limit <= 0 {
+			limit = DefaultMaxEventSize
+		}
+		payload, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+		if err != nil {
+			http.Error(w, "invalid commit event", http.StatusBadRequest)
+			return
+		}
+		commit, err := DecodeCommitEvent(payload, d.maxEventSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if d.filtersOut(commit) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if until, ok := d.defers(commit); ok {
+			writeJSON(w, http.StatusAccepted, DeferredBuild{commit, until})
+			return
+		}
+		jobId, ok := d.submit(commit)
+		if !ok {
+			http.Error(w, "commit already submitted", http.StatusConflict)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, QueuedCommit{jobId, commit, d.clock.Now()})
+	}
+}
+
+// usageHandler reports the build minutes consumed in a month, the current one
+// by default, e.g. GET /usage?month=2020-10&org=octocat, by the repositories
+// the caller can view
+func usageHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		month := r.URL.Query().Get("month")
+		if month == "" {
+			month = d.clock.Now().UTC().Format(usageMonthLayout)
+		} else if _, err := time.Parse(usageMonthLayout, month); err != nil {
+			http.Error(w, "month must be in the YYYY-MM format", http.StatusBadRequest)
+			return
+		}
+		report, err := d.usage.Report(month, r.URL.Query().Get("org"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, report.restrict(d.visible(r)))
+	}
+}
+
+// branchesHandler lists the status of every branch built so far the caller
+// can view, including the first failing commit of the broken ones
+func branchesHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		visible := d.visible(r)
+		branches := []BranchStatus{}
+		for _, branch := range d.branches.List() {
+			if visible(branch.Repository) {
+				branches = append(branches, branch)
+			}
+		}
+		writeJSON(w, http.StatusOK, branches)
+	}
+}
+
+// Longest time a consumer of the event stream can wait for new events, it must
+// stay below the write timeout of the server
+const maxEventsWait time.Duration = 8 * time.Second
+
+type eventsResponse struct {
+	Events     []JobEvent `json:"events"`
+	NextCursor uint64     `json:"next_cursor"`
+	Truncated  bool       `json:"truncated"`
+}
+
+// eventsHandler serves the stream of job events following a cursor, e.g.
+// GET /events?cursor=42&limit=100&wait=5s. With wait set the request is held
+// until at least one event is available. Consumers resume from next_cursor
+// once they processed the events received. WebSocket upgrades are served by
+// eventsSocketHandler. Only the events of the repositories the caller can
+// view are served.
+func eventsHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		events, visible := d.events, d.visible(r)
+		if websocket.IsWebSocketUpgrade(r) {
+			eventsSocketHandler(events, visible)(w, r)
+			return
+		}
+		query := r.URL.Query()
+		var cursor uint64
+		limit := 100
+		var err error
+		if c := query.Get("cursor"); c != "" {
+			if cursor, err = strconv.ParseUint(c, 10, 64); err != nil {
+				http.Error(w, "invalid cursor", http.StatusBadRequest)
+				return
+			}
+		}
+		if l := query.Get("limit"); l != "" {
+			if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+		if wait := query.Get("wait"); wait != "" {
+			timeout, err := time.ParseDuration(wait)
+			if err != nil {
+				http.Error(w, "invalid wait duration", http.StatusBadRequest)
+				return
+			}
+			if timeout > maxEventsWait {
+				timeout = maxEventsWait
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			events.Wait(ctx, cursor)
+			cancel()
+		}
+		res := eventsResponse{NextCursor: cursor, Events: []JobEvent{}}
+		batch, truncated := events.Since(cursor, limit)
+		res.Truncated = truncated
+		for _, event := range batch {
+			// Hidden events are skipped over by the cursor too
+			res.NextCursor = event.Cursor
+			if visible(event.Commit.GetRepositoryName()) {
+				res.Events = append(res.Events, event)
+			}
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// metricsHandler serves the metrics to the callers allowed to view the whole
+// dispatcher
+func metricsHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, PermissionView, "") {
+			return
+		}
+		d.metrics.ServeHTTP(w, r)
+	}
+}
+
+// workersHandler shows and updates the settings of the dispatching workers
+// pool, updates require the manage_runners permission, e.g.
+// PUT /admin/workers {"size": 4} or {"autoscale": true, "min": 2, "max": 16}.
+// The size, or the max when autoscaling, is bounded by the workers limit.
+func workersHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		workers := d.workers
+		switch r.Method {
+		case http.MethodGet:
+			if !d.authorize(w, r, PermissionView, "") {
+				return
+			}
+		case http.MethodPut:
+			if !d.authorize(w, r, PermissionManageRunners, "") {
+				return
+			}
+			settings := workers.Settings()
+			if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+				http.Error(w, "invalid workers settings", http.StatusBadRequest)
+				return
+			}
+			defer r.Body.Close()
+			size := settings.Size
+			if settings.Autoscale {
+				size = settings.Max
+			}
+			if size < 1 || size > d.workersLimit {
+				http.Error(w, "workers must be between 1 and "+strconv.Itoa(d.workersLimit),
+					http.StatusBadRequest)
+				return
+			}
+			workers.SetAutoscale(settings.Autoscale, settings.Min, settings.Max)
+			if !settings.Autoscale {
+				workers.Resize(settings.Size)
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, workers.Settings())
+	}
+}
+
+// credentialsHandler serves the clone credentials of a repository to the
+// runners on GET /credentials/{owner}/{name}, DELETE revokes them. Both
+// require the manage_secrets permission, runners fetch them with the token
+// of a running job of the repository instead.
+func credentialsHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		repository := strings.Trim(strings.TrimPrefix(r.URL.Path, "/credentials"), "/")
+		cloning := r.Method == http.MethodGet && d.cloning(r, repository)
+		if !cloning && !d.authorize(w, r, PermissionManageSecrets, repository) {
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			credentials, ok := d.repositoryCredentials(repository)
+			if !ok {
+				http.Error(w, "no credentials", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, http.StatusOK, credentials)
+		case http.MethodDelete:
+			d.revokeCredentials(repository)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// annotationsHandler lets steps annotate their own job, authenticating with
+// the token scoped to it, e.g. POST /annotations {"key": "coverage", "value": "87%"}
+func annotationsHandler(tokens *JobTokens, annotations *AnnotationStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		jobId, ok := tokens.Verify(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if !ok {
+			http.Error(w, "invalid job token", http.StatusForbidden)
+			return
+		}
+		var annotation Annotation
+		if err := json.NewDecoder(r.Body).Decode(&annotation); err != nil || annotation.Key == "" {
+			http.Error(w, "invalid annotation", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+		annotations.Set(jobId, annotation)
+		writeJSON(w, http.StatusOK, annotations.Get(jobId))
+	}
+}
+
+// commitHandler answers what happened to a commit, GET
+// /commit?repository={name}&id={commit} returns the last job of the commit
+func commitHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		repository, id := r.URL.Query().Get("repository"), r.URL.Query().Get("id")
+		if repository == "" || id == "" {
+			http.Error(w, "repository and id are required", http.StatusBadRequest)
+			return
+		}
+		if !d.authorize(w, r, PermissionView, repository) {
+			return
+		}
+		job, err := d.jobs.GetByCommit(repository, id)
+		if err == ErrNotFound {
+			http.Error(w, "commit not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	}
+}
+
+// Max number of jobs in a page of the listing
+const maxJobsPage int = 500
+
+type jobsResponse struct {
+	Jobs       []Job  `json:"jobs"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// jobsListHandler lists the jobs on /jobs, newest first, e.g.
+// GET /jobs?repository=octocat/test&branch=master&state=FAILED&since=2020-11-01T00:00:00Z
+// filtering on the creation time with since and until in RFC3339 format.
+// Pages are of limit jobs, the next one is requested passing the returned
+// next_cursor as cursor. Only the jobs the caller can view are listed.
+func jobsListHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		filter := JobFilter{
+			Repository: query.Get("repository"),
+			Branch:     query.Get("branch"),
+			State:      JobState(strings.ToUpper(query.Get("state"))),
+			visible:    d.visible(r),
+		}
+		var err error
+		for param, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+			if v := query.Get(param); v != "" {
+				if *t, err = time.Parse(time.RFC3339, v); err != nil {
+					http.Error(w, "invalid "+param, http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		limit, ok := pageLimit(query)
+		if !ok {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		var res jobsResponse
+		res.Jobs, res.NextCursor, err = d.jobs.List(filter, query.Get("cursor"), limit)
+		if err == ErrInvalidCursor {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// pageLimit reads the number of jobs per page, 50 by default and at most
+// maxJobsPage, returning false if invalid
+func pageLimit(query url.Values) (int, bool) {
+	limit := 50
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return 0, false
+		}
+	}
+	if limit > maxJobsPage {
+		limit = maxJobsPage
+	}
+	return limit, true
+}
+
+// jobSearchHandler searches the jobs on /jobs/search, newest first, e.g.
+// GET /jobs/search?q=repo:octocat/test+status:failed+author:octocat+after:2020-11-01
+// see ParseJobQuery for the query syntax. Pages work as in the listing, as
+// the restriction to the jobs the caller can view.
+func jobSearchHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		search, err := ParseJobQuery(query.Get("q"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit, ok := pageLimit(query)
+		if !ok {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		search.visible = d.visible(r)
+		var res jobsResponse
+		res.Jobs, res.NextCursor, err = d.jobs.Search(search, query.Get("cursor"), limit)
+		if err == ErrInvalidCursor {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// Subresources of a job its runner POSTs to with the job token
+var runnerReports = map[string]bool{"logs": true, "artifacts": true, "steps": true, "result": true}
+
+// jobsHandler serves the job API under /jobs/{id}:
+// - /jobs/{id} the job record, with its state
+// - /jobs/{id}/annotations the annotations set by the steps
+// - /jobs/{id}/graph the graph of the pipeline steps, with their timings
+// - /jobs/{id}/logs the output of the steps, see jobLogsHandler
+// - /jobs/{id}/logs/stream the output as Server-Sent Events
+// - /jobs/{id}/result the result reported by the runner, see jobResultHandler
+// - /jobs/{id}/steps the steps reported by the runner, see jobStepsHandler
+// - /jobs/{id}/secrets the secrets fetched by the runner, see jobSecretsHandler
+// - /jobs/{id}/artifacts the artifacts of the steps, see jobArtifactsHandler
+// - /jobs/{id}/config the effective pipeline, see jobConfigHandler
+// DELETE /jobs/{id} or POST /jobs/{id}/cancel cancels a job, pending or
+// running, it requires the cancel permission. POST /jobs/{id}/retry schedules
+// again the commit of a failed, cancelled or skipped job as a new job, it
+// requires the trigger permission. The rest requires the view one, but the
+// reports the runners POST with the job token.
+func jobsHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+		parts := strings.Split(path, "/")
+		jobId := parts[0]
+		cancel := (r.Method == http.MethodDelete && len(parts) == 1) ||
+			(r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "cancel")
+		retry := r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "retry"
+		// The runner of the job reports with the job token, checked by the
+		// report handlers, unknown jobs are answered not found by them too.
+		// The job token grants nothing else.
+		report := len(parts) == 2 && ((r.Method == http.MethodPost && runnerReports[parts[1]]) ||
+			(r.Method == http.MethodGet && parts[1] == "secrets"))
+		if !report {
+			job, err := d.jobs.Get(jobId)
+			if err != nil && err != ErrNotFound {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			permission := PermissionView
+			if cancel {
+				permission = PermissionCancel
+			} else if retry {
+				permission = PermissionTrigger
+			}
+			if err == nil && !d.authorize(w, r, permission, job.Commit.GetRepositoryName()) {
+				return
+			}
+		}
+		if cancel {
+			job, err := d.cancelJob(jobId)
+			switch {
+			case err == ErrNotFound:
+				http.Error(w, "job not found", http.StatusNotFound)
+			case err != nil && job.Done():
+				http.Error(w, "job already "+string(job.State), http.StatusConflict)
+			case err != nil:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			default:
+				writeJSON(w, http.StatusOK, job)
+			}
+			return
+		}
+		if len(parts) == 2 && parts[1] == "logs" {
+			jobLogsHandler(d, jobId)(w, r)
+			return
+		}
+		if len(parts) == 3 && parts[1] == "logs" && parts[2] == "stream" {
+			jobLogsStreamHandler(d, jobId)(w, r)
+			return
+		}
+		if len(parts) >= 2 && len(parts) <= 3 && parts[1] == "artifacts" {
+			jobArtifactsHandler(d, jobId, strings.Join(parts[2:], ""))(w, r)
+			return
+		}
+		if len(parts) == 2 && parts[1] == "config" {
+			jobConfigHandler(d, jobId)(w, r)
+			return
+		}
+		if len(parts) == 2 && parts[1] == "steps" {
+			jobStepsHandler(d, jobId)(w, r)
+			return
+		}
+		if len(parts) == 2 && parts[1] == "result" {
+			jobResultHandler(d, jobId)(w, r)
+			return
+		}
+		if len(parts) == 2 && parts[1] == "secrets" {
+			jobSecretsHandler(d, jobId)(w, r)
+			return
+		}
+		if retry {
+			job, err := d.retryJob(jobId)
+			switch err {
+			case nil:
+				writeJSON(w, http.StatusCreated, job)
+			case ErrNotFound:
+				http.Error(w, "job not found", http.StatusNotFound)
+			case ErrNotRetryable:
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if len(parts) == 1 {
+			job, err := d.jobs.Get(jobId)
+			if err == ErrNotFound {
+				http.Error(w, "job not found", http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, job)
+			return
+		}
+		if len(parts) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		switch parts[1] {
+		case "annotations":
+			writeJSON(w, http.StatusOK, d.annotations.Get(jobId))
+		case "graph":
+			steps, err := getStepResults(d.store, jobId)
+			if err == ErrNotFound {
+				http.Error(w, "graph not available", http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, NewPipelineGraph(jobId, steps))
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
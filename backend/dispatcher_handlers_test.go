@@ -0,0 +1,499 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunnersHandler(t *testing.T) {
+	runner := NewRunnerProxy("127.0.0.1:9898")
+	runner.SetAlive(true)
+	commit := Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "dev"}}
+	runner.startJob(commit)
+	runner.finishJob(commit, "OK")
+	handler := runnersHandler(NewDispatcher("commits", time.Second, []*RunnerProxy{runner}))
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/runners/"+runner.Id, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("runnersHandler failed: expected 200 got %d", rec.Code)
+	}
+	var info RunnerInfo
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if !info.Alive || len(info.History) != 1 || info.History[0].Result != "OK" {
+		t.Errorf("runnersHandler failed: unexpected runner detail %v", info)
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/runners/unknown", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("runnersHandler failed: expected 404 got %d", rec.Code)
+	}
+}
+
+func TestRunnersHandlerDelete(t *testing.T) {
+	idle, busy := NewRunnerProxy("127.0.0.1:9898"), NewRunnerProxy("127.0.0.1:9899")
+	busy.startJob(Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "dev"}})
+	d := NewDispatcher("commits", time.Second, []*RunnerProxy{idle, busy}, WithAdminToken("secret"))
+	handler := runnersHandler(d)
+	remove := func(id, token string) int {
+		req := httptest.NewRequest(http.MethodDelete, "/runners/"+id, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+	if code := remove(idle.Id, ""); code != http.StatusForbidden || len(d.runnerList()) != 2 {
+		t.Errorf("runnersHandler failed: expected 403 without token got %d", code)
+	}
+	if code := remove(idle.Id, "secret"); code != http.StatusNoContent || len(d.runnerList()) != 1 {
+		t.Errorf("runnersHandler failed: expected 204 removing an idle runner got %d", code)
+	}
+	if code := remove(busy.Id, "secret"); code != http.StatusConflict || !busy.IsDraining() {
+		t.Errorf("runnersHandler failed: expected 409 and the busy runner drained got %d", code)
+	}
+	if code := remove(idle.Id, "secret"); code != http.StatusNotFound {
+		t.Errorf("runnersHandler failed: expected 404 for a removed runner got %d", code)
+	}
+}
+
+func TestBuildsHandlerPipelineOverride(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil, WithAdminToken("secret"))
+	handler := buildsHandler(d)
+	body := `{"repository":{"name":"octocat/test","branch":"dev"},"commit_id":"abc",` +
+		`"pipeline":"steps:\n  - name: test\n    command: make test\n"}`
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/builds", strings.NewReader(body)))
+	if rec.Code != http.StatusForbidden || d.queue.Len() != 0 {
+		t.Errorf("buildsHandler failed: expected 403 got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/builds", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusAccepted || d.queue.Len() != 1 {
+		t.Errorf("buildsHandler failed: expected 202 got %d", rec.Code)
+	}
+}
+
+func TestAnnotationsHandler(t *testing.T) {
+	tokens, annotations := NewJobTokens(), NewAnnotationStore()
+	handler := annotationsHandler(tokens, annotations)
+	body := `{"key":"coverage","value":"87%"}`
+
+	req := httptest.NewRequest(http.MethodPost, "/annotations", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer job-1.forged")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("annotationsHandler failed: expected 403 got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/annotations", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+tokens.Issue("job-1"))
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusOK || annotations.Get("job-1")["coverage"] != "87%" {
+		t.Errorf("annotationsHandler failed: annotation not stored, got %d", rec.Code)
+	}
+}
+
+func TestJobTokensPersisted(t *testing.T) {
+	store := NewMemoryStore()
+	token := NewDispatcher("commits", time.Second, nil, WithStore(store)).jobTokens.Issue("job-a")
+	// A restarted dispatcher still accepts the tokens of the running jobs
+	restarted := NewDispatcher("commits", time.Second, nil, WithStore(store))
+	if jobId, ok := restarted.jobTokens.Verify(token); !ok || jobId != "job-a" {
+		t.Errorf("loadJobTokens failed: expected job-a got %q %v", jobId, ok)
+	}
+	if _, ok := NewDispatcher("commits", time.Second, nil).jobTokens.Verify(token); ok {
+		t.Errorf("loadJobTokens failed: expected the token refused by another store")
+	}
+}
+
+func TestCommitHandler(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil)
+	jobs := d.jobs
+	commit := Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "dev"}}
+	jobs.Create(NewJob("job-1", commit))
+	jobs.Update("job-1", func(job *Job) error {
+		job.Runner = "runner-1"
+		return job.Transition(JobRunning)
+	})
+	handler := commitHandler(d)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/commit?repository=octocat/test&id=abc", nil))
+	var job Job
+	if err := json.NewDecoder(rec.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || job.State != JobRunning || job.Runner != "runner-1" {
+		t.Errorf("commitHandler failed: unexpected %d %v", rec.Code, job)
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/commit?repository=octocat/test&id=def", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("commitHandler failed: expected 404 got %d", rec.Code)
+	}
+}
+
+func TestJobsHandlerCancel(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil)
+	jobId := d.enqueue(Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "dev"}})
+	handler := jobsHandler(d)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/jobs/"+jobId+"/cancel", nil))
+	if rec.Code != http.StatusOK || d.queue.Len() != 0 {
+		t.Errorf("jobsHandler failed: expected pending job cancelled got %d", rec.Code)
+	}
+	if job, _ := d.jobs.Get(jobId); job.State != JobCancelled {
+		t.Errorf("jobsHandler failed: expected CANCELLED got %s", job.State)
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodDelete, "/jobs/"+jobId, nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("jobsHandler failed: expected 409 got %d", rec.Code)
+	}
+}
+
+func TestJobsHandlerRetry(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil)
+	commit := Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "dev"}}
+	jobId, _ := d.submit(commit)
+	handler := jobsHandler(d)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/jobs/"+jobId+"/retry", nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("jobsHandler failed: expected 409 retrying a pending job got %d", rec.Code)
+	}
+	d.cancelJob(jobId)
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/jobs/"+jobId+"/retry", nil))
+	var job Job
+	if err := json.NewDecoder(rec.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusCreated || job.RetryOf != jobId || job.State != JobPending ||
+		d.queue.Len() != 1 {
+		t.Errorf("jobsHandler failed: unexpected retry %d %v", rec.Code, job)
+	}
+}
+
+func TestJobsHandlerLogs(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil)
+	jobId := d.enqueue(Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "dev"}})
+	handler := jobsHandler(d)
+
+	req := httptest.NewRequest(http.MethodPost, "/jobs/"+jobId+"/logs", strings.NewReader("\x1b[32mok\x1b[0m\n"))
+	req.Header.Set("Authorization", "Bearer "+d.jobTokens.Issue("other"))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("jobsHandler failed: expected 403 with the token of another job got %d", rec.Code)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/jobs/"+jobId+"/logs", strings.NewReader("\x1b[32mok\x1b[0m\n"))
+	req.Header.Set("Authorization", "Bearer "+d.jobTokens.Issue(jobId))
+	handler(httptest.NewRecorder(), req)
+
+	// Following returns once the job is done
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		d.cancelJob(jobId)
+	}()
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/jobs/"+jobId+"/logs?follow=true", nil))
+	if rec.Body.String() != "\x1b[32mok\x1b[0m\n" {
+		t.Errorf("jobsHandler failed: unexpected logs %q", rec.Body.String())
+	}
+
+	// The logs of finished jobs survive a restart
+	restarted := NewDispatcher("commits", time.Second, nil, WithStore(d.store))
+	rec = httptest.NewRecorder()
+	jobsHandler(restarted)(rec, httptest.NewRequest(http.MethodGet, "/jobs/"+jobId+"/logs?follow=true", nil))
+	if rec.Body.String() != "\x1b[32mok\x1b[0m\n" {
+		t.Errorf("jobsHandler failed: unexpected logs after a restart %q", rec.Body.String())
+	}
+
+	// Rendered as plain text, offsets counting the raw bytes
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/jobs/"+jobId+"/logs?plain=true&offset=5", nil))
+	if rec.Body.String() != "ok\n" {
+		t.Errorf("jobsHandler failed: unexpected plain logs %q", rec.Body.String())
+	}
+}
+
+// outputRunner succeeds every job, handing its output with the response
+type outputRunner struct{}
+
+func (outputRunner) RunCommitJob(req RunnerRequest, res *RunnerResponse) error {
+	res.Response, res.Logs = "OK", []byte("[0.001] built\n")
+	return nil
+}
+
+func TestJobsHandlerLogsNotStreamed(t *testing.T) {
+	server := rpc.NewServer()
+	server.RegisterName("Runner", outputRunner{})
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go server.ServeConn(serverConn)
+	proxy := NewRunnerProxy("r1")
+	proxy.Alive, proxy.RpcClient = true, rpc.NewClient(clientConn)
+	d := NewDispatcher("commits", time.Second, []*RunnerProxy{proxy})
+	commit := Commit{Id: "a", Repository: Repository{GitHub, "octocat/test", "master"}}
+	job := NewJob("job-a", commit)
+	d.jobs.Create(job)
+	d.forwardToRunner(proxy, job.Id, commit)
+	rec := httptest.NewRecorder()
+	jobsHandler(d)(rec, httptest.NewRequest(http.MethodGet, "/jobs/job-a/logs", nil))
+	if rec.Body.String() != "[0.001] built\n" {
+		t.Errorf("jobsHandler failed: expected the output handed with the response got %q", rec.Body.String())
+	}
+}
+
+func TestDispatcherLogWriterAsync(t *testing.T) {
+	release := make(chan struct{})
+	var posts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		body, _ := ioutil.ReadAll(r.Body)
+		posts = append(posts, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	logs := newDispatcherLogWriter(&Runner{}, RunnerRequest{JobId: "job-a", APIURL: server.URL})
+	// Writing doesn't wait for the dispatcher
+	written := make(chan struct{})
+	go func() {
+		for _, chunk := range []string{"a\n", "b\n", "c\n"} {
+			logs.Write([]byte(chunk))
+		}
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("dispatcherLogWriter.Write failed: blocked on the dispatcher")
+	}
+	close(release)
+	logs.Close()
+	if joined := strings.Join(posts, ""); joined != "a\nb\nc\n" || len(posts) > 2 {
+		t.Errorf("dispatcherLogWriter failed: expected the output batched in order got %q", posts)
+	}
+}
+
+func TestJobLogCapture(t *testing.T) {
+	capture := &jobLogCapture{}
+	big := make([]byte, maxJobLogSize-1)
+	capture.Write(big)
+	if n, err := capture.Write([]byte("ok\n")); n != 3 || err != nil {
+		t.Errorf("jobLogCapture.Write failed: expected 3 bytes written got %d %v", n, err)
+	}
+	if len(capture.data) != maxJobLogSize || capture.data[len(capture.data)-1] != 'o' {
+		t.Errorf("jobLogCapture.Write failed: expected the output capped at %d bytes got %d", maxJobLogSize, len(capture.data))
+	}
+}
+
+func TestJobResultCallback(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil)
+	jobId := d.enqueue(Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "dev"}})
+	server := httptest.NewServer(jobsHandler(d))
+	defer server.Close()
+
+	runner := &Runner{streamLogs: true}
+	req := RunnerRequest{JobId: jobId, JobToken: d.jobTokens.Issue(jobId), APIURL: server.URL}
+	res := &RunnerResponse{Response: "NOK", Error: "step test exited with code 2", Steps: []StepResult{
+		{Name: "build", Status: StepSuccess},
+		{Name: "test", Status: StepFailure, ExitCode: 2},
+	}}
+	runner.reportResult(req, runner.jobResult(req, res, nil, 3*time.Second))
+
+	job, err := d.jobs.Get(jobId)
+	if err != nil || job.Result == nil {
+		t.Fatalf("jobResultHandler failed: result not stored, %v", err)
+	}
+	if job.Result.ExitCode != 2 || job.Result.Step != "test" || job.Result.Duration != 3 ||
+		job.Result.LogLocation != server.URL+"/jobs/"+jobId+"/logs" {
+		t.Errorf("jobResultHandler failed: unexpected result %v", job.Result)
+	}
+}
+
+func TestJobsHandlerLogsStream(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil)
+	jobId := d.enqueue(Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "dev"}})
+	d.logs.Append(jobId, []byte("building\r\ntest"))
+
+	// The partial line is sent once completed, the stream ends with the job
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		d.logs.Append(jobId, []byte("ing\n"))
+		d.cancelJob(jobId)
+	}()
+	rec := httptest.NewRecorder()
+	jobsHandler(d)(rec, httptest.NewRequest(http.MethodGet, "/jobs/"+jobId+"/logs/stream", nil))
+	expected := "id: 10\ndata: building\n\nid: 18\ndata: testing\n\nevent: end\ndata: CANCELLED\n\n"
+	if rec.Body.String() != expected {
+		t.Errorf("jobsHandler failed: unexpected event stream %q", rec.Body.String())
+	}
+
+	// Resuming from the last event received
+	req := httptest.NewRequest(http.MethodGet, "/jobs/"+jobId+"/logs/stream", nil)
+	req.Header.Set("Last-Event-ID", "10")
+	rec = httptest.NewRecorder()
+	jobsHandler(d)(rec, req)
+	if !strings.HasPrefix(rec.Body.String(), "id: 18\ndata: testing\n\n") {
+		t.Errorf("jobsHandler failed: unexpected resumed stream %q", rec.Body.String())
+	}
+}
+
+func TestCommitsHandler(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil, WithSubmitToken("s3cr3t"))
+	handler := commitsHandler(d)
+	event := `{"id": "abc", "repository": {"hosting_service": "github", "name": "octocat/test", "branch": "dev"}}`
+	cases := []struct {
+		token, body string
+		expected    int
+	}{
+		{"", event, http.StatusForbidden},
+		{"s3cr3t", `{"id": "abc"}`, http.StatusBadRequest},
+		{"s3cr3t", event, http.StatusAccepted},
+		{"s3cr3t", event, http.StatusConflict},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/commits", strings.NewReader(c.body))
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != c.expected {
+			t.Errorf("commitsHandler failed: expected %d got %d %s", c.expected, rec.Code, rec.Body.String())
+		}
+	}
+	if d.queue.Len() != 1 {
+		t.Errorf("commitsHandler failed: expected 1 queued commit got %d", d.queue.Len())
+	}
+}
+
+func TestJobsHandlerArtifacts(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil)
+	jobId := d.enqueue(Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "dev"}})
+	server := httptest.NewServer(jobsHandler(d))
+	defer server.Close()
+
+	runner := &Runner{}
+	req := RunnerRequest{JobId: jobId, JobToken: d.jobTokens.Issue(jobId), APIURL: server.URL}
+	if err := runner.uploadArtifact(req, "test", "build/reports/", strings.NewReader("tar")); err != nil {
+		t.Fatalf("Runner.uploadArtifact failed: %v", err)
+	}
+	res, err := http.Get(server.URL + "/jobs/" + jobId + "/artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var artifacts []Artifact
+	json.NewDecoder(res.Body).Decode(&artifacts)
+	res.Body.Close()
+	if len(artifacts) != 1 || artifacts[0].Name != "test-reports.tar" || artifacts[0].Size != 3 {
+		t.Fatalf("jobsHandler failed: unexpected artifacts %v", artifacts)
+	}
+	res, err = http.Get(server.URL + "/jobs/" + jobId + "/artifacts/test-reports.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(content) != "tar" {
+		t.Errorf("jobsHandler failed: unexpected artifact download %d %q", res.StatusCode, content)
+	}
+}
+
+func TestHandlersFollowTheClock(t *testing.T) {
+	clock := newFakeClock()
+	d := NewDispatcher("commits", time.Second, nil, WithClock(clock), WithAdminToken("secret"),
+		WithResultCache("octocat/test"))
+	req := httptest.NewRequest(http.MethodPost, "/builds",
+		strings.NewReader(`{"repository":{"name":"octocat/test","branch":"dev"},"commit_id":"abc"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	buildsHandler(d)(rec, req)
+	var queued QueuedCommit
+	json.NewDecoder(rec.Body).Decode(&queued)
+	if !queued.EnqueuedAt.Equal(clock.Now()) || !queued.Commit.Timestamp.Equal(clock.Now()) {
+		t.Errorf("buildsHandler failed: expected the build enqueued at %v got %+v", clock.Now(), queued)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/usage", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	usageHandler(d)(rec, req)
+	var report UsageReport
+	json.NewDecoder(rec.Body).Decode(&report)
+	if report.Month != "2020-01" {
+		t.Errorf("usageHandler failed: expected the month of the clock 2020-01 got %q", report.Month)
+	}
+
+	d.cacheResult("job-a", queued.Commit, "hash")
+	job := NewJob("job-b", queued.Commit)
+	if cached, ok := d.cachedResult(job); !ok || !cached.CreatedAt.Equal(clock.Now()) {
+		t.Errorf("cacheResult failed: expected the result cached at %v got %+v", clock.Now(), cached)
+	}
+}
+
+func TestBuildsHandlerValidation(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil, WithAdminToken("secret"))
+	for body, expected := range map[string]string{
+		`{"commit_id":"abc"}`:                                    "repository name is required",
+		`{"repository":{"name":"octocat/test"}}`:                 "commit id is required",
+		`{"repository":{"name":"octocat/test"},"commit_id":"a"}`: "branch is required, the repository has no default branch",
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/builds", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		buildsHandler(d)(rec, req)
+		if message := strings.TrimSpace(rec.Body.String()); rec.Code != http.StatusBadRequest || message != expected {
+			t.Errorf("buildsHandler failed: expected 400 %q got %d %q for %s", expected, rec.Code, message, body)
+		}
+	}
+}
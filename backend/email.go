@@ -0,0 +1,254 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// EmailConfig sets the SMTP server and the recipients of the emails sent
+// when a job fails or its branch recovers. Subject and body are
+// text/template templates executed on an EmailData, e.g.
+//
+//	email:
+//	  smtp:
+//	    host: smtp.example.com
+//	    port: 587
+//	    username: narwhal
+//	    password: secret
+//	  from: narwhal@example.com
+//	  to:
+//	    - ci@example.com
+//	  authors: true
+//	  subject: "{{.Repository}} {{.State}}"
+type EmailConfig struct {
+	SMTP SMTPConfig `yaml:"smtp"`
+	From string     `yaml:"from"`
+	// Addresses always emailed
+	To []string `yaml:"to,omitempty"`
+	// Email the author of the commit too
+	Authors bool   `yaml:"authors,omitempty"`
+	Subject string `yaml:"subject,omitempty"`
+	Body    string `yaml:"body,omitempty"`
+}
+
+type SMTPConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+}
+
+const (
+	defaultEmailSubject = `[narwhal] {{.Repository}}{{with .Branch}}@{{.}}{{end}} ` +
+		`{{if .Recovered}}recovered{{else}}failed{{end}} on {{.Commit}}`
+	defaultEmailBody = `{{if .Recovered}}The build of {{.Commit}} is green again.{{else}}` +
+		`The build of {{.Commit}} {{.State}}{{with .Job.Category}} ({{.}}){{end}}.{{end}}
+
+Repository: {{.Repository}}
+Branch:     {{.Branch}}
+Commit:     {{.Job.Commit.Id}}
+Author:     {{.Job.Commit.Author.Name}} <{{.Job.Commit.Author.Email}}>
+Message:    {{.Job.Commit.Message}}
+Duration:   {{.Duration}}
+{{with .Job.Error}}Error:      {{.}}
+{{end}}{{with .LogsURL}}Logs:       {{.}}
+{{end}}`
+)
+
+// EmailData is what the email templates are executed on
+type EmailData struct {
+	Job Job
+	// True if the job turned its branch green again
+	Recovered  bool
+	Repository string
+	Branch     string
+	// Short commit SHA
+	Commit   string
+	State    JobState
+	Duration time.Duration
+	// Empty if the dispatcher has no public URL
+	LogsURL string
+}
+
+// EmailNotifier emails the commit authors and a list of addresses when a
+// job fails or recovers its branch, delivery is best-effort and doesn't
+// block the caller
+type EmailNotifier struct {
+	config  EmailConfig
+	authors map[string]Recipient
+	subject *template.Template
+	body    *template.Template
+	// Delivers the messages, smtp.SendMail but in tests
+	send func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// NewEmailNotifier returns an error if the templates don't parse, authors
+// maps the commit authors to their recipients as in LoadAuthorsMapping
+func NewEmailNotifier(config EmailConfig, authors map[string]Recipient) (*EmailNotifier, error) {
+	if config.SMTP.Host == "" || config.From == "" {
+		return nil, fmt.Errorf("email notifications need an SMTP host and a from address")
+	}
+	if config.Subject == "" {
+		config.Subject = defaultEmailSubject
+	}
+	if config.Body == "" {
+		config.Body = defaultEmailBody
+	}
+	if config.SMTP.Port == 0 {
+		config.SMTP.Port = 25
+	}
+	subject, err := template.New("subject").Parse(config.Subject)
+	if err != nil {
+		return nil, err
+	}
+	body, err := template.New("body").Parse(config.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &EmailNotifier{config, authors, subject, body, smtp.SendMail}, nil
+}
+
+// WithEmailNotifications emails the failures and the recoveries
+func WithEmailNotifications(notifier *EmailNotifier) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.email = notifier
+	}
+}
+
+// recipients returns the addresses to email about a job, without duplicates
+func (e *EmailNotifier) recipients(job Job, extra []string) []string {
+	to := []string{}
+	seen := map[string]bool{}
+	add := func(address string) {
+		if address != "" && !seen[strings.ToLower(address)] {
+			seen[strings.ToLower(address)] = true
+			to = append(to, address)
+		}
+	}
+	for _, address := range e.config.To {
+		add(address)
+	}
+	for _, address := range extra {
+		add(address)
+	}
+	if e.config.Authors {
+		add(authorRecipient(e.authors, job.Commit.Author).Email)
+	}
+	return to
+}
+
+// message renders the email about a job, headers included
+func (e *EmailNotifier) message(job Job, recovered bool, to []string, publicURL string) ([]byte, error) {
+	data := EmailData{
+		Job:        job,
+		Recovered:  recovered,
+		Repository: job.Commit.GetRepositoryName(),
+		Branch:     job.Commit.Repository.Branch,
+		Commit:     shortId(job.Commit.Id),
+		State:      job.State,
+	}
+	if job.StartedAt != nil && job.FinishedAt != nil {
+		data.Duration = job.FinishedAt.Sub(*job.StartedAt).Round(time.Second)
+	}
+	if publicURL != "" {
+		data.LogsURL = fmt.Sprintf("%s/jobs/%s/logs", strings.TrimRight(publicURL, "/"), job.Id)
+	}
+	var subject, body bytes.Buffer
+	if err := e.subject.Execute(&subject, data); err != nil {
+		return nil, err
+	}
+	if err := e.body.Execute(&body, data); err != nil {
+		return nil, err
+	}
+	var msg bytes.Buffer
+	headers := [][2]string{
+		{"From", e.config.From},
+		{"To", strings.Join(to, ", ")},
+		// Headers can't span lines
+		{"Subject", mime.QEncoding.Encode("utf-8", strings.Join(strings.Fields(subject.String()), " "))},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+	}
+	for _, header := range headers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", header[0], header[1])
+	}
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body.String(), "\n", "\r\n"))
+	return msg.Bytes(), nil
+}
+
+// Notify emails about a failed job or one that recovered its branch, the
+// configured recipients and the extra ones
+func (e *EmailNotifier) Notify(job Job, recovered bool, publicURL string, extra ...string) {
+	if e == nil || (job.State != JobFailed && !recovered) {
+		return
+	}
+	to := e.recipients(job, extra)
+	if len(to) == 0 {
+		return
+	}
+	msg, err := e.message(job, recovered, to, publicURL)
+	if err != nil {
+		log.Printf("Error rendering the email of job %s: %v\n", job.Id, err)
+		return
+	}
+	var auth smtp.Auth
+	if e.config.SMTP.Username != "" {
+		auth = smtp.PlainAuth("", e.config.SMTP.Username, e.config.SMTP.Password, e.config.SMTP.Host)
+	}
+	addr := net.JoinHostPort(e.config.SMTP.Host, strconv.Itoa(e.config.SMTP.Port))
+	go func() {
+		if err := e.send(addr, auth, e.config.From, to, msg); err != nil {
+			log.Printf("Error emailing about job %s: %v\n", job.Id, err)
+		}
+	}()
+}
+
+// notifyEmail emails about a finished job, if enabled
+func (d *Dispatcher) notifyEmail(jobId string, recovered bool) {
+	if d.email == nil {
+		return
+	}
+	job, err := d.jobs.Get(jobId)
+	if err != nil {
+		log.Printf("Error emailing about job %s: %v\n", jobId, err)
+		return
+	}
+	targets := d.notificationTargets(job.Commit.GetRepositoryName())
+	d.email.Notify(job, recovered, d.publicURL, targets.Email...)
+}
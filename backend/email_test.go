@@ -0,0 +1,174 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"net/smtp"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sentEmail struct {
+	addr string
+	to   []string
+	msg  string
+}
+
+func newTestEmailNotifier(t *testing.T, config EmailConfig) (*EmailNotifier, chan sentEmail) {
+	config.SMTP.Host, config.From = "smtp.example.com", "narwhal@example.com"
+	notifier, err := NewEmailNotifier(config, map[string]Recipient{
+		"jdoe": {Email: "john.doe@example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan sentEmail, 10)
+	notifier.send = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		sent <- sentEmail{addr, to, string(msg)}
+		return nil
+	}
+	return notifier, sent
+}
+
+func failedJob(id string, commit Commit) Job {
+	started := time.Date(2020, 11, 1, 10, 0, 0, 0, time.UTC)
+	finished := started.Add(90 * time.Second)
+	job := NewJob(id, commit)
+	job.State, job.StartedAt, job.FinishedAt = JobFailed, &started, &finished
+	job.Category, job.Error = FailureTest, "step test exited with code 1"
+	return job
+}
+
+func TestNewEmailNotifier(t *testing.T) {
+	if _, err := NewEmailNotifier(EmailConfig{From: "narwhal@example.com"}, nil); err == nil {
+		t.Error("NewEmailNotifier failed: expected an error without SMTP host")
+	}
+	config := EmailConfig{SMTP: SMTPConfig{Host: "smtp.example.com"}, From: "narwhal@example.com",
+		Subject: "{{.Repository"}
+	if _, err := NewEmailNotifier(config, nil); err == nil {
+		t.Error("NewEmailNotifier failed: expected an error parsing the subject")
+	}
+}
+
+func TestEmailNotifierRecipients(t *testing.T) {
+	notifier, _ := newTestEmailNotifier(t, EmailConfig{
+		To:      []string{"ci@example.com", "John.Doe@example.com"},
+		Authors: true,
+	})
+	commit := Commit{Id: "a", Author: Author{Email: "jdoe@users.example.com", Username: "jdoe"}}
+	expected := []string{"ci@example.com", "John.Doe@example.com"}
+	if to := notifier.recipients(NewJob("job-a", commit), nil); !reflect.DeepEqual(to, expected) {
+		t.Errorf("EmailNotifier.recipients failed: expected %v got %v", expected, to)
+	}
+	commit.Author = Author{Email: "alice@example.com"}
+	expected = []string{"ci@example.com", "John.Doe@example.com", "alice@example.com"}
+	if to := notifier.recipients(NewJob("job-a", commit), nil); !reflect.DeepEqual(to, expected) {
+		t.Errorf("EmailNotifier.recipients failed: expected %v got %v", expected, to)
+	}
+	expected = []string{"ci@example.com", "John.Doe@example.com", "team@example.com", "alice@example.com"}
+	extra := []string{"team@example.com", "CI@example.com"}
+	if to := notifier.recipients(NewJob("job-a", commit), extra); !reflect.DeepEqual(to, expected) {
+		t.Errorf("EmailNotifier.recipients failed: expected %v got %v", expected, to)
+	}
+}
+
+func TestEmailNotifierMessage(t *testing.T) {
+	notifier, _ := newTestEmailNotifier(t, EmailConfig{})
+	commit := Commit{Id: "1a2b3c4d5e", Message: "Add feature",
+		Author:     Author{Name: "John Doe", Email: "jdoe@example.com"},
+		Repository: Repository{GitHub, "octocat/test", "master"}}
+	msg, err := notifier.message(failedJob("job-1", commit), false, []string{"ci@example.com"},
+		"http://narwhal.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"From: narwhal@example.com\r\n",
+		"To: ci@example.com\r\n",
+		"Subject: [narwhal] octocat/test@master failed on 1a2b3c4\r\n",
+		"The build of 1a2b3c4 FAILED (test_failure).\r\n",
+		"Author:     John Doe <jdoe@example.com>\r\n",
+		"Duration:   1m30s\r\n",
+		"Error:      step test exited with code 1\r\n",
+		"Logs:       http://narwhal.local/jobs/job-1/logs\r\n",
+	} {
+		if !strings.Contains(string(msg), expected) {
+			t.Errorf("EmailNotifier.message failed: expected %q in\n%s", expected, msg)
+		}
+	}
+	notifier, _ = newTestEmailNotifier(t, EmailConfig{Subject: "{{.Repository}}\n{{.State}}"})
+	msg, err = notifier.message(failedJob("job-1", commit), false, nil, "")
+	if err != nil || !strings.Contains(string(msg), "Subject: octocat/test FAILED\r\n") {
+		t.Errorf("EmailNotifier.message failed: expected a single line subject in\n%s %v", msg, err)
+	}
+}
+
+func TestDispatcherEmailRecovery(t *testing.T) {
+	notifier, sent := newTestEmailNotifier(t, EmailConfig{To: []string{"ci@example.com"}})
+	d := NewDispatcher("commits", time.Second, nil, WithEmailNotifications(notifier))
+	repository := Repository{GitHub, "octocat/test", "master"}
+	for i, state := range []JobState{JobSuccess, JobFailed, JobSuccess, JobSuccess} {
+		commit := Commit{Id: string(rune('a' + i)), Repository: repository}
+		job := NewJob("job-"+commit.Id, commit)
+		job.State = state
+		d.jobs.Create(job)
+		d.aggregator.Track(commit, commit.Id)
+		status := StatusSuccess
+		if state == JobFailed {
+			status = StatusFailure
+		}
+		d.complete(job.Id, commit, status, "")
+	}
+	// Emails are sent concurrently, in any order
+	subjects := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case email := <-sent:
+			if email.addr != "smtp.example.com:25" {
+				t.Errorf("Expected an email to smtp.example.com:25, got %s", email.addr)
+			}
+			subject := strings.SplitN(strings.SplitN(email.msg, "Subject: ", 2)[1], "\r\n", 2)[0]
+			subjects[subject] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected 2 emails, got %v", subjects)
+		}
+	}
+	expected := map[string]bool{
+		"[narwhal] octocat/test@master failed on b":    true,
+		"[narwhal] octocat/test@master recovered on c": true,
+	}
+	if !reflect.DeepEqual(subjects, expected) {
+		t.Errorf("Expected emails %v, got %v", expected, subjects)
+	}
+	select {
+	case email := <-sent:
+		t.Errorf("Unexpected email %s", email.msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,172 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Max number of job events retained for consumers to catch up
+const eventLogSize int = 10000
+
+const jobEventsBucket string = "job_events"
+
+type JobEventType string
+
+const (
+	JobEnqueued  JobEventType = "enqueued"
+	JobStarted   JobEventType = "started"
+	JobCompleted JobEventType = "completed"
+	// Reported by the runner as soon as a step is over
+	JobStepFinished JobEventType = "step_finished"
+	// Named after the event as JobCancelled is the state of the job
+	JobCancelledEvent JobEventType = "cancelled"
+	// A commit not built as asked by its message
+	JobSkippedEvent JobEventType = "skipped"
+)
+
+// A change in the state of a job, the cursor is a strictly increasing
+// sequence number consumers use to resume the stream where they left off
+type JobEvent struct {
+	Cursor    uint64       `json:"cursor"`
+	Type      JobEventType `json:"type"`
+	JobId     string       `json:"job_id"`
+	Commit    Commit       `json:"commit"`
+	Runner    string       `json:"runner,omitempty"`
+	Status    ResultStatus `json:"status,omitempty"`
+	Timestamp time.Time    `json:"timestamp"`
+	// Annotations set by the steps, only on completed events
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Why the job failed, only on failed completed events
+	Category FailureCategory `json:"category,omitempty"`
+	// Result of the step, only on step finished events
+	Step *StepResult `json:"step,omitempty"`
+}
+
+// EventLog retains the latest job events, persisted in the store so that the
+// cursors survive a restart. Consumers read them by cursor and acknowledge
+// implicitly by asking for the following ones, which gives at-least-once
+// delivery as long as they don't fall behind the retention window.
+type EventLog struct {
+	mutex   sync.Mutex
+	store   Store
+	events  []JobEvent
+	next    uint64
+	changed chan struct{}
+}
+
+// NewEventLog loads the events retained in the store
+func NewEventLog(store Store) (*EventLog, error) {
+	l := &EventLog{store: store, events: []JobEvent{}, next: 1, changed: make(chan struct{})}
+	values, err := store.List(jobEventsBucket, "")
+	if err != nil {
+		return l, err
+	}
+	for _, value := range values {
+		var event JobEvent
+		if err := json.Unmarshal(value, &event); err != nil {
+			return l, err
+		}
+		l.events = append(l.events, event)
+		l.next = event.Cursor + 1
+	}
+	return l, nil
+}
+
+// Keys are zero padded for the store to list the events in cursor order
+func eventKey(cursor uint64) string {
+	return fmt.Sprintf("%020d", cursor)
+}
+
+// Append stores an event assigning it the next cursor, waking up every
+// consumer waiting for new events
+func (l *EventLog) Append(event JobEvent) JobEvent {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	event.Cursor = l.next
+	event.Timestamp = time.Now()
+	l.next++
+	l.events = append(l.events, event)
+	if value, err := json.Marshal(event); err != nil {
+		log.Printf("Error encoding event %d: %v\n", event.Cursor, err)
+	} else if err := l.store.Put(jobEventsBucket, eventKey(event.Cursor), value); err != nil {
+		log.Printf("Error storing event %d: %v\n", event.Cursor, err)
+	}
+	if len(l.events) > eventLogSize {
+		for _, evicted := range l.events[:len(l.events)-eventLogSize] {
+			if err := l.store.Delete(jobEventsBucket, eventKey(evicted.Cursor)); err != nil {
+				log.Printf("Error evicting event %d: %v\n", evicted.Cursor, err)
+			}
+		}
+		l.events = l.events[len(l.events)-eventLogSize:]
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return event
+}
+
+// Since returns at most limit events following the given cursor, and true if
+// some of the events requested were already evicted
+func (l *EventLog) Since(cursor uint64, limit int) ([]JobEvent, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	events := []JobEvent{}
+	truncated := len(l.events) > 0 && l.events[0].Cursor > cursor+1
+	for _, event := range l.events {
+		if event.Cursor <= cursor {
+			continue
+		}
+		if len(events) == limit {
+			break
+		}
+		events = append(events, event)
+	}
+	return events, truncated
+}
+
+// Wait blocks until an event following the cursor is available or the
+// context is done
+func (l *EventLog) Wait(ctx context.Context, cursor uint64) {
+	for {
+		l.mutex.Lock()
+		available, changed := l.next-1 > cursor, l.changed
+		l.mutex.Unlock()
+		if available {
+			return
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
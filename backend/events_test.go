@@ -0,0 +1,117 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEventLogResumeFromCursor(t *testing.T) {
+	store := NewMemoryStore()
+	events, _ := NewEventLog(store)
+	events.Append(JobEvent{Type: JobEnqueued, Commit: Commit{Id: "a"}})
+	events.Append(JobEvent{Type: JobStarted, Commit: Commit{Id: "a"}})
+	events.Append(JobEvent{Type: JobCompleted, Commit: Commit{Id: "a"}})
+
+	batch, truncated := events.Since(0, 2)
+	if truncated || len(batch) != 2 || batch[1].Cursor != 2 {
+		t.Fatalf("EventLog.Since failed: unexpected batch %v", batch)
+	}
+	batch, _ = events.Since(batch[1].Cursor, 2)
+	if len(batch) != 1 || batch[0].Type != JobCompleted {
+		t.Errorf("EventLog.Since failed: unexpected batch %v", batch)
+	}
+
+	// Consumers resume where they left off after a restart
+	restarted, err := NewEventLog(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, _ = restarted.Since(2, 10)
+	if len(batch) != 1 || batch[0].Type != JobCompleted || batch[0].Cursor != 3 {
+		t.Errorf("NewEventLog failed: expected the completed event got %v", batch)
+	}
+	if event := restarted.Append(JobEvent{Type: JobEnqueued}); event.Cursor != 4 {
+		t.Errorf("EventLog.Append failed: expected cursor 4 got %d", event.Cursor)
+	}
+}
+
+func TestEventLogWait(t *testing.T) {
+	events, _ := NewEventLog(NewMemoryStore())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		events.Append(JobEvent{Type: JobEnqueued})
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	events.Wait(ctx, 0)
+	if ctx.Err() != nil {
+		t.Errorf("EventLog.Wait failed: timed out waiting for an event")
+	}
+}
+
+func TestEventsSocket(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil)
+	jobId := d.enqueue(Commit{Id: "a", Repository: Repository{GitHub, "octocat/test", "dev"}})
+	server := httptest.NewServer(eventsHandler(d))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?cursor=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Step results reported by the runner are published as they arrive
+	runner := &Runner{}
+	req := RunnerRequest{JobId: jobId, JobToken: d.jobTokens.Issue(jobId)}
+	go func() {
+		jobs := httptest.NewServer(jobsHandler(d))
+		defer jobs.Close()
+		req.APIURL = jobs.URL
+		runner.reportStep(req, StepResult{Name: "build", Status: StepSuccess})
+	}()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for _, expected := range []JobEventType{JobEnqueued, JobStepFinished} {
+		var event JobEvent
+		if err := conn.ReadJSON(&event); err != nil {
+			t.Fatalf("eventsSocketHandler failed: %v", err)
+		}
+		if event.Type != expected || event.JobId != jobId {
+			t.Errorf("eventsSocketHandler failed: expected %s event got %v", expected, event)
+		}
+		if expected == JobStepFinished && (event.Step == nil || event.Step.Name != "build") {
+			t.Errorf("eventsSocketHandler failed: unexpected step %v", event.Step)
+		}
+	}
+}
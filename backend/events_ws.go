@@ -0,0 +1,126 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Timings of the WebSocket event streams, subscribers not answering a ping
+// within pongWait are dropped
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	// Events are read-only and carry no credentials, any origin is fine
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// eventsSocketHandler publishes the job events on a WebSocket, one JSON
+// message per event, e.g. GET /events?cursor=42 with the upgrade headers.
+// Subscribers resume from the cursor of the last event received, truncated
+// streams are not notified as with polling, a gap in the cursors tells it.
+// Only the events of the visible repositories are published.
+func eventsSocketHandler(events *EventLog, visible func(string) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var cursor uint64
+		if c := r.URL.Query().Get("cursor"); c != "" {
+			var err error
+			if cursor, err = strconv.ParseUint(c, 10, 64); err != nil {
+				http.Error(w, "invalid cursor", http.StatusBadRequest)
+				return
+			}
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// The upgrader already answered with an error
+			return
+		}
+		defer conn.Close()
+
+		// Subscribers are not expected to send anything but control frames,
+		// reading them is needed to notice a closed connection
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		go func() {
+			defer cancel()
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+
+		lastPing := time.Now()
+		for {
+			if time.Since(lastPing) >= wsPingPeriod {
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+					return
+				}
+				lastPing = time.Now()
+			}
+			batch, _ := events.Since(cursor, 100)
+			for _, event := range batch {
+				if !visible(event.Commit.GetRepositoryName()) {
+					cursor = event.Cursor
+					continue
+				}
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				if err := conn.WriteJSON(event); err != nil {
+					log.Printf("Error publishing events to %s: %v\n", r.RemoteAddr, err)
+					return
+				}
+				cursor = event.Cursor
+			}
+			if len(batch) > 0 {
+				continue
+			}
+			waitCtx, stop := context.WithDeadline(ctx, lastPing.Add(wsPingPeriod))
+			events.Wait(waitCtx, cursor)
+			stop()
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
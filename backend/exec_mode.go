@@ -0,0 +1,199 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"io"
+	"io/ioutil"
+)
+
+// Modes of execution of the steps of a pipeline
+const (
+	// Every step runs in a container of its own, the default
+	containerMode string = "container"
+	// Every step runs through an exec inside a single container kept alive
+	// for the whole job, saving the startup of a container per step
+	execMode string = "exec"
+)
+
+// Command keeping the job container alive while its steps are executed
+var jobContainerCmd = []string{"/bin/sh", "-c", "trap 'exit 0' TERM; while :; do sleep 3600 & wait; done"}
+
+// validateMode checks the execution mode of the pipeline, empty meaning the
+// default one
+func (c *CIConfig) validateMode() error {
+	switch c.Mode {
+	case "", containerMode, execMode:
+		return nil
+	}
+	return fmt.Errorf("unknown pipeline mode %q, expected %s or %s", c.Mode, containerMode, execMode)
+}
+
+// execSteps tells if the steps run inside a single job container
+func (c *CIConfig) execSteps() bool {
+	return c.Mode == execMode
+}
+
+// startJobContainer creates and starts the long-lived container the steps of
+// a job in exec mode run in, labelled like the job resources with no step.
+// With cacheDependencies it runs the cached image with the dependencies of
+// every step installed, building it on the first use with the output of the
+// install written to logs. It's up to the caller to remove it once the job is
+// over.
+func startJobContainer(labels map[string]string, ciConfig *CIConfig, dir, user, network string,
+	cacheDependencies bool, logs io.Writer) (string, error) {
+	ctx := context.Background()
+	cli, err := docker.NewEnvClient()
+	if err != nil {
+		return "", err
+	}
+
+	reader, err := cli.ImagePull(ctx, ciConfig.ImageName, types.ImagePullOptions{})
+	if err != nil {
+		return "", err
+	}
+	io.Copy(ioutil.Discard, reader)
+	reader.Close()
+
+	image := ciConfig.ImageName
+	if dependencies := ciConfig.dependencies(); cacheDependencies && len(dependencies) > 0 {
+		step := Step{Name: "dependencies", Dependencies: dependencies}
+		if image, _, err = dependencyImage(ctx, cli, image, step, logs); err != nil {
+			return "", err
+		}
+	}
+
+	resp, err := cli.ContainerCreate(ctx, &container.Config{
+		Image:      image,
+		Cmd:        jobContainerCmd,
+		WorkingDir: workspaceDir,
+		User:       user,
+		Tty:        false,
+		Labels:     labels,
+	}, &container.HostConfig{
+		Binds:       []string{dir + ":" + workspaceDir},
+		NetworkMode: container.NetworkMode(network),
+	}, nil, "")
+	if err != nil {
+		return "", err
+	}
+	if err := cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		cli.ContainerRemove(ctx, resp.ID, types.ContainerRemoveOptions{Force: true})
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// removeJobContainer removes the container of a job in exec mode
+func removeJobContainer(containerId string) error {
+	cli, err := docker.NewEnvClient()
+	if err != nil {
+		return err
+	}
+	return cli.ContainerRemove(context.Background(), containerId, types.ContainerRemoveOptions{Force: true})
+}
+
+// installExecConfig returns the exec installing the dependencies of a step
+// in the job container, as root whatever user the steps run as
+func installExecConfig(step Step) types.ExecConfig {
+	return types.ExecConfig{
+		User:         rootUser,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          installCommand(step),
+	}
+}
+
+// runExec executes a command inside a running container, streaming its
+// output to the given writer until it exits
+func runExec(ctx context.Context, cli *docker.Client, containerId string, config types.ExecConfig,
+	logs io.Writer) (types.ContainerExecInspect, error) {
+	exec, err := cli.ContainerExecCreate(ctx, containerId, config)
+	if err != nil {
+		return types.ContainerExecInspect{}, err
+	}
+	attach, err := cli.ContainerExecAttach(ctx, exec.ID, config)
+	if err != nil {
+		return types.ContainerExecInspect{}, err
+	}
+	// The stream ends as soon as the command exits
+	stdcopy.StdCopy(logs, logs, attach.Reader)
+	attach.Close()
+	return cli.ContainerExecInspect(ctx, exec.ID)
+}
+
+// execStep executes a step inside the running job container, streaming its
+// output to the given writer, the artifacts of the step are handed to upload
+// once it's over, if set. Its dependencies are installed first with install,
+// unless the job container runs the cached image having them. Mirrors
+// runContainer, except for the container being shared by every step of the
+// job.
+func execStep(containerId string, ciConfig *CIConfig, step Step, user string, install bool,
+	logs io.Writer, upload func(p string, archive io.Reader) error) error {
+	ctx := context.Background()
+	cli, err := docker.NewEnvClient()
+	if err != nil {
+		return err
+	}
+
+	if install && len(step.Dependencies) > 0 {
+		info, err := runExec(ctx, cli, containerId, installExecConfig(step), logs)
+		if err != nil {
+			return err
+		}
+		if info.ExitCode != 0 {
+			return &ExitError{Step: step.Name, Code: info.ExitCode}
+		}
+	}
+	// The container is shared by the steps, one of them may have run out of
+	// memory already
+	before := inspectContainerState(ctx, cli, containerId)
+	info, err := runExec(ctx, cli, containerId, types.ExecConfig{
+		User:         user,
+		AttachStdout: true,
+		AttachStderr: true,
+		Env:          stepEnv(ciConfig.Env, step),
+		Cmd:          stepCommand(step),
+	}, logs)
+	if err != nil {
+		return err
+	}
+	if upload != nil {
+		collectArtifacts(ctx, cli, containerId, step, upload)
+	}
+	if info.ExitCode != 0 {
+		return exitError(step.Name, info.ExitCode, before,
+			inspectContainerState(ctx, cli, containerId), true)
+	}
+	return nil
+}
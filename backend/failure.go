@@ -0,0 +1,91 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+// FailureCategory tells why a step or a job failed, e.g. to tell apart
+// failing tests from a broken runner. Pipelines may declare their own
+// categories for given exit codes of a step.
+type FailureCategory string
+
+const (
+	// The step command exited with a non-zero code
+	FailureTest FailureCategory = "test_failure"
+	// The step could not run at all, e.g. the image pull or the clone failed
+	FailureInfra FailureCategory = "infra_failure"
+	// The container was killed by the kernel running out of memory
+	FailureOOMKilled FailureCategory = "oom_killed"
+	// The container was killed by SIGKILL, e.g. on reaching a resource limit
+	FailureResourceKilled FailureCategory = "resource_killed"
+)
+
+// categorize returns the failure category of a step given the error of its
+// execution, a kill takes precedence over the categories declared by the
+// pipeline
+func (s Step) categorize(err error) FailureCategory {
+	exitErr, ok := err.(*ExitError)
+	switch {
+	case err == nil:
+		return ""
+	case !ok:
+		return FailureInfra
+	case exitErr.OOMKilled:
+		return FailureOOMKilled
+	case exitErr.ResourceKilled():
+		return FailureResourceKilled
+	}
+	if category, ok := s.Failures[exitErr.Code]; ok {
+		return FailureCategory(category)
+	}
+	return FailureTest
+}
+
+// failureCategory returns the category of the first failed step, steps
+// following it are skipped
+func failureCategory(steps []StepResult) FailureCategory {
+	for _, step := range steps {
+		if step.Status == StepFailure {
+			return step.Category
+		}
+	}
+	return ""
+}
+
+// Counters of the steps killed, by failure category
+var killedStepsMetrics = map[FailureCategory]string{
+	FailureOOMKilled:      "narwhal_oom_killed_steps_total",
+	FailureResourceKilled: "narwhal_resource_killed_steps_total",
+}
+
+// countKilledSteps records the steps killed out of memory or on a resource
+// limit
+func (d *Dispatcher) countKilledSteps(steps []StepResult) {
+	for _, step := range steps {
+		if name, ok := killedStepsMetrics[step.Category]; ok {
+			d.metrics.Inc(name)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+)
+
+// Most annotations accepted by GitHub for each request on a check run
+const maxCheckAnnotations int = 50
+
+// JobReport is the state of a job handed to the JobReporter, with its steps
+// and output once done
+type JobReport struct {
+	Job   Job
+	Steps []StepResult
+	Logs  []byte
+}
+
+// JobReporter follows every job upstream as it's queued, started and
+// finished, e.g. as a check run on the hosting service
+type JobReporter interface {
+	ReportJob(report JobReport) error
+}
+
+// WithJobReporter reports the progress of every job, along with the details
+// of its outcome, through the given reporter
+func WithJobReporter(reporter JobReporter) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.jobReporter = reporter
+	}
+}
+
+// reportJob hands the current state of a job to the job reporter, if any,
+// failures are logged as they must not stop the dispatching. The reports of
+// a job are serialized, e.g. so that a single check run is created for it
+// and a stale state doesn't overwrite the latest.
+func (d *Dispatcher) reportJob(jobId string) {
+	if d.jobReporter == nil {
+		return
+	}
+	d.reportLocks.Lock(jobId)
+	defer d.reportLocks.Unlock(jobId)
+	job, err := d.jobs.Get(jobId)
+	if err != nil {
+		log.Printf("Error reporting job %s: %v\n", jobId, err)
+		return
+	}
+	report := JobReport{Job: job}
+	if job.Done() {
+		report.Steps, _ = getStepResults(d.store, jobId)
+		report.Logs, _ = d.logs.Read(jobId, 0)
+	}
+	if err := d.jobReporter.ReportJob(report); err != nil {
+		log.Printf("Error reporting job %s: %v\n", jobId, err)
+	}
+}
+
+var (
+	// Location of a failed test assertion, e.g. "    calc_test.go:12: want 2"
+	testFailureLine = regexp.MustCompile(`^\s+([\w./-]+\.go):(\d+): (.+)$`)
+	// Location of a build error, e.g. "./calc.go:3:9: undefined: x"
+	buildErrorLine = regexp.MustCompile(`^(?:\./)?([\w./-]+\.go):(\d+):(?:\d+:)? (.+)$`)
+)
+
+// packageDir returns the path of a Go package relative to the root of the
+// repository, assuming the module is named after the repository URL
+func packageDir(pkg, repository string) string {
+	for _, host := range []string{"github.com/", "gitlab.com/", "bitbucket.org/"} {
+		module := host + repository
+		if pkg == module {
+			return ""
+		} else if strings.HasPrefix(pkg, module+"/") {
+			return strings.TrimPrefix(pkg, module+"/") + "/"
+		}
+	}
+	return ""
+}
+
+func annotation(path string, line int, title, message string) *github.CheckRunAnnotation {
+	return &github.CheckRunAnnotation{
+		Path:            github.String(path),
+		StartLine:       github.Int(line),
+		EndLine:         github.Int(line),
+		AnnotationLevel: github.String("failure"),
+		Title:           github.String(title),
+		Message:         github.String(message),
+	}
+}
+
+// checkAnnotations locates the failed tests of the steps and the build errors
+// printed in the logs of a job in the files of the repository
+func checkAnnotations(report JobReport) []*github.CheckRunAnnotation {
+	annotations := []*github.CheckRunAnnotation{}
+	for _, step := range report.Steps {
+		if step.Tests == nil {
+			continue
+		}
+		for _, pkg := range step.Tests.Packages {
+			for _, failure := range pkg.Failures {
+				for _, line := range strings.Split(failure.Output, "\n") {
+					match := testFailureLine.FindStringSubmatch(line)
+					if match == nil {
+						continue
+					}
+					n, _ := strconv.Atoi(match[2])
+					path := packageDir(pkg.Name, report.Job.Commit.GetRepositoryName()) + match[1]
+					annotations = append(annotations, annotation(path, n, failure.Test+" failed", match[3]))
+					break
+				}
+			}
+		}
+	}
+	if report.Job.State == JobFailed {
+		for _, line := range logLines(report.Logs) {
+			text := ParseLogLine(line).Text
+			match := buildErrorLine.FindStringSubmatch(strings.TrimRight(string(text), "\r\n"))
+			if match == nil {
+				continue
+			}
+			n, _ := strconv.Atoi(match[2])
+			annotations = append(annotations, annotation(match[1], n, "Build error", match[3]))
+		}
+	}
+	if len(annotations) > maxCheckAnnotations {
+		annotations = annotations[:maxCheckAnnotations]
+	}
+	return annotations
+}
+
+// checkSummary renders the outcome of the steps of a job in markdown
+func checkSummary(report JobReport) string {
+	var b strings.Builder
+	if report.Job.Error != "" {
+		fmt.Fprintf(&b, "%s\n\n", report.Job.Error)
+	}
+	for _, step := range report.Steps {
+		fmt.Fprintf(&b, "- **%s**: %s", step.Name, step.Status)
+		if step.Tests != nil {
+			fmt.Fprintf(&b, ", %d passed, %d failed, %d skipped tests",
+				step.Tests.Passed, step.Tests.Failed, step.Tests.Skipped)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// GitHubChecksReporter creates a check run for every job of the GitHub
+// repositories, following its state and attaching to its completion the
+// failed tests and the build errors as annotations. It authenticates as a
+// GitHub App installation, the Checks API refusing personal access tokens.
+type GitHubChecksReporter struct {
+	mutex     sync.Mutex
+	client    *github.Client
+	publicURL string
+	// Check runs of the jobs not yet completed, by job ID
+	runs map[string]int64
+}
+
+func NewGitHubChecksReporter(app *GitHubApp, publicURL string) *GitHubChecksReporter {
+	httpClient := &http.Client{Transport: app, Timeout: 15 * time.Second}
+	return &GitHubChecksReporter{
+		client:    github.NewClient(httpClient),
+		publicURL: strings.TrimRight(publicURL, "/"),
+		runs:      map[string]int64{},
+	}
+}
+
+func (g *GitHubChecksReporter) ReportJob(report JobReport) error {
+	job := report.Job
+	parts := strings.SplitN(job.Commit.GetRepositoryName(), "/", 2)
+	if job.Commit.Repository.HostingService != GitHub || len(parts) != 2 {
+		return nil
+	}
+	status, conclusion := "queued", ""
+	switch job.State {
+	case JobRunning:
+		status = "in_progress"
+	case JobSuccess:
+		status, conclusion = "completed", "success"
+	case JobFailed:
+		status, conclusion = "completed", "failure"
+	case JobCancelled:
+		status, conclusion = "completed", "cancelled"
+	case JobSkipped:
+		status, conclusion = "completed", "skipped"
+	}
+	var output *github.CheckRunOutput
+	var completedAt *github.Timestamp
+	if conclusion != "" {
+		annotations := checkAnnotations(report)
+		output = &github.CheckRunOutput{
+			Title:       github.String("Build " + conclusion),
+			Summary:     github.String(checkSummary(report)),
+			Annotations: annotations,
+		}
+		completedAt = &github.Timestamp{Time: time.Now()}
+		if job.FinishedAt != nil {
+			completedAt.Time = *job.FinishedAt
+		}
+	}
+	var detailsURL *string
+	if g.publicURL != "" {
+		detailsURL = github.String(g.publicURL + "/jobs/" + job.Id)
+	}
+	ctx := context.Background()
+	g.mutex.Lock()
+	id, ok := g.runs[job.Id]
+	g.mutex.Unlock()
+	if !ok {
+		opts := github.CreateCheckRunOptions{
+			Name:        statusContext,
+			HeadSHA:     job.Commit.Id,
+			DetailsURL:  detailsURL,
+			ExternalID:  github.String(job.Id),
+			Status:      github.String(status),
+			Output:      output,
+			CompletedAt: completedAt,
+		}
+		if conclusion != "" {
+			opts.Conclusion = github.String(conclusion)
+		}
+		if job.StartedAt != nil {
+			opts.StartedAt = &github.Timestamp{Time: *job.StartedAt}
+		}
+		run, _, err := g.client.Checks.CreateCheckRun(ctx, parts[0], parts[1], opts)
+		if err != nil {
+			return err
+		}
+		if conclusion == "" {
+			g.mutex.Lock()
+			g.runs[job.Id] = run.GetID()
+			g.mutex.Unlock()
+		}
+		return nil
+	}
+	opts := github.UpdateCheckRunOptions{
+		Name:        statusContext,
+		DetailsURL:  detailsURL,
+		Status:      github.String(status),
+		Output:      output,
+		CompletedAt: completedAt,
+	}
+	if conclusion != "" {
+		opts.Conclusion = github.String(conclusion)
+		g.mutex.Lock()
+		delete(g.runs, job.Id)
+		g.mutex.Unlock()
+	}
+	_, _, err := g.client.Checks.UpdateCheckRun(ctx, parts[0], parts[1], id, opts)
+	return err
+}
@@ -0,0 +1,149 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckAnnotations(t *testing.T) {
+	commit := Commit{Repository: Repository{HostingService: GitHub, Name: "octocat/calc"}}
+	job := NewJob("job-1", commit)
+	job.State = JobFailed
+	steps := []StepResult{{Name: "test", Status: StepFailure, Tests: &TestSummary{
+		Failed: 1,
+		Packages: []PackageResult{{
+			Name: "github.com/octocat/calc/sum",
+			Failures: []TestFailure{{
+				Test:   "TestSum",
+				Output: "=== RUN   TestSum\n    sum_test.go:12: expected 4 got 5\n--- FAIL: TestSum (0.00s)\n",
+			}},
+		}},
+	}}}
+	logs := []byte("[0.002] ::narwhal::step-start {\"step\":\"build\"}\n[1.250] ./div.go:3:9: undefined: x\nok\n")
+	annotations := checkAnnotations(JobReport{Job: job, Steps: steps, Logs: logs})
+	if len(annotations) != 2 {
+		t.Fatalf("Expected 2 annotations got %d", len(annotations))
+	}
+	if a := annotations[0]; a.GetPath() != "sum/sum_test.go" || a.GetStartLine() != 12 ||
+		a.GetMessage() != "expected 4 got 5" {
+		t.Errorf("Unexpected test failure annotation %v", a)
+	}
+	if a := annotations[1]; a.GetPath() != "div.go" || a.GetStartLine() != 3 ||
+		a.GetMessage() != "undefined: x" {
+		t.Errorf("Unexpected build error annotation %v", a)
+	}
+}
+
+func TestGitHubChecksReporter(t *testing.T) {
+	var requests []string
+	var completed map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/app/installations/34/access_tokens" {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"token": "ghs_1", "expires_at": "` + time.Now().Add(time.Hour).Format(time.RFC3339) + `"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer ghs_1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Method == http.MethodPatch {
+			json.NewDecoder(r.Body).Decode(&completed)
+		}
+		w.Write([]byte(`{"id": 42}`))
+	}))
+	defer server.Close()
+	reporter := NewGitHubChecksReporter(newTestGitHubApp(t, server.URL), "http://narwhal.local")
+	reporter.client.BaseURL, _ = url.Parse(server.URL + "/")
+	commit := Commit{Id: "abc", Repository: Repository{HostingService: GitHub, Name: "octocat/calc"}}
+	job := NewJob("job-1", commit)
+	if err := reporter.ReportJob(JobReport{Job: job}); err != nil {
+		t.Fatal(err)
+	}
+	job.Transition(JobRunning)
+	job.Transition(JobSuccess)
+	if err := reporter.ReportJob(JobReport{Job: job}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"POST /repos/octocat/calc/check-runs", "PATCH /repos/octocat/calc/check-runs/42"}
+	if len(requests) != 2 || requests[0] != expected[0] || requests[1] != expected[1] {
+		t.Errorf("Expected requests %v got %v", expected, requests)
+	}
+	if completed["status"] != "completed" || completed["conclusion"] != "success" {
+		t.Errorf("Expected the check run completed got %v", completed)
+	}
+	if len(reporter.runs) != 0 {
+		t.Errorf("Expected the completed check run to be forgotten")
+	}
+}
+
+// overlapReporter records whether reports of the same job overlapped
+type overlapReporter struct {
+	mutex      sync.Mutex
+	reporting  map[string]bool
+	overlapped bool
+}
+
+func (o *overlapReporter) ReportJob(report JobReport) error {
+	o.mutex.Lock()
+	if o.reporting[report.Job.Id] {
+		o.overlapped = true
+	}
+	o.reporting[report.Job.Id] = true
+	o.mutex.Unlock()
+	time.Sleep(time.Millisecond)
+	o.mutex.Lock()
+	o.reporting[report.Job.Id] = false
+	o.mutex.Unlock()
+	return nil
+}
+
+func TestReportJobSerialized(t *testing.T) {
+	reporter := &overlapReporter{reporting: map[string]bool{}}
+	d := NewDispatcher("commits", time.Second, nil, WithJobReporter(reporter))
+	jobId := d.enqueue(Commit{Id: "abc", Repository: Repository{GitHub, "octocat/calc", "master"}})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.reportJob(jobId)
+		}()
+	}
+	wg.Wait()
+	if reporter.overlapped {
+		t.Errorf("Dispatcher.reportJob failed: expected the reports of a job serialized")
+	}
+}
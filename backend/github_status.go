@@ -0,0 +1,94 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+)
+
+// Context of the commit statuses set by the dispatcher
+const statusContext string = "narwhal"
+
+// States and descriptions of the GitHub commit statuses, which have no
+// running state, a running job is pending with its own description
+var gitHubStates = map[ResultStatus][2]string{
+	StatusPending: {"pending", "Queued"},
+	StatusRunning: {"pending", "Running"},
+	StatusSuccess: {"success", "Build succeeded"},
+	StatusFailure: {"failure", "Build failed"},
+}
+
+// bearerTransport authenticates every request with a token
+type bearerTransport string
+
+func (t bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+string(t))
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// GitHubStatusReporter sets the status of the commits of the GitHub
+// repositories, linking the dispatcher API answering about the commit. The
+// commits of other hosting services are only logged.
+type GitHubStatusReporter struct {
+	client    *github.Client
+	publicURL string
+}
+
+func NewGitHubStatusReporter(token, publicURL string) *GitHubStatusReporter {
+	httpClient := &http.Client{Transport: bearerTransport(token), Timeout: 15 * time.Second}
+	return &GitHubStatusReporter{github.NewClient(httpClient), strings.TrimRight(publicURL, "/")}
+}
+
+func (g *GitHubStatusReporter) ReportStatus(commit Commit, status ResultStatus) error {
+	state, ok := gitHubStates[status]
+	if commit.Repository.HostingService != GitHub || !ok {
+		return logReporter{}.ReportStatus(commit, status)
+	}
+	parts := strings.SplitN(commit.GetRepositoryName(), "/", 2)
+	if len(parts) != 2 {
+		return logReporter{}.ReportStatus(commit, status)
+	}
+	repoStatus := &github.RepoStatus{
+		State:       github.String(state[0]),
+		Description: github.String(state[1]),
+		Context:     github.String(statusContext),
+	}
+	if g.publicURL != "" {
+		query := url.Values{"repository": {commit.GetRepositoryName()}, "id": {commit.Id}}
+		repoStatus.TargetURL = github.String(g.publicURL + "/commit?" + query.Encode())
+	}
+	_, _, err := g.client.Repositories.CreateStatus(context.Background(), parts[0], parts[1],
+		commit.Id, repoStatus)
+	return err
+}
@@ -0,0 +1,107 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// States of the GitLab commit statuses
+var gitLabStates = map[ResultStatus]string{
+	StatusPending: "pending",
+	StatusRunning: "running",
+	StatusSuccess: "success",
+	StatusFailure: "failed",
+}
+
+// GitLabStatusReporter sets the build status of the commits of the GitLab
+// repositories, on gitlab.com or on a self-managed instance
+type GitLabStatusReporter struct {
+	baseURL   string
+	token     string
+	publicURL string
+	client    *http.Client
+}
+
+func NewGitLabStatusReporter(baseURL, token, publicURL string) *GitLabStatusReporter {
+	if baseURL == "" {
+		baseURL = "https://gitlab.com"
+	}
+	return &GitLabStatusReporter{
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		token:     token,
+		publicURL: strings.TrimRight(publicURL, "/"),
+		client:    &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+func (g *GitLabStatusReporter) ReportStatus(commit Commit, status ResultStatus) error {
+	state, ok := gitLabStates[status]
+	if commit.Repository.HostingService != GitLab || !ok {
+		return logReporter{}.ReportStatus(commit, status)
+	}
+	body := map[string]string{
+		"state":       state,
+		"name":        statusContext,
+		"description": "Build " + string(status),
+	}
+	if branch := commit.Repository.Branch; branch != "" {
+		body["ref"] = branch
+	}
+	if g.publicURL != "" {
+		query := url.Values{"repository": {commit.GetRepositoryName()}, "id": {commit.Id}}
+		body["target_url"] = g.publicURL + "/commit?" + query.Encode()
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	// Projects are addressed by their URL-encoded full path
+	endpoint := fmt.Sprintf("%s/api/v4/projects/%s/statuses/%s", g.baseURL,
+		url.PathEscape(commit.GetRepositoryName()), commit.Id)
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("PRIVATE-TOKEN", g.token)
+	res, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("GitLab answered with status %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGitLabStatusReporter(t *testing.T) {
+	var path, token string
+	var status map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, token = r.URL.RawPath, r.Header.Get("PRIVATE-TOKEN")
+		json.NewDecoder(r.Body).Decode(&status)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	reporter := HostingReporter{GitLab: NewGitLabStatusReporter(server.URL, "secret", "")}
+	commit := Commit{Id: "abc", Repository: Repository{HostingService: GitLab, Name: "group/calc", Branch: "main"}}
+	if err := reporter.ReportStatus(commit, StatusFailure); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/api/v4/projects/group%2Fcalc/statuses/abc" || token != "secret" {
+		t.Errorf("Unexpected request to %s authenticated by %q", path, token)
+	}
+	if status["state"] != "failed" || status["ref"] != "main" || status["name"] != statusContext {
+		t.Errorf("Unexpected status %v", status)
+	}
+	// Commits of other hosting services are only logged
+	path = ""
+	commit.Repository.HostingService = GitHub
+	if err := reporter.ReportStatus(commit, StatusRunning); err != nil || path != "" {
+		t.Errorf("Expected the GitHub commit not to be reported to GitLab")
+	}
+}
@@ -0,0 +1,177 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Test output formats the runner can parse out of the output of a step
+const goTestJSONFormat string = "go-json"
+
+// Max output kept for each failed test, the head is the most telling part
+const maxTestFailureOutput int = 8 * 1024
+
+// TestFailure is a failed test along with its output
+type TestFailure struct {
+	Test   string `json:"test"`
+	Output string `json:"output,omitempty"`
+}
+
+// PackageResult summarizes the tests of a package
+type PackageResult struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	Elapsed  float64       `json:"elapsed_seconds"`
+	Passed   int           `json:"passed"`
+	Failed   int           `json:"failed"`
+	Skipped  int           `json:"skipped"`
+	Failures []TestFailure `json:"failures,omitempty"`
+}
+
+// TestSummary is the structured result of the tests run by a step
+type TestSummary struct {
+	Passed   int             `json:"passed"`
+	Failed   int             `json:"failed"`
+	Skipped  int             `json:"skipped"`
+	Elapsed  float64         `json:"elapsed_seconds"`
+	Packages []PackageResult `json:"packages"`
+}
+
+// goTestEvent is a line of the output of go test -json, see go doc
+// test2json
+type goTestEvent struct {
+	Time    time.Time
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+// goTestParser reads the output of go test -json written into it, ignoring
+// any line that is not a test event, e.g. the output of the dependencies
+// installation
+type goTestParser struct {
+	mutex    sync.Mutex
+	partial  bytes.Buffer
+	packages map[string]*PackageResult
+	outputs  map[string]*bytes.Buffer
+}
+
+func newGoTestParser() *goTestParser {
+	return &goTestParser{packages: map[string]*PackageResult{}, outputs: map[string]*bytes.Buffer{}}
+}
+
+func (p *goTestParser) Write(data []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.partial.Write(data)
+	for {
+		i := bytes.IndexByte(p.partial.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := p.partial.Next(i + 1)
+		var event goTestEvent
+		if json.Unmarshal(line, &event) == nil && event.Action != "" && event.Package != "" {
+			p.record(event)
+		}
+	}
+	return len(data), nil
+}
+
+// record accounts a test event, mutex held
+func (p *goTestParser) record(event goTestEvent) {
+	pkg, ok := p.packages[event.Package]
+	if !ok {
+		pkg = &PackageResult{Name: event.Package}
+		p.packages[event.Package] = pkg
+	}
+	key := event.Package + " " + event.Test
+	switch event.Action {
+	case "output":
+		if event.Test == "" {
+			return
+		}
+		output, ok := p.outputs[key]
+		if !ok {
+			output = &bytes.Buffer{}
+			p.outputs[key] = output
+		}
+		if output.Len() < maxTestFailureOutput {
+			output.WriteString(event.Output)
+		}
+	case "pass", "fail", "skip":
+		if event.Test == "" {
+			pkg.Status, pkg.Elapsed = event.Action, event.Elapsed
+			return
+		}
+		switch event.Action {
+		case "pass":
+			pkg.Passed++
+		case "skip":
+			pkg.Skipped++
+		case "fail":
+			pkg.Failed++
+			output := ""
+			if buf, ok := p.outputs[key]; ok {
+				output = buf.String()
+				if len(output) > maxTestFailureOutput {
+					output = output[:maxTestFailureOutput]
+				}
+			}
+			pkg.Failures = append(pkg.Failures, TestFailure{event.Test, output})
+		}
+		delete(p.outputs, key)
+	}
+}
+
+// Summary returns the results of the tests parsed so far, nil if none
+func (p *goTestParser) Summary() *TestSummary {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.packages) == 0 {
+		return nil
+	}
+	summary := &TestSummary{Packages: make([]PackageResult, 0, len(p.packages))}
+	for _, pkg := range p.packages {
+		summary.Passed += pkg.Passed
+		summary.Failed += pkg.Failed
+		summary.Skipped += pkg.Skipped
+		summary.Elapsed += pkg.Elapsed
+		summary.Packages = append(summary.Packages, *pkg)
+	}
+	sort.Slice(summary.Packages, func(i, j int) bool {
+		return summary.Packages[i].Name < summary.Packages[j].Name
+	})
+	return summary
+}
@@ -0,0 +1,66 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+const goTestOutput = `Installing dependencies
+{"Action":"run","Package":"example.com/calc","Test":"TestAdd"}
+{"Action":"output","Package":"example.com/calc","Test":"TestAdd","Output":"=== RUN   TestAdd\n"}
+{"Action":"pass","Package":"example.com/calc","Test":"TestAdd","Elapsed":0.01}
+{"Action":"run","Package":"example.com/calc","Test":"TestDiv"}
+{"Action":"output","Package":"example.com/calc","Test":"TestDiv","Output":"    calc_test.go:12: division by zero\n"}
+{"Action":"fail","Package":"example.com/calc","Test":"TestDiv","Elapsed":0.02}
+{"Action":"fail","Package":"example.com/calc","Elapsed":0.5}
+{"Action":"skip","Package":"example.com/calc/internal","Test":"TestSlow","Elapsed":0}
+{"Action":"pass","Package":"example.com/calc/internal","Elapsed":0.25}
+`
+
+func TestGoTestParser(t *testing.T) {
+	parser := newGoTestParser()
+	// Events split across writes are reassembled
+	io.Copy(parser, iotest.OneByteReader(strings.NewReader(goTestOutput)))
+	summary := parser.Summary()
+	if summary == nil || summary.Passed != 1 || summary.Failed != 1 || summary.Skipped != 1 ||
+		summary.Elapsed != 0.75 || len(summary.Packages) != 2 {
+		t.Fatalf("goTestParser failed: unexpected summary %v", summary)
+	}
+	calc := summary.Packages[0]
+	if calc.Name != "example.com/calc" || calc.Status != "fail" || len(calc.Failures) != 1 ||
+		calc.Failures[0].Test != "TestDiv" ||
+		calc.Failures[0].Output != "    calc_test.go:12: division by zero\n" {
+		t.Errorf("goTestParser failed: unexpected package result %v", calc)
+	}
+	if newGoTestParser().Summary() != nil {
+		t.Errorf("goTestParser failed: summary without tests")
+	}
+}
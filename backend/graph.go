@@ -0,0 +1,110 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Bucket of the step results of each job
+const stepsBucket string = "steps"
+
+// A step of the pipeline graph, steps are executed sequentially so each one
+// depends on the previous
+type GraphNode struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	Status     StepStatus `json:"status"`
+	StartedAt  time.Time  `json:"started_at,omitempty"`
+	FinishedAt time.Time  `json:"finished_at,omitempty"`
+	Duration   float64    `json:"duration_seconds"`
+	DependsOn  []string   `json:"depends_on"`
+	Error      string     `json:"error,omitempty"`
+}
+
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// PipelineGraph describes the steps of a job and their dependencies, ready
+// to be rendered by dashboards
+type PipelineGraph struct {
+	JobId string      `json:"job_id"`
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// NewPipelineGraph builds the graph of a job out of the results of its steps
+func NewPipelineGraph(jobId string, steps []StepResult) PipelineGraph {
+	graph := PipelineGraph{JobId: jobId, Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	previous, seen := "", map[string]bool{}
+	for i, step := range steps {
+		node := GraphNode{
+			Id:         step.Name,
+			Name:       step.Name,
+			Status:     step.Status,
+			StartedAt:  step.StartedAt,
+			FinishedAt: step.FinishedAt,
+			Duration:   step.FinishedAt.Sub(step.StartedAt).Seconds(),
+			DependsOn:  []string{},
+			Error:      step.Error,
+		}
+		// Step names are not required to be unique
+		if node.Id == "" || seen[node.Id] {
+			node.Id = fmt.Sprintf("%s#%d", node.Name, i)
+		}
+		seen[node.Id] = true
+		if previous != "" {
+			node.DependsOn = append(node.DependsOn, previous)
+			graph.Edges = append(graph.Edges, GraphEdge{previous, node.Id})
+		}
+		graph.Nodes = append(graph.Nodes, node)
+		previous = node.Id
+	}
+	return graph
+}
+
+func putStepResults(store Store, jobId string, steps []StepResult) error {
+	value, err := json.Marshal(steps)
+	if err != nil {
+		return err
+	}
+	return store.Put(stepsBucket, jobId, value)
+}
+
+func getStepResults(store Store, jobId string) ([]StepResult, error) {
+	value, err := store.Get(stepsBucket, jobId)
+	if err != nil {
+		return nil, err
+	}
+	var steps []StepResult
+	err = json.Unmarshal(value, &steps)
+	return steps, err
+}
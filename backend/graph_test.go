@@ -0,0 +1,52 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewPipelineGraph(t *testing.T) {
+	start := time.Date(2020, 11, 1, 10, 0, 0, 0, time.UTC)
+	steps := []StepResult{
+		{Name: "build", Status: StepSuccess, StartedAt: start, FinishedAt: start.Add(2 * time.Second)},
+		{Name: "test", Status: StepFailure, StartedAt: start.Add(2 * time.Second),
+			FinishedAt: start.Add(5 * time.Second), Error: "exit 1"},
+		{Name: "test", Status: StepSkipped},
+	}
+	graph := NewPipelineGraph("job-1", steps)
+	if len(graph.Nodes) != 3 || len(graph.Edges) != 2 {
+		t.Fatalf("NewPipelineGraph failed: expected 3 nodes and 2 edges got %v", graph)
+	}
+	if graph.Nodes[1].Duration != 3 || graph.Nodes[1].DependsOn[0] != "build" {
+		t.Errorf("NewPipelineGraph failed: unexpected node %v", graph.Nodes[1])
+	}
+	if graph.Nodes[2].Id == graph.Nodes[1].Id {
+		t.Errorf("NewPipelineGraph failed: duplicate node id %s", graph.Nodes[2].Id)
+	}
+}
@@ -0,0 +1,218 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/rpc"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	docker "github.com/docker/docker/client"
+)
+
+// How often an idle runner checks for images to pull
+const prePullCheckInterval time.Duration = 10 * time.Second
+
+// Images pushed by the dispatcher to a runner, replacing the previous ones
+type PrePullImagesRequest struct {
+	Images []string
+}
+
+type PrePullImagesResponse struct{}
+
+// imageUsage tracks the image each repository was last built with, those of
+// the repositories built within the window are pre-pulled by the runners
+type imageUsage struct {
+	mutex        sync.Mutex
+	window       time.Duration
+	repositories map[string]repositoryImage
+}
+
+type repositoryImage struct {
+	image   string
+	builtAt time.Time
+}
+
+// WithImagePrePull pushes to the runners the images of the repositories built
+// within the window, which they pull while idle, so the jobs don't wait on the
+// pulls after the images are updated
+func WithImagePrePull(window time.Duration) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.imageUsage = &imageUsage{window: window, repositories: map[string]repositoryImage{}}
+	}
+}
+
+// record tracks the image a repository was built with
+func (u *imageUsage) record(repository, image string, builtAt time.Time) {
+	if u == nil || image == "" {
+		return
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.repositories[repository] = repositoryImage{image, builtAt}
+}
+
+// images returns the sorted images of the repositories accepted, built within
+// the window, forgetting the ones built before
+func (u *imageUsage) images(now time.Time, accepts func(string) bool) []string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	set := map[string]bool{}
+	for repository, used := range u.repositories {
+		if now.Sub(used.builtAt) > u.window {
+			delete(u.repositories, repository)
+		} else if accepts(repository) {
+			set[used.image] = true
+		}
+	}
+	images := make([]string, 0, len(set))
+	for image := range set {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	return images
+}
+
+// pushImages sends a runner the images to pre-pull, only when they changed
+// since the last push or the runner was dialed again, e.g. after a restart
+func (d *Dispatcher) pushImages(runner *RunnerProxy) {
+	if d.imageUsage == nil {
+		return
+	}
+	images := d.imageUsage.images(d.clock.Now(), runner.Accepts)
+	runner.pushImages(images)
+}
+
+// pushImages sends the images to pre-pull unless they were already sent
+// through the current connection
+func (p *RunnerProxy) pushImages(images []string) {
+	key := strings.Join(images, ",")
+	p.mutex.Lock()
+	client := p.RpcClient
+	if client == nil || (client == p.prePullClient && key == p.prePullImages) {
+		p.mutex.Unlock()
+		return
+	}
+	p.prePullClient, p.prePullImages = client, key
+	p.mutex.Unlock()
+	client.Go("Runner.PrePullImages", PrePullImagesRequest{images}, &PrePullImagesResponse{},
+		make(chan *rpc.Call, 1))
+}
+
+// WithIdlePrePull pulls the images pushed by the dispatcher while no job is
+// running, refreshing each of them once per interval
+func WithIdlePrePull(interval time.Duration) RunnerOption {
+	return func(r *Runner) {
+		r.prePullInterval = interval
+		r.prePulledAt = map[string]time.Time{}
+	}
+}
+
+// PrePullImages replaces the images to pull while idle, ignored unless
+// enabled with WithIdlePrePull
+func (r *Runner) PrePullImages(req PrePullImagesRequest, res *PrePullImagesResponse) error {
+	if r.prePullInterval == 0 {
+		return nil
+	}
+	r.prePullMutex.Lock()
+	defer r.prePullMutex.Unlock()
+	r.prePullImages = map[string]bool{}
+	for _, image := range req.Images {
+		r.prePullImages[image] = true
+	}
+	for image := range r.prePulledAt {
+		if !r.prePullImages[image] {
+			delete(r.prePulledAt, image)
+		}
+	}
+	return nil
+}
+
+// isIdle tells if the runner has no job running
+func (r *Runner) isIdle() bool {
+	r.jobsMutex.Lock()
+	defer r.jobsMutex.Unlock()
+	return len(r.active) == 0
+}
+
+// stalePrePulls returns the images not pulled within the interval
+func (r *Runner) stalePrePulls(now time.Time) []string {
+	r.prePullMutex.Lock()
+	defer r.prePullMutex.Unlock()
+	var stale []string
+	for image := range r.prePullImages {
+		if now.Sub(r.prePulledAt[image]) >= r.prePullInterval {
+			stale = append(stale, image)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// prePullLoop pulls the stale images one at a time while the runner is idle,
+// a job starting stops it until the next check
+func (r *Runner) prePullLoop() {
+	for range time.Tick(prePullCheckInterval) {
+		for _, image := range r.stalePrePulls(time.Now()) {
+			if !r.isIdle() {
+				break
+			}
+			if err := pullImage(image); err != nil {
+				log.Printf("Unable to pre-pull image %s: %v\n", image, err)
+			}
+			// Failures are not retried before the interval either, the
+			// images dropped in the meantime are forgotten
+			r.prePullMutex.Lock()
+			if r.prePullImages[image] {
+				r.prePulledAt[image] = time.Now()
+			}
+			r.prePullMutex.Unlock()
+		}
+	}
+}
+
+// pullImage pulls the latest version of an image
+func pullImage(image string) error {
+	cli, err := docker.NewEnvClient()
+	if err != nil {
+		return err
+	}
+	reader, err := cli.ImagePull(context.Background(), image, types.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(ioutil.Discard, reader)
+	return err
+}
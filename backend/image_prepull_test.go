@@ -0,0 +1,87 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImageUsage(t *testing.T) {
+	var disabled *imageUsage
+	disabled.record("octocat/test", "golang:1.21", time.Now())
+
+	now := time.Now()
+	usage := &imageUsage{window: time.Hour, repositories: map[string]repositoryImage{}}
+	usage.record("octocat/test", "golang:1.21", now.Add(-2*time.Hour))
+	usage.record("octocat/web", "node:20", now.Add(-time.Minute))
+	usage.record("octocat/api", "golang:1.21", now)
+	usage.record("octocat/cli", "golang:1.21", now)
+	usage.record("infra/deploy", "alpine", now)
+	usage.record("octocat/empty", "", now)
+	accepts := func(repository string) bool { return strings.HasPrefix(repository, "octocat/") }
+	expected := []string{"golang:1.21", "node:20"}
+	if images := usage.images(now, accepts); !reflect.DeepEqual(images, expected) {
+		t.Errorf("imageUsage.images failed: expected %v got %v", expected, images)
+	}
+	if _, ok := usage.repositories["octocat/test"]; ok {
+		t.Errorf("imageUsage.images failed: expected the stale repository to be forgotten")
+	}
+}
+
+func TestRunnerPrePullImages(t *testing.T) {
+	r := &Runner{}
+	r.PrePullImages(PrePullImagesRequest{[]string{"golang:1.21"}}, &PrePullImagesResponse{})
+	if len(r.prePullImages) != 0 {
+		t.Errorf("Runner.PrePullImages failed: expected the images ignored when disabled")
+	}
+
+	WithIdlePrePull(time.Hour)(r)
+	now := time.Now()
+	r.PrePullImages(PrePullImagesRequest{[]string{"node:20", "golang:1.21"}}, &PrePullImagesResponse{})
+	r.prePulledAt["node:20"] = now.Add(-time.Minute)
+	expected := []string{"golang:1.21"}
+	if stale := r.stalePrePulls(now); !reflect.DeepEqual(stale, expected) {
+		t.Errorf("Runner.stalePrePulls failed: expected %v got %v", expected, stale)
+	}
+	r.prePulledAt["node:20"] = now.Add(-2 * time.Hour)
+	expected = []string{"golang:1.21", "node:20"}
+	if stale := r.stalePrePulls(now); !reflect.DeepEqual(stale, expected) {
+		t.Errorf("Runner.stalePrePulls failed: expected %v got %v", expected, stale)
+	}
+	// Dropped images are forgotten
+	r.PrePullImages(PrePullImagesRequest{[]string{"golang:1.21"}}, &PrePullImagesResponse{})
+	if _, ok := r.prePulledAt["node:20"]; ok {
+		t.Errorf("Runner.PrePullImages failed: expected node:20 to be forgotten")
+	}
+	r.trackJob("job", Commit{})
+	if r.isIdle() {
+		t.Errorf("Runner.isIdle failed: expected the runner busy")
+	}
+}
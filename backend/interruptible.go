@@ -0,0 +1,187 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"fmt"
+	"log"
+	"net/rpc"
+	"time"
+)
+
+// interruptible tells if the pipeline may be interrupted once running
+func (c *CIConfig) interruptible() bool {
+	return c.Interruptible == nil || *c.Interruptible
+}
+
+// interruptible tells if the job may still be interrupted once the step
+// started
+func (s Step) interruptible() bool {
+	return s.Interruptible == nil || *s.Interruptible
+}
+
+type InterruptJobRequest struct {
+	JobId  string
+	Reason string
+}
+
+type InterruptJobResponse struct {
+	Interrupted bool
+}
+
+// InterruptJob cancels a running job only if it's interruptible, unlike
+// CancelJob which always does. Jobs whose configuration isn't read yet, whose
+// pipeline is not interruptible or which started a step not interruptible
+// are left running.
+func (r *Runner) InterruptJob(req InterruptJobRequest, res *InterruptJobResponse) error {
+	r.jobsMutex.Lock()
+	if !r.interruptible[req.JobId] {
+		r.jobsMutex.Unlock()
+		return nil
+	}
+	if r.cancelled == nil {
+		r.cancelled = map[string]bool{}
+	}
+	r.cancelled[req.JobId] = true
+	r.jobsMutex.Unlock()
+	log.Printf("Interrupting job %s: %s\n", req.JobId, req.Reason)
+	res.Interrupted = true
+	r.chaos.release(req.JobId)
+	// The steps left are skipped anyway, even if the current one can't be
+	// killed
+	if _, err := removeJobContainers(req.JobId); err != nil {
+		log.Printf("Error removing the containers of job %s: %v\n", req.JobId, err)
+	}
+	return nil
+}
+
+// setInterruptible records whether a job may be interrupted from now on
+func (r *Runner) setInterruptible(jobId string, interruptible bool) {
+	r.jobsMutex.Lock()
+	defer r.jobsMutex.Unlock()
+	if r.interruptible == nil {
+		r.interruptible = map[string]bool{}
+	}
+	r.interruptible[jobId] = interruptible
+}
+
+// startStep returns false if the job was cancelled, otherwise the job stops
+// being interruptible if the step isn't, atomically so that an interruption
+// can't hit the step
+func (r *Runner) startStep(jobId string, step Step) bool {
+	r.jobsMutex.Lock()
+	defer r.jobsMutex.Unlock()
+	if r.cancelled[jobId] {
+		return false
+	}
+	if !step.interruptible() {
+		r.interruptible[jobId] = false
+	}
+	return true
+}
+
+// WithAutoCancel cancels the jobs of a branch superseded by a newer commit
+// submitted, pending ones or running ones if interruptible
+func WithAutoCancel() DispatcherOption {
+	return func(d *Dispatcher) {
+		d.autoCancel = true
+	}
+}
+
+// supersede cancels the pending and running jobs of the ref of a commit
+// newly submitted as its job, the branch or the pull request, running ones
+// only if their runner agrees and pending ones unless their pipeline was
+// last seen not interruptible
+func (d *Dispatcher) supersede(commit Commit, jobId string) {
+	// Tags and releases don't move their ref, they supersede nothing
+	trigger := commit.TriggeredBy()
+	if !d.autoCancel || commit.Bisect || commit.ref() == "" ||
+		(trigger != PushTrigger && trigger != PullRequestTrigger) {
+		return
+	}
+	query := JobQuery{
+		JobFilter: JobFilter{Repository: commit.GetRepositoryName()},
+		states:    []JobState{JobPending, JobRunning},
+	}
+	jobs, _, err := d.jobs.Search(query, "", maxJobsPage)
+	if err != nil {
+		log.Printf("Error looking for the jobs superseded by %s: %v\n", jobId, err)
+		return
+	}
+	reason := fmt.Sprintf("superseded by commit %s", commit.Id)
+	for _, job := range jobs {
+		if job.Id == jobId || job.Commit.Id == commit.Id || job.Commit.Bisect ||
+			job.Commit.ref() != commit.ref() {
+			continue
+		}
+		if job.State == JobPending {
+			if d.requirements(job.Commit).Uninterruptible {
+				log.Printf("Job %s not interruptible, left pending\n", job.Id)
+				continue
+			}
+			if _, err := d.cancelJob(job.Id); err == nil {
+				log.Printf("Cancelled job %s, %s\n", job.Id, reason)
+			}
+			continue
+		}
+		go d.interruptJob(job, reason)
+	}
+}
+
+// interruptJob asks the runner of a job to interrupt it, cancelling it if
+// the runner agrees
+func (d *Dispatcher) interruptJob(job Job, reason string) {
+	var runner *RunnerProxy
+	for _, r := range d.runnerList() {
+		if r.Id == job.Runner {
+			runner = r
+			break
+		}
+	}
+	if runner == nil || runner.client() == nil {
+		return
+	}
+	var res InterruptJobResponse
+	call := runner.client().Go("Runner.InterruptJob", InterruptJobRequest{job.Id, reason},
+		&res, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			log.Printf("Error interrupting job %s on runner %s: %v\n", job.Id, runner.Addr, call.Error)
+			return
+		}
+	case <-time.After(runner.Transport.merge(DefaultTransportConfig).CallTimeout):
+		return
+	}
+	if !res.Interrupted {
+		log.Printf("Job %s not interruptible, left running\n", job.Id)
+		return
+	}
+	if _, err := d.cancelJob(job.Id); err == nil {
+		log.Printf("Interrupted job %s, %s\n", job.Id, reason)
+	}
+}
@@ -0,0 +1,135 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func TestParseCIConfigInterruptible(t *testing.T) {
+	config, err := ParseCIConfig([]byte(`name: deploy
+image: alpine
+interruptible: false
+steps:
+  - name: build
+    command: make
+  - name: deploy
+    command: make deploy
+    interruptible: false
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.interruptible() || !config.Steps[0].interruptible() || config.Steps[1].interruptible() {
+		t.Errorf("ParseCIConfig failed: unexpected interruptible flags %+v", config)
+	}
+	if config, _ := ParseCIConfig([]byte("name: test\nimage: alpine\n")); !config.interruptible() {
+		t.Errorf("ParseCIConfig failed: expected pipelines interruptible by default")
+	}
+}
+
+func TestRunnerInterruptJob(t *testing.T) {
+	r := &Runner{}
+	var res InterruptJobResponse
+	if r.InterruptJob(InterruptJobRequest{JobId: "unknown"}, &res); res.Interrupted {
+		t.Errorf("Runner.InterruptJob failed: expected a job not started left alone")
+	}
+
+	r.setInterruptible("test", true)
+	if !r.startStep("test", Step{Name: "build"}) {
+		t.Fatal("Runner.startStep failed: expected the step started")
+	}
+	if r.InterruptJob(InterruptJobRequest{JobId: "test"}, &res); !res.Interrupted || !r.isCancelled("test") {
+		t.Errorf("Runner.InterruptJob failed: expected the job interrupted")
+	}
+	if r.startStep("test", Step{Name: "lint"}) {
+		t.Errorf("Runner.startStep failed: expected no step started once interrupted")
+	}
+
+	deploy := false
+	r.setInterruptible("deploy", true)
+	r.startStep("deploy", Step{Name: "deploy", Interruptible: &deploy})
+	res = InterruptJobResponse{}
+	if r.InterruptJob(InterruptJobRequest{JobId: "deploy"}, &res); res.Interrupted || r.isCancelled("deploy") {
+		t.Errorf("Runner.InterruptJob failed: expected the deploy job left running")
+	}
+}
+
+func TestDispatcherSupersede(t *testing.T) {
+	runner := &Runner{}
+	server := rpc.NewServer()
+	server.Register(runner)
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go server.ServeConn(serverConn)
+	proxy := &RunnerProxy{Id: "r1", Alive: true, RpcClient: rpc.NewClient(clientConn)}
+	d := NewDispatcher("commits", time.Second, []*RunnerProxy{proxy}, WithAutoCancel())
+
+	master := Repository{GitHub, "octocat/test", "master"}
+	pending, _ := d.submit(Commit{Id: "a", Repository: master})
+	other, _ := d.submit(Commit{Id: "b", Repository: Repository{GitHub, "octocat/test", "dev"}})
+	// A pull request from master is not on the master ref
+	pullRequest, _ := d.submit(Commit{Id: "f", Repository: master, Event: PullRequestTrigger,
+		PullRequest: &PullRequest{Number: 1, HeadRef: "refs/pull/1/head"}})
+	// The pipeline of the release branch was last seen not interruptible
+	release := Repository{GitHub, "octocat/test", "release"}
+	d.learnRequirements(Commit{Repository: release}, pipelineRequirements{Uninterruptible: true})
+	uninterruptible, _ := d.submit(Commit{Id: "g", Repository: release})
+	d.submit(Commit{Id: "h", Repository: release})
+	running := map[string]bool{}
+	for _, id := range []string{"c", "d"} {
+		job := NewJob("job-"+id, Commit{Id: id, Repository: master})
+		job.State, job.Runner = JobRunning, "r1"
+		d.jobs.Create(job)
+		running[job.Id] = id == "c"
+		runner.setInterruptible(job.Id, running[job.Id])
+	}
+	latest, _ := d.submit(Commit{Id: "e", Repository: master})
+
+	expected := map[string]JobState{pending: JobCancelled, other: JobPending, latest: JobPending,
+		pullRequest: JobPending, uninterruptible: JobPending, "job-c": JobCancelled, "job-d": JobRunning}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		states := map[string]JobState{}
+		for id := range expected {
+			job, _ := d.jobs.Get(id)
+			states[id] = job.State
+		}
+		if states["job-c"] == JobCancelled || time.Now().After(deadline) {
+			for id, state := range expected {
+				if states[id] != state {
+					t.Errorf("Expected job %s %s got %s", id, state, states[id])
+				}
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
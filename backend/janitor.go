@@ -0,0 +1,169 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	volumetypes "github.com/docker/docker/api/types/volume"
+	docker "github.com/docker/docker/client"
+)
+
+// Volumes labelled as cache survive their job, they are meant to be shared
+// by the following ones
+const cacheLabel string = "narwhal.cache"
+
+// resourcesClient is the part of the Docker client reclaiming the job volumes
+// and networks
+type resourcesClient interface {
+	VolumeList(ctx context.Context, filter filters.Args) (volumetypes.VolumesListOKBody, error)
+	VolumeRemove(ctx context.Context, volumeID string, force bool) error
+	NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error)
+	NetworkRemove(ctx context.Context, networkID string) error
+	NetworkDisconnect(ctx context.Context, networkID, containerID string, force bool) error
+}
+
+// jobNetworkName returns the name of the network shared by the steps of a
+// job
+func jobNetworkName(jobId string) string {
+	return "narwhal-" + jobId
+}
+
+// WithMetrics serves the runner metrics, e.g. the resources reclaimed by the
+// janitor, in the Prometheus format on the given address
+func WithMetrics(addr string) RunnerOption {
+	return func(r *Runner) {
+		go func() {
+			if err := http.ListenAndServe(addr, r.metrics); err != nil {
+				log.Printf("Error serving metrics: %v\n", err)
+			}
+		}()
+	}
+}
+
+// createJobNetwork creates the network of a job, labelled like its
+// containers. On failure the steps fall back to the default network.
+func (r *Runner) createJobNetwork(jobId string, commit Commit) string {
+	cli, err := docker.NewEnvClient()
+	if err == nil {
+		labels := r.containerLabels(jobId, commit, Step{})
+		delete(labels, stepLabel)
+		_, err = cli.NetworkCreate(context.Background(), jobNetworkName(jobId),
+			types.NetworkCreate{CheckDuplicate: true, Labels: labels})
+	}
+	if err != nil {
+		log.Printf("Error creating the network of job %s: %v\n", jobId, err)
+		return ""
+	}
+	return jobNetworkName(jobId)
+}
+
+// removeJobResources removes the volumes and networks of a finished job
+func (r *Runner) removeJobResources(jobId string) {
+	cli, err := docker.NewEnvClient()
+	if err != nil {
+		log.Printf("Error removing the resources of job %s: %v\n", jobId, err)
+		return
+	}
+	r.reclaim(context.Background(), cli, []string{jobIdLabel + "=" + jobId}, func(string) bool { return false })
+}
+
+// sweepJobResources removes the volumes and networks left behind by jobs of
+// the runner no longer running, e.g. killed along with a previous runner
+// process
+func (r *Runner) sweepJobResources(ctx context.Context, cli resourcesClient, keep func(string) bool) {
+	r.reclaim(ctx, cli, []string{jobIdLabel, r.ownedLabel()}, func(jobId string) bool {
+		return r.isActive(jobId) || keep(jobId)
+	})
+}
+
+// reclaim removes the job volumes and networks matching all the label
+// filters, skipping the cache volumes and the ones of the jobs to keep
+func (r *Runner) reclaim(ctx context.Context, cli resourcesClient, labels []string,
+	keep func(jobId string) bool) {
+	args := filters.NewArgs()
+	for _, label := range labels {
+		args.Add("label", label)
+	}
+	volumes, err := cli.VolumeList(ctx, args)
+	if err != nil {
+		log.Printf("Error listing job volumes: %v\n", err)
+	}
+	for _, volume := range volumes.Volumes {
+		if volume.Labels[cacheLabel] == "true" || keep(volume.Labels[jobIdLabel]) {
+			continue
+		}
+		if err := cli.VolumeRemove(ctx, volume.Name, false); err != nil {
+			log.Printf("Error removing volume %s: %v\n", volume.Name, err)
+			continue
+		}
+		r.count("narwhal_runner_reclaimed_volumes_total", 1)
+		if volume.UsageData != nil && volume.UsageData.Size > 0 {
+			r.count("narwhal_runner_reclaimed_volume_bytes_total", float64(volume.UsageData.Size))
+		}
+	}
+	networks, err := cli.NetworkList(ctx, types.NetworkListOptions{Filters: args})
+	if err != nil {
+		log.Printf("Error listing job networks: %v\n", err)
+	}
+	for _, network := range networks {
+		if keep(network.Labels[jobIdLabel]) {
+			continue
+		}
+		r.detachProxies(ctx, cli, network.ID)
+		if err := cli.NetworkRemove(ctx, network.ID); err != nil {
+			log.Printf("Error removing network %s: %v\n", network.Name, err)
+			continue
+		}
+		r.count("narwhal_runner_reclaimed_networks_total", 1)
+	}
+}
+
+// count adds to a runner metric, runners built without metrics skip it
+func (r *Runner) count(name string, value float64) {
+	if r.metrics != nil {
+		r.metrics.Add(name, value)
+	}
+}
+
+// newRunnerMetrics declares the metrics of the runner
+func newRunnerMetrics() *Metrics {
+	metrics := NewMetrics()
+	metrics.Register("narwhal_runner_reclaimed_volumes_total",
+		"Job volumes removed by the janitor")
+	metrics.Register("narwhal_runner_reclaimed_volume_bytes_total",
+		"Size of the job volumes removed by the janitor, when reported by the driver")
+	metrics.Register("narwhal_runner_reclaimed_networks_total",
+		"Job networks removed by the janitor")
+	metrics.Register("narwhal_runner_pruned_dependency_images_total",
+		"Cached dependency images removed once outdated")
+	return metrics
+}
@@ -0,0 +1,109 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	volumetypes "github.com/docker/docker/api/types/volume"
+)
+
+// fakeResources filters its volumes and networks by label like the daemon
+// does, recording the removed ones
+type fakeResources struct {
+	volumes  []*types.Volume
+	networks []types.NetworkResource
+	removed  []string
+}
+
+func (f *fakeResources) VolumeList(ctx context.Context, args filters.Args) (volumetypes.VolumesListOKBody, error) {
+	var body volumetypes.VolumesListOKBody
+	for _, volume := range f.volumes {
+		if args.MatchKVList("label", volume.Labels) {
+			body.Volumes = append(body.Volumes, volume)
+		}
+	}
+	return body, nil
+}
+
+func (f *fakeResources) VolumeRemove(ctx context.Context, volumeID string, force bool) error {
+	f.removed = append(f.removed, volumeID)
+	return nil
+}
+
+func (f *fakeResources) NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error) {
+	var networks []types.NetworkResource
+	for _, network := range f.networks {
+		if options.Filters.MatchKVList("label", network.Labels) {
+			networks = append(networks, network)
+		}
+	}
+	return networks, nil
+}
+
+func (f *fakeResources) NetworkRemove(ctx context.Context, networkID string) error {
+	f.removed = append(f.removed, networkID)
+	return nil
+}
+
+func (f *fakeResources) NetworkDisconnect(ctx context.Context, networkID, containerID string, force bool) error {
+	return nil
+}
+
+func TestSweepJobResources(t *testing.T) {
+	owned := func(runnerId, jobId string) map[string]string {
+		return map[string]string{runnerIdLabel: runnerId, jobIdLabel: jobId}
+	}
+	cache := owned("runner-1", "job-1")
+	cache[cacheLabel] = "true"
+	cli := &fakeResources{
+		volumes: []*types.Volume{
+			{Name: "finished", Labels: owned("runner-1", "job-1")},
+			{Name: "cache", Labels: cache},
+			{Name: "active", Labels: owned("runner-1", "job-2")},
+			{Name: "kept", Labels: owned("runner-1", "job-3")},
+			{Name: "other-runner", Labels: owned("runner-2", "job-4")},
+			{Name: "unlabelled", Labels: map[string]string{jobIdLabel: "job-5"}},
+		},
+		networks: []types.NetworkResource{
+			{ID: "finished-net", Labels: owned("runner-1", "job-1")},
+			{ID: "other-runner-net", Labels: owned("runner-2", "job-4")},
+		},
+	}
+	r := &Runner{id: "runner-1", active: map[string]bool{"job-2": true}}
+	r.sweepJobResources(context.Background(), cli, func(jobId string) bool { return jobId == "job-3" })
+	sort.Strings(cli.removed)
+	expected := []string{"finished", "finished-net"}
+	if !reflect.DeepEqual(cli.removed, expected) {
+		t.Errorf("sweepJobResources failed: expected %v got %v", expected, cli.removed)
+	}
+}
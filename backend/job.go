@@ -0,0 +1,337 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buckets of the jobs and of the last job of each commit
+const (
+	jobsBucket       string = "jobs"
+	commitJobsBucket string = "commit_jobs"
+)
+
+type JobState string
+
+const (
+	JobPending   JobState = "PENDING"
+	JobRunning   JobState = "RUNNING"
+	JobSuccess   JobState = "SUCCESS"
+	JobFailed    JobState = "FAILED"
+	JobCancelled JobState = "CANCELLED"
+	// Not run as asked by the commit message, see WithSkipCIPattern
+	JobSkipped JobState = "SKIPPED"
+)
+
+// ErrNotRetryable is returned retrying a job neither failed nor cancelled
+var ErrNotRetryable = errors.New("only failed, cancelled or skipped jobs can be retried")
+
+// Allowed transitions of the job state machine, SUCCESS, FAILED, CANCELLED
+// and SKIPPED are final. A RUNNING job goes back to PENDING when handed back
+// by a runner not matching the labels required by its pipeline.
+var jobTransitions = map[JobState][]JobState{
+	JobPending: {JobRunning, JobCancelled, JobSkipped},
+	JobRunning: {JobSuccess, JobFailed, JobCancelled, JobPending},
+}
+
+// Job is the execution of a commit pipeline on a runner
+type Job struct {
+	Id         string     `json:"id"`
+	Commit     Commit     `json:"commit"`
+	State      JobState   `json:"state"`
+	Runner     string     `json:"runner,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// ID of the job this one retries, if any
+	RetryOf string `json:"retry_of,omitempty"`
+	// Result reported by the runner once the job is over
+	Result *JobResult `json:"result,omitempty"`
+	// Why the job failed, only on failed jobs
+	Category FailureCategory `json:"category,omitempty"`
+	// ID of the job whose result this one reuses, if any
+	CachedFrom string `json:"cached_from,omitempty"`
+	// Hash of the effective pipeline configuration, once run
+	ConfigHash string `json:"config_hash,omitempty"`
+	// Percentage covered by the tests, if the pipeline reads a report
+	Coverage *float64 `json:"coverage,omitempty"`
+	// Name of the scheduled build triggering the job, if any
+	Schedule string `json:"schedule,omitempty"`
+	// Why a pending job is not dispatched yet, e.g. no runner matching the
+	// labels its pipeline requires
+	Waiting string `json:"waiting,omitempty"`
+}
+
+func NewJob(id string, commit Commit) Job {
+	return Job{Id: id, Commit: commit, State: JobPending, CreatedAt: time.Now()}
+}
+
+// Done returns true if the job reached a final state
+func (j *Job) Done() bool {
+	return len(jobTransitions[j.State]) == 0
+}
+
+// Transition moves the job to the given state now, see TransitionAt
+func (j *Job) Transition(state JobState) error {
+	return j.TransitionAt(state, time.Now())
+}
+
+// TransitionAt moves the job to the given state, setting its timestamps to
+// now, returning an error if the transition is not allowed
+func (j *Job) TransitionAt(state JobState, now time.Time) error {
+	for _, allowed := range jobTransitions[j.State] {
+		if allowed != state {
+			continue
+		}
+		switch state {
+		case JobPending:
+			j.StartedAt = nil
+		case JobRunning:
+			j.StartedAt = &now
+		default:
+			j.FinishedAt = &now
+		}
+		j.State = state
+		return nil
+	}
+	return fmt.Errorf("job %s: invalid transition from %s to %s", j.Id, j.State, state)
+}
+
+// JobStore persists the jobs on top of a Store, indexing the last job of
+// each commit and the fields searched by Search
+type JobStore struct {
+	mutex sync.Mutex
+	store Store
+}
+
+func NewJobStore(store Store) *JobStore {
+	return &JobStore{store: store}
+}
+
+func (s *JobStore) put(job Job) error {
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(jobsBucket, job.Id, value)
+}
+
+// Create stores a new job, making it the last one of its commit
+func (s *JobStore) Create(job Job) error {
+	if err := s.put(job); err != nil {
+		return err
+	}
+	if err := s.index(job); err != nil {
+		return err
+	}
+	return s.store.Put(commitJobsBucket,
+		commitKey(job.Commit.GetRepositoryName(), job.Commit.Id), []byte(job.Id))
+}
+
+func (s *JobStore) Get(id string) (Job, error) {
+	var job Job
+	value, err := s.store.Get(jobsBucket, id)
+	if err != nil {
+		return job, err
+	}
+	err = json.Unmarshal(value, &job)
+	return job, err
+}
+
+// GetByCommit returns the last job of a commit
+func (s *JobStore) GetByCommit(repository, commitId string) (Job, error) {
+	id, err := s.store.Get(commitJobsBucket, commitKey(repository, commitId))
+	if err != nil {
+		return Job{}, err
+	}
+	return s.Get(string(id))
+}
+
+// Update applies fn to the stored job, persisting it only if fn succeeds
+func (s *JobStore) Update(id string, fn func(*Job) error) (Job, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	job, err := s.Get(id)
+	if err != nil {
+		return job, err
+	}
+	if err := fn(&job); err != nil {
+		return job, err
+	}
+	return job, s.put(job)
+}
+
+// Delete removes a job and its index entries, the last job of its commit
+// becomes the newest remaining one
+func (s *JobStore) Delete(job Job) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.store.Delete(jobsBucket, job.Id); err != nil {
+		return err
+	}
+	for _, key := range indexKeys(job) {
+		if err := s.store.Delete(jobIndexBucket, key); err != nil {
+			return err
+		}
+	}
+	repository := job.Commit.GetRepositoryName()
+	key := commitKey(repository, job.Commit.Id)
+	if last, err := s.store.Get(commitJobsBucket, key); err != nil || string(last) != job.Id {
+		return nil
+	}
+	query := JobQuery{JobFilter: JobFilter{Repository: repository}, Commit: strings.ToLower(job.Commit.Id)}
+	remaining, _, err := s.Search(query, "", maxJobsPage)
+	if err != nil {
+		return err
+	}
+	for _, other := range remaining {
+		if other.Commit.Id == job.Commit.Id {
+			return s.store.Put(commitJobsBucket, key, []byte(other.Id))
+		}
+	}
+	return s.store.Delete(commitJobsBucket, key)
+}
+
+// JobFilter selects the jobs to list, zero fields match everything
+type JobFilter struct {
+	Repository string
+	Branch     string
+	State      JobState
+	Since      time.Time
+	Until      time.Time
+	// Repositories the caller can view, all if nil
+	visible func(string) bool
+}
+
+func (f JobFilter) match(job Job) bool {
+	switch {
+	case f.visible != nil && !f.visible(job.Commit.GetRepositoryName()):
+		return false
+	case f.Repository != "" && job.Commit.GetRepositoryName() != f.Repository:
+		return false
+	case f.Branch != "" && job.Commit.Repository.Branch != f.Branch:
+		return false
+	case f.State != "" && job.State != f.State:
+		return false
+	case !f.Since.IsZero() && job.CreatedAt.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !job.CreatedAt.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// A cursor points right after a job in the listing order, it's opaque to
+// the clients
+func encodeJobCursor(job Job) string {
+	raw := strconv.FormatInt(job.CreatedAt.UnixNano(), 10) + "/" + job.Id
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeJobCursor(cursor string) (int64, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(raw), "/", 2)
+	if len(parts) != 2 {
+		return 0, "", ErrInvalidCursor
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	return nanos, parts[1], nil
+}
+
+// List returns up to limit jobs matching the filter, newest first, starting
+// after the cursor if any, with the cursor of the next page, empty on the
+// last one
+func (s *JobStore) List(filter JobFilter, cursor string, limit int) ([]Job, string, error) {
+	jobs, err := s.scan(filter.match)
+	if err != nil {
+		return nil, "", err
+	}
+	return pageJobs(jobs, cursor, limit)
+}
+
+// scan reads all the stored jobs, returning the ones matched
+func (s *JobStore) scan(match func(Job) bool) ([]Job, error) {
+	values, err := s.store.List(jobsBucket, "")
+	if err != nil {
+		return nil, err
+	}
+	jobs := []Job{}
+	for _, value := range values {
+		var job Job
+		if err := json.Unmarshal(value, &job); err != nil {
+			return nil, err
+		}
+		if match(job) {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+// pageJobs sorts the jobs newest first and returns up to limit of them
+// starting after the cursor, if any, with the cursor of the next page
+func pageJobs(jobs []Job, cursor string, limit int) ([]Job, string, error) {
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].CreatedAt.Equal(jobs[j].CreatedAt) {
+			return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+		}
+		return jobs[i].Id < jobs[j].Id
+	})
+	if cursor != "" {
+		nanos, id, err := decodeJobCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		start := sort.Search(len(jobs), func(i int) bool {
+			created := jobs[i].CreatedAt.UnixNano()
+			return created < nanos || (created == nanos && jobs[i].Id > id)
+		})
+		jobs = jobs[start:]
+	}
+	if len(jobs) <= limit {
+		return jobs, "", nil
+	}
+	return jobs[:limit], encodeJobCursor(jobs[limit-1]), nil
+}
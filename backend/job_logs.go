@@ -0,0 +1,508 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bucket of the logs of the finished jobs
+const jobLogsBucket string = "job_logs"
+
+// Limits of the job logs kept in memory by the dispatcher, the output beyond
+// the max size of a job is dropped and only the logs of the most recent jobs
+// are retained
+const (
+	maxJobLogSize int = 4 * 1024 * 1024
+	maxJobLogs    int = 200
+)
+
+type jobLog struct {
+	data      []byte
+	done      bool
+	truncated bool
+	changed   chan struct{}
+}
+
+// JobLogs buffers the output of the jobs shipped by the runners, so that it
+// can be read or followed while the job runs
+type JobLogs struct {
+	mutex sync.Mutex
+	logs  map[string]*jobLog
+	order []string
+}
+
+func NewJobLogs() *JobLogs {
+	return &JobLogs{logs: map[string]*jobLog{}, order: []string{}}
+}
+
+// get returns the log of a job, creating it if missing, to be called with
+// the mutex held
+func (l *JobLogs) get(jobId string) *jobLog {
+	if jl, ok := l.logs[jobId]; ok {
+		return jl
+	}
+	jl := &jobLog{changed: make(chan struct{})}
+	l.logs[jobId] = jl
+	l.order = append(l.order, jobId)
+	if len(l.order) > maxJobLogs {
+		delete(l.logs, l.order[0])
+		l.order = l.order[1:]
+	}
+	return jl
+}
+
+// notify wakes up the readers following the log, mutex held
+func (jl *jobLog) notify() {
+	close(jl.changed)
+	jl.changed = make(chan struct{})
+}
+
+func (l *JobLogs) Append(jobId string, data []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	jl := l.get(jobId)
+	if jl.done {
+		return
+	}
+	jl.append(data)
+}
+
+// Extend appends to the log of a job even once complete, returning the whole
+// log, e.g. with output delivered late by the runner
+func (l *JobLogs) Extend(jobId string, data []byte) []byte {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	jl := l.get(jobId)
+	jl.append(data)
+	return append([]byte(nil), jl.data...)
+}
+
+// append adds output to the log within the max size, mutex held
+func (jl *jobLog) append(data []byte) {
+	if room := maxJobLogSize - len(jl.data); len(data) > room {
+		data, jl.truncated = data[:room], true
+	}
+	jl.data = append(jl.data, data...)
+	jl.notify()
+}
+
+// Close marks the log of a job complete, once the job is done
+func (l *JobLogs) Close(jobId string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	jl := l.get(jobId)
+	jl.done = true
+	jl.notify()
+}
+
+// Has tells if the log of a job is held in memory
+func (l *JobLogs) Has(jobId string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, ok := l.logs[jobId]
+	return ok
+}
+
+// Complete tells if the complete log of a job is held in memory
+func (l *JobLogs) Complete(jobId string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	jl, ok := l.logs[jobId]
+	return ok && jl.done
+}
+
+// Remove drops the log of a job from memory
+func (l *JobLogs) Remove(jobId string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, ok := l.logs[jobId]; !ok {
+		return
+	}
+	delete(l.logs, jobId)
+	for i, id := range l.order {
+		if id == jobId {
+			l.order = append(l.order[:i], l.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Restore loads the complete log of a finished job, e.g. read back from the
+// store once evicted
+func (l *JobLogs) Restore(jobId string, data []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	jl := l.get(jobId)
+	jl.data, jl.done = data, true
+	jl.notify()
+}
+
+// Read returns the output following offset and whether the log is complete
+func (l *JobLogs) Read(jobId string, offset int) ([]byte, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	jl, ok := l.logs[jobId]
+	if !ok || offset >= len(jl.data) {
+		return nil, ok && jl.done
+	}
+	return append([]byte(nil), jl.data[offset:]...), jl.done
+}
+
+// Wait blocks until output following offset is available, the log is
+// complete or the context is done
+func (l *JobLogs) Wait(ctx context.Context, jobId string, offset int) {
+	l.mutex.Lock()
+	jl := l.get(jobId)
+	if offset < len(jl.data) || jl.done {
+		l.mutex.Unlock()
+		return
+	}
+	changed := jl.changed
+	l.mutex.Unlock()
+	select {
+	case <-changed:
+	case <-ctx.Done():
+	}
+}
+
+// closeLogs completes the log of a finished job and stores it, so that it
+// can still be read after a restart or once evicted from memory
+func (d *Dispatcher) closeLogs(jobId string) {
+	d.logs.Close(jobId)
+	data, _ := d.logs.Read(jobId, 0)
+	if data == nil {
+		data = []byte{}
+	}
+	if err := d.store.Put(jobLogsBucket, jobId, data); err != nil {
+		log.Printf("Error storing logs of job %s: %v\n", jobId, err)
+	}
+}
+
+// appendLateLogs appends output delivered from the spool of a runner, once
+// the job is over it's added to the stored log too
+func (d *Dispatcher) appendLateLogs(jobId string, data []byte) {
+	job, err := d.jobs.Get(jobId)
+	if err != nil || !job.Done() {
+		d.logs.Append(jobId, data)
+		return
+	}
+	d.loadLogs(job)
+	if err := d.store.Put(jobLogsBucket, jobId, d.logs.Extend(jobId, data)); err != nil {
+		log.Printf("Error storing logs of job %s: %v\n", jobId, err)
+	}
+}
+
+// loadLogs reads back from the store the log of a finished job missing from
+// memory, as followers would otherwise wait for it forever
+func (d *Dispatcher) loadLogs(job Job) {
+	if !job.Done() || d.logs.Complete(job.Id) {
+		return
+	}
+	data, err := d.store.Get(jobLogsBucket, job.Id)
+	if err != nil && err != ErrNotFound {
+		log.Printf("Error reading logs of job %s: %v\n", job.Id, err)
+	}
+	d.logs.Restore(job.Id, data)
+}
+
+// jobLogsHandler serves /jobs/{id}/logs: the runners POST the output of
+// the steps authenticated with the job token, the output spooled during a
+// partition is kept even once the job is over. GET returns it from the offset
+// byte on, following it until the job is done with follow=true. The output is
+// stored as-is, plain=true strips its ANSI escape sequences, the offset still
+// counting the bytes of the raw output.
+func jobLogsHandler(d *Dispatcher, jobId string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			tokenJobId, ok := d.jobTokens.Verify(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+			if !ok || tokenJobId != jobId {
+				http.Error(w, "invalid job token", http.StatusForbidden)
+				return
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(maxJobLogSize)))
+			if err != nil {
+				http.Error(w, "invalid log chunk", http.StatusBadRequest)
+				return
+			}
+			if r.Header.Get(spooledReportHeader) == "true" {
+				d.appendLateLogs(jobId, data)
+			} else {
+				d.logs.Append(jobId, data)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodGet:
+			job, err := d.jobs.Get(jobId)
+			if err == ErrNotFound {
+				http.Error(w, "job not found", http.StatusNotFound)
+				return
+			} else if err == nil {
+				d.loadLogs(job)
+			}
+			offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+			if err != nil || offset < 0 {
+				offset = 0
+			}
+			follow := r.URL.Query().Get("follow") == "true"
+			var stripper *ansiStripper
+			if r.URL.Query().Get("plain") == "true" {
+				stripper = &ansiStripper{}
+			}
+			if follow {
+				// Following outlives the write timeout of the server
+				http.NewResponseController(w).SetWriteDeadline(time.Time{})
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			flusher, _ := w.(http.Flusher)
+			for {
+				data, done := d.logs.Read(jobId, offset)
+				if len(data) > 0 {
+					offset += len(data)
+					if stripper != nil {
+						data = stripper.Strip(data)
+					}
+					w.Write(data)
+					if flusher != nil {
+						flusher.Flush()
+					}
+				}
+				if done || !follow || r.Context().Err() != nil {
+					return
+				}
+				d.waitLogs(r.Context(), jobId, offset)
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// Interval of the comments keeping idle event streams open through proxies
+const logStreamKeepAlive = 15 * time.Second
+
+// jobLogsStreamHandler serves GET /jobs/{id}/logs/stream, following the
+// output of a job as Server-Sent Events, one per line. The ID of each event is
+// the offset following the line, sent back as Last-Event-ID a reconnecting
+// client resumes from there. A final end event carries the job state. Like
+// the logs, plain=true strips the ANSI escape sequences of the lines.
+func jobLogsStreamHandler(d *Dispatcher, jobId string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		job, err := d.jobs.Get(jobId)
+		if err == ErrNotFound {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		} else if err == nil {
+			d.loadLogs(job)
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		offset, err := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+		if err != nil || offset < 0 {
+			offset = 0
+		}
+		var stripper *ansiStripper
+		if r.URL.Query().Get("plain") == "true" {
+			stripper = &ansiStripper{}
+		}
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		for {
+			data, done := d.logs.Read(jobId, offset)
+			// Only whole lines are sent until the job is done, a trailing
+			// carriage return may still be followed by its line feed
+			end := len(data)
+			if !done {
+				if end > 0 && data[end-1] == '\r' {
+					end--
+				}
+				end = bytes.LastIndexAny(data[:end], "\r\n") + 1
+			}
+			for _, line := range logLines(data[:end]) {
+				offset += len(line)
+				if stripper != nil {
+					line = stripper.Strip(line)
+				}
+				fmt.Fprintf(w, "id: %d\ndata: %s\n\n", offset, bytes.TrimRight(line, "\r\n"))
+			}
+			if done {
+				state := ""
+				if job, err := d.jobs.Get(jobId); err == nil {
+					state = string(job.State)
+				}
+				fmt.Fprintf(w, "event: end\ndata: %s\n\n", state)
+				flusher.Flush()
+				return
+			}
+			flusher.Flush()
+			ctx, cancel := context.WithTimeout(r.Context(), logStreamKeepAlive)
+			d.waitLogs(ctx, jobId, offset+len(data)-end)
+			cancel()
+			if r.Context().Err() != nil {
+				return
+			}
+			if ctx.Err() == context.DeadlineExceeded {
+				fmt.Fprint(w, ": keep-alive\n\n")
+			}
+		}
+	}
+}
+
+// logLines splits the output in lines keeping their terminators, a carriage
+// return alone ends a line too, as progress bars rewrite it in place
+func logLines(data []byte) [][]byte {
+	lines := [][]byte{}
+	for len(data) > 0 {
+		i := bytes.IndexAny(data, "\r\n")
+		if i < 0 {
+			i = len(data) - 1
+		} else if data[i] == '\r' && i+1 < len(data) && data[i+1] == '\n' {
+			i++
+		}
+		lines = append(lines, data[:i+1])
+		data = data[i+1:]
+	}
+	return lines
+}
+
+// WithLogStreaming ships the output of the steps to the dispatcher as they
+// run, so that it can be followed through its API. Otherwise it's handed to
+// the dispatcher once the job is over.
+func WithLogStreaming() RunnerOption {
+	return func(r *Runner) {
+		r.streamLogs = true
+	}
+}
+
+// jobLogCapture keeps the output of a job not streamed, within the max size
+// of the job logs
+type jobLogCapture struct {
+	data []byte
+}
+
+func (c *jobLogCapture) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := maxJobLogSize - len(c.data); len(p) > room {
+		p = p[:room]
+	}
+	c.data = append(c.data, p...)
+	return n, nil
+}
+
+// dispatcherLogWriter posts the output it receives to the job logs endpoint
+// of the dispatcher in the background, so that a slow dispatcher never holds
+// the steps back. The output written meanwhile is batched in the next post,
+// within the max size of the job logs. Failures are logged once and the
+// chunk spooled if the runner has a spool, dropped otherwise, as they must
+// never break the job execution.
+type dispatcherLogWriter struct {
+	runner  *Runner
+	req     RunnerRequest
+	mutex   sync.Mutex
+	pending []byte
+	closed  bool
+	wake    chan struct{}
+	done    chan struct{}
+	failed  bool
+}
+
+func newDispatcherLogWriter(runner *Runner, req RunnerRequest) *dispatcherLogWriter {
+	w := &dispatcherLogWriter{runner: runner, req: req,
+		wake: make(chan struct{}, 1), done: make(chan struct{})}
+	go w.ship()
+	return w
+}
+
+func (w *dispatcherLogWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return len(p), nil
+	}
+	data := p
+	if room := maxJobLogSize - len(w.pending); len(data) > room {
+		data = data[:room]
+	}
+	w.pending = append(w.pending, data...)
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+// ship posts the pending output every time some is written, until closed
+func (w *dispatcherLogWriter) ship() {
+	defer close(w.done)
+	for range w.wake {
+		w.mutex.Lock()
+		chunk := w.pending
+		w.pending = nil
+		w.mutex.Unlock()
+		if len(chunk) == 0 {
+			continue
+		}
+		report := newDispatcherReport(w.req, "logs", "", chunk)
+		if err := w.runner.deliver(report, 1); err != nil && !w.failed {
+			log.Printf("Error streaming logs to the dispatcher: %v\n", err)
+			w.failed = true
+		}
+	}
+}
+
+// Close waits for the output written so far to be posted
+func (w *dispatcherLogWriter) Close() error {
+	w.mutex.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.wake)
+	}
+	w.mutex.Unlock()
+	<-w.done
+	return nil
+}
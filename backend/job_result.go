@@ -0,0 +1,197 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Exit code reported when the job failed before or outside of any step, e.g.
+// the clone of the repository
+const infraFailureExitCode int = -1
+
+// JobResult is reported by the runner to the dispatcher once a job is over
+type JobResult struct {
+	// Exit code of the failed step, 0 on success
+	ExitCode int          `json:"exit_code"`
+	Step     string       `json:"step,omitempty"`
+	Error    string       `json:"error,omitempty"`
+	Duration float64      `json:"duration_seconds"`
+	Steps    []StepResult `json:"steps"`
+	// Where the full output of the job can be read, if known
+	LogLocation string `json:"log_location,omitempty"`
+	// Why the job failed, only on failures
+	Category FailureCategory `json:"category,omitempty"`
+	// Percentage covered by the tests, if the pipeline reads a report
+	Coverage *float64 `json:"coverage,omitempty"`
+}
+
+// jobResult summarizes the execution of a job
+func (r *Runner) jobResult(req RunnerRequest, res *RunnerResponse, err error,
+	duration time.Duration) JobResult {
+	result := JobResult{Duration: duration.Seconds(), Steps: res.Steps, Coverage: res.Coverage}
+	if result.Steps == nil {
+		result.Steps = []StepResult{}
+	}
+	if err == nil && res.Error != "" {
+		err = fmt.Errorf("%s", res.Error)
+	}
+	for _, step := range res.Steps {
+		if step.Status == StepFailure {
+			result.Step, result.ExitCode = step.Name, step.ExitCode
+			result.Category = step.Category
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+		if result.ExitCode == 0 {
+			result.ExitCode = infraFailureExitCode
+		}
+		if result.Category == "" {
+			result.Category = res.Category
+		}
+		if result.Category == "" {
+			result.Category = FailureInfra
+		}
+	}
+	// Streamed or handed over with the response, the output ends up there
+	if req.APIURL != "" {
+		result.LogLocation = strings.TrimRight(req.APIURL, "/") + "/jobs/" + req.JobId + "/logs"
+	}
+	return result
+}
+
+// Attempts to report a result to the dispatcher before giving up
+const resultReportAttempts int = 3
+
+// reportResult posts the result of a job to the dispatcher, authenticated
+// with the job token
+func (r *Runner) reportResult(req RunnerRequest, result JobResult) {
+	if err := r.postToDispatcher(req, "result", result, resultReportAttempts); err != nil {
+		log.Printf("Error reporting the result of job %s: %v\n", req.JobId, err)
+	}
+}
+
+// reportStep posts the result of a step to the dispatcher as soon as it's
+// over, a single attempt is made as the job result includes it anyway
+func (r *Runner) reportStep(req RunnerRequest, step StepResult) {
+	if err := r.postToDispatcher(req, "steps", step, 1); err != nil {
+		log.Printf("Error reporting step %s of job %s: %v\n", step.Name, req.JobId, err)
+	}
+}
+
+// postToDispatcher posts a JSON value to the /jobs/{id}/{path} endpoint of
+// the dispatcher authenticated with the job token, retrying with a linear
+// backoff and spooling it if configured
+func (r *Runner) postToDispatcher(req RunnerRequest, path string, v interface{}, attempts int) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return r.deliver(newDispatcherReport(req, path, "application/json", body), attempts)
+}
+
+// jobResultHandler stores the result of a job posted by its runner on
+// /jobs/{id}/result, authenticated with the job token, and serves it back
+func jobResultHandler(d *Dispatcher, jobId string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			tokenJobId, ok := d.jobTokens.Verify(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+			if !ok || tokenJobId != jobId {
+				http.Error(w, "invalid job token", http.StatusForbidden)
+				return
+			}
+			var result JobResult
+			if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+				http.Error(w, "invalid job result", http.StatusBadRequest)
+				return
+			}
+			_, err := d.jobs.Update(jobId, func(job *Job) error {
+				job.Result = &result
+				return nil
+			})
+			if err == ErrNotFound {
+				http.Error(w, "job not found", http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodGet:
+			job, err := d.jobs.Get(jobId)
+			if err == ErrNotFound || (err == nil && job.Result == nil) {
+				http.Error(w, "result not available", http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, job.Result)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// jobStepsHandler publishes a step_finished event for every step result
+// posted by the runner of a job on /jobs/{id}/steps, authenticated with the
+// job token
+func jobStepsHandler(d *Dispatcher, jobId string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		tokenJobId, ok := d.jobTokens.Verify(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if !ok || tokenJobId != jobId {
+			http.Error(w, "invalid job token", http.StatusForbidden)
+			return
+		}
+		var step StepResult
+		if err := json.NewDecoder(r.Body).Decode(&step); err != nil || step.Name == "" {
+			http.Error(w, "invalid step result", http.StatusBadRequest)
+			return
+		}
+		job, err := d.jobs.Get(jobId)
+		if err == ErrNotFound {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		d.events.Append(JobEvent{Type: JobStepFinished, JobId: jobId, Commit: job.Commit, Step: &step})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,281 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Bucket of the search indexes of the jobs, each job has a key per indexed
+// field value, e.g. "repository:octocat/hello|<created at>|<job ID>", so
+// that a prefix listing returns the IDs of the jobs with that value
+const jobIndexBucket string = "job_index"
+
+// Marks the stores whose jobs were all indexed
+const jobIndexVersion string = "!version"
+
+// Fields of the jobs indexed for search, state and dates are filtered while
+// scanning the indexed jobs as they change or are ranges
+const (
+	indexCommit     string = "commit"
+	indexAuthor     string = "author"
+	indexBranch     string = "branch"
+	indexRepository string = "repository"
+)
+
+// ErrInvalidQuery is returned searching with a malformed query
+var ErrInvalidQuery = errors.New("invalid query")
+
+// JobQuery is a parsed job search, zero fields match everything
+type JobQuery struct {
+	JobFilter
+	// Prefix of the commit SHA
+	Commit string
+	// Email or username of the commit author
+	Author string
+	// Words to find in the repository, the branch or the commit message
+	Terms []string
+	// States allowed on top of the queried one, any if empty
+	states []JobState
+}
+
+// Names of the query fields, with their aliases
+var jobQueryFields = map[string]string{
+	"repo":       "repository",
+	"repository": "repository",
+	"branch":     "branch",
+	"sha":        "commit",
+	"commit":     "commit",
+	"status":     "state",
+	"state":      "state",
+	"author":     "author",
+	"after":      "since",
+	"since":      "since",
+	"before":     "until",
+	"until":      "until",
+}
+
+// parseQueryTime reads an RFC3339 timestamp or a 2006-01-02 date
+func parseQueryTime(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// ParseJobQuery reads a search query made of space separated field:value
+// pairs and words, e.g.
+//
+//	repo:octocat/hello branch:master status:failed after:2020-01-01 flaky
+//
+// Fields are repo, branch, sha (a prefix), status, author (email or
+// username), after and before (dates or RFC3339 timestamps), words are
+// looked for in the repository, the branch and the commit message
+func ParseJobQuery(q string) (JobQuery, error) {
+	var query JobQuery
+	for _, token := range strings.Fields(q) {
+		parts := strings.SplitN(token, ":", 2)
+		if len(parts) == 1 {
+			query.Terms = append(query.Terms, strings.ToLower(token))
+			continue
+		}
+		field, ok := jobQueryFields[strings.ToLower(parts[0])]
+		if !ok || parts[1] == "" {
+			return query, fmt.Errorf("%w: %s", ErrInvalidQuery, token)
+		}
+		value := parts[1]
+		var err error
+		switch field {
+		case "repository":
+			query.Repository = value
+		case "branch":
+			query.Branch = value
+		case "commit":
+			query.Commit = strings.ToLower(value)
+		case "state":
+			query.State = JobState(strings.ToUpper(value))
+			if _, known := jobStates[query.State]; !known {
+				return query, fmt.Errorf("%w: unknown status %s", ErrInvalidQuery, value)
+			}
+		case "author":
+			query.Author = strings.ToLower(value)
+		case "since":
+			query.Since, err = parseQueryTime(value)
+		case "until":
+			query.Until, err = parseQueryTime(value)
+		}
+		if err != nil {
+			return query, fmt.Errorf("%w: %s", ErrInvalidQuery, token)
+		}
+	}
+	return query, nil
+}
+
+var jobStates = map[JobState]bool{
+	JobPending: true, JobRunning: true, JobSuccess: true, JobFailed: true, JobCancelled: true,
+	JobSkipped: true,
+}
+
+func (q JobQuery) match(job Job) bool {
+	if !q.JobFilter.match(job) {
+		return false
+	}
+	if len(q.states) > 0 && !containsState(q.states, job.State) {
+		return false
+	}
+	commit := job.Commit
+	if q.Commit != "" && !strings.HasPrefix(strings.ToLower(commit.Id), q.Commit) {
+		return false
+	}
+	if q.Author != "" && strings.ToLower(commit.Author.Email) != q.Author &&
+		strings.ToLower(commit.Author.Username) != q.Author {
+		return false
+	}
+	text := strings.ToLower(strings.Join([]string{
+		commit.GetRepositoryName(), commit.Repository.Branch, commit.Message}, "\n"))
+	for _, term := range q.Terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsState(states []JobState, state JobState) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// indexPrefix returns the prefix of the index keys of the most selective
+// field of the query, empty if none is indexed
+func (q JobQuery) indexPrefix() string {
+	switch {
+	case q.Commit != "":
+		return indexCommit + ":" + q.Commit
+	case q.Author != "":
+		return indexAuthor + ":" + q.Author + "|"
+	case q.Branch != "" && q.Repository != "":
+		return indexBranch + ":" + q.Repository + "@" + q.Branch + "|"
+	case q.Repository != "":
+		return indexRepository + ":" + q.Repository + "|"
+	}
+	return ""
+}
+
+// indexKeys returns the keys of the index entries of a job
+func indexKeys(job Job) []string {
+	commit := job.Commit
+	values := map[string]string{
+		indexCommit:     strings.ToLower(commit.Id),
+		indexRepository: commit.GetRepositoryName(),
+		indexBranch:     commit.GetRepositoryName() + "@" + commit.Repository.Branch,
+	}
+	suffix := fmt.Sprintf("|%020d|%s", job.CreatedAt.UnixNano(), job.Id)
+	keys := []string{}
+	for field, value := range values {
+		keys = append(keys, field+":"+value+suffix)
+	}
+	for _, author := range []string{commit.Author.Email, commit.Author.Username} {
+		if author != "" {
+			keys = append(keys, indexAuthor+":"+strings.ToLower(author)+suffix)
+		}
+	}
+	return keys
+}
+
+// index adds the index entries of a job, the indexed fields never change
+func (s *JobStore) index(job Job) error {
+	for _, key := range indexKeys(job) {
+		if err := s.store.Put(jobIndexBucket, key, []byte(job.Id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexAll indexes the jobs stored before the indexes existed, once
+func (s *JobStore) indexAll() error {
+	if _, err := s.store.Get(jobIndexBucket, jobIndexVersion); err == nil {
+		return nil
+	} else if err != ErrNotFound {
+		return err
+	}
+	jobs, err := s.scan(func(Job) bool { return true })
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if err := s.index(job); err != nil {
+			return err
+		}
+	}
+	return s.store.Put(jobIndexBucket, jobIndexVersion, []byte("1"))
+}
+
+// Search returns up to limit jobs matching the query, newest first,
+// starting after the cursor if any, with the cursor of the next page. Only
+// the jobs indexed under the most selective field of the query are read,
+// all of them if it has no indexed field.
+func (s *JobStore) Search(query JobQuery, cursor string, limit int) ([]Job, string, error) {
+	prefix := query.indexPrefix()
+	if prefix == "" {
+		jobs, err := s.scan(query.match)
+		if err != nil {
+			return nil, "", err
+		}
+		return pageJobs(jobs, cursor, limit)
+	}
+	ids, err := s.store.List(jobIndexBucket, prefix)
+	if err != nil {
+		return nil, "", err
+	}
+	jobs := []Job{}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if seen[string(id)] {
+			continue
+		}
+		seen[string(id)] = true
+		job, err := s.Get(string(id))
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, "", err
+		}
+		if query.match(job) {
+			jobs = append(jobs, job)
+		}
+	}
+	return pageJobs(jobs, cursor, limit)
+}
@@ -0,0 +1,170 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseJobQuery(t *testing.T) {
+	query, err := ParseJobQuery("repo:octocat/test branch:master sha:1A2B status:failed " +
+		"author:Octocat after:2020-11-01 before:2020-11-02T10:00:00Z Flaky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := JobQuery{
+		JobFilter: JobFilter{
+			Repository: "octocat/test",
+			Branch:     "master",
+			State:      JobFailed,
+			Since:      time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC),
+			Until:      time.Date(2020, 11, 2, 10, 0, 0, 0, time.UTC),
+		},
+		Commit: "1a2b",
+		Author: "octocat",
+		Terms:  []string{"flaky"},
+	}
+	if !reflect.DeepEqual(query, expected) {
+		t.Errorf("ParseJobQuery failed: expected %+v got %+v", expected, query)
+	}
+	for _, q := range []string{"color:red", "status:broken", "after:yesterday", "repo:"} {
+		if _, err := ParseJobQuery(q); err == nil {
+			t.Errorf("ParseJobQuery failed: expected an error parsing %q", q)
+		}
+	}
+}
+
+func createSearchJobs(jobs *JobStore) {
+	start := time.Date(2020, 11, 1, 10, 0, 0, 0, time.UTC)
+	commits := []Commit{
+		{Id: "a1", Message: "Fix flaky test", Author: Author{Email: "jdoe@example.com"},
+			Repository: Repository{GitHub, "octocat/test", "master"}},
+		{Id: "a2", Author: Author{Email: "jdoe@example.com", Username: "jdoe"},
+			Repository: Repository{GitHub, "octocat/test", "dev"}},
+		{Id: "b1", Author: Author{Email: "alice@example.com"},
+			Repository: Repository{GitHub, "octocat/other", "master"}},
+		{Id: "a3", Message: "Add feature", Author: Author{Email: "alice@example.com"},
+			Repository: Repository{GitHub, "octocat/test", "master"}},
+	}
+	for i, commit := range commits {
+		job := NewJob("job-"+commit.Id, commit)
+		job.CreatedAt = start.Add(time.Duration(i) * time.Minute)
+		if i%2 == 0 {
+			job.State = JobFailed
+		}
+		jobs.Create(job)
+	}
+}
+
+func searchIds(t *testing.T, jobs *JobStore, q string) []string {
+	query, err := ParseJobQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, _, err := jobs.Search(query, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, job := range found {
+		ids = append(ids, job.Id)
+	}
+	return ids
+}
+
+func TestJobStoreSearch(t *testing.T) {
+	jobs := NewJobStore(NewMemoryStore())
+	createSearchJobs(jobs)
+	cases := map[string][]string{
+		"repo:octocat/test":                        {"job-a3", "job-a2", "job-a1"},
+		"repo:octocat/test branch:master":          {"job-a3", "job-a1"},
+		"sha:a":                                    {"job-a3", "job-a2", "job-a1"},
+		"author:JDOE":                              {"job-a2"},
+		"author:alice@example.com status:FAILED":   {"job-b1"},
+		"branch:master after:2020-11-01T10:01:00Z": {"job-a3", "job-b1"},
+		"flaky": {"job-a1"},
+		"":      {"job-a3", "job-b1", "job-a2", "job-a1"},
+	}
+	for q, expected := range cases {
+		if ids := searchIds(t, jobs, q); !reflect.DeepEqual(ids, expected) {
+			t.Errorf("JobStore.Search failed: expected %v searching %q got %v", expected, q, ids)
+		}
+	}
+	query, _ := ParseJobQuery("repo:octocat/test")
+	page, cursor, err := jobs.Search(query, "", 2)
+	if err != nil || len(page) != 2 || cursor == "" {
+		t.Fatalf("JobStore.Search failed: unexpected first page %v %s %v", page, cursor, err)
+	}
+	page, cursor, err = jobs.Search(query, cursor, 2)
+	if err != nil || len(page) != 1 || page[0].Id != "job-a1" || cursor != "" {
+		t.Errorf("JobStore.Search failed: unexpected last page %v %s %v", page, cursor, err)
+	}
+}
+
+func TestJobStoreIndexAll(t *testing.T) {
+	store := NewMemoryStore()
+	jobs := NewJobStore(store)
+	createSearchJobs(jobs)
+	// Drop the indexes as if the jobs were stored by an older version
+	for _, id := range []string{"job-a1", "job-a2", "job-b1", "job-a3"} {
+		job, _ := jobs.Get(id)
+		for _, key := range indexKeys(job) {
+			store.Delete(jobIndexBucket, key)
+		}
+	}
+	if ids := searchIds(t, jobs, "repo:octocat/test"); len(ids) != 0 {
+		t.Fatalf("JobStore.Search failed: expected no indexed jobs, got %v", ids)
+	}
+	if err := jobs.indexAll(); err != nil {
+		t.Fatal(err)
+	}
+	if ids := searchIds(t, jobs, "repo:octocat/test"); len(ids) != 3 {
+		t.Errorf("JobStore.indexAll failed: expected 3 jobs found, got %v", ids)
+	}
+}
+
+func TestJobSearchHandler(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil)
+	createSearchJobs(d.jobs)
+	handler := jobSearchHandler(d)
+	cases := map[string]int{
+		"/jobs/search?q=repo:octocat/test+status:failed": http.StatusOK,
+		"/jobs/search?q=color:red":                       http.StatusBadRequest,
+		"/jobs/search?q=flaky&limit=0":                   http.StatusBadRequest,
+	}
+	for url, status := range cases {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != status {
+			t.Errorf("jobSearchHandler failed: expected %d on %s got %d", status, url, rec.Code)
+		}
+	}
+}
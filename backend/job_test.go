@@ -0,0 +1,78 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobTransitions(t *testing.T) {
+	jobs := NewJobStore(NewMemoryStore())
+	commit := Commit{Id: "a", Repository: Repository{GitHub, "octocat/test", "master"}}
+	if err := jobs.Create(NewJob("job-1", commit)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jobs.Update("job-1", func(j *Job) error { return j.Transition(JobSuccess) }); err == nil {
+		t.Errorf("Job.Transition failed: PENDING to SUCCESS allowed")
+	}
+	for _, state := range []JobState{JobRunning, JobFailed} {
+		if _, err := jobs.Update("job-1", func(j *Job) error { return j.Transition(state) }); err != nil {
+			t.Fatalf("Job.Transition failed: %v", err)
+		}
+	}
+	job, err := jobs.GetByCommit("octocat/test", "a")
+	if err != nil || job.State != JobFailed || !job.Done() || job.StartedAt == nil || job.FinishedAt == nil {
+		t.Errorf("JobStore.GetByCommit failed: unexpected %v %v", job, err)
+	}
+	if err := job.Transition(JobCancelled); err == nil {
+		t.Errorf("Job.Transition failed: final state left")
+	}
+}
+
+func TestJobStoreList(t *testing.T) {
+	jobs := NewJobStore(NewMemoryStore())
+	start := time.Date(2020, 11, 1, 10, 0, 0, 0, time.UTC)
+	for i, branch := range []string{"master", "dev", "master", "master"} {
+		commit := Commit{Id: string(rune('a' + i)), Repository: Repository{GitHub, "octocat/test", branch}}
+		job := NewJob("job-"+commit.Id, commit)
+		job.CreatedAt = start.Add(time.Duration(i) * time.Minute)
+		jobs.Create(job)
+	}
+	filter := JobFilter{Branch: "master", Until: start.Add(3 * time.Minute)}
+	page, cursor, err := jobs.List(filter, "", 1)
+	if err != nil || len(page) != 1 || page[0].Id != "job-c" || cursor == "" {
+		t.Fatalf("JobStore.List failed: unexpected first page %v %s %v", page, cursor, err)
+	}
+	page, cursor, err = jobs.List(filter, cursor, 1)
+	if err != nil || len(page) != 1 || page[0].Id != "job-a" || cursor != "" {
+		t.Errorf("JobStore.List failed: unexpected last page %v %s %v", page, cursor, err)
+	}
+	if _, _, err := jobs.List(filter, "???", 1); err != ErrInvalidCursor {
+		t.Errorf("JobStore.List failed: expected ErrInvalidCursor got %v", err)
+	}
+}
@@ -0,0 +1,409 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const jobWebhooksBucket string = "job_webhooks"
+
+// Delivery of the job webhooks, a failed attempt is retried after a backoff
+// doubling from webhookRetryBackoff, only the latest deliveries of each
+// webhook are tracked
+const (
+	maxWebhookAttempts     int           = 5
+	webhookRetryBackoff    time.Duration = time.Second
+	maxWebhookDeliveries   int           = 100
+	webhookSignatureHeader string        = "X-Narwhal-Signature"
+)
+
+// Events notified to the webhooks registered without an explicit list
+var defaultWebhookEvents = []JobEventType{JobEnqueued, JobStarted, JobCompleted, JobCancelledEvent}
+
+var ErrInvalidWebhook = errors.New("invalid webhook")
+
+// JobWebhook receives the lifecycle events of the jobs, of a repository or
+// of all of them, as JSON encoded JobEvent payloads signed with its secret:
+// the X-Narwhal-Signature header carries "sha256=" followed by the hex
+// encoded HMAC-SHA256 of the body
+type JobWebhook struct {
+	Id  string `json:"id"`
+	URL string `json:"url"`
+	// Repository whose jobs are notified, all if empty
+	Repository string         `json:"repository,omitempty"`
+	Events     []JobEventType `json:"events"`
+	// Only returned on creation, generated if not set
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (h JobWebhook) validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute http(s) URL", ErrInvalidWebhook)
+	}
+	for _, event := range h.Events {
+		switch event {
+		case JobEnqueued, JobStarted, JobCompleted, JobCancelledEvent, JobStepFinished, JobSkippedEvent:
+		default:
+			return fmt.Errorf("%w: unknown event %s", ErrInvalidWebhook, event)
+		}
+	}
+	return nil
+}
+
+func (h JobWebhook) subscribed(event JobEvent) bool {
+	if h.Repository != "" && h.Repository != event.Commit.GetRepositoryName() {
+		return false
+	}
+	for _, e := range h.Events {
+		if e == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// sign returns the signature header value of a payload
+func (h JobWebhook) sign(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(h.Secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type DeliveryState string
+
+const (
+	DeliveryPending   DeliveryState = "pending"
+	DeliveryDelivered DeliveryState = "delivered"
+	DeliveryFailed    DeliveryState = "failed"
+)
+
+// JobWebhookDelivery tracks the delivery of an event to a webhook
+type JobWebhookDelivery struct {
+	Id        string        `json:"id"`
+	WebhookId string        `json:"webhook_id"`
+	Event     JobEventType  `json:"event"`
+	JobId     string        `json:"job_id"`
+	State     DeliveryState `json:"state"`
+	Attempts  int           `json:"attempts"`
+	// Of the last attempt, zero if it got no answer
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// JobWebhooks holds the registered webhooks, persisted in the store, and
+// delivers them the job events
+type JobWebhooks struct {
+	mutex      sync.Mutex
+	store      Store
+	hooks      map[string]JobWebhook
+	deliveries map[string][]*JobWebhookDelivery
+	client     *http.Client
+	clock      Clock
+	random     io.Reader
+}
+
+// NewJobWebhooks loads the webhooks registered in the store
+func NewJobWebhooks(store Store, clock Clock, random io.Reader) (*JobWebhooks, error) {
+	h := &JobWebhooks{
+		store:      store,
+		hooks:      map[string]JobWebhook{},
+		deliveries: map[string][]*JobWebhookDelivery{},
+		client:     &http.Client{Timeout: 10 * time.Second},
+		clock:      clock,
+		random:     random,
+	}
+	values, err := store.List(jobWebhooksBucket, "")
+	if err != nil {
+		return h, err
+	}
+	for _, value := range values {
+		var hook JobWebhook
+		if err := json.Unmarshal(value, &hook); err != nil {
+			return h, err
+		}
+		h.hooks[hook.Id] = hook
+	}
+	return h, nil
+}
+
+// Register validates and stores a webhook, returning it with its ID and
+// secret
+func (h *JobWebhooks) Register(hook JobWebhook) (JobWebhook, error) {
+	if len(hook.Events) == 0 {
+		hook.Events = defaultWebhookEvents
+	}
+	if err := hook.validate(); err != nil {
+		return hook, err
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	hook.Id = randomId(h.random)
+	if hook.Secret == "" {
+		hook.Secret = randomId(h.random) + randomId(h.random)
+	}
+	hook.CreatedAt = h.clock.Now()
+	value, err := json.Marshal(hook)
+	if err != nil {
+		return hook, err
+	}
+	if err := h.store.Put(jobWebhooksBucket, hook.Id, value); err != nil {
+		return hook, err
+	}
+	h.hooks[hook.Id] = hook
+	return hook, nil
+}
+
+// Get returns a webhook without its secret
+func (h *JobWebhooks) Get(id string) (JobWebhook, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	hook, ok := h.hooks[id]
+	hook.Secret = ""
+	return hook, ok
+}
+
+// List returns the webhooks without their secret, oldest first
+func (h *JobWebhooks) List() []JobWebhook {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	hooks := make([]JobWebhook, 0, len(h.hooks))
+	for _, hook := range h.hooks {
+		hook.Secret = ""
+		hooks = append(hooks, hook)
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		if !hooks[i].CreatedAt.Equal(hooks[j].CreatedAt) {
+			return hooks[i].CreatedAt.Before(hooks[j].CreatedAt)
+		}
+		return hooks[i].Id < hooks[j].Id
+	})
+	return hooks
+}
+
+// Delete unregisters a webhook, the deliveries in flight are completed
+func (h *JobWebhooks) Delete(id string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, ok := h.hooks[id]; !ok {
+		return ErrNotFound
+	}
+	if err := h.store.Delete(jobWebhooksBucket, id); err != nil {
+		return err
+	}
+	delete(h.hooks, id)
+	delete(h.deliveries, id)
+	return nil
+}
+
+// Deliveries returns the latest deliveries of a webhook, newest first
+func (h *JobWebhooks) Deliveries(id string) []JobWebhookDelivery {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	tracked := h.deliveries[id]
+	deliveries := make([]JobWebhookDelivery, len(tracked))
+	for i, delivery := range tracked {
+		deliveries[len(tracked)-1-i] = *delivery
+	}
+	return deliveries
+}
+
+// Notify starts the delivery of an event to every subscribed webhook
+func (h *JobWebhooks) Notify(event JobEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, hook := range h.hooks {
+		if !hook.subscribed(event) {
+			continue
+		}
+		now := h.clock.Now()
+		delivery := &JobWebhookDelivery{
+			Id:        randomId(h.random),
+			WebhookId: hook.Id,
+			Event:     event.Type,
+			JobId:     event.JobId,
+			State:     DeliveryPending,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		tracked := append(h.deliveries[hook.Id], delivery)
+		if len(tracked) > maxWebhookDeliveries {
+			tracked = tracked[len(tracked)-maxWebhookDeliveries:]
+		}
+		h.deliveries[hook.Id] = tracked
+		go h.deliver(hook, delivery, event)
+	}
+}
+
+// deliver posts the event to the webhook until it answers with a 2xx
+// status or the attempts are exhausted
+func (h *JobWebhooks) deliver(hook JobWebhook, delivery *JobWebhookDelivery, event JobEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding event of job %s: %v\n", event.JobId, err)
+		return
+	}
+	backoff := webhookRetryBackoff
+	for attempt := 1; ; attempt++ {
+		status, err := h.post(hook, delivery.Id, event.Type, payload)
+		h.mutex.Lock()
+		delivery.Attempts, delivery.StatusCode, delivery.Error = attempt, status, ""
+		delivery.UpdatedAt = h.clock.Now()
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		switch {
+		case err == nil:
+			delivery.State = DeliveryDelivered
+		case attempt == maxWebhookAttempts:
+			delivery.State = DeliveryFailed
+		}
+		done := delivery.State != DeliveryPending
+		h.mutex.Unlock()
+		if done {
+			if err != nil {
+				log.Printf("Webhook %s failed delivering %s: %v\n", hook.Id, delivery.Id, err)
+			}
+			return
+		}
+		<-h.clock.After(backoff)
+		backoff *= 2
+	}
+}
+
+func (h *JobWebhooks) post(hook JobWebhook, deliveryId string, event JobEventType,
+	payload []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Narwhal-Event", string(event))
+	req.Header.Set("X-Narwhal-Delivery", deliveryId)
+	req.Header.Set(webhookSignatureHeader, hook.sign(payload))
+	res, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("webhook answered with status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// Run notifies the webhooks of the events appended to the log after the
+// cursor until the context is done
+func (h *JobWebhooks) Run(ctx context.Context, events *EventLog, cursor uint64) {
+	for ctx.Err() == nil {
+		events.Wait(ctx, cursor)
+		batch, _ := events.Since(cursor, 100)
+		for _, event := range batch {
+			h.Notify(event)
+			cursor = event.Cursor
+		}
+	}
+}
+
+// jobWebhooksHandler manages the job webhooks, admin token required:
+//   - GET /webhooks lists them, POST /webhooks registers one, e.g.
+//     {"url": "https://example.com/hook", "repository": "octocat/hello", "events": ["completed"]}
+//   - GET or DELETE /webhooks/{id}
+//   - GET /webhooks/{id}/deliveries the latest deliveries, newest first
+func jobWebhooksHandler(hooks *JobWebhooks, adminToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, adminToken) {
+			http.Error(w, "admin token required", http.StatusForbidden)
+			return
+		}
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhooks"), "/")
+		parts := strings.Split(path, "/")
+		switch {
+		case path == "" && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, hooks.List())
+		case path == "" && r.Method == http.MethodPost:
+			var hook JobWebhook
+			if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+				http.Error(w, "invalid webhook", http.StatusBadRequest)
+				return
+			}
+			defer r.Body.Close()
+			hook, err := hooks.Register(hook)
+			if errors.Is(err, ErrInvalidWebhook) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusCreated, hook)
+		case len(parts) == 1 && r.Method == http.MethodGet:
+			hook, ok := hooks.Get(parts[0])
+			if !ok {
+				http.Error(w, "webhook not found", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, http.StatusOK, hook)
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			if err := hooks.Delete(parts[0]); err == ErrNotFound {
+				http.Error(w, "webhook not found", http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case len(parts) == 2 && parts[1] == "deliveries" && r.Method == http.MethodGet:
+			if _, ok := hooks.Get(parts[0]); !ok {
+				http.Error(w, "webhook not found", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, http.StatusOK, hooks.Deliveries(parts[0]))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
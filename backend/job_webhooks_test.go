@@ -0,0 +1,190 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJobWebhooksRegister(t *testing.T) {
+	store := NewMemoryStore()
+	hooks, _ := NewJobWebhooks(store, SystemClock, defaultRandomness)
+	for _, invalid := range []JobWebhook{
+		{URL: "ftp://example.com"},
+		{URL: "/relative"},
+		{URL: "https://example.com", Events: []JobEventType{"exploded"}},
+	} {
+		if _, err := hooks.Register(invalid); err == nil {
+			t.Errorf("JobWebhooks.Register failed: expected %+v rejected", invalid)
+		}
+	}
+	hook, err := hooks.Register(JobWebhook{URL: "https://example.com/hook", Repository: "octocat/test"})
+	if err != nil || hook.Id == "" || hook.Secret == "" || len(hook.Events) != len(defaultWebhookEvents) {
+		t.Fatalf("JobWebhooks.Register failed: unexpected webhook %+v %v", hook, err)
+	}
+	// Reloaded from the store, secrets are never listed
+	hooks, _ = NewJobWebhooks(store, SystemClock, defaultRandomness)
+	listed := hooks.List()
+	if len(listed) != 1 || listed[0].Id != hook.Id || listed[0].Secret != "" {
+		t.Errorf("JobWebhooks.List failed: unexpected webhooks %+v", listed)
+	}
+	if err := hooks.Delete(hook.Id); err != nil || len(hooks.List()) != 0 {
+		t.Errorf("JobWebhooks.Delete failed: %v", err)
+	}
+	if err := hooks.Delete(hook.Id); err != ErrNotFound {
+		t.Errorf("JobWebhooks.Delete failed: expected ErrNotFound got %v", err)
+	}
+}
+
+func TestJobWebhooksDelivery(t *testing.T) {
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+	hooks, _ := NewJobWebhooks(NewMemoryStore(), SystemClock, defaultRandomness)
+	hook, _ := hooks.Register(JobWebhook{URL: server.URL, Repository: "octocat/test",
+		Events: []JobEventType{JobCompleted}, Secret: "secret"})
+
+	commit := Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "master"}}
+	other := Commit{Id: "def", Repository: Repository{GitHub, "octocat/other", "master"}}
+	hooks.Notify(JobEvent{Cursor: 1, Type: JobStarted, JobId: "job-1", Commit: commit})
+	hooks.Notify(JobEvent{Cursor: 2, Type: JobCompleted, JobId: "job-2", Commit: other})
+	hooks.Notify(JobEvent{Cursor: 3, Type: JobCompleted, JobId: "job-1", Commit: commit})
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		if r.Header.Get(webhookSignatureHeader) != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("Unexpected signature %s", r.Header.Get(webhookSignatureHeader))
+		}
+		var event JobEvent
+		json.Unmarshal(body, &event)
+		if event.JobId != "job-1" || event.Type != JobCompleted || r.Header.Get("X-Narwhal-Event") != "completed" {
+			t.Errorf("Unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook not called")
+	}
+	select {
+	case r := <-received:
+		t.Errorf("Unexpected delivery %s", r.Header.Get("X-Narwhal-Event"))
+	case <-time.After(100 * time.Millisecond):
+	}
+	deliveries := hooks.Deliveries(hook.Id)
+	if len(deliveries) != 1 || deliveries[0].JobId != "job-1" {
+		t.Fatalf("JobWebhooks.Deliveries failed: unexpected deliveries %+v", deliveries)
+	}
+}
+
+func TestJobWebhooksRetry(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+	clock := newFakeClock()
+	hooks, _ := NewJobWebhooks(NewMemoryStore(), clock, defaultRandomness)
+	hook, _ := hooks.Register(JobWebhook{URL: server.URL})
+	hooks.Notify(JobEvent{Cursor: 1, Type: JobEnqueued, JobId: "job-1"})
+
+	if backoff := <-clock.requested; backoff != webhookRetryBackoff {
+		t.Errorf("Expected a retry after %s got %s", webhookRetryBackoff, backoff)
+	}
+	delivery := hooks.Deliveries(hook.Id)[0]
+	if delivery.State != DeliveryPending || delivery.Attempts != 1 || delivery.StatusCode != http.StatusBadGateway {
+		t.Errorf("Unexpected delivery after the first attempt %+v", delivery)
+	}
+	clock.Advance(webhookRetryBackoff)
+	deadline := time.Now().Add(5 * time.Second)
+	for hooks.Deliveries(hook.Id)[0].State == DeliveryPending && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	delivery = hooks.Deliveries(hook.Id)[0]
+	if delivery.State != DeliveryDelivered || delivery.Attempts != 2 || delivery.Error != "" {
+		t.Errorf("Unexpected delivery after the retry %+v", delivery)
+	}
+}
+
+func TestJobWebhooksHandler(t *testing.T) {
+	hooks, _ := NewJobWebhooks(NewMemoryStore(), SystemClock, defaultRandomness)
+	handler := jobWebhooksHandler(hooks, "admin")
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+		req.Header.Set("Authorization", "Bearer admin")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	rec := request(http.MethodPost, "/webhooks", `{"url": "https://example.com/hook", "events": ["completed"]}`)
+	var hook JobWebhook
+	if err := json.NewDecoder(rec.Body).Decode(&hook); err != nil || rec.Code != http.StatusCreated ||
+		hook.Secret == "" {
+		t.Fatalf("jobWebhooksHandler failed: unexpected registration %d %+v", rec.Code, hook)
+	}
+	if rec := request(http.MethodPost, "/webhooks", `{"url": "nope"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("jobWebhooksHandler failed: expected 400 got %d", rec.Code)
+	}
+	if rec := request(http.MethodGet, "/webhooks/"+hook.Id, ""); rec.Code != http.StatusOK ||
+		strings.Contains(rec.Body.String(), hook.Secret) {
+		t.Errorf("jobWebhooksHandler failed: unexpected webhook %d %s", rec.Code, rec.Body)
+	}
+	if rec := request(http.MethodGet, "/webhooks/"+hook.Id+"/deliveries", ""); rec.Code != http.StatusOK ||
+		strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("jobWebhooksHandler failed: unexpected deliveries %d %s", rec.Code, rec.Body)
+	}
+	if rec := request(http.MethodDelete, "/webhooks/"+hook.Id, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("jobWebhooksHandler failed: expected 204 got %d", rec.Code)
+	}
+	if rec := request(http.MethodGet, "/webhooks/"+hook.Id+"/deliveries", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("jobWebhooksHandler failed: expected 404 got %d", rec.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/webhooks", nil)
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("jobWebhooksHandler failed: expected 403 without admin token got %d", rec.Code)
+	}
+}
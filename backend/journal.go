@@ -0,0 +1,115 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// A job the runner started, kept in the journal until it's done
+type JournalEntry struct {
+	JobId     string    `json:"job_id"`
+	Commit    Commit    `json:"commit"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// JobJournal persists the jobs running on a runner to a JSON file, so that
+// after a restart the runner knows which containers belong to jobs it was
+// running
+type JobJournal struct {
+	mutex   sync.Mutex
+	path    string
+	entries map[string]JournalEntry
+}
+
+// OpenJobJournal loads the journal at path, a missing file is an empty one
+func OpenJobJournal(path string) (*JobJournal, error) {
+	j := &JobJournal{path: path, entries: map[string]JournalEntry{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &j.entries); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// save writes the journal to a temporary file renamed over the previous one,
+// so a crash never leaves it truncated
+func (j *JobJournal) save() error {
+	data, err := json.Marshal(j.entries)
+	if err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+func (j *JobJournal) Add(jobId string, commit Commit) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.entries[jobId] = JournalEntry{jobId, commit, time.Now()}
+	return j.save()
+}
+
+func (j *JobJournal) Remove(jobId string) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if _, ok := j.entries[jobId]; !ok {
+		return nil
+	}
+	delete(j.entries, jobId)
+	return j.save()
+}
+
+func (j *JobJournal) Get(jobId string) (JournalEntry, bool) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	entry, ok := j.entries[jobId]
+	return entry, ok
+}
+
+// Entries returns the journaled jobs
+func (j *JobJournal) Entries() []JournalEntry {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	entries := make([]JournalEntry, 0, len(j.entries))
+	for _, entry := range j.entries {
+		entries = append(entries, entry)
+	}
+	return entries
+}
@@ -0,0 +1,63 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestJobJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "narwhal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "journal.json")
+	journal, err := OpenJobJournal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := Commit{Id: "a", Repository: Repository{GitHub, "octocat/test", "master"}}
+	journal.Add("job-1", commit)
+	journal.Add("job-2", commit)
+	journal.Remove("job-1")
+
+	// A restarted runner finds the jobs it was running
+	journal, err = OpenJobJournal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := journal.Entries(); len(entries) != 1 || entries[0].JobId != "job-2" {
+		t.Errorf("OpenJobJournal failed: unexpected entries %v", entries)
+	}
+	if entry, ok := journal.Get("job-2"); !ok || entry.Commit.Id != "a" {
+		t.Errorf("JobJournal.Get failed: unexpected %v", entry)
+	}
+}
@@ -0,0 +1,63 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestKeyedMutex(t *testing.T) {
+	var locks keyedMutex
+	var wg sync.WaitGroup
+	counters := map[string]*int{"a": new(int), "b": new(int)}
+	for i := 0; i < 100; i++ {
+		for key, counter := range counters {
+			wg.Add(1)
+			go func(key string, counter *int) {
+				defer wg.Done()
+				locks.Lock(key)
+				defer locks.Unlock(key)
+				*counter++
+			}(key, counter)
+		}
+	}
+	wg.Wait()
+	for key, counter := range counters {
+		if *counter != 100 {
+			t.Errorf("keyedMutex failed: expected 100 got %d for %s", *counter, key)
+		}
+	}
+	if len(locks.locks) != 0 {
+		t.Errorf("keyedMutex failed: expected the locks dropped got %d", len(locks.locks))
+	}
+	// Other keys are not held back
+	locks.Lock("a")
+	locks.Lock("b")
+	locks.Unlock("b")
+	locks.Unlock("a")
+}
@@ -0,0 +1,120 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrNotSealed is returned opening a payload that was not encrypted
+var ErrNotSealed = errors.New("payload not encrypted")
+
+// sealedPayload is the envelope of an encrypted payload, naming the key it
+// was encrypted with
+type sealedPayload struct {
+	KeyId string `json:"kid"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"sealed"`
+}
+
+// Keyring holds the AES-256 keys shared by the agents and the dispatchers to
+// encrypt the payloads published on the message queue. Payloads are sealed
+// with the current key and opened with the one they name, so that keys can
+// be rotated by adding the new one to the dispatchers first, then making it
+// current on the agents and finally dropping the old one.
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// ParseKeyring reads a keyring from a comma separated list of id:key pairs,
+// keys are base64 encoded 32 bytes and the first one is the current, e.g.
+// 2021-02:q83vEjRWeJq83vEjRWeJq83vEjRWeJq83vEjRWeJq8M=,2021-01:...
+func ParseKeyring(spec string) (*Keyring, error) {
+	keyring := &Keyring{keys: map[string]cipher.AEAD{}}
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid key %q, expected id:base64", pair)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("key %s must be 32 base64 encoded bytes", parts[0])
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if keyring.current == "" {
+			keyring.current = parts[0]
+		}
+		keyring.keys[parts[0]] = aead
+	}
+	return keyring, nil
+}
+
+// Seal encrypts a payload with the current key, authenticating its id too
+func (k *Keyring) Seal(payload []byte) ([]byte, error) {
+	aead := k.keys[k.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealedPayload{k.current, nonce, aead.Seal(nil, nonce, payload, []byte(k.current))})
+}
+
+// Open decrypts a sealed payload with the key it names
+func (k *Keyring) Open(sealed []byte) ([]byte, error) {
+	var envelope sealedPayload
+	if err := json.Unmarshal(sealed, &envelope); err != nil || envelope.Data == nil {
+		return nil, ErrNotSealed
+	}
+	aead, ok := k.keys[envelope.KeyId]
+	if !ok {
+		return nil, fmt.Errorf("payload sealed with unknown key %q", envelope.KeyId)
+	}
+	if len(envelope.Nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid payload nonce")
+	}
+	payload, err := aead.Open(nil, envelope.Nonce, envelope.Data, []byte(envelope.KeyId))
+	if err != nil {
+		return nil, fmt.Errorf("payload not authentic: %v", err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,61 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import "testing"
+
+func TestKeyringRotation(t *testing.T) {
+	old := "2021-01:AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+	current := "2021-02:HxkdHBsaGRgXFhUUExIREA8ODQwLCgkIBwYFBAMCAQA="
+	agent, err := ParseKeyring(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := agent.Seal([]byte(`{"id": "abc"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Dispatchers knowing both keys open the payloads sealed with either
+	dispatcher, err := ParseKeyring(current + "," + old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload, err := dispatcher.Open(sealed); err != nil || string(payload) != `{"id": "abc"}` {
+		t.Errorf("Keyring.Open failed: unexpected payload %q %v", payload, err)
+	}
+	if _, err := dispatcher.Open([]byte(`{"id": "abc"}`)); err != ErrNotSealed {
+		t.Errorf("Keyring.Open failed: expected ErrNotSealed got %v", err)
+	}
+	rotated, _ := ParseKeyring(current)
+	if _, err := rotated.Open(sealed); err == nil {
+		t.Errorf("Keyring.Open failed: payload opened with a dropped key")
+	}
+	if _, err := ParseKeyring("short:AAEC"); err == nil {
+		t.Errorf("ParseKeyring failed: short key accepted")
+	}
+}
@@ -0,0 +1,62 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+// Version of narwhal, set at build time with
+// -ldflags "-X github.com/codepr/narwhal/backend.Version=..."
+var Version = "dev"
+
+// Labels applied to the step containers, so that operators and the runner
+// reconciliation can tell the narwhal owned ones apart
+const (
+	jobIdLabel      string = "narwhal.job_id"
+	stepLabel       string = "narwhal.step"
+	repositoryLabel string = "narwhal.repository"
+	commitLabel     string = "narwhal.commit"
+	versionLabel    string = "narwhal.version"
+	runnerIdLabel   string = "narwhal.runner_id"
+)
+
+// containerLabels returns the labels of the container of a step, owned by the
+// runner
+func (r *Runner) containerLabels(jobId string, commit Commit, step Step) map[string]string {
+	return map[string]string{
+		runnerIdLabel:   r.id,
+		jobIdLabel:      jobId,
+		stepLabel:       step.Name,
+		repositoryLabel: commit.GetRepositoryName(),
+		commitLabel:     commit.Id,
+		versionLabel:    Version,
+	}
+}
+
+// ownedLabel returns the label filter matching the containers, volumes and
+// networks of the runner, runners sharing a Docker daemon leave each other's
+// ones alone
+func (r *Runner) ownedLabel() string {
+	return runnerIdLabel + "=" + r.id
+}
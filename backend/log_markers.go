@@ -0,0 +1,155 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Prefix of the marker lines the runner injects in the job logs
+const logMarkerPrefix string = "::narwhal::"
+
+// Kinds of log markers
+const (
+	StepStartMarker string = "step-start"
+	StepEndMarker   string = "step-end"
+)
+
+// LogMarker delimits the output of a step in the job logs, so that the steps
+// can be folded and timed from the log stream alone
+type LogMarker struct {
+	Kind     string     `json:"-"`
+	Step     string     `json:"step"`
+	Status   StepStatus `json:"status,omitempty"`
+	ExitCode int        `json:"exit_code,omitempty"`
+}
+
+// LogLine is a line of the job logs split in its parts
+type LogLine struct {
+	// Time elapsed since the job started on the runner, unknown on lines
+	// without a timestamp
+	Elapsed time.Duration
+	// Set on marker lines only
+	Marker *LogMarker
+	Text   []byte
+}
+
+var logTimestampRegexp = regexp.MustCompile(`^\[(\d+)\.(\d{3})\] `)
+
+// ParseLogLine splits a line of the job logs in its timestamp, the marker
+// it carries, if any, and the output of the step
+func ParseLogLine(line []byte) LogLine {
+	parsed := LogLine{Text: line}
+	if match := logTimestampRegexp.FindSubmatch(line); match != nil {
+		seconds, _ := strconv.ParseInt(string(match[1]), 10, 64)
+		millis, _ := strconv.ParseInt(string(match[2]), 10, 64)
+		parsed.Elapsed = time.Duration(seconds)*time.Second + time.Duration(millis)*time.Millisecond
+		parsed.Text = line[len(match[0]):]
+	}
+	if bytes.HasPrefix(parsed.Text, []byte(logMarkerPrefix)) {
+		fields := bytes.SplitN(bytes.TrimRight(parsed.Text[len(logMarkerPrefix):], "\r\n"), []byte(" "), 2)
+		marker := &LogMarker{Kind: string(fields[0])}
+		if len(fields) == 2 && json.Unmarshal(fields[1], marker) == nil {
+			parsed.Marker = marker
+		}
+	}
+	return parsed
+}
+
+// jobLogStream ships the output of a job prefixing every line with the time
+// elapsed since the job started, read from the monotonic clock, and delimits
+// the steps with markers, the same for every destination of the output
+type jobLogStream struct {
+	out       io.Writer
+	startedAt time.Time
+	lineStart bool
+}
+
+func newJobLogStream(out io.Writer) *jobLogStream {
+	return &jobLogStream{out: out, startedAt: time.Now(), lineStart: true}
+}
+
+func (s *jobLogStream) Write(p []byte) (int, error) {
+	n := len(p)
+	elapsed := time.Since(s.startedAt)
+	prefix := fmt.Sprintf("[%d.%03d] ", elapsed/time.Second, elapsed%time.Second/time.Millisecond)
+	stamped := make([]byte, 0, n+len(prefix))
+	for len(p) > 0 {
+		if s.lineStart {
+			stamped = append(stamped, prefix...)
+			s.lineStart = false
+		}
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			stamped = append(stamped, p...)
+			break
+		}
+		stamped = append(stamped, p[:i+1]...)
+		p = p[i+1:]
+		s.lineStart = true
+	}
+	s.out.Write(stamped)
+	return n, nil
+}
+
+// step returns the stream of the output of a step, shipped to the given
+// writers too, e.g. the log sinks, stamped from the start of the job
+func (s *jobLogStream) step(writers ...io.WriteCloser) *jobLogStream {
+	outs := []io.Writer{s.out}
+	for _, w := range writers {
+		outs = append(outs, w)
+	}
+	return &jobLogStream{out: io.MultiWriter(outs...), startedAt: s.startedAt, lineStart: true}
+}
+
+// mark writes a marker on a line of its own
+func (s *jobLogStream) mark(marker LogMarker) {
+	if s == nil {
+		return
+	}
+	if !s.lineStart {
+		s.Write([]byte("\n"))
+	}
+	data, _ := json.Marshal(marker)
+	s.Write([]byte(logMarkerPrefix + marker.Kind + " " + string(data) + "\n"))
+}
+
+// StepStart marks the beginning of the output of a step
+func (s *jobLogStream) StepStart(step string) {
+	s.mark(LogMarker{Kind: StepStartMarker, Step: step})
+}
+
+// StepEnd marks the end of the output of a step, with its outcome
+func (s *jobLogStream) StepEnd(result StepResult) {
+	s.mark(LogMarker{Kind: StepEndMarker, Step: result.Name, Status: result.Status, ExitCode: result.ExitCode})
+}
@@ -0,0 +1,114 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestJobLogStream(t *testing.T) {
+	var out bytes.Buffer
+	stream := newJobLogStream(&out)
+	stream.StepStart("build")
+	stream.Write([]byte("compiling"))
+	stream.Write([]byte("... done\nlinking\n"))
+	stream.Write([]byte("no newline"))
+	stream.StepEnd(StepResult{Name: "build", Status: StepFailure, ExitCode: 2})
+
+	expected := []string{
+		`::narwhal::step-start {"step":"build"}`,
+		"compiling... done",
+		"linking",
+		"no newline",
+		`::narwhal::step-end {"step":"build","status":"failure","exit_code":2}`,
+	}
+	lines := logLines(out.Bytes())
+	if len(lines) != len(expected) {
+		t.Fatalf("jobLogStream failed: unexpected lines %q", out.String())
+	}
+	for i, line := range lines {
+		parsed := ParseLogLine(line)
+		if text := string(bytes.TrimRight(parsed.Text, "\n")); text != expected[i] {
+			t.Errorf("jobLogStream failed: expected %q got %q", expected[i], text)
+		}
+		if !logTimestampRegexp.Match(line) {
+			t.Errorf("jobLogStream failed: missing timestamp on %q", line)
+		}
+	}
+	if marker := ParseLogLine(lines[4]).Marker; marker == nil || marker.Kind != StepEndMarker ||
+		marker.Step != "build" || marker.Status != StepFailure || marker.ExitCode != 2 {
+		t.Errorf("ParseLogLine failed: unexpected marker %v", marker)
+	}
+}
+
+// bufferCloser is a sink writer recording its output
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error {
+	return nil
+}
+
+func TestJobLogStreamStep(t *testing.T) {
+	var out bytes.Buffer
+	sink := &bufferCloser{}
+	step := newJobLogStream(&out).step(sink)
+	step.StepStart("build")
+	step.Write([]byte("compiling\nlinking\n"))
+	step.StepEnd(StepResult{Name: "build", Status: StepSuccess})
+	// The sinks get the same stamped lines and markers as the dispatcher
+	if sink.String() != out.String() {
+		t.Errorf("jobLogStream.step failed: expected %q on the sink got %q", out.String(), sink.String())
+	}
+	lines := logLines(sink.Bytes())
+	if len(lines) != 4 || ParseLogLine(lines[0]).Marker == nil || ParseLogLine(lines[3]).Marker == nil {
+		t.Fatalf("jobLogStream.step failed: expected the step delimited by markers got %q", sink.String())
+	}
+	for _, line := range lines {
+		if !logTimestampRegexp.Match(line) {
+			t.Errorf("jobLogStream.step failed: missing timestamp on %q", line)
+		}
+	}
+}
+
+func TestParseLogLine(t *testing.T) {
+	parsed := ParseLogLine([]byte("[62.045] ::narwhal::step-start {\"step\":\"test\"}\n"))
+	if parsed.Elapsed != 62*time.Second+45*time.Millisecond {
+		t.Errorf("ParseLogLine failed: unexpected elapsed time %s", parsed.Elapsed)
+	}
+	if parsed.Marker == nil || parsed.Marker.Kind != StepStartMarker || parsed.Marker.Step != "test" {
+		t.Errorf("ParseLogLine failed: unexpected marker %v", parsed.Marker)
+	}
+	// Lines logged before the timestamps are returned as-is
+	parsed = ParseLogLine([]byte("--- step build\n"))
+	if parsed.Elapsed != 0 || parsed.Marker != nil || string(parsed.Text) != "--- step build\n" {
+		t.Errorf("ParseLogLine failed: unexpected line %v", parsed)
+	}
+}
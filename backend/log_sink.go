@@ -0,0 +1,358 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of log lines buffered before shipping them to a remote sink
+const logSinkBatchSize int = 100
+
+// LogSink is an external destination where job logs are shipped while the
+// steps are running, in addition to the local output of the runner
+type LogSink interface {
+	// Open returns a writer receiving the output of a step of a commit job,
+	// closing it flushes any pending line
+	Open(commit Commit, step string) io.WriteCloser
+}
+
+// S3Credentials sign the requests of the s3 log sink, an empty region means
+// us-east-1
+type S3Credentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Region          string
+}
+
+// NewLogSink creates a sink from a `kind=url` specification, supported kinds
+// are `loki` (base URL of the Loki server), `elasticsearch` (base URL of the
+// cluster followed by the index name, e.g. http://localhost:9200/logs) and
+// `s3` (endpoint followed by the bucket and an optional key prefix, e.g.
+// https://s3.eu-west-1.amazonaws.com/bucket/narwhal), the latter signed with
+// the given credentials
+func NewLogSink(spec string, credentials S3Credentials) (LogSink, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid log sink %q, expected kind=url", spec)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	url := strings.TrimRight(parts[1], "/")
+	switch parts[0] {
+	case "loki":
+		return lokiSink{url, client}, nil
+	case "elasticsearch":
+		return elasticsearchSink{url, client}, nil
+	case "s3":
+		return newS3Sink(url, credentials, client)
+	}
+	return nil, fmt.Errorf("%s log sink not supported", parts[0])
+}
+
+type logLine struct {
+	Timestamp time.Time
+	Line      string
+}
+
+// lineBatcher splits the stream written into it into lines, handing them in
+// batches to a flush function
+type lineBatcher struct {
+	mutex   sync.Mutex
+	partial bytes.Buffer
+	lines   []logLine
+	flush   func([]logLine) error
+}
+
+func newLineBatcher(flush func([]logLine) error) *lineBatcher {
+	return &lineBatcher{flush: flush, lines: make([]logLine, 0, logSinkBatchSize)}
+}
+
+func (b *lineBatcher) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.partial.Write(p)
+	for {
+		i := bytes.IndexByte(b.partial.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := string(b.partial.Next(i + 1))
+		b.lines = append(b.lines, logLine{time.Now(), strings.TrimRight(line, "\r\n")})
+		if len(b.lines) >= logSinkBatchSize {
+			b.ship()
+		}
+	}
+	return len(p), nil
+}
+
+// ship flushes the buffered lines, remote failures are only logged as the
+// sink must never break the job execution
+func (b *lineBatcher) ship() {
+	if len(b.lines) == 0 {
+		return
+	}
+	if err := b.flush(b.lines); err != nil {
+		log.Printf("Error shipping logs: %v\n", err)
+	}
+	b.lines = b.lines[:0]
+}
+
+func (b *lineBatcher) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.partial.Len() > 0 {
+		b.lines = append(b.lines, logLine{time.Now(), b.partial.String()})
+		b.partial.Reset()
+	}
+	b.ship()
+	return nil
+}
+
+func postJSON(client *http.Client, url, contentType string, body []byte) error {
+	res, err := client.Post(url, contentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%s answered with status %d", url, res.StatusCode)
+	}
+	return nil
+}
+
+// lokiSink pushes lines through the Loki HTTP push API, labelling the stream
+// with repository, commit and step
+type lokiSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s lokiSink) Open(commit Commit, step string) io.WriteCloser {
+	labels := map[string]string{
+		"job":        "narwhal",
+		"repository": commit.GetRepositoryName(),
+		"commit":     commit.Id,
+		"step":       step,
+	}
+	return newLineBatcher(func(lines []logLine) error {
+		values := make([][2]string, len(lines))
+		for i, l := range lines {
+			values[i] = [2]string{strconv.FormatInt(l.Timestamp.UnixNano(), 10), l.Line}
+		}
+		payload, err := json.Marshal(map[string]interface{}{
+			"streams": []interface{}{
+				map[string]interface{}{"stream": labels, "values": values},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		return postJSON(s.client, s.url+"/loki/api/v1/push", "application/json", payload)
+	})
+}
+
+// elasticsearchSink indexes every line as a document through the bulk API
+type elasticsearchSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s elasticsearchSink) Open(commit Commit, step string) io.WriteCloser {
+	return newLineBatcher(func(lines []logLine) error {
+		var body bytes.Buffer
+		encoder := json.NewEncoder(&body)
+		for _, l := range lines {
+			encoder.Encode(map[string]interface{}{"index": map[string]string{}})
+			encoder.Encode(map[string]interface{}{
+				"@timestamp": l.Timestamp,
+				"repository": commit.GetRepositoryName(),
+				"commit":     commit.Id,
+				"step":       step,
+				"message":    l.Line,
+			})
+		}
+		return postJSON(s.client, s.url+"/_bulk", "application/x-ndjson", body.Bytes())
+	})
+}
+
+// s3Sink uploads every batch of lines as an object, objects can't be appended
+// to. The keys are numbered in order under prefix/repository/commit/step.
+type s3Sink struct {
+	endpoint    string
+	bucket      string
+	prefix      string
+	credentials S3Credentials
+	client      *http.Client
+}
+
+func newS3Sink(rawURL string, credentials S3Credentials, client *http.Client) (*s3Sink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 log sink: %v", err)
+	}
+	path := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if u.Host == "" || path[0] == "" {
+		return nil, fmt.Errorf("invalid s3 log sink %q, expected endpoint/bucket[/prefix]", rawURL)
+	}
+	if credentials.AccessKeyId == "" || credentials.SecretAccessKey == "" {
+		return nil, fmt.Errorf("s3 log sink requires credentials")
+	}
+	if credentials.Region == "" {
+		credentials.Region = "us-east-1"
+	}
+	sink := &s3Sink{
+		endpoint:    u.Scheme + "://" + u.Host,
+		bucket:      path[0],
+		credentials: credentials,
+		client:      client,
+	}
+	if len(path) == 2 {
+		sink.prefix = path[1]
+	}
+	return sink, nil
+}
+
+func (s *s3Sink) Open(commit Commit, step string) io.WriteCloser {
+	segments := []string{commit.GetRepositoryName(), commit.Id, step}
+	if s.prefix != "" {
+		segments = append([]string{s.prefix}, segments...)
+	}
+	key := strings.Join(segments, "/")
+	part := 0
+	return newLineBatcher(func(lines []logLine) error {
+		var body bytes.Buffer
+		for _, l := range lines {
+			body.WriteString(l.Line)
+			body.WriteByte('\n')
+		}
+		part++
+		return s.put(fmt.Sprintf("%s/%06d.log", key, part), body.Bytes(), time.Now())
+	})
+}
+
+// put uploads an object, signing the request with AWS signature version 4
+func (s *s3Sink) put(key string, body []byte, now time.Time) error {
+	path := "/" + awsEscape(s.bucket) + "/" + awsEscape(key)
+	req, err := http.NewRequest(http.MethodPut, s.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	s.sign(req, path, body, now)
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%s answered with status %d", s.endpoint, res.StatusCode)
+	}
+	return nil
+}
+
+func (s *s3Sink) sign(req *http.Request, path string, body []byte, now time.Time) {
+	stamp := now.UTC().Format("20060102T150405Z")
+	date := stamp[:8]
+	payloadHash := sha256Hex(body)
+	headers := map[string]string{
+		"content-type":         req.Header.Get("Content-Type"),
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           stamp,
+	}
+	if s.credentials.SessionToken != "" {
+		headers["x-amz-security-token"] = s.credentials.SessionToken
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+		if name != "host" {
+			req.Header.Set(name, headers[name])
+		}
+	}
+	signed := strings.Join(names, ";")
+	request := strings.Join([]string{req.Method, path, "", canonical.String(), signed, payloadHash}, "\n")
+	scope := date + "/" + s.credentials.Region + "/s3/aws4_request"
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", stamp, scope, sha256Hex([]byte(request))}, "\n")
+	key := awsSigningKey(s.credentials.SecretAccessKey, date, s.credentials.Region, "s3")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.credentials.AccessKeyId, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func awsSigningKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// awsEscape encodes every byte but the unreserved characters and the slashes
+// separating the segments of a key, as the signature expects
+func awsEscape(key string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
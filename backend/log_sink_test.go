@@ -0,0 +1,107 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLokiSink(t *testing.T) {
+	var pushed []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Streams []struct {
+				Stream map[string]string `json:"stream"`
+				Values [][2]string       `json:"values"`
+			} `json:"streams"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		for _, v := range payload.Streams[0].Values {
+			pushed = append(pushed, v[1])
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink, err := NewLogSink("loki="+server.URL, S3Credentials{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sink.Open(Commit{Id: "abc"}, "test")
+	w.Write([]byte("first line\nsecond "))
+	w.Write([]byte("line\nno newline"))
+	w.Close()
+	if len(pushed) != 3 || pushed[1] != "second line" || pushed[2] != "no newline" {
+		t.Errorf("lokiSink failed: unexpected lines %q", pushed)
+	}
+}
+
+func TestS3Sink(t *testing.T) {
+	objects := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != http.MethodPut || r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) ||
+			!strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") ||
+			!strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/s3/aws4_request") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		objects[r.URL.EscapedPath()] = string(body)
+	}))
+	defer server.Close()
+
+	if _, err := NewLogSink("s3="+server.URL+"/bucket", S3Credentials{}); err == nil {
+		t.Errorf("NewLogSink failed: expected an error without credentials")
+	}
+	sink, err := NewLogSink("s3="+server.URL+"/bucket/ci", S3Credentials{"AKID", "secret", "", "eu-west-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sink.Open(Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "master"}}, "unit tests")
+	w.Write([]byte("first line\nsecond line\n"))
+	w.Close()
+	expected := map[string]string{"/bucket/ci/octocat/test/abc/unit%20tests/000001.log": "first line\nsecond line\n"}
+	if !reflect.DeepEqual(objects, expected) {
+		t.Errorf("s3Sink failed: expected %v got %v", expected, objects)
+	}
+}
+
+func TestAWSSigningKey(t *testing.T) {
+	// Example of the AWS signature version 4 documentation
+	key := awsSigningKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam")
+	expected := "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"
+	if hex.EncodeToString(key) != expected {
+		t.Errorf("awsSigningKey failed: expected %s got %x", expected, key)
+	}
+}
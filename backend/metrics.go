@@ -0,0 +1,157 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics is a minimal registry of counters and gauges, served in the
+// Prometheus text exposition format
+type Metrics struct {
+	mutex    sync.Mutex
+	counters map[string]float64
+	gauges   map[string]func() []Sample
+	help     map[string]string
+}
+
+// Sample is a value of a gauge, with its labels if any
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters: map[string]float64{},
+		gauges:   map[string]func() []Sample{},
+		help:     map[string]string{},
+	}
+}
+
+// Register declares a counter with its description, starting from zero
+func (m *Metrics) Register(name, help string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.counters[name]; !ok {
+		m.counters[name] = 0
+	}
+	m.help[name] = help
+}
+
+// RegisterGauge declares a gauge with its description, its samples are
+// collected on every scrape
+func (m *Metrics) RegisterGauge(name, help string, collect func() []Sample) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.gauges[name] = collect
+	m.help[name] = help
+}
+
+func (m *Metrics) Inc(name string) {
+	m.Add(name, 1)
+}
+
+func (m *Metrics) Add(name string, value float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.counters[name] += value
+}
+
+func (m *Metrics) Get(name string) float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.counters[name]
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	counters := make(map[string]float64, len(m.counters))
+	for name, value := range m.counters {
+		counters[name] = value
+	}
+	gauges := make(map[string]func() []Sample, len(m.gauges))
+	for name, collect := range m.gauges {
+		gauges[name] = collect
+	}
+	help := make(map[string]string, len(m.help))
+	for name, text := range m.help {
+		help[name] = text
+	}
+	m.mutex.Unlock()
+	names := make([]string, 0, len(counters)+len(gauges))
+	for name := range counters {
+		names = append(names, name)
+	}
+	for name := range gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		collect, gauge := gauges[name]
+		if text, ok := help[name]; ok {
+			kind := "counter"
+			if gauge {
+				kind = "gauge"
+			}
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, text, name, kind)
+		}
+		if !gauge {
+			fmt.Fprintf(w, "%s %v\n", name, counters[name])
+			continue
+		}
+		// Collected out of the lock, as gauges may take their own
+		for _, sample := range collect() {
+			fmt.Fprintf(w, "%s%s %v\n", name, formatLabels(sample.Labels), sample.Value)
+		}
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders the labels of a sample sorted by name, e.g.
+// {repository="octocat/test"}
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(labels[name]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
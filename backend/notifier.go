@@ -0,0 +1,94 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+type RunnerEventType string
+
+const (
+	RunnerRegistered RunnerEventType = "registered"
+	RunnerDied       RunnerEventType = "died"
+	RunnerRecovered  RunnerEventType = "recovered"
+	RunnerDraining   RunnerEventType = "draining"
+	RunnerRemoved    RunnerEventType = "removed"
+)
+
+// Payload sent to the webhooks on every runner lifecycle change
+type RunnerEvent struct {
+	Event     RunnerEventType `json:"event"`
+	Runner    RunnerInfo      `json:"runner"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+// WebhookNotifier POSTs JSON encoded events to a set of URLs, delivery is
+// best-effort and doesn't block the caller
+type WebhookNotifier struct {
+	urls   []string
+	client *http.Client
+}
+
+func NewWebhookNotifier(urls ...string) *WebhookNotifier {
+	return &WebhookNotifier{urls, &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (n *WebhookNotifier) Notify(event interface{}) {
+	if n == nil || len(n.urls) == 0 {
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding webhook event: %v\n", err)
+		return
+	}
+	for _, url := range n.urls {
+		go func(url string) {
+			res, err := n.client.Post(url, "application/json", bytes.NewReader(payload))
+			if err != nil {
+				log.Printf("Error delivering webhook to %s: %v\n", url, err)
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode >= 300 {
+				log.Printf("Webhook %s answered with status %d\n", url, res.StatusCode)
+			}
+		}(url)
+	}
+}
+
+func (n *WebhookNotifier) notifyRunnerEvent(event RunnerEventType, runner *RunnerProxy) {
+	if event == "" {
+		return
+	}
+	n.Notify(RunnerEvent{event, runner.Info(false), time.Now()})
+}
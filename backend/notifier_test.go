@@ -0,0 +1,99 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRunnerProxySetAlive(t *testing.T) {
+	runner := NewRunnerProxy("127.0.0.1:9898")
+	for i, c := range []struct {
+		alive    bool
+		expected RunnerEventType
+	}{
+		{false, ""},
+		{true, RunnerRegistered},
+		{true, ""},
+		{false, RunnerDied},
+		{false, ""},
+		{true, RunnerRecovered},
+	} {
+		if event := runner.SetAlive(c.alive); event != c.expected {
+			t.Errorf("RunnerProxy.SetAlive failed: expected %q at heartbeat %d got %q", c.expected, i, event)
+		}
+	}
+}
+
+func TestRunnerWebhooks(t *testing.T) {
+	events := make(chan RunnerEvent, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event RunnerEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer server.Close()
+	runner := NewRunnerProxy("127.0.0.1:9898")
+	d := NewDispatcher("commits", time.Second, []*RunnerProxy{runner},
+		WithAdminToken("secret"), WithRunnerWebhooks(server.URL))
+	drain := func() {
+		req := httptest.NewRequest(http.MethodPost, "/runners/"+runner.Id+"/drain", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		runnersHandler(d)(httptest.NewRecorder(), req)
+	}
+
+	drain()
+	select {
+	case event := <-events:
+		if event.Event != RunnerDraining || event.Runner.Id != runner.Id || !event.Runner.Draining {
+			t.Errorf("runnersHandler failed: expected the draining event got %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("runnersHandler failed: expected the draining event notified")
+	}
+	// Draining again changes nothing, nor is notified
+	drain()
+	d.runnerNotifier.notifyRunnerEvent(runner.SetAlive(true), runner)
+	select {
+	case event := <-events:
+		if event.Event != RunnerRegistered {
+			t.Errorf("WebhookNotifier failed: expected the registered event got %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("WebhookNotifier failed: expected the registered event notified")
+	}
+	d.runnerNotifier.notifyRunnerEvent(runner.SetAlive(true), runner)
+	select {
+	case event := <-events:
+		t.Errorf("WebhookNotifier failed: unexpected %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
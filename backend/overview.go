@@ -0,0 +1,131 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"net/http"
+	"sort"
+)
+
+// Overview is a snapshot of the jobs running and waiting, feeding capacity
+// dashboards
+type Overview struct {
+	RunningJobs int          `json:"running_jobs"`
+	QueueDepth  int          `json:"queue_depth"`
+	Runners     []RunnerLoad `json:"runners"`
+	// Jobs running for each repository, the idle ones are left out
+	Repositories map[string]int `json:"repositories"`
+}
+
+// RunnerLoad is the number of jobs running on a runner
+type RunnerLoad struct {
+	Id          string `json:"id"`
+	Addr        string `json:"addr"`
+	Alive       bool   `json:"alive"`
+	Draining    bool   `json:"draining"`
+	RunningJobs int    `json:"running_jobs"`
+}
+
+// overview counts the jobs running on each runner and for each repository
+func (d *Dispatcher) overview() Overview {
+	overview := Overview{
+		QueueDepth:   d.queue.Len(),
+		Runners:      []RunnerLoad{},
+		Repositories: map[string]int{},
+	}
+	for _, runner := range d.runnerList() {
+		info := runner.Info(false)
+		overview.Runners = append(overview.Runners, RunnerLoad{
+			Id:          info.Id,
+			Addr:        info.Addr,
+			Alive:       info.Alive,
+			Draining:    info.Draining,
+			RunningJobs: len(info.CurrentJobs),
+		})
+		overview.RunningJobs += len(info.CurrentJobs)
+		for _, commit := range info.CurrentJobs {
+			overview.Repositories[commit.GetRepositoryName()]++
+		}
+	}
+	sort.Slice(overview.Runners, func(i, j int) bool {
+		return overview.Runners[i].Id < overview.Runners[j].Id
+	})
+	return overview
+}
+
+// registerOverviewGauges exports the overview as Prometheus gauges
+func (d *Dispatcher) registerOverviewGauges() {
+	d.metrics.RegisterGauge("narwhal_running_jobs", "Jobs currently running on the runners",
+		func() []Sample {
+			return []Sample{{Value: float64(d.overview().RunningJobs)}}
+		})
+	d.metrics.RegisterGauge("narwhal_queue_depth", "Jobs waiting to be dispatched to a runner",
+		func() []Sample {
+			return []Sample{{Value: float64(d.queue.Len())}}
+		})
+	d.metrics.RegisterGauge("narwhal_runner_running_jobs", "Jobs currently running on each runner",
+		func() []Sample {
+			var samples []Sample
+			for _, runner := range d.overview().Runners {
+				samples = append(samples, Sample{
+					Labels: map[string]string{"runner": runner.Id, "addr": runner.Addr},
+					Value:  float64(runner.RunningJobs),
+				})
+			}
+			return samples
+		})
+	d.metrics.RegisterGauge("narwhal_repository_running_jobs",
+		"Jobs currently running for each repository with any",
+		func() []Sample {
+			var samples []Sample
+			for repository, jobs := range d.overview().Repositories {
+				samples = append(samples, Sample{
+					Labels: map[string]string{"repository": repository},
+					Value:  float64(jobs),
+				})
+			}
+			sort.Slice(samples, func(i, j int) bool {
+				return samples[i].Labels["repository"] < samples[j].Labels["repository"]
+			})
+			return samples
+		})
+}
+
+// overviewHandler serves the jobs running on each runner and for each
+// repository, and the depth of the queue on GET /admin/overview
+func overviewHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !d.authorize(w, r, PermissionView, "") {
+			return
+		}
+		writeJSON(w, http.StatusOK, d.overview())
+	}
+}
@@ -0,0 +1,72 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOverview(t *testing.T) {
+	busy, idle := NewRunnerProxy("10.0.0.1:9898"), NewRunnerProxy("10.0.0.2:9898")
+	d := NewDispatcher("commits", time.Second, []*RunnerProxy{busy, idle})
+	busy.startJob(Commit{Id: "a", Repository: Repository{GitHub, "octocat/test", "master"}})
+	busy.startJob(Commit{Id: "b", Repository: Repository{GitHub, "octocat/test", "dev"}})
+	idle.startJob(Commit{Id: "c", Repository: Repository{GitHub, "octocat/web", "master"}})
+	idle.finishJob(Commit{Id: "c", Repository: Repository{GitHub, "octocat/web", "master"}}, "OK")
+	d.queue.Push("job", Commit{Id: "d", Repository: Repository{GitHub, "octocat/web", "master"}})
+
+	w := httptest.NewRecorder()
+	overviewHandler(d)(w, httptest.NewRequest("GET", "/admin/overview", nil))
+	var overview Overview
+	if err := json.NewDecoder(w.Body).Decode(&overview); err != nil {
+		t.Fatal(err)
+	}
+	if overview.RunningJobs != 2 || overview.QueueDepth != 1 || len(overview.Runners) != 2 ||
+		overview.Repositories["octocat/test"] != 2 || len(overview.Repositories) != 1 {
+		t.Errorf("overviewHandler failed: unexpected %+v", overview)
+	}
+
+	w = httptest.NewRecorder()
+	d.metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		"# TYPE narwhal_running_jobs gauge",
+		"narwhal_running_jobs 2",
+		"narwhal_queue_depth 1",
+		`narwhal_runner_running_jobs{addr="10.0.0.1:9898",runner="` + busy.Id + `"} 2`,
+		`narwhal_runner_running_jobs{addr="10.0.0.2:9898",runner="` + idle.Id + `"} 0`,
+		`narwhal_repository_running_jobs{repository="octocat/test"} 2`,
+		"# TYPE narwhal_poison_events_total counter",
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("Metrics.ServeHTTP failed: expected %q in\n%s", line, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"sync"
+	"time"
+)
+
+// Longest a worker waits for a runner before trying again, the backoff
+// doubles from noRunnerBackoff while no runner is available as the workers
+// are woken up as soon as one recovers anyway
+const maxNoRunnerBackoff time.Duration = 30 * time.Second
+
+// parkingLot holds the workers waiting for a runner to become available, so
+// that they resume dispatching on the first healthy heartbeat of a runner or
+// as soon as a job finishes, instead of on their next retry
+type parkingLot struct {
+	mutex  sync.Mutex
+	parked int
+	wakeup chan struct{}
+}
+
+func newParkingLot() *parkingLot {
+	return &parkingLot{wakeup: make(chan struct{})}
+}
+
+// ticket returns the channel closed on the next wake up, to be taken before
+// looking for a runner so that a runner recovering in between isn't missed
+func (p *parkingLot) ticket() <-chan struct{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.wakeup
+}
+
+// park blocks until the ticket is woken up or stop is closed, returning
+// true, or until the timeout fires
+func (p *parkingLot) park(ticket <-chan struct{}, timeout <-chan time.Time, stop <-chan struct{}) bool {
+	p.mutex.Lock()
+	p.parked++
+	p.mutex.Unlock()
+	defer func() {
+		p.mutex.Lock()
+		p.parked--
+		p.mutex.Unlock()
+	}()
+	select {
+	case <-ticket:
+		return true
+	case <-stop:
+		return true
+	case <-timeout:
+		return false
+	}
+}
+
+// unpark wakes up every parked worker, returning how many were parked
+func (p *parkingLot) unpark() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	close(p.wakeup)
+	p.wakeup = make(chan struct{})
+	return p.parked
+}
+
+// nextBackoff doubles a no runner backoff up to maxNoRunnerBackoff
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff *= 2; backoff > maxNoRunnerBackoff {
+		return maxNoRunnerBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,114 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestNextBackoff(t *testing.T) {
+	backoff := noRunnerBackoff
+	for i := 0; i < 10; i++ {
+		backoff = nextBackoff(backoff)
+	}
+	if backoff != maxNoRunnerBackoff {
+		t.Errorf("Expected the backoff capped at %v got %v", maxNoRunnerBackoff, backoff)
+	}
+}
+
+func TestDispatchWorkerParking(t *testing.T) {
+	clock := newFakeClock()
+	d := NewDispatcher("commits", time.Second, nil, WithClock(clock),
+		WithRandomness(bytes.NewReader(make([]byte, 256))))
+	d.enqueue(Commit{Id: "abc"})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		d.dispatchWorker(stop)
+		close(done)
+	}()
+
+	// With zeroed randomness the jitter is the shortest, half the backoff
+	for _, expected := range []time.Duration{noRunnerBackoff / 2, noRunnerBackoff} {
+		if backoff := <-clock.requested; backoff != expected {
+			t.Fatalf("Expected a backoff of %v got %v", expected, backoff)
+		}
+		clock.Advance(expected)
+	}
+	if backoff := <-clock.requested; backoff != 2*noRunnerBackoff {
+		t.Fatalf("Expected a backoff of %v got %v", 2*noRunnerBackoff, backoff)
+	}
+
+	// A runner recovering wakes the worker up right away, resetting its backoff
+	deadline := time.Now().Add(5 * time.Second)
+	for d.parking.unpark() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case backoff := <-clock.requested:
+		if backoff != noRunnerBackoff/2 {
+			t.Errorf("Expected the backoff reset to %v got %v", noRunnerBackoff/2, backoff)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the parked worker woken up")
+	}
+	close(stop)
+	clock.Advance(maxNoRunnerBackoff)
+	<-done
+}
+
+func TestFinishJobUnparks(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil)
+	runner := NewRunnerProxy("127.0.0.1:9898")
+	commit := Commit{Id: "abc"}
+	runner.startJob(commit)
+	woken := make(chan bool)
+	go func() {
+		woken <- d.parking.park(d.parking.ticket(), nil, nil)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.parking.mutex.Lock()
+		parked := d.parking.parked
+		d.parking.mutex.Unlock()
+		if parked == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	d.finishJob(runner, commit, "OK")
+	select {
+	case ok := <-woken:
+		if !ok {
+			t.Errorf("Dispatcher.finishJob failed: expected the worker woken up")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Dispatcher.finishJob failed: expected the parked worker woken up")
+	}
+}
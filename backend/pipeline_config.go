@@ -0,0 +1,135 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Bucket of the effective pipeline configurations, by hash
+const pipelineConfigsBucket string = "pipeline_configs"
+
+// putPipelineConfig stores an effective configuration, shared by every job
+// that ran it
+func (d *Dispatcher) putPipelineConfig(hash, config string) {
+	if hash == "" {
+		return
+	}
+	if err := d.store.Put(pipelineConfigsBucket, hash, []byte(config)); err != nil {
+		log.Printf("Error storing pipeline configuration %s: %v\n", hash, err)
+	}
+}
+
+// jobConfig returns the effective configuration a job ran with
+func (d *Dispatcher) jobConfig(jobId string) (string, error) {
+	job, err := d.jobs.Get(jobId)
+	if err != nil {
+		return "", err
+	}
+	if job.ConfigHash == "" {
+		return "", ErrNotFound
+	}
+	config, err := d.store.Get(pipelineConfigsBucket, job.ConfigHash)
+	return string(config), err
+}
+
+// diffLines returns a line based diff from a to b, each line prefixed by
+// "-" if removed, "+" if added and " " if kept
+func diffLines(a, b string) string {
+	x := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	y := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+	// Length of the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var diff strings.Builder
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			fmt.Fprintf(&diff, " %s\n", x[i])
+			i, j = i+1, j+1
+		case j == len(y) || (i < len(x) && lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&diff, "-%s\n", x[i])
+			i++
+		default:
+			fmt.Fprintf(&diff, "+%s\n", y[j])
+			j++
+		}
+	}
+	return diff.String()
+}
+
+// jobConfigHandler serves GET /jobs/{id}/config, the effective pipeline
+// configuration of a job, or with ?diff={other} its diff from the one of
+// another job
+func jobConfigHandler(d *Dispatcher, jobId string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		config, err := d.jobConfig(jobId)
+		if err == ErrNotFound {
+			http.Error(w, "configuration not available", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if other := r.URL.Query().Get("diff"); other != "" {
+			base, err := d.jobConfig(other)
+			if err == ErrNotFound {
+				http.Error(w, "configuration of job "+other+" not available", http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprint(w, diffLines(base, config))
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-yaml")
+		fmt.Fprint(w, config)
+	}
+}
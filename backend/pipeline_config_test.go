@@ -0,0 +1,65 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobConfigHandler(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil)
+	commit := Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "master"}}
+	configs := []string{}
+	for _, pipeline := range []string{
+		"variables: {GO: '1.15'}\nsteps:\n  - name: test\n    command: go${GO} test ./...\n",
+		"variables: {GO: '1.16'}\nsteps:\n  - name: test\n    command: go${GO} test ./...\n",
+	} {
+		ciConfig, err := ParseCIConfig([]byte(pipeline))
+		if err != nil {
+			t.Fatal(err)
+		}
+		effective, _ := ciConfig.Effective()
+		jobId := d.enqueue(commit)
+		d.putPipelineConfig(configHash(effective), string(effective))
+		d.jobs.Update(jobId, func(job *Job) error {
+			job.ConfigHash = configHash(effective)
+			return nil
+		})
+		configs = append(configs, jobId)
+	}
+
+	rec := httptest.NewRecorder()
+	jobsHandler(d)(rec, httptest.NewRequest(http.MethodGet, "/jobs/"+configs[1]+"/config?diff="+configs[0], nil))
+	expected := "-  command: go1.15 test ./...\n+  command: go1.16 test ./...\n"
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), expected) {
+		t.Errorf("jobConfigHandler failed: unexpected diff %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,89 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import "fmt"
+
+// PullRequest is a GitHub pull request or a GitLab merge request, built as
+// the result of merging its head into its base branch when the hosting
+// service provides it, as its head otherwise
+type PullRequest struct {
+	Number int    `json:"number"`
+	Title  string `json:"title,omitempty"`
+	URL    string `json:"url,omitempty"`
+	// Branch the changes are proposed for and the one they come from, which
+	// may belong to a fork
+	BaseBranch string `json:"base_branch"`
+	HeadBranch string `json:"head_branch"`
+	// Last commit of the head branch, the one the build status is reported
+	// for
+	HeadSHA string `json:"head_sha"`
+	// Refs of the merge result and of the head in the base repository, e.g.
+	// refs/pull/42/merge and refs/pull/42/head
+	MergeRef string `json:"merge_ref,omitempty"`
+	HeadRef  string `json:"head_ref"`
+	// Whether the head branch belongs to another repository, whose authors
+	// must not reach the credentials and the secrets of the base one
+	Fork bool `json:"fork,omitempty"`
+}
+
+// GitHubPullRequestRefs returns the merge and head refs of a GitHub pull
+// request
+func GitHubPullRequestRefs(number int) (string, string) {
+	return fmt.Sprintf("refs/pull/%d/merge", number), fmt.Sprintf("refs/pull/%d/head", number)
+}
+
+// GitLabMergeRequestRefs returns the merge and head refs of a GitLab merge
+// request, the merge one only exists with merged results pipelines enabled
+func GitLabMergeRequestRefs(iid int) (string, string) {
+	return fmt.Sprintf("refs/merge-requests/%d/merge", iid), fmt.Sprintf("refs/merge-requests/%d/head", iid)
+}
+
+// checkoutRefs returns the refs to check out in place of the default branch,
+// in order of preference, none for the branch pushes and the tags
+func (c *Commit) checkoutRefs() []string {
+	if c.PullRequest == nil {
+		return nil
+	}
+	var refs []string
+	if c.PullRequest.MergeRef != "" {
+		refs = append(refs, c.PullRequest.MergeRef)
+	}
+	return append(refs, c.PullRequest.HeadRef)
+}
+
+// fromFork tells if the commit is built for a pull request opened from a
+// fork
+func (c *Commit) fromFork() bool {
+	return c.PullRequest != nil && c.PullRequest.Fork
+}
+
+// mergedBuild tells if the commit is built merged into the base branch, a
+// result that changes with the base branch
+func (c *Commit) mergedBuild() bool {
+	return c.PullRequest != nil && c.PullRequest.MergeRef != ""
+}
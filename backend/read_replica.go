@@ -0,0 +1,95 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// WithReadReplica runs the dispatcher as a read replica of the one sharing
+// its store: it serves the jobs, their logs and artifacts, the badges and the
+// stats from the store, without consuming the commit queue nor dispatching,
+// so that dashboard and API traffic scales apart from the scheduling. Writes
+// are refused, they go to the primary dispatcher.
+func WithReadReplica() DispatcherOption {
+	return func(d *Dispatcher) {
+		d.readReplica = true
+	}
+}
+
+// ErrReadReplica is returned by Consume on read replicas
+var ErrReadReplica = errors.New("read replicas don't consume the commit queue")
+
+// replicaRouter routes the read-only part of the API served from the store,
+// the scheduling state, e.g. the queue or the runners, lives on the primary
+func (d *Dispatcher) replicaRouter() *http.ServeMux {
+	router := http.NewServeMux()
+	router.Handle("/metrics", metricsHandler(d))
+	router.Handle("/commit", readOnly(commitHandler(d)))
+	router.Handle("/jobs", readOnly(jobsListHandler(d)))
+	router.Handle("/jobs/", readOnly(jobsHandler(d)))
+	router.Handle("/jobs/search", readOnly(jobSearchHandler(d)))
+	router.Handle("/repos/", readOnly(reposHandler(d)))
+	router.Handle("/badge/", readOnly(badgeHandler(d)))
+	// Sessions are stateless, replicas sharing the signing secret log in too
+	router.Handle("/login", loginHandler(d))
+	router.Handle("/login/", loginHandler(d))
+	router.Handle("/session", sessionHandler(d))
+	return router
+}
+
+// readOnly refuses any request but GET and HEAD
+func readOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", strings.Join([]string{http.MethodGet, http.MethodHead}, ", "))
+			http.Error(w, "read replica, send writes to the primary dispatcher", http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// waitLogs blocks until the log of a job grows past offset, it's complete or
+// the context is done. Read replicas don't receive the output of the running
+// jobs, they check the store at every heartbeat interval for the complete log
+// instead.
+func (d *Dispatcher) waitLogs(ctx context.Context, jobId string, offset int) {
+	if !d.readReplica {
+		d.logs.Wait(ctx, jobId, offset)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.heartbeatInterval)
+	defer cancel()
+	d.logs.Wait(ctx, jobId, offset)
+	if job, err := d.jobs.Get(jobId); err == nil {
+		d.loadLogs(job)
+	}
+}
@@ -0,0 +1,73 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadReplica(t *testing.T) {
+	store := NewMemoryStore()
+	primary := NewDispatcher("commits", time.Second, nil, WithStore(store))
+	replica := NewDispatcher("commits", 10*time.Millisecond, nil, WithStore(store), WithReadReplica())
+	jobId := primary.enqueue(Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "dev"}})
+	primary.logs.Append(jobId, []byte("ok\n"))
+	router := replica.replicaRouter()
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/"+jobId, nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("replicaRouter failed: expected 200 on the job got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/jobs/"+jobId, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("replicaRouter failed: expected 405 on a cancel got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/queue", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("replicaRouter failed: expected 404 on the queue got %d", rec.Code)
+	}
+
+	// The log of a running job is followed until the primary stores it
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		primary.cancelJob(jobId)
+	}()
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/"+jobId+"/logs?follow=true", nil))
+	if rec.Body.String() != "ok\n" {
+		t.Errorf("replicaRouter failed: unexpected followed logs %q", rec.Body.String())
+	}
+	if err := replica.Consume(); err != ErrReadReplica {
+		t.Errorf("Dispatcher.Consume failed: expected ErrReadReplica got %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/rpc"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	docker "github.com/docker/docker/client"
+)
+
+type CleanupJobRequest struct {
+	JobId string
+}
+
+type CleanupJobResponse struct {
+	Removed int
+}
+
+// removeJobContainers force removes every container of a job, running or not
+func removeJobContainers(jobId string) (int, error) {
+	ctx := context.Background()
+	cli, err := docker.NewEnvClient()
+	if err != nil {
+		return 0, err
+	}
+	args := filters.NewArgs()
+	args.Add("label", jobIdLabel+"="+jobId)
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, c := range containers {
+		err := cli.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{Force: true})
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// CleanupJob removes the leftover containers of a job given up by the
+// dispatcher
+func (r *Runner) CleanupJob(req CleanupJobRequest, res *CleanupJobResponse) error {
+	r.chaos.release(req.JobId)
+	removed, err := removeJobContainers(req.JobId)
+	res.Removed = removed
+	return err
+}
+
+// WithZombieReaper fails the jobs still RUNNING after the given limit, most
+// likely because their runner died mid-job, asking the runner to remove
+// their containers. With requeue their commit is scheduled again as a new
+// job.
+func WithZombieReaper(limit time.Duration, requeue bool) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.zombieLimit, d.requeueZombies = limit, requeue
+	}
+}
+
+// reapZombies periodically reaps the zombie jobs until stopped
+func (d *Dispatcher) reapZombies(interval time.Duration, stop <-chan interface{}) {
+	for {
+		select {
+		case <-d.clock.After(interval):
+			if err := d.reap(d.clock.Now().Add(-d.zombieLimit)); err != nil {
+				log.Printf("Error reaping zombie jobs: %v\n", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reap fails the jobs running since before the deadline
+func (d *Dispatcher) reap(deadline time.Time) error {
+	jobs, _, err := d.jobs.List(JobFilter{State: JobRunning, Until: deadline}, "", maxJobsPage)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if job.StartedAt == nil || job.StartedAt.After(deadline) {
+			continue
+		}
+		reason := fmt.Sprintf("reaped after running for more than %s", d.zombieLimit)
+		if !d.updateJob(job.Id, func(j *Job) error {
+			j.Error, j.Category = reason, FailureInfra
+			return j.TransitionAt(JobFailed, d.clock.Now())
+		}) {
+			continue
+		}
+		log.Printf("Job %s of commit %s %s\n", job.Id, job.Commit.Id, reason)
+		d.cleanupJob(job)
+		d.complete(job.Id, job.Commit, StatusFailure, FailureInfra)
+		if d.requeueZombies {
+			d.enqueue(job.Commit)
+		}
+	}
+	return nil
+}
+
+// cleanupJob asks the runner of a job to remove its containers, without
+// waiting for the answer
+func (d *Dispatcher) cleanupJob(job Job) {
+	for _, runner := range d.runnerList() {
+		if runner.Id != job.Runner {
+			continue
+		}
+		if client := runner.client(); client != nil {
+			call := client.Go("Runner.CleanupJob", CleanupJobRequest{job.Id},
+				&CleanupJobResponse{}, make(chan *rpc.Call, 1))
+			go func() {
+				if c := <-call.Done; c.Error != nil {
+					log.Printf("Error cleaning up job %s on runner %s: %v\n",
+						job.Id, runner.Addr, c.Error)
+				}
+			}()
+		}
+		return
+	}
+}
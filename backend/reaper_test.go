@@ -0,0 +1,62 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReapZombies(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil, WithZombieReaper(time.Hour, true))
+	commit := Commit{Id: "a", Repository: Repository{GitHub, "octocat/test", "master"}}
+	jobId := d.enqueue(commit)
+	d.queue.Pop()
+	started := time.Now().Add(-2 * time.Hour)
+	d.jobs.Update(jobId, func(job *Job) error {
+		job.CreatedAt = started
+		if err := job.Transition(JobRunning); err != nil {
+			return err
+		}
+		job.StartedAt = &started
+		return nil
+	})
+	if err := d.reap(time.Now().Add(-d.zombieLimit)); err != nil {
+		t.Fatal(err)
+	}
+	job, _ := d.jobs.Get(jobId)
+	if job.State != JobFailed || job.Error == "" {
+		t.Errorf("Dispatcher.reap failed: expected FAILED job got %v", job)
+	}
+	if d.queue.Len() != 1 {
+		t.Errorf("Dispatcher.reap failed: expected the commit requeued")
+	}
+	if requeued, _ := d.jobs.GetByCommit("octocat/test", "a"); requeued.Id == jobId ||
+		requeued.State != JobPending {
+		t.Errorf("Dispatcher.reap failed: unexpected requeued job %v", requeued)
+	}
+}
@@ -0,0 +1,265 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/rpc"
+	"os"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// Result of a step container found after the runner lost track of its job,
+// usually because it restarted mid-job
+type OrphanResult struct {
+	JobId    string
+	Step     string
+	ExitCode int
+}
+
+type CollectOrphansRequest struct{}
+
+type CollectOrphansResponse struct {
+	Results []OrphanResult
+}
+
+// WithJournal keeps a journal of the running jobs at path and reconciles it
+// with the job containers at startup and every interval: containers of
+// journaled jobs the runner is no longer running have their logs collected
+// and their result reported as orphan, the ones of unknown jobs are removed
+func WithJournal(path string, interval time.Duration) RunnerOption {
+	return func(r *Runner) {
+		journal, err := OpenJobJournal(path)
+		if err != nil {
+			log.Fatalf("Unable to open the job journal: %v", err)
+		}
+		r.journal, r.reconcileInterval = journal, interval
+	}
+}
+
+// trackJob records a job as running in this process and in the journal
+func (r *Runner) trackJob(jobId string, commit Commit) {
+	r.jobsMutex.Lock()
+	if r.active == nil {
+		r.active = map[string]bool{}
+	}
+	r.active[jobId] = true
+	r.jobsMutex.Unlock()
+	if r.journal != nil {
+		if err := r.journal.Add(jobId, commit); err != nil {
+			log.Printf("Error journaling job %s: %v\n", jobId, err)
+		}
+	}
+}
+
+func (r *Runner) untrackJob(jobId string) {
+	r.jobsMutex.Lock()
+	delete(r.active, jobId)
+	delete(r.cancelled, jobId)
+	delete(r.interruptible, jobId)
+	r.jobsMutex.Unlock()
+	if r.journal != nil {
+		if err := r.journal.Remove(jobId); err != nil {
+			log.Printf("Error journaling job %s: %v\n", jobId, err)
+		}
+	}
+}
+
+func (r *Runner) isActive(jobId string) bool {
+	r.jobsMutex.Lock()
+	defer r.jobsMutex.Unlock()
+	return r.active[jobId]
+}
+
+func (r *Runner) addOrphan(result OrphanResult) {
+	r.jobsMutex.Lock()
+	defer r.jobsMutex.Unlock()
+	r.orphans = append(r.orphans, result)
+}
+
+// CollectOrphans hands the orphan results to the dispatcher, forgetting them
+func (r *Runner) CollectOrphans(req CollectOrphansRequest, res *CollectOrphansResponse) error {
+	r.jobsMutex.Lock()
+	defer r.jobsMutex.Unlock()
+	res.Results, r.orphans = r.orphans, nil
+	return nil
+}
+
+// reconcileLoop reconciles the containers right away and then periodically
+func (r *Runner) reconcileLoop() {
+	for {
+		if err := r.reconcile(); err != nil {
+			log.Printf("Error reconciling containers: %v\n", err)
+		}
+		time.Sleep(r.reconcileInterval)
+	}
+}
+
+// reconcile matches the job containers against the journal, sweeping the
+// volumes and networks of the jobs over
+func (r *Runner) reconcile() error {
+	ctx := context.Background()
+	cli, err := docker.NewEnvClient()
+	if err != nil {
+		return err
+	}
+	args := filters.NewArgs()
+	args.Add("label", jobIdLabel)
+	args.Add("label", r.ownedLabel())
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
+	if err != nil {
+		return err
+	}
+	withContainers := map[string]bool{}
+	for _, c := range containers {
+		jobId := c.Labels[jobIdLabel]
+		withContainers[jobId] = true
+		if r.isActive(jobId) || r.isCollecting(c.ID) {
+			continue
+		}
+		entry, ok := r.journal.Get(jobId)
+		if !ok {
+			log.Printf("Removing leftover container %s of unknown job %s\n", c.ID, jobId)
+			cli.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{Force: true})
+			continue
+		}
+		// The job container of the exec mode never exits by itself, the
+		// steps executed inside of it can't be resumed
+		if _, ok := c.Labels[stepLabel]; !ok {
+			log.Printf("Removing job container %s of interrupted job %s\n", c.ID, jobId)
+			cli.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{Force: true})
+			continue
+		}
+		r.setCollecting(c.ID, true)
+		go r.collectOrphan(cli, entry, c)
+	}
+	// Journaled jobs left without containers are over
+	for _, entry := range r.journal.Entries() {
+		if !r.isActive(entry.JobId) && !withContainers[entry.JobId] {
+			r.journal.Remove(entry.JobId)
+		}
+	}
+	// Resources of jobs whose containers are still around are in use
+	r.sweepJobResources(ctx, cli, func(jobId string) bool { return withContainers[jobId] })
+	return nil
+}
+
+func (r *Runner) isCollecting(containerId string) bool {
+	r.jobsMutex.Lock()
+	defer r.jobsMutex.Unlock()
+	return r.collecting[containerId]
+}
+
+func (r *Runner) setCollecting(containerId string, collecting bool) {
+	r.jobsMutex.Lock()
+	defer r.jobsMutex.Unlock()
+	if r.collecting == nil {
+		r.collecting = map[string]bool{}
+	}
+	if collecting {
+		r.collecting[containerId] = true
+	} else {
+		delete(r.collecting, containerId)
+	}
+}
+
+// collectOrphan resumes the log collection of a container of a journaled
+// job, waiting for it to exit to report its result before removing it
+func (r *Runner) collectOrphan(cli *docker.Client, entry JournalEntry, c types.Container) {
+	ctx := context.Background()
+	defer r.setCollecting(c.ID, false)
+	step := c.Labels[stepLabel]
+	writers := []io.Writer{os.Stdout}
+	for _, sink := range r.logSinks {
+		w := sink.Open(entry.Commit, step)
+		defer w.Close()
+		writers = append(writers, w)
+	}
+	logs := io.MultiWriter(writers...)
+	fmt.Fprintf(logs, "narwhal: resuming log collection of job %s after a runner restart\n", entry.JobId)
+	out, err := cli.ContainerLogs(ctx, c.ID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+		Since:      fmt.Sprintf("%d", entry.StartedAt.Unix()),
+	})
+	if err == nil {
+		stdcopy.StdCopy(logs, logs, out)
+		out.Close()
+	}
+	exitCode, err := cli.ContainerWait(ctx, c.ID)
+	if err != nil {
+		log.Printf("Error waiting for container %s: %v\n", c.ID, err)
+		return
+	}
+	log.Printf("Orphan step %s of job %s exited with code %d\n", step, entry.JobId, exitCode)
+	r.addOrphan(OrphanResult{JobId: entry.JobId, Step: step, ExitCode: int(exitCode)})
+	cli.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{Force: true})
+}
+
+// collectOrphans fetches the orphan results of a runner, failing the jobs
+// still running whose runner lost track of them
+func (d *Dispatcher) collectOrphans(runner *RunnerProxy) {
+	client := runner.client()
+	if client == nil {
+		return
+	}
+	var res CollectOrphansResponse
+	call := client.Go("Runner.CollectOrphans", CollectOrphansRequest{}, &res, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return
+		}
+	case <-time.After(runner.Transport.merge(DefaultTransportConfig).CallTimeout):
+		return
+	}
+	for _, orphan := range res.Results {
+		log.Printf("Runner %s reported orphan step %s of job %s, exit code %d\n",
+			runner.Addr, orphan.Step, orphan.JobId, orphan.ExitCode)
+		job, err := d.jobs.Get(orphan.JobId)
+		if err != nil || job.State != JobRunning || job.Runner != runner.Id {
+			continue
+		}
+		reason := fmt.Sprintf("runner restarted mid-job, step %s exited with code %d",
+			orphan.Step, orphan.ExitCode)
+		if d.updateJob(job.Id, func(j *Job) error {
+			j.Error, j.Category = reason, FailureInfra
+			return j.TransitionAt(JobFailed, d.clock.Now())
+		}) {
+			d.complete(job.Id, job.Commit, StatusFailure, FailureInfra)
+		}
+	}
+}
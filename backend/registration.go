@@ -0,0 +1,467 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Challenge sent by the dispatcher to the advertised address of a runner
+// asking to register, only a runner knowing the registration secret can
+// answer it
+type ChallengeRequest struct {
+	Nonce string
+	Addr  string
+}
+
+type ChallengeResponse struct {
+	Signature string
+}
+
+// Body of a runner registration request
+type registrationRequest struct {
+	Addr         string              `json:"addr"`
+	Capabilities *RunnerCapabilities `json:"capabilities,omitempty"`
+}
+
+var ErrChallengeFailed = errors.New("registration challenge failed")
+
+// challengeSignature binds the nonce to the advertised address, so that an
+// answer can't be replayed for another address
+func challengeSignature(secret, nonce, addr string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(nonce + "\n" + addr))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// WithRegistrationSecret sets the secret shared with the dispatcher, used to
+// answer the registration challenges
+func WithRegistrationSecret(secret string) RunnerOption {
+	return func(r *Runner) {
+		r.registrationSecret = secret
+	}
+}
+
+// Challenge signs the nonce with the address the runner advertises itself,
+// never the one in the request, so that a runner can't be made to vouch for
+// an address registered by someone else
+func (r *Runner) Challenge(req ChallengeRequest, res *ChallengeResponse) error {
+	if r.registrationSecret == "" {
+		return errors.New("registration not enabled")
+	}
+	addr, err := normalizeAddr(r.advertiseAddr)
+	if err != nil {
+		return fmt.Errorf("no advertised address: %v", err)
+	}
+	res.Signature = challengeSignature(r.registrationSecret, req.Nonce, addr)
+	return nil
+}
+
+// Challenge asks the runner to sign a nonce, within the call timeout
+func (p *RunnerProxy) Challenge(nonce string) (string, error) {
+	client := p.client()
+	if client == nil {
+		return "", errors.New("runner not connected")
+	}
+	var res ChallengeResponse
+	req := ChallengeRequest{Nonce: nonce, Addr: p.Addr}
+	call := client.Go("Runner.Challenge", req, &res, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return res.Signature, call.Error
+	case <-time.After(p.Transport.merge(DefaultTransportConfig).CallTimeout):
+		return "", errors.New("challenge timed out")
+	}
+}
+
+// DetectAdvertiseAddr returns the address the dispatcher reaches a runner
+// listening on listenAddr at: the listening host if it's a specific one,
+// otherwise the address of the interface routing to the dispatcher, so that
+// runners behind NAT or in containers advertise a reachable address
+func DetectAdvertiseAddr(dispatcherURL, listenAddr string) (string, error) {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return normalizeAddr(listenAddr)
+	}
+	u, err := url.Parse(dispatcherURL)
+	if err != nil || u.Hostname() == "" {
+		return "", fmt.Errorf("invalid dispatcher URL %q", dispatcherURL)
+	}
+	dispatcherPort := u.Port()
+	if dispatcherPort == "" {
+		dispatcherPort = "80"
+		if u.Scheme == "https" {
+			dispatcherPort = "443"
+		}
+	}
+	// Connecting a UDP socket only picks the route, nothing is sent
+	conn, err := net.Dial("udp", net.JoinHostPort(u.Hostname(), dispatcherPort))
+	if err != nil {
+		return "", fmt.Errorf("detecting the outbound interface: %v", err)
+	}
+	defer conn.Close()
+	return normalizeAddr(net.JoinHostPort(conn.LocalAddr().(*net.UDPAddr).IP.String(), port))
+}
+
+// Features of the runner protocol the dispatcher relies on, advertised on
+// registration so that a runner lacking any of them refuses to join
+var runnerCapabilities = []string{"challenge", "labels", "hand_back", "secrets"}
+
+// Heartbeats a registered runner may miss before registering again, the
+// dispatcher likely restarted and forgot it
+const missedHeartbeats int = 3
+
+// RegistrationResponse is the answer of the dispatcher to a registration,
+// stored by the runner
+type RegistrationResponse struct {
+	RunnerId string `json:"runner_id"`
+	// Interval of the heartbeats probing the runner
+	HeartbeatInterval float64 `json:"heartbeat_interval_seconds"`
+	// Version of the dispatcher, see Version
+	Version string `json:"version"`
+	// Features the runner must support
+	Capabilities []string `json:"capabilities"`
+}
+
+func (d *Dispatcher) registrationResponse(runner *RunnerProxy) RegistrationResponse {
+	return RegistrationResponse{
+		RunnerId:          runner.Id,
+		HeartbeatInterval: d.heartbeatInterval.Seconds(),
+		Version:           Version,
+		Capabilities:      runnerCapabilities,
+	}
+}
+
+func (r RegistrationResponse) heartbeatInterval() time.Duration {
+	return time.Duration(r.HeartbeatInterval * float64(time.Second))
+}
+
+// compatible returns an error if the runner lacks any of the capabilities
+// the dispatcher requires
+func (r RegistrationResponse) compatible() error {
+	for _, required := range r.Capabilities {
+		if !containsString(runnerCapabilities, required) {
+			return fmt.Errorf("dispatcher %s requires the unsupported capability %s", r.Version, required)
+		}
+	}
+	return nil
+}
+
+// RegisterRunner asks the dispatcher to add the runner listening on addr to
+// its pool, reporting its capabilities, the dispatcher then challenges the
+// runner on that address
+func RegisterRunner(dispatcherURL, addr string, capabilities *RunnerCapabilities) (RegistrationResponse, error) {
+	var registration RegistrationResponse
+	addr, err := normalizeAddr(addr)
+	if err != nil {
+		return registration, err
+	}
+	body, err := json.Marshal(registrationRequest{addr, capabilities})
+	if err != nil {
+		return registration, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Post(strings.TrimRight(dispatcherURL, "/")+"/runners",
+		"application/json", bytes.NewReader(body))
+	if err != nil {
+		return registration, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusOK {
+		return registration, &RegistrationError{StatusCode: res.StatusCode}
+	}
+	if err := json.NewDecoder(res.Body).Decode(&registration); err != nil {
+		return registration, fmt.Errorf("decoding the registration: %v", err)
+	}
+	if err := registration.compatible(); err != nil {
+		return registration, &RegistrationError{Err: err}
+	}
+	return registration, nil
+}
+
+// RegistrationError is returned when the dispatcher refuses to register the
+// runner, or when the runner can't work with it
+type RegistrationError struct {
+	// Status answered by the dispatcher, 0 if it accepted the registration
+	StatusCode int
+	Err        error
+}
+
+func (e *RegistrationError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("dispatcher refused registration with status %d", e.StatusCode)
+}
+
+// permanent tells if registering again can't succeed, e.g. on a wrong
+// secret or address, rather than on a dispatcher not ready yet
+func (e *RegistrationError) permanent() bool {
+	switch {
+	case e.Err != nil:
+		return true
+	case e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests:
+		return false
+	}
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+// Bounds of the backoff between the failed registration attempts of a runner
+const (
+	registrationBackoff    = time.Second
+	maxRegistrationBackoff = time.Minute
+)
+
+// WithRegistration registers the runner to the dispatcher as reachable at
+// addr once listening, confirming the registration every interval, see
+// keepRegistered. Requires the registration secret.
+func WithRegistration(dispatcherURL, addr string, interval time.Duration) RunnerOption {
+	return func(r *Runner) {
+		r.dispatcherURL, r.advertiseAddr, r.registrationInterval = dispatcherURL, addr, interval
+	}
+}
+
+// Registration returns the last registration accepted by the dispatcher
+func (r *Runner) Registration() RegistrationResponse {
+	r.registrationMutex.Lock()
+	defer r.registrationMutex.Unlock()
+	return r.registration
+}
+
+// registrationLapsed tells if the registration made at registeredAt is due
+// to be confirmed, either as interval elapsed or as the dispatcher stopped
+// probing the runner
+func (r *Runner) registrationLapsed(registeredAt time.Time, interval time.Duration) bool {
+	r.registrationMutex.Lock()
+	defer r.registrationMutex.Unlock()
+	now := time.Now()
+	if now.Sub(registeredAt) >= interval {
+		return true
+	}
+	heartbeat := r.registration.heartbeatInterval()
+	last := r.lastHeartbeat
+	if last.Before(registeredAt) {
+		last = registeredAt
+	}
+	return heartbeat > 0 && now.Sub(last) > time.Duration(missedHeartbeats)*heartbeat
+}
+
+// keepRegistered registers the runner to the dispatcher, retrying with a
+// backoff between minBackoff and maxBackoff while it fails, e.g. the
+// dispatcher not being up yet, then confirms the registration every interval,
+// or as soon as the heartbeats stop, so that a restarted dispatcher, which
+// forgot its registered runners, gets it back. Returns once stop is closed,
+// or with the error of a permanent refusal, e.g. a wrong secret.
+func (r *Runner) keepRegistered(stop <-chan struct{}, minBackoff, maxBackoff time.Duration) error {
+	backoff, registered := minBackoff, false
+	sleep := func(d time.Duration) bool {
+		select {
+		case <-time.After(d):
+			return true
+		case <-stop:
+			return false
+		}
+	}
+	for {
+		registration, err := RegisterRunner(r.dispatcherURL, r.advertiseAddr, r.capabilities())
+		var refused *RegistrationError
+		if errors.As(err, &refused) && refused.permanent() {
+			return err
+		}
+		if err != nil {
+			wait := jitter(defaultRandomness, backoff)
+			log.Printf("Registration to %s failed, retrying in %v: %v\n",
+				r.dispatcherURL, wait.Round(time.Millisecond), err)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			registered = false
+			if !sleep(wait) {
+				return nil
+			}
+			continue
+		}
+		if !registered {
+			log.Printf("Registered to %s as runner %s at %s\n", r.dispatcherURL, registration.RunnerId, r.advertiseAddr)
+			if registration.Version != Version {
+				log.Printf("Dispatcher version %s differs from the runner version %s\n", registration.Version, Version)
+			}
+		}
+		backoff, registered = minBackoff, true
+		r.registrationMutex.Lock()
+		r.registration = registration
+		r.registrationMutex.Unlock()
+		registeredAt, check := time.Now(), r.registrationInterval
+		if heartbeat := registration.heartbeatInterval(); heartbeat > 0 && heartbeat < check {
+			check = heartbeat
+		}
+		for !r.registrationLapsed(registeredAt, r.registrationInterval) {
+			if !sleep(check) {
+				return nil
+			}
+		}
+	}
+}
+
+// registerRunner adds the runner advertising addr to the pool once it proved
+// to hold the registration secret, answering a challenge sent over a
+// connection the dispatcher opens itself. Returns false if the runner was
+// already registered, updating its capabilities.
+func (d *Dispatcher) registerRunner(addr string, capabilities *RunnerCapabilities) (*RunnerProxy, bool, error) {
+	if d.registrationSecret == "" {
+		return nil, false, errors.New("runner registration not enabled")
+	}
+	if err := capabilities.compatible(); err != nil {
+		return nil, false, err
+	}
+	for _, runner := range d.runnerList() {
+		if runner.Addr == addr {
+			// Its max jobs may have been raised
+			runner.setCapabilities(capabilities)
+			d.parking.unpark()
+			return runner, false, nil
+		}
+	}
+	runner := NewRunnerProxy(addr)
+	runner.clock, runner.capabilities = d.clock, capabilities
+	if err := runner.Dial(); err != nil {
+		return nil, false, err
+	}
+	nonce := d.newId()
+	signature, err := runner.Challenge(nonce)
+	expected := challengeSignature(d.registrationSecret, nonce, addr)
+	if err != nil || !hmac.Equal([]byte(signature), []byte(expected)) {
+		runner.client().Close()
+		return nil, false, ErrChallengeFailed
+	}
+	d.runnersMutex.Lock()
+	defer d.runnersMutex.Unlock()
+	for _, r := range d.runners {
+		if r.Addr == addr {
+			runner.client().Close()
+			r.setCapabilities(capabilities)
+			return r, false, nil
+		}
+	}
+	d.runners = append(d.runners, runner)
+	d.saveRunner(addr, capabilities)
+	d.startProbe(runner)
+	return runner, true, nil
+}
+
+// Bucket of the runners registered at runtime, by address
+const registeredRunnersBucket string = "registered_runners"
+
+// saveRunner persists a runner registered at runtime, added back to the pool
+// on restart
+func (d *Dispatcher) saveRunner(addr string, capabilities *RunnerCapabilities) {
+	value, _ := json.Marshal(registrationRequest{Addr: addr, Capabilities: capabilities})
+	if err := d.store.Put(registeredRunnersBucket, addr, value); err != nil {
+		log.Printf("Error saving runner %s: %v\n", addr, err)
+	}
+}
+
+// restoreRunners adds the runners registered before a restart to the pool,
+// considered dead until they answer a heartbeat
+func (d *Dispatcher) restoreRunners() {
+	values, err := d.store.List(registeredRunnersBucket, "")
+	if err != nil {
+		log.Printf("Error loading the registered runners: %v\n", err)
+		return
+	}
+	d.runnersMutex.Lock()
+	defer d.runnersMutex.Unlock()
+	for _, value := range values {
+		var registered registrationRequest
+		if err := json.Unmarshal(value, &registered); err != nil {
+			log.Printf("Error loading a registered runner: %v\n", err)
+			continue
+		}
+		known := false
+		for _, runner := range d.runners {
+			known = known || runner.Addr == registered.Addr
+		}
+		if !known {
+			runner := NewRunnerProxy(registered.Addr)
+			runner.capabilities = registered.Capabilities
+			d.runners = append(d.runners, runner)
+		}
+	}
+}
+
+// ErrRunnerBusy is returned when removing a runner still running jobs
+var ErrRunnerBusy = errors.New("runner still running jobs")
+
+// deregisterRunner removes a runner from the pool, closing its connection. A
+// runner still running jobs is drained instead, so that it can be removed
+// once they're done.
+func (d *Dispatcher) deregisterRunner(id string) (*RunnerProxy, error) {
+	d.runnersMutex.Lock()
+	defer d.runnersMutex.Unlock()
+	for i, runner := range d.runners {
+		if runner.Id != id {
+			continue
+		}
+		runner.Drain()
+		if runner.jobsCount() > 0 {
+			return runner, ErrRunnerBusy
+		}
+		d.runners = append(d.runners[:i:i], d.runners[i+1:]...)
+		d.stopProbe(runner)
+		if err := d.store.Delete(registeredRunnersBucket, runner.Addr); err != nil {
+			log.Printf("Error deleting runner %s: %v\n", runner.Addr, err)
+		}
+		if client := runner.client(); client != nil {
+			client.Close()
+		}
+		return runner, nil
+	}
+	return nil, ErrNotFound
+}
+
+// runnerList returns a snapshot of the runners of the pool
+func (d *Dispatcher) runnerList() []*RunnerProxy {
+	d.runnersMutex.RLock()
+	defer d.runnersMutex.RUnlock()
+	return append([]*RunnerProxy(nil), d.runners...)
+}
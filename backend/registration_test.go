@@ -0,0 +1,240 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveRunner exposes a runner over RPC on a random local port
+func serveRunner(t *testing.T, runner *Runner) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := rpc.NewServer()
+	server.RegisterName("Runner", runner)
+	if runner.advertiseAddr == "" {
+		runner.advertiseAddr = listener.Addr().String()
+	}
+	go server.Accept(listener)
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().String()
+}
+
+func TestRegisterRunnerChallenge(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil, WithRunnerRegistration("secret"))
+	impostor := serveRunner(t, &Runner{registrationSecret: "guess"})
+	if _, _, err := d.registerRunner(impostor, nil); err != ErrChallengeFailed {
+		t.Errorf("registerRunner failed: expected ErrChallengeFailed got %v", err)
+	}
+	// A genuine runner advertising another address doesn't vouch for this one
+	elsewhere := serveRunner(t, &Runner{registrationSecret: "secret", advertiseAddr: "10.0.0.1:9898"})
+	if _, _, err := d.registerRunner(elsewhere, nil); err != ErrChallengeFailed {
+		t.Errorf("registerRunner failed: expected ErrChallengeFailed got %v", err)
+	}
+	addr := serveRunner(t, &Runner{registrationSecret: "secret"})
+	runner, created, err := d.registerRunner(addr, nil)
+	if err != nil || !created || runner.Addr != addr {
+		t.Fatalf("registerRunner failed: unexpected %v %v %v", runner, created, err)
+	}
+	if _, created, _ := d.registerRunner(addr, nil); created {
+		t.Errorf("registerRunner failed: runner registered twice")
+	}
+	if len(d.runnerList()) != 1 {
+		t.Errorf("registerRunner failed: expected 1 runner got %d", len(d.runnerList()))
+	}
+}
+
+func TestRegisteredRunnersRestored(t *testing.T) {
+	store := NewMemoryStore()
+	d := NewDispatcher("commits", time.Second, nil, WithStore(store), WithRunnerRegistration("secret"))
+	addr := serveRunner(t, &Runner{registrationSecret: "secret"})
+	runner, _, err := d.registerRunner(addr, &RunnerCapabilities{MaxJobs: 2, Features: runnerCapabilities})
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := NewDispatcher("commits", time.Second, nil, WithStore(store), WithRunnerRegistration("secret"))
+	runners := restarted.runnerList()
+	if len(runners) != 1 || runners[0].Addr != addr || runners[0].capabilities.MaxJobs != 2 {
+		t.Fatalf("restoreRunners failed: expected runner %s got %v", addr, runners)
+	}
+	if _, err := d.deregisterRunner(runner.Id); err != nil {
+		t.Fatal(err)
+	}
+	restarted = NewDispatcher("commits", time.Second, nil, WithStore(store), WithRunnerRegistration("secret"))
+	if runners := restarted.runnerList(); len(runners) != 0 {
+		t.Errorf("restoreRunners failed: expected the removed runner forgotten got %v", runners)
+	}
+}
+
+func TestRegisteredRunnerProbeStopped(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil, WithRunnerRegistration("secret"))
+	addr := serveRunner(t, &Runner{registrationSecret: "secret"})
+	runner, _, err := d.registerRunner(addr, &RunnerCapabilities{Features: runnerCapabilities})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop, ok := d.probes[runner.Id]
+	if !ok {
+		t.Fatalf("registerRunner failed: expected a heartbeat goroutine started for %s", runner.Id)
+	}
+	if _, err := d.deregisterRunner(runner.Id); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stop:
+	default:
+		t.Errorf("deregisterRunner failed: expected the heartbeat goroutine of %s stopped", runner.Id)
+	}
+	if _, ok := d.probes[runner.Id]; ok {
+		t.Errorf("deregisterRunner failed: expected the probe of %s forgotten", runner.Id)
+	}
+
+	// A stopped probe returns
+	stop = make(chan interface{})
+	done := make(chan struct{})
+	go func() {
+		d.probeRunner(d.heartbeats, stop)
+		close(done)
+	}()
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("probeRunner failed: expected to return once stopped")
+	}
+}
+
+func TestDetectAdvertiseAddr(t *testing.T) {
+	for _, test := range []struct {
+		dispatcherURL, listenAddr, expected string
+	}{
+		{"http://10.0.0.1:28919", "192.168.1.7:9898", "192.168.1.7:9898"},
+		{"http://10.0.0.1:28919", "Runner.Local:9898", "runner.local:9898"},
+		{"http://127.0.0.1:28919", ":9898", "127.0.0.1:9898"},
+		{"http://127.0.0.1", "0.0.0.0:9898", "127.0.0.1:9898"},
+	} {
+		addr, err := DetectAdvertiseAddr(test.dispatcherURL, test.listenAddr)
+		if err != nil || addr != test.expected {
+			t.Errorf("DetectAdvertiseAddr failed: expected %s got %s %v for %s",
+				test.expected, addr, err, test.listenAddr)
+		}
+	}
+	if _, err := DetectAdvertiseAddr("", ":9898"); err == nil {
+		t.Errorf("DetectAdvertiseAddr failed: expected an error without dispatcher URL")
+	}
+}
+
+func TestKeepRegistered(t *testing.T) {
+	var attempts int32
+	dispatcher := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first attempts find the dispatcher not ready yet
+		if atomic.AddInt32(&attempts, 1) <= 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, http.StatusOK, RegistrationResponse{RunnerId: "r1", HeartbeatInterval: 0.001,
+			Version: Version, Capabilities: runnerCapabilities})
+	}))
+	defer dispatcher.Close()
+	// Never probed, the runner registers again after missing the heartbeats
+	r := &Runner{}
+	WithRegistration(dispatcher.URL, "127.0.0.1:9898", time.Hour)(r)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		r.keepRegistered(stop, time.Millisecond, 2*time.Millisecond)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&attempts) < 6 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	<-done
+	if n := atomic.LoadInt32(&attempts); n < 6 {
+		t.Errorf("keepRegistered failed: expected retries and confirmations got %d attempts", n)
+	}
+	if registration := r.Registration(); registration.RunnerId != "r1" ||
+		registration.heartbeatInterval() != time.Millisecond {
+		t.Errorf("keepRegistered failed: unexpected registration %v", registration)
+	}
+}
+
+func TestKeepRegisteredRefused(t *testing.T) {
+	for _, status := range []int{http.StatusForbidden, http.StatusBadRequest, http.StatusConflict} {
+		var attempts int32
+		dispatcher := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			w.WriteHeader(status)
+		}))
+		r := &Runner{}
+		WithRegistration(dispatcher.URL, "127.0.0.1:9898", time.Hour)(r)
+		done := make(chan error)
+		go func() { done <- r.keepRegistered(nil, time.Millisecond, 2*time.Millisecond) }()
+		select {
+		case err := <-done:
+			if refused, ok := err.(*RegistrationError); !ok || refused.StatusCode != status {
+				t.Errorf("keepRegistered failed: expected the %d refusal got %v", status, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("keepRegistered failed: expected no retry on %d got %d attempts", status, atomic.LoadInt32(&attempts))
+		}
+		if n := atomic.LoadInt32(&attempts); n != 1 {
+			t.Errorf("keepRegistered failed: expected 1 attempt on %d got %d", status, n)
+		}
+		dispatcher.Close()
+	}
+}
+
+func TestRegistrationResponse(t *testing.T) {
+	addr := serveRunner(t, &Runner{registrationSecret: "secret"})
+	d := NewDispatcher("commits", 5*time.Second, nil, WithRunnerRegistration("secret"))
+	server := httptest.NewServer(runnersHandler(d))
+	defer server.Close()
+	registration, err := RegisterRunner(server.URL, addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := RegistrationResponse{RunnerId: NewRunnerProxy(addr).Id, HeartbeatInterval: 5,
+		Version: Version, Capabilities: runnerCapabilities}
+	if !reflect.DeepEqual(registration, expected) {
+		t.Errorf("RegisterRunner failed: expected %v got %v", expected, registration)
+	}
+	registration.Capabilities = append(registration.Capabilities, "teleport")
+	if err := registration.compatible(); err == nil {
+		t.Errorf("compatible failed: expected an error on an unsupported capability")
+	}
+}
@@ -0,0 +1,137 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Defaults of the release pipelines
+const defaultReleaseGoVersion string = "1.21"
+
+var defaultReleaseTargets = []string{
+	"linux/amd64", "linux/arm64", "darwin/amd64", "darwin/arm64", "windows/amd64",
+}
+
+var releaseTargetRegexp = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9]+$`)
+
+// ReleaseConfig turns a pipeline into the release of a Go project: its main
+// packages are cross-compiled as static binaries for every GOOS/GOARCH target,
+// each target in a step of its own appended to the ones of the pipeline, and
+// collected as artifacts along with their checksums, e.g.
+//
+//	name: narwhal
+//	release:
+//	  packages: [./cmd/agent, ./cmd/dispatcher, ./cmd/runner]
+//	  targets: [linux/amd64, linux/arm64]
+//	  ldflags: -X github.com/codepr/narwhal/backend.Version=${VERSION}
+type ReleaseConfig struct {
+	// Main packages to build, the root one by default
+	Packages []string `yaml:"packages,omitempty"`
+	// GOOS/GOARCH pairs, see defaultReleaseTargets
+	Targets []string `yaml:"targets,omitempty"`
+	// Version of the golang image the binaries are built with, unless the
+	// pipeline sets an image
+	GoVersion string `yaml:"go_version,omitempty"`
+	// Linker flags added to the ones stripping the binaries, the environment
+	// variables in them are expanded by the shell
+	LDFlags string `yaml:"ldflags,omitempty"`
+}
+
+// shellQuote quotes a string as a single shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+var doubleQuoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`")
+
+// shellDoubleQuote quotes a string as a single shell word, leaving the
+// variables in it to be expanded by the shell
+func shellDoubleQuote(s string) string {
+	return `"` + doubleQuoteEscaper.Replace(s) + `"`
+}
+
+// releaseStepName returns the name of the step building a target
+func releaseStepName(target string) string {
+	return "build-" + strings.Replace(target, "/", "-", 1)
+}
+
+// expandRelease validates the release of the pipeline and appends its steps,
+// the effective configuration only retains the steps
+func (c *CIConfig) expandRelease() error {
+	release := c.Release
+	if release == nil {
+		return nil
+	}
+	packages, targets := release.Packages, release.Targets
+	if len(packages) == 0 {
+		packages = []string{"."}
+	}
+	if len(targets) == 0 {
+		targets = defaultReleaseTargets
+	}
+	if c.ImageName == "" {
+		version := release.GoVersion
+		if version == "" {
+			version = defaultReleaseGoVersion
+		}
+		c.ImageName = "golang:" + version
+	}
+	quoted := make([]string, len(packages))
+	for i, pkg := range packages {
+		quoted[i] = shellQuote(pkg)
+	}
+	ldflags := strings.TrimSpace("-s -w " + release.LDFlags)
+	seen := map[string]bool{}
+	for _, target := range targets {
+		if !releaseTargetRegexp.MatchString(target) {
+			return fmt.Errorf("invalid release target %q, expected GOOS/GOARCH", target)
+		}
+		if seen[target] {
+			return fmt.Errorf("duplicate release target %s", target)
+		}
+		seen[target] = true
+		parts := strings.SplitN(target, "/", 2)
+		dir := "dist/" + parts[0] + "_" + parts[1]
+		// With -o pointing to a directory every package gets its own binary
+		c.Steps = append(c.Steps, Step{
+			Name: releaseStepName(target),
+			Cmd: fmt.Sprintf("mkdir -p %s && CGO_ENABLED=0 GOOS=%s GOARCH=%s go build -trimpath -ldflags %s -o %s/ %s",
+				dir, parts[0], parts[1], shellDoubleQuote(ldflags), dir, strings.Join(quoted, " ")),
+			Artifacts: []string{dir},
+		})
+	}
+	c.Steps = append(c.Steps, Step{
+		Name:      "checksums",
+		Cmd:       "cd dist && find . -type f ! -name SHA256SUMS | sort | xargs sha256sum > SHA256SUMS",
+		Artifacts: []string{"dist/SHA256SUMS"},
+	})
+	c.Release = nil
+	return nil
+}
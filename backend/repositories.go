@@ -0,0 +1,210 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// WithRepositoryRegistration builds only the commits of the repositories
+// registered through the /repositories API, ignoring the others
+func WithRepositoryRegistration() DispatcherOption {
+	return func(d *Dispatcher) {
+		d.requireRegistration = true
+	}
+}
+
+// registered tells if a repository has stored settings, on errors reading
+// them it's assumed to be
+func (d *Dispatcher) registered(repository string) bool {
+	_, err := d.store.Get(repositorySettingsBucket, repository)
+	if err != nil && err != ErrNotFound {
+		log.Printf("Error reading the settings of %s: %v\n", repository, err)
+	}
+	return err != ErrNotFound
+}
+
+// repositories returns the settings of the registered repositories sorted
+// by name
+func (d *Dispatcher) repositories() ([]RepositorySettings, error) {
+	values, err := d.store.List(repositorySettingsBucket, "")
+	if err != nil {
+		return nil, err
+	}
+	repositories := make([]RepositorySettings, 0, len(values))
+	for _, value := range values {
+		var settings RepositorySettings
+		if err := json.Unmarshal(value, &settings); err != nil {
+			return nil, err
+		}
+		repositories = append(repositories, settings)
+	}
+	return repositories, nil
+}
+
+// notificationTargets returns the destinations registered for the jobs of a
+// repository, none on errors
+func (d *Dispatcher) notificationTargets(repository string) NotificationTargets {
+	settings, err := d.repositorySettings(repository)
+	if err != nil {
+		log.Printf("Error reading the settings of %s: %v\n", repository, err)
+	}
+	return settings.Notifications
+}
+
+// authorizeSettings checks the permissions needed to write the settings of
+// a repository, credentials require the manage_secrets one too
+func (d *Dispatcher) authorizeSettings(w http.ResponseWriter, r *http.Request, settings RepositorySettings) bool {
+	if !d.authorize(w, r, PermissionManageRepositories, settings.Repository) {
+		return false
+	}
+	return settings.Credentials == nil || d.authorize(w, r, PermissionManageSecrets, settings.Repository)
+}
+
+// writeSettings stores the settings of a repository answering with the
+// public ones
+func (d *Dispatcher) writeSettings(w http.ResponseWriter, status int, settings RepositorySettings) {
+	if err := d.putRepositorySettings(settings); errors.Is(err, ErrInvalidSettings) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, status, settings.public())
+}
+
+// repositoriesHandler manages the registered repositories. GET /repositories
+// lists the visible ones and POST registers one, GET, PUT and DELETE on
+// /repositories/{owner}/{name} read, replace and unregister one, along with
+// its secrets, see secretsHandler. Reads
+// require the view permission, writes the manage_repositories one and setting
+// the clone credentials the manage_secrets one too, e.g.
+//
+//	POST /repositories {"repository": "octocat/hello-world", "default_branch": "main",
+//	  "notifications": {"email": ["team@example.com"]}, "credentials": {"token": "..."}}
+func repositoriesHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		repository := strings.Trim(strings.TrimPrefix(r.URL.Path, "/repositories"), "/")
+		if name := strings.TrimSuffix(repository, "/secrets"); name != repository && strings.Contains(name, "/") {
+			secretsHandler(d, name, "")(w, r)
+			return
+		}
+		if i := strings.LastIndex(repository, "/secrets/"); i > 0 && strings.Contains(repository[:i], "/") &&
+			!strings.Contains(repository[i+len("/secrets/"):], "/") {
+			secretsHandler(d, repository[:i], repository[i+len("/secrets/"):])(w, r)
+			return
+		}
+		if repository == "" {
+			switch r.Method {
+			case http.MethodGet:
+				repositories, err := d.repositories()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				visible := d.visible(r)
+				public := []RepositorySettings{}
+				for _, settings := range repositories {
+					if visible(settings.Repository) {
+						public = append(public, settings.public())
+					}
+				}
+				writeJSON(w, http.StatusOK, public)
+			case http.MethodPost:
+				var settings RepositorySettings
+				if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+					http.Error(w, "invalid repository settings", http.StatusBadRequest)
+					return
+				}
+				defer r.Body.Close()
+				if !d.authorizeSettings(w, r, settings) {
+					return
+				}
+				if d.registered(settings.Repository) {
+					http.Error(w, "repository already registered", http.StatusConflict)
+					return
+				}
+				d.writeSettings(w, http.StatusCreated, settings)
+			default:
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			if !d.authorize(w, r, PermissionView, repository) {
+				return
+			}
+			if !d.registered(repository) {
+				http.Error(w, "repository not registered", http.StatusNotFound)
+				return
+			}
+			settings, err := d.repositorySettings(repository)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, settings.public())
+		case http.MethodPut:
+			var settings RepositorySettings
+			if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+				http.Error(w, "invalid repository settings", http.StatusBadRequest)
+				return
+			}
+			defer r.Body.Close()
+			settings.Repository = repository
+			if !d.authorizeSettings(w, r, settings) {
+				return
+			}
+			d.writeSettings(w, http.StatusOK, settings)
+		case http.MethodDelete:
+			if !d.authorize(w, r, PermissionManageRepositories, repository) {
+				return
+			}
+			if !d.registered(repository) {
+				http.Error(w, "repository not registered", http.StatusNotFound)
+				return
+			}
+			if err := d.store.Delete(repositorySettingsBucket, repository); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := d.deleteSecrets(repository); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepositoriesHandler(t *testing.T) {
+	access, _ := NewAccessControl(AccessToken{Name: "dev", Token: "dev-token", Grants: []AccessGrant{
+		{Repositories: []string{"octocat/*"}, Permissions: []Permission{PermissionView, PermissionManageRepositories}},
+	}})
+	d := NewDispatcher("commits", time.Second, nil, WithAdminToken("admin"),
+		WithAccessControl(access), WithRepositoryRegistration())
+	handler := repositoriesHandler(d)
+	call := func(method, path, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	repository := `{"repository":"octocat/test","default_branch":"main",` +
+		`"notifications":{"email":["team@example.com"]},"credentials":{"token":"t0k3n"}}`
+	for _, test := range []struct {
+		method, path, body, token string
+		expected                  int
+	}{
+		{http.MethodGet, "/repositories/octocat/test", "", "dev-token", http.StatusNotFound},
+		// Setting the credentials requires the manage_secrets permission
+		{http.MethodPost, "/repositories", repository, "dev-token", http.StatusForbidden},
+		{http.MethodPost, "/repositories", `{"repository":"octocat"}`, "admin", http.StatusBadRequest},
+		{http.MethodPost, "/repositories", `{"repository":"octocat/test","notifications":{"email":["nope"]}}`,
+			"admin", http.StatusBadRequest},
+		{http.MethodPost, "/repositories", repository, "admin", http.StatusCreated},
+		{http.MethodPost, "/repositories", repository, "admin", http.StatusConflict},
+		{http.MethodPost, "/repositories", `{"repository":"acme/app"}`, "admin", http.StatusCreated},
+		{http.MethodPut, "/repositories/acme/app", `{"default_branch":"trunk"}`, "dev-token", http.StatusForbidden},
+		{http.MethodPut, "/repositories/octocat/test", `{"default_branch":"develop"}`, "dev-token", http.StatusOK},
+	} {
+		if rec := call(test.method, test.path, test.body, test.token); rec.Code != test.expected {
+			t.Errorf("repositoriesHandler failed: expected %d got %d for %s %s %s",
+				test.expected, rec.Code, test.method, test.path, test.body)
+		}
+	}
+
+	// The credentials are kept by the updates without them and never served
+	if credentials, ok := d.repositoryCredentials("octocat/test"); !ok || credentials.Token != "t0k3n" {
+		t.Errorf("Dispatcher.repositoryCredentials failed: unexpected %+v", credentials)
+	}
+	rec := call(http.MethodGet, "/repositories/octocat/test", "", "dev-token")
+	if strings.Contains(rec.Body.String(), "t0k3n") {
+		t.Errorf("repositoriesHandler failed: credentials served %s", rec.Body.String())
+	}
+	var settings RepositorySettings
+	json.NewDecoder(rec.Body).Decode(&settings)
+	if settings.DefaultBranch != "develop" || len(settings.Notifications.Email) != 0 {
+		t.Errorf("repositoriesHandler failed: unexpected %+v", settings)
+	}
+	var listed []RepositorySettings
+	json.NewDecoder(call(http.MethodGet, "/repositories", "", "dev-token").Body).Decode(&listed)
+	if len(listed) != 1 || listed[0].Repository != "octocat/test" {
+		t.Errorf("repositoriesHandler failed: expected only octocat/test visible got %+v", listed)
+	}
+
+	// Only the registered repositories are built, on their default branch
+	// if none is requested
+	builds := buildsHandler(d)
+	for body, expected := range map[string]int{
+		`{"repository":{"name":"octocat/test"},"commit_id":"a"}`:  http.StatusAccepted,
+		`{"repository":{"name":"octocat/other"},"commit_id":"a"}`: http.StatusNotFound,
+		`{"repository":{"name":"octocat/test"}}`:                  http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/builds", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin")
+		rec := httptest.NewRecorder()
+		builds(rec, req)
+		if rec.Code != expected {
+			t.Errorf("buildsHandler failed: expected %d got %d for %s", expected, rec.Code, body)
+		}
+		var queued QueuedCommit
+		if json.NewDecoder(rec.Body).Decode(&queued); rec.Code == http.StatusAccepted &&
+			queued.Commit.Repository.Branch != "develop" {
+			t.Errorf("buildsHandler failed: expected the default branch got %q", queued.Commit.Repository.Branch)
+		}
+	}
+	if !d.filtersOut(Commit{Id: "a", Repository: Repository{Name: "octocat/other", Branch: "main"}}) ||
+		d.metrics.Get("narwhal_unregistered_commits_total") != 1 {
+		t.Errorf("Dispatcher.filtersOut failed: expected the commit of an unregistered repository ignored")
+	}
+
+	if rec := call(http.MethodDelete, "/repositories/octocat/test", "", "dev-token"); rec.Code != http.StatusNoContent {
+		t.Errorf("repositoriesHandler failed: expected 204 got %d", rec.Code)
+	}
+	if d.registered("octocat/test") {
+		t.Errorf("repositoriesHandler failed: expected octocat/test unregistered")
+	}
+}
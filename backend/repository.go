@@ -34,6 +34,8 @@ package backend
 import (
 	"errors"
 	"fmt"
+	"net/url"
+	"strings"
 )
 
 type HostingService string
@@ -42,6 +44,8 @@ const (
 	GitHub    HostingService = "github"
 	BitBucket HostingService = "bitbucket"
 	GitLab                   = "gitlab"
+	// Repositories cloned straight from their URL, e.g. self-hosted Git
+	Git HostingService = "git"
 )
 
 type Repository struct {
@@ -65,3 +69,78 @@ func (r Repository) CloneCommand(path string) (string, error) {
 	return "", errors.New(fmt.Sprintf("%s hosting service not supported",
 		r.HostingService))
 }
+
+// CloneURL returns the URL the repository is cloned from, over SSH if asked
+// for
+func (r Repository) CloneURL(ssh bool) string {
+	host := "github.com"
+	switch r.HostingService {
+	case GitLab:
+		host = "gitlab.com"
+	case BitBucket:
+		host = "bitbucket.org"
+	}
+	if ssh {
+		return "git@" + host + ":" + r.Name + ".git"
+	}
+	return "https://" + host + "/" + r.Name
+}
+
+// ParseRepositoryURL reads the repository out of its web or clone URL, e.g.
+// https://github.com/octocat/test or git@github.com:octocat/test.git, the
+// branch is left empty
+func ParseRepositoryURL(repoURL string) (Repository, error) {
+	var host, path string
+	if strings.HasPrefix(repoURL, "git@") {
+		parts := strings.SplitN(strings.TrimPrefix(repoURL, "git@"), ":", 2)
+		if len(parts) != 2 {
+			return Repository{}, fmt.Errorf("invalid repository URL %s", repoURL)
+		}
+		host, path = parts[0], parts[1]
+	} else {
+		u, err := url.Parse(repoURL)
+		if err != nil {
+			return Repository{}, err
+		}
+		host, path = u.Hostname(), u.Path
+	}
+	name := strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	if strings.Count(name, "/") < 1 {
+		return Repository{}, fmt.Errorf("invalid repository URL %s", repoURL)
+	}
+	switch host {
+	case "github.com":
+		return Repository{HostingService: GitHub, Name: name}, nil
+	case "gitlab.com":
+		return Repository{HostingService: GitLab, Name: name}, nil
+	case "bitbucket.org", "bitbucket.com":
+		return Repository{HostingService: BitBucket, Name: name}, nil
+	}
+	return Repository{}, fmt.Errorf("%s hosting service not supported", host)
+}
+
+// ParseGitURL reads the repository out of any Git URL, the ones of the known
+// hosting services as ParseRepositoryURL does, the others are named after the
+// path and must be cloned from the URL itself, see Commit.CloneURL, e.g. https://git.example.com/team/project.git or
+// ssh://git@git.example.com:2222/team/project.git
+func ParseGitURL(repoURL string) (Repository, error) {
+	if repository, err := ParseRepositoryURL(repoURL); err == nil {
+		return repository, nil
+	}
+	var path string
+	if strings.Contains(repoURL, "://") {
+		u, err := url.Parse(repoURL)
+		if err != nil {
+			return Repository{}, err
+		}
+		path = u.Path
+	} else if i := strings.Index(repoURL, ":"); i > 0 && !strings.Contains(repoURL[:i], "/") {
+		// scp-like syntax, e.g. git@git.example.com:team/project.git
+		path = repoURL[i+1:]
+	}
+	name := strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	if name == "" {
+		return Repository{}, fmt.Errorf("invalid Git URL %s", repoURL)
+	}
+	return Repository{HostingService: Git, Name: name}, nil
+}
@@ -0,0 +1,130 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateEnv checks the names of the variables of a repository, the
+// NARWHAL_ prefix is reserved to the ones set by the runners
+func validateEnv(env map[string]string) error {
+	for name := range env {
+		if !envNameRegexp.MatchString(name) || strings.HasPrefix(strings.ToUpper(name), "NARWHAL_") {
+			return fmt.Errorf("%w: invalid variable name %q", ErrInvalidSettings, name)
+		}
+	}
+	return nil
+}
+
+// repositoryEnv returns the variables of a repository injected into its
+// jobs, none on errors
+func (d *Dispatcher) repositoryEnv(repository string) map[string]string {
+	settings, err := d.repositorySettings(repository)
+	if err != nil {
+		log.Printf("Error reading the settings of %s: %v\n", repository, err)
+	}
+	return settings.Env
+}
+
+// repositoryEnvHandler serves the variables of a repository on
+// /repos/{owner}/{name}/env, GET lists them and PUT replaces them all, GET,
+// PUT and DELETE on /repos/{owner}/{name}/env/{NAME} read, set and unset
+// one. Reads require the view permission, writes the manage_repositories one,
+// e.g. PUT /repos/octocat/hello-world/env/DEPLOY_TARGET "staging"
+func repositoryEnvHandler(d *Dispatcher, repository, name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		permission := PermissionManageRepositories
+		if r.Method == http.MethodGet {
+			permission = PermissionView
+		}
+		if !d.authorize(w, r, permission, repository) {
+			return
+		}
+		settings, err := d.repositorySettings(repository)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if settings.Env == nil {
+			settings.Env = map[string]string{}
+		}
+		switch {
+		case r.Method == http.MethodGet && name == "":
+		case r.Method == http.MethodGet:
+			value, ok := settings.Env[name]
+			if !ok {
+				http.Error(w, "no variable "+name, http.StatusNotFound)
+				return
+			}
+			writeJSON(w, http.StatusOK, value)
+			return
+		case r.Method == http.MethodPut && name == "":
+			settings.Env = map[string]string{}
+			if err := json.NewDecoder(r.Body).Decode(&settings.Env); err != nil {
+				http.Error(w, "invalid variables", http.StatusBadRequest)
+				return
+			}
+			defer r.Body.Close()
+		case r.Method == http.MethodPut:
+			var value string
+			if err := json.NewDecoder(r.Body).Decode(&value); err != nil {
+				http.Error(w, "invalid variable value", http.StatusBadRequest)
+				return
+			}
+			defer r.Body.Close()
+			settings.Env[name] = value
+		case r.Method == http.MethodDelete && name != "":
+			if _, ok := settings.Env[name]; !ok {
+				http.Error(w, "no variable "+name, http.StatusNotFound)
+				return
+			}
+			delete(settings.Env, name)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Method != http.MethodGet {
+			if err := d.putRepositorySettings(settings); errors.Is(err, ErrInvalidSettings) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, settings.Env)
+	}
+}
@@ -0,0 +1,119 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepositoryEnvHandler(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil, WithAdminToken("admin"))
+	handler := reposHandler(d)
+	call := func(method, path, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	for _, test := range []struct {
+		method, path, body, token string
+		expected                  int
+	}{
+		{http.MethodPut, "/repos/octocat/test/env", `{"GOFLAGS":"-mod=mod"}`, "", http.StatusForbidden},
+		{http.MethodPut, "/repos/octocat/test/env", `{"1ST":"x"}`, "admin", http.StatusBadRequest},
+		{http.MethodPut, "/repos/octocat/test/env", `{"narwhal_job_id":"x"}`, "admin", http.StatusBadRequest},
+		{http.MethodPut, "/repos/octocat/test/env", `{"GOFLAGS":"-mod=mod","TARGET":"prod"}`, "admin", http.StatusOK},
+		{http.MethodPut, "/repos/octocat/test/env/TARGET", `"staging"`, "admin", http.StatusOK},
+		{http.MethodPut, "/repos/octocat/test/env/DEBUG", `"1"`, "admin", http.StatusOK},
+		{http.MethodDelete, "/repos/octocat/test/env/GOFLAGS", "", "admin", http.StatusOK},
+		{http.MethodDelete, "/repos/octocat/test/env/GOFLAGS", "", "admin", http.StatusNotFound},
+		{http.MethodGet, "/repos/octocat/test/env/GOFLAGS", "", "", http.StatusNotFound},
+		{http.MethodPost, "/repos/octocat/test/env", "", "admin", http.StatusMethodNotAllowed},
+	} {
+		if rec := call(test.method, test.path, test.body, test.token); rec.Code != test.expected {
+			t.Errorf("repositoryEnvHandler failed: expected %d got %d for %s %s %s",
+				test.expected, rec.Code, test.method, test.path, test.body)
+		}
+	}
+	var env map[string]string
+	json.NewDecoder(call(http.MethodGet, "/repos/octocat/test/env", "", "").Body).Decode(&env)
+	expected := map[string]string{"TARGET": "staging", "DEBUG": "1"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("repositoryEnvHandler failed: expected %v got %v", expected, env)
+	}
+	var value string
+	json.NewDecoder(call(http.MethodGet, "/repos/octocat/test/env/TARGET", "", "").Body).Decode(&value)
+	if value != "staging" {
+		t.Errorf("repositoryEnvHandler failed: expected staging got %q", value)
+	}
+}
+
+// Runner RPC service recording the requests
+type recordingRunner struct {
+	requests chan RunnerRequest
+}
+
+func (r *recordingRunner) RunCommitJob(req RunnerRequest, res *RunnerResponse) error {
+	r.requests <- req
+	res.Response = "OK"
+	return nil
+}
+
+func TestForwardRepositoryEnv(t *testing.T) {
+	runner := &recordingRunner{make(chan RunnerRequest, 1)}
+	server := rpc.NewServer()
+	server.RegisterName("Runner", runner)
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go server.ServeConn(serverConn)
+	proxy := NewRunnerProxy("r1")
+	proxy.Alive, proxy.RpcClient = true, rpc.NewClient(clientConn)
+	d := NewDispatcher("commits", time.Second, []*RunnerProxy{proxy})
+	d.putRepositorySettings(RepositorySettings{Repository: "octocat/test", Env: map[string]string{"TARGET": "prod"}})
+
+	commit := Commit{Id: "a", Repository: Repository{GitHub, "octocat/test", "master"}}
+	job := NewJob("job-a", commit)
+	d.jobs.Create(job)
+	go d.forwardToRunner(proxy, job.Id, commit)
+	select {
+	case req := <-runner.requests:
+		if !reflect.DeepEqual(req.Env, map[string]string{"TARGET": "prod"}) {
+			t.Errorf("Dispatcher.forwardToRunner failed: unexpected env %v", req.Env)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Dispatcher.forwardToRunner failed: no request received")
+	}
+}
@@ -0,0 +1,90 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"fmt"
+	"path"
+)
+
+// RepositoryPolicy restricts the repositories a runner builds, e.g. a deploy
+// runner only accepting org/infra. Entries are path patterns like org/*, a
+// repository matching any deny entry is rejected, and when the allow list is
+// not empty only the repositories matching it are accepted.
+type RepositoryPolicy struct {
+	Allow []string
+	Deny  []string
+}
+
+func matchesAny(patterns []string, repository string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, repository); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Permits tells if the policy accepts the builds of a repository, a nil
+// policy accepts all of them
+func (p *RepositoryPolicy) Permits(repository string) bool {
+	if p == nil {
+		return true
+	}
+	if matchesAny(p.Deny, repository) {
+		return false
+	}
+	return len(p.Allow) == 0 || matchesAny(p.Allow, repository)
+}
+
+// validate checks that all the patterns of the policy are well formed
+func (p *RepositoryPolicy) validate() error {
+	for _, pattern := range append(append([]string{}, p.Allow...), p.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid repository pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// WithRepositoryPolicy only accepts the jobs of the repositories matching the
+// allow patterns, if any, and none of the deny patterns. The policy is
+// advertised to the dispatcher through the heartbeats to route the jobs, and
+// enforced again before running them.
+func WithRepositoryPolicy(allow, deny []string) RunnerOption {
+	return func(r *Runner) {
+		r.policy = &RepositoryPolicy{Allow: allow, Deny: deny}
+	}
+}
+
+// accepts returns an error if the runner policy rejects the job
+func (r *Runner) accepts(req RunnerRequest) error {
+	if repository := req.CommitJob.GetRepositoryName(); !r.policy.Permits(repository) {
+		return fmt.Errorf("repository %s not accepted by the runner", repository)
+	}
+	return nil
+}
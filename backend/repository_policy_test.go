@@ -0,0 +1,101 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func TestRepositoryPolicyPermits(t *testing.T) {
+	policy := &RepositoryPolicy{Allow: []string{"org/*"}, Deny: []string{"org/legacy"}}
+	cases := map[string]bool{
+		"org/infra":    true,
+		"org/legacy":   false,
+		"octocat/test": false,
+	}
+	for repository, expected := range cases {
+		if policy.Permits(repository) != expected {
+			t.Errorf("Permits(%s) expected %v", repository, expected)
+		}
+	}
+	var none *RepositoryPolicy
+	if !none.Permits("octocat/test") {
+		t.Errorf("A nil policy expected to permit all the repositories")
+	}
+	if err := (&RepositoryPolicy{Deny: []string{"org/["}}).validate(); err == nil {
+		t.Errorf("validate expected an error on a malformed pattern")
+	}
+}
+
+func TestRunnerAccepts(t *testing.T) {
+	r := &Runner{policy: &RepositoryPolicy{Allow: []string{"org/infra"}}}
+	req := RunnerRequest{CommitJob: Commit{Repository: Repository{Name: "octocat/test"}}}
+	if err := r.accepts(req); err == nil {
+		t.Errorf("accepts expected to reject octocat/test")
+	}
+	req.CommitJob.Repository.Name = "org/infra"
+	if err := r.accepts(req); err != nil {
+		t.Errorf("accepts expected to accept org/infra, got %v", err)
+	}
+}
+
+func TestPickRunnerPolicy(t *testing.T) {
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	deploy := &RunnerProxy{Id: "deploy", Alive: true, RpcClient: rpc.NewClient(conn),
+		policy: &RepositoryPolicy{Allow: []string{"org/infra"}}}
+	d := NewDispatcher("commits", time.Second, []*RunnerProxy{deploy})
+	if runner := d.pickRunner("octocat/test", pipelineRequirements{}); runner != nil {
+		t.Errorf("pickRunner expected no runner for octocat/test, got %s", runner.Id)
+	}
+	if runner := d.pickRunner("org/infra", pipelineRequirements{}); runner != deploy {
+		t.Errorf("pickRunner expected the deploy runner for org/infra")
+	}
+}
+
+func TestDispatchablePolicy(t *testing.T) {
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	deploy := &RunnerProxy{Id: "deploy", Alive: true, RpcClient: rpc.NewClient(conn),
+		policy: &RepositoryPolicy{Allow: []string{"org/infra"}}}
+	d := NewDispatcher("commits", time.Second, []*RunnerProxy{deploy})
+	denied := d.enqueue(Commit{Id: "a", Repository: Repository{GitHub, "octocat/test", "main"}})
+	allowed := d.enqueue(Commit{Id: "b", Repository: Repository{GitHub, "org/infra", "main"}})
+	item, runner := d.dispatchable()
+	if item.JobId != allowed || runner != deploy {
+		t.Errorf("dispatchable failed: expected %s on the deploy runner got %s %v", allowed, item.JobId, runner)
+	}
+	if queued := d.queue.Snapshot(); len(queued) != 1 || queued[0].JobId != denied {
+		t.Errorf("dispatchable failed: expected %s left at the head of the queue got %v", denied, queued)
+	}
+	if _, runner := d.dispatchable(); runner != nil {
+		t.Errorf("dispatchable failed: expected no runner for %s", denied)
+	}
+}
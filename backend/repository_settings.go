@@ -0,0 +1,290 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Bucket of the settings of each repository
+const repositorySettingsBucket string = "repository_settings"
+
+var ErrInvalidSettings = errors.New("invalid repository settings")
+
+// BranchFilter restricts the branches whose pushes are built. Entries are
+// path patterns like feature/*, a branch matching any exclude entry is not
+// built, and when the include list is not empty only the branches matching
+// it are.
+type BranchFilter struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Permits tells if the pushes to a branch are built
+func (f BranchFilter) Permits(branch string) bool {
+	if matchesAny(f.Exclude, branch) {
+		return false
+	}
+	return len(f.Include) == 0 || matchesAny(f.Include, branch)
+}
+
+// NotificationTargets are the destinations notified of the jobs of a
+// repository on top of the globally configured ones
+type NotificationTargets struct {
+	// Slack incoming webhook, overriding the configured one
+	Slack string `json:"slack,omitempty"`
+	// Addresses emailed about failures, requires email notifications
+	Email []string `json:"email,omitempty"`
+}
+
+// RepositorySettings are the settings of a repository managed through the
+// dispatcher API, a repository with stored settings is registered
+type RepositorySettings struct {
+	Repository string       `json:"repository"`
+	Branches   BranchFilter `json:"branches"`
+	// Branch built when a build request names none
+	DefaultBranch string              `json:"default_branch,omitempty"`
+	Notifications NotificationTargets `json:"notifications"`
+	// Variables set in the environment of every job, overriding the ones of
+	// the CI configuration
+	Env map[string]string `json:"env,omitempty"`
+	// Windows the pushes are built in, see BuildWindow
+	Windows []BuildWindow `json:"windows,omitempty"`
+	// Clone credentials, taking precedence over the configured ones. Never
+	// served back, a write without them keeps the stored ones.
+	Credentials *Credentials `json:"credentials,omitempty"`
+}
+
+// public returns the settings without the secrets
+func (s RepositorySettings) public() RepositorySettings {
+	s.Credentials = nil
+	return s
+}
+
+func (s RepositorySettings) validate() error {
+	if !strings.Contains(s.Repository, "/") || strings.Trim(s.Repository, "/") != s.Repository {
+		return fmt.Errorf("%w: invalid repository name %q", ErrInvalidSettings, s.Repository)
+	}
+	for _, address := range s.Notifications.Email {
+		if _, err := mail.ParseAddress(address); err != nil {
+			return fmt.Errorf("%w: invalid email address %q", ErrInvalidSettings, address)
+		}
+	}
+	if s.Notifications.Slack != "" {
+		if u, err := url.Parse(s.Notifications.Slack); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+			return fmt.Errorf("%w: invalid Slack webhook", ErrInvalidSettings)
+		}
+	}
+	if err := validateEnv(s.Env); err != nil {
+		return err
+	}
+	if err := validateBranchPatterns(append(append([]string{}, s.Branches.Include...), s.Branches.Exclude...)); err != nil {
+		return err
+	}
+	for _, window := range s.Windows {
+		if err := window.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateBranchPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("%w: invalid branch pattern %q", ErrInvalidSettings, pattern)
+		}
+	}
+	return nil
+}
+
+// repositorySettings returns the stored settings of a repository, the zero
+// ones building everything if none
+func (d *Dispatcher) repositorySettings(repository string) (RepositorySettings, error) {
+	settings := RepositorySettings{Repository: repository}
+	value, err := d.store.Get(repositorySettingsBucket, repository)
+	if err == ErrNotFound {
+		return settings, nil
+	} else if err != nil {
+		return settings, err
+	}
+	err = json.Unmarshal(value, &settings)
+	return settings, err
+}
+
+// putRepositorySettings stores the settings of a repository, keeping the
+// stored credentials if the new settings carry none
+func (d *Dispatcher) putRepositorySettings(settings RepositorySettings) error {
+	if err := settings.validate(); err != nil {
+		return err
+	}
+	if settings.Credentials == nil {
+		stored, err := d.repositorySettings(settings.Repository)
+		if err != nil {
+			return err
+		}
+		settings.Credentials = stored.Credentials
+	}
+	value, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return d.store.Put(repositorySettingsBucket, settings.Repository, value)
+}
+
+// updatedSettings applies the fields of a request body to the stored settings
+// of a repository, the fields left out keep their stored value. The variables
+// given replace the stored ones rather than being merged into them.
+func (d *Dispatcher) updatedSettings(r *http.Request, repository string) (RepositorySettings, error) {
+	defer r.Body.Close()
+	settings, err := d.repositorySettings(repository)
+	if err != nil {
+		return settings, err
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return settings, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return settings, fmt.Errorf("%w: %v", ErrInvalidSettings, err)
+	}
+	if _, ok := fields["env"]; ok {
+		settings.Env = nil
+	}
+	// The stored credentials are kept by putRepositorySettings, only the
+	// given ones must be authorized
+	settings.Credentials = nil
+	if err := json.Unmarshal(body, &settings); err != nil {
+		return settings, fmt.Errorf("%w: %v", ErrInvalidSettings, err)
+	}
+	settings.Repository = repository
+	return settings, nil
+}
+
+// dropRegisteredCredentials removes the credentials from the settings of a
+// repository, if registered with some
+func (d *Dispatcher) dropRegisteredCredentials(repository string) error {
+	settings, err := d.repositorySettings(repository)
+	if err != nil || settings.Credentials == nil {
+		return err
+	}
+	settings.Credentials = nil
+	value, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return d.store.Put(repositorySettingsBucket, repository, value)
+}
+
+// filtersOut tells if a commit is not to be built, its repository not being
+// registered while registration is required or, for pushes, the branch not
+// built by the repository. On errors reading the settings it's built.
+func (d *Dispatcher) filtersOut(commit Commit) bool {
+	repository := commit.GetRepositoryName()
+	if d.requireRegistration && !d.registered(repository) {
+		log.Printf("Ignored commit %s of %s, repository not registered\n", commit.Id, repository)
+		d.metrics.Inc("narwhal_unregistered_commits_total")
+		return true
+	}
+	if commit.TriggeredBy() != PushTrigger {
+		return false
+	}
+	settings, err := d.repositorySettings(repository)
+	if err != nil {
+		log.Printf("Error reading the settings of %s: %v\n", repository, err)
+		return false
+	}
+	if settings.Branches.Permits(commit.Repository.Branch) {
+		return false
+	}
+	log.Printf("Ignored commit %s of %s, branch %s filtered out\n",
+		commit.Id, repository, commit.Repository.Branch)
+	d.metrics.Inc("narwhal_filtered_pushes_total")
+	return true
+}
+
+// repositorySettingsHandler serves the settings of a repository on
+// /repos/{owner}/{name}/settings, GET requires the view permission, PUT
+// updating the fields given and DELETE resetting them, which unregisters the
+// repository, the manage_repositories one, e.g.
+// PUT {"branches": {"exclude": ["dependabot/*", "tmp/*"]}}
+func repositorySettingsHandler(d *Dispatcher, repository string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if !d.authorize(w, r, PermissionView, repository) {
+				return
+			}
+		case http.MethodPut:
+			settings, err := d.updatedSettings(r, repository)
+			if errors.Is(err, ErrInvalidSettings) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !d.authorizeSettings(w, r, settings) {
+				return
+			}
+			if err := d.putRepositorySettings(settings); errors.Is(err, ErrInvalidSettings) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		case http.MethodDelete:
+			if !d.authorize(w, r, PermissionManageRepositories, repository) {
+				return
+			}
+			if err := d.store.Delete(repositorySettingsBucket, repository); err != nil && err != ErrNotFound {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		settings, err := d.repositorySettings(repository)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, settings.public())
+	}
+}
@@ -0,0 +1,154 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBranchFilter(t *testing.T) {
+	filter := BranchFilter{Include: []string{"main", "release/*", "feature/*"}, Exclude: []string{"feature/tmp-*"}}
+	for branch, expected := range map[string]bool{
+		"main":            true,
+		"release/1.0":     true,
+		"feature/login":   true,
+		"feature/tmp-wip": false,
+		"dependabot/npm":  false,
+	} {
+		if filter.Permits(branch) != expected {
+			t.Errorf("BranchFilter.Permits failed: expected %v for %s", expected, branch)
+		}
+	}
+	if !(BranchFilter{}).Permits("anything") {
+		t.Errorf("BranchFilter.Permits failed: expected the empty filter to permit everything")
+	}
+}
+
+func TestRepositorySettingsUpdate(t *testing.T) {
+	access, _ := NewAccessControl(
+		AccessToken{Name: "ops", Token: "ops-token", Grants: []AccessGrant{
+			{Repositories: []string{"*"}, Permissions: []Permission{PermissionManageRunners}}}},
+		AccessToken{Name: "maintainer", Token: "maintainer-token", Grants: []AccessGrant{
+			{Repositories: []string{"octocat/*"}, Permissions: []Permission{PermissionManageRepositories}}}},
+	)
+	d := NewDispatcher("commits", time.Second, nil, WithAdminToken("admin"), WithAccessControl(access))
+	d.putRepositorySettings(RepositorySettings{
+		Repository:    "octocat/test",
+		Env:           map[string]string{"TARGET": "prod", "DEBUG": "1"},
+		Windows:       []BuildWindow{{Branches: []string{"dependabot/*"}, Schedule: "0 2 * * *"}},
+		Notifications: NotificationTargets{Email: []string{"team@example.com"}},
+		Credentials:   &Credentials{Token: "s3cr3t"},
+	})
+	handler := reposHandler(d)
+	call := func(body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/repos/octocat/test/settings", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	if rec := call(`{"branches":{"exclude":["tmp/*"]}}`, "ops-token"); rec.Code != http.StatusForbidden {
+		t.Errorf("repositorySettingsHandler failed: expected 403 got %d", rec.Code)
+	}
+	if rec := call(`{"branches":{"exclude":["tmp/*"]}}`, "maintainer-token"); rec.Code != http.StatusOK {
+		t.Errorf("repositorySettingsHandler failed: expected 200 got %d", rec.Code)
+	}
+	settings, _ := d.repositorySettings("octocat/test")
+	if len(settings.Branches.Exclude) != 1 || len(settings.Env) != 2 || len(settings.Windows) != 1 ||
+		len(settings.Notifications.Email) != 1 || settings.Credentials == nil {
+		t.Errorf("repositorySettingsHandler failed: expected the other settings kept got %+v", settings)
+	}
+	// The variables given replace the stored ones
+	if rec := call(`{"env":{"TARGET":"staging"}}`, "maintainer-token"); rec.Code != http.StatusOK {
+		t.Errorf("repositorySettingsHandler failed: expected 200 got %d", rec.Code)
+	}
+	settings, _ = d.repositorySettings("octocat/test")
+	if len(settings.Env) != 1 || settings.Env["TARGET"] != "staging" || len(settings.Branches.Exclude) != 1 {
+		t.Errorf("repositorySettingsHandler failed: expected env TARGET=staging only got %+v", settings)
+	}
+	if rec := call(`{"credentials":{"token":"other"}}`, "maintainer-token"); rec.Code != http.StatusForbidden {
+		t.Errorf("repositorySettingsHandler failed: expected 403 got %d", rec.Code)
+	}
+}
+
+func TestRepositorySettingsHandler(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil, WithAdminToken("admin"), WithSubmitToken("submit"))
+	handler := reposHandler(d)
+	call := func(method, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/repos/octocat/test/settings", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	settings := `{"branches":{"exclude":["dependabot/*"]}}`
+	if rec := call(http.MethodPut, settings, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("repositorySettingsHandler failed: expected 403 got %d", rec.Code)
+	}
+	if rec := call(http.MethodPut, `{"branches":{"include":["["]}}`, "admin"); rec.Code != http.StatusBadRequest {
+		t.Errorf("repositorySettingsHandler failed: expected 400 got %d", rec.Code)
+	}
+	if rec := call(http.MethodPut, settings, "admin"); rec.Code != http.StatusOK {
+		t.Errorf("repositorySettingsHandler failed: expected 200 got %d", rec.Code)
+	}
+	var stored RepositorySettings
+	json.NewDecoder(call(http.MethodGet, "", "").Body).Decode(&stored)
+	if stored.Repository != "octocat/test" || len(stored.Branches.Exclude) != 1 {
+		t.Errorf("repositorySettingsHandler failed: unexpected %+v", stored)
+	}
+
+	// Pushes to the excluded branches are dropped, tags are built anyway
+	commits := commitsHandler(d)
+	for event, expected := range map[string]int{
+		`{"id":"a","repository":{"hosting_service":"github","name":"octocat/test","branch":"dependabot/npm"}}`: http.StatusNoContent,
+		`{"id":"b","repository":{"hosting_service":"github","name":"octocat/test","branch":"main"}}`:           http.StatusAccepted,
+		`{"id":"c","event":"tag","tag":"v1","repository":{"hosting_service":"github","name":"octocat/test"}}`:  http.StatusAccepted,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/commits", strings.NewReader(event))
+		req.Header.Set("Authorization", "Bearer submit")
+		rec := httptest.NewRecorder()
+		commits(rec, req)
+		if rec.Code != expected {
+			t.Errorf("commitsHandler failed: expected %d got %d for %s", expected, rec.Code, event)
+		}
+	}
+	if d.metrics.Get("narwhal_filtered_pushes_total") != 1 {
+		t.Errorf("Dispatcher.filtersOut failed: expected 1 filtered push")
+	}
+
+	if rec := call(http.MethodDelete, "", "admin"); rec.Code != http.StatusOK {
+		t.Errorf("repositorySettingsHandler failed: expected 200 got %d", rec.Code)
+	}
+	if settings, _ := d.repositorySettings("octocat/test"); len(settings.Branches.Exclude) != 0 {
+		t.Errorf("repositorySettingsHandler failed: expected the settings reset got %+v", settings)
+	}
+}
@@ -40,3 +40,72 @@ func TestRepositoryCloneCommand(t *testing.T) {
 		t.Errorf("repository.CloneCommand failed: expected %s got %s", expected, cloneCmd)
 	}
 }
+
+func TestRepositoryCloneURL(t *testing.T) {
+	for _, c := range []struct {
+		repository Repository
+		ssh        bool
+		expected   string
+	}{
+		{Repository{GitHub, "octocat/test", ""}, false, "https://github.com/octocat/test"},
+		{Repository{GitHub, "octocat/test", ""}, true, "git@github.com:octocat/test.git"},
+		{Repository{GitLab, "group/test", ""}, false, "https://gitlab.com/group/test"},
+		{Repository{BitBucket, "team/test", ""}, true, "git@bitbucket.org:team/test.git"},
+	} {
+		if url := c.repository.CloneURL(c.ssh); url != c.expected {
+			t.Errorf("Repository.CloneURL failed: expected %s got %s", c.expected, url)
+		}
+	}
+}
+
+func TestParseRepositoryURL(t *testing.T) {
+	for _, u := range []string{
+		"https://github.com/octocat/test",
+		"https://github.com/octocat/test.git",
+		"https://github.com:443/octocat/test.git",
+		"git@github.com:octocat/test.git",
+	} {
+		repository, err := ParseRepositoryURL(u)
+		if err != nil || repository.HostingService != GitHub || repository.Name != "octocat/test" {
+			t.Errorf("ParseRepositoryURL failed: unexpected %v %v for %s", repository, err, u)
+		}
+	}
+	if _, err := ParseRepositoryURL("https://example.com/octocat/test"); err == nil {
+		t.Errorf("ParseRepositoryURL failed: expected error for unknown host")
+	}
+}
+
+func TestParseGitURL(t *testing.T) {
+	cases := []struct {
+		url      string
+		expected Repository
+	}{
+		{"https://github.com/octocat/test.git", Repository{HostingService: GitHub, Name: "octocat/test"}},
+		{"https://git.example.com/team/project.git", Repository{HostingService: Git, Name: "team/project"}},
+		{"ssh://git@git.example.com:2222/team/project.git", Repository{HostingService: Git, Name: "team/project"}},
+		{"gitea@git.example.com:project.git", Repository{HostingService: Git, Name: "project"}},
+	}
+	for _, c := range cases {
+		repository, err := ParseGitURL(c.url)
+		if err != nil || repository != c.expected {
+			t.Errorf("ParseGitURL failed: expected %v got %v %v", c.expected, repository, err)
+		}
+	}
+	for _, u := range []string{"/srv/git/project", "https://git.example.com/"} {
+		if _, err := ParseGitURL(u); err == nil {
+			t.Errorf("ParseGitURL failed: expected error for %s", u)
+		}
+	}
+}
+
+func TestCommitCloneURL(t *testing.T) {
+	commit := Commit{Repository: Repository{HostingService: Git, Name: "team/project"},
+		CloneURL: "ssh://git@git.example.com:2222/team/project.git"}
+	if url := commit.cloneURL(false); url != commit.CloneURL {
+		t.Errorf("Commit.cloneURL failed: expected %s got %s", commit.CloneURL, url)
+	}
+	commit = Commit{Repository: Repository{GitHub, "octocat/test", "main"}}
+	if url := commit.cloneURL(true); url != "git@github.com:octocat/test.git" {
+		t.Errorf("Commit.cloneURL failed: expected git@github.com:octocat/test.git got %s", url)
+	}
+}
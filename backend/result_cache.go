@@ -0,0 +1,139 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Bucket of the successful builds by commit SHA
+const resultCacheBucket string = "result_cache"
+
+// CachedResult is a successful build of a commit, reused by the builds of
+// the same commit running the same pipeline, e.g. on a fork
+type CachedResult struct {
+	JobId      string    `json:"job_id"`
+	Repository string    `json:"repository"`
+	ConfigHash string    `json:"config_hash"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// configHash returns the hex encoded SHA-256 of an effective CI configuration
+func configHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// resultCacheKey identifies the pipeline a build of a commit runs. The
+// configuration committed in the repository is the same for a given SHA,
+// while inline pipelines are told apart by their hash. Builds of tags and
+// pull requests see other variables and steps, they are keyed apart too, see
+// buildKey.
+func resultCacheKey(commit Commit) string {
+	if commit.Pipeline != "" {
+		return commit.buildKey() + "/inline-" + configHash([]byte(commit.Pipeline))
+	}
+	return commit.buildKey() + "/repository"
+}
+
+// WithResultCache reuses the result of a successful build of the same commit
+// with an identical pipeline instead of building it again, for the given
+// repositories, * enables it for all of them
+func WithResultCache(repositories ...string) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.resultCache = map[string]bool{}
+		for _, repository := range repositories {
+			d.resultCache[repository] = true
+		}
+	}
+}
+
+// cachesResults tells if the builds of a repository can reuse the previous
+// ones
+func (d *Dispatcher) cachesResults(repository string) bool {
+	return d.resultCache[repository] || d.resultCache["*"]
+}
+
+// cacheResult records the successful build of a commit. Pull requests built
+// merged into their base branch are not, the base branch moves on.
+func (d *Dispatcher) cacheResult(jobId string, commit Commit, hash string) {
+	if !d.cachesResults(commit.GetRepositoryName()) || hash == "" || commit.mergedBuild() {
+		return
+	}
+	value, err := json.Marshal(CachedResult{jobId, commit.GetRepositoryName(), hash, d.clock.Now()})
+	if err == nil {
+		err = d.store.Put(resultCacheBucket, resultCacheKey(commit), value)
+	}
+	if err != nil {
+		log.Printf("Error caching the result of job %s: %v\n", jobId, err)
+	}
+}
+
+// cachedResult returns the successful build the job can reuse, if any
+func (d *Dispatcher) cachedResult(job Job) (CachedResult, bool) {
+	var cached CachedResult
+	// Scheduled builds run regardless, e.g. nightly builds catching flakes
+	if job.Schedule != "" || !d.cachesResults(job.Commit.GetRepositoryName()) || job.Commit.mergedBuild() {
+		return cached, false
+	}
+	value, err := d.store.Get(resultCacheBucket, resultCacheKey(job.Commit))
+	if err != nil {
+		if err != ErrNotFound {
+			log.Printf("Error reading the result cache: %v\n", err)
+		}
+		return cached, false
+	}
+	if err := json.Unmarshal(value, &cached); err != nil {
+		return cached, false
+	}
+	return cached, true
+}
+
+// reuseResult completes a job with the result of a previous build of its
+// commit, copying its steps
+func (d *Dispatcher) reuseResult(job Job, cached CachedResult) {
+	log.Printf("Commit %s of %s already built by job %s, reusing its result\n",
+		job.Commit.Id, job.Commit.GetRepositoryName(), cached.JobId)
+	d.metrics.Inc("narwhal_cached_results_total")
+	job.CachedFrom, job.ConfigHash = cached.JobId, cached.ConfigHash
+	job.TransitionAt(JobRunning, d.clock.Now())
+	job.TransitionAt(JobSuccess, d.clock.Now())
+	if err := d.jobs.Create(job); err != nil {
+		log.Printf("Error storing job %s: %v\n", job.Id, err)
+	}
+	if steps, err := getStepResults(d.store, cached.JobId); err == nil {
+		if err := putStepResults(d.store, job.Id, steps); err != nil {
+			log.Printf("Error storing steps of job %s: %v\n", job.Id, err)
+		}
+	}
+	d.events.Append(JobEvent{Type: JobEnqueued, JobId: job.Id, Commit: job.Commit})
+	d.complete(job.Id, job.Commit, StatusSuccess, "")
+}
@@ -0,0 +1,72 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResultCache(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil, WithResultCache("octocat/fork"))
+	original := Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "master"}}
+	d.cacheResult("job-1", original, configHash([]byte("steps: []")))
+	if _, ok := d.cachedResult(NewJob("job-2", original)); ok {
+		t.Errorf("Dispatcher.cacheResult failed: result cached for a repository not enabled")
+	}
+
+	d = NewDispatcher("commits", time.Second, nil, WithResultCache("*"))
+	d.cacheResult("job-1", original, configHash([]byte("steps: []")))
+	fork := Commit{Id: "abc", Repository: Repository{GitHub, "octocat/fork", "feature"}}
+	job, err := d.jobs.Get(d.enqueue(fork))
+	if err != nil || job.State != JobSuccess || job.CachedFrom != "job-1" {
+		t.Errorf("Dispatcher.schedule failed: cached result not reused %v %v", job, err)
+	}
+	if d.queue.Len() != 0 {
+		t.Errorf("Dispatcher.schedule failed: cached commit queued")
+	}
+
+	// Tags of the commit are built again, their pipeline may differ
+	tagged := Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", ""}, Event: TagTrigger, Tag: "v1.0.0"}
+	if job, _ := d.jobs.Get(d.enqueue(tagged)); job.State != JobPending {
+		t.Errorf("Dispatcher.schedule failed: push result reused by a tag build")
+	}
+
+	// Pull requests merged into their base branch are built every time
+	pr := Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "feature"}, Event: PullRequestTrigger,
+		PullRequest: &PullRequest{Number: 1, MergeRef: "refs/pull/1/merge", HeadRef: "refs/pull/1/head"}}
+	d.cacheResult("job-3", pr, configHash([]byte("steps: []")))
+	if job, _ := d.jobs.Get(d.enqueue(pr)); job.State != JobPending {
+		t.Errorf("Dispatcher.schedule failed: cached result reused for a merged pull request")
+	}
+
+	// A different inline pipeline builds the commit again
+	fork.Pipeline = "steps: [{name: lint, command: make lint}]"
+	if job, _ := d.jobs.Get(d.enqueue(fork)); job.State != JobPending {
+		t.Errorf("Dispatcher.schedule failed: cached result reused with another pipeline")
+	}
+}
@@ -0,0 +1,286 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backoff of the deliveries of the spooled reports, doubling on every failed
+// attempt
+const (
+	minSpoolBackoff = time.Second
+	maxSpoolBackoff = time.Minute
+)
+
+// Header set on the reports delivered from the spool, possibly after the
+// job is over
+const spooledReportHeader string = "X-Narwhal-Spooled"
+
+// errReportRejected is returned when the dispatcher refuses a report, e.g.
+// for an unknown job, delivering it again would not help. Timeouts and rate
+// limits are not rejections.
+var errReportRejected = errors.New("report rejected by the dispatcher")
+
+// dispatcherReport is a POST of the runner to the API of the dispatcher on
+// behalf of a job: its result, the result of a step or a chunk of its logs
+type dispatcherReport struct {
+	JobId       string `json:"job_id"`
+	URL         string `json:"url"`
+	Token       string `json:"token"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body"`
+	// Read back from the spool
+	spooled bool
+}
+
+// newDispatcherReport addresses a report to the /jobs/{id}/{path} endpoint of
+// the dispatcher, authenticated with the job token
+func newDispatcherReport(req RunnerRequest, path, contentType string, body []byte) dispatcherReport {
+	return dispatcherReport{
+		JobId:       req.JobId,
+		URL:         strings.TrimRight(req.APIURL, "/") + "/jobs/" + req.JobId + "/" + path,
+		Token:       req.JobToken,
+		ContentType: contentType,
+		Body:        body,
+	}
+}
+
+// send posts the report once, client errors but 408 and 429 are reported as
+// rejections
+func (p dispatcherReport) send(client *http.Client) error {
+	httpReq, err := http.NewRequest(http.MethodPost, p.URL, bytes.NewReader(p.Body))
+	if err != nil {
+		return err
+	}
+	if p.ContentType != "" {
+		httpReq.Header.Set("Content-Type", p.ContentType)
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+p.Token)
+	if p.spooled {
+		httpReq.Header.Set(spooledReportHeader, "true")
+	}
+	res, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode < 300:
+		return nil
+	case res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests:
+	case res.StatusCode < 500:
+		return fmt.Errorf("%w: status %d", errReportRejected, res.StatusCode)
+	}
+	return fmt.Errorf("dispatcher answered with status %d", res.StatusCode)
+}
+
+// resultSpool keeps on disk the reports the runner could not deliver to the
+// dispatcher, e.g. during a network partition, delivering them again in order
+// with a backoff until they arrive. Once a job has reports spooled its next
+// ones are queued behind them, so that the dispatcher receives them in order.
+type resultSpool struct {
+	dir    string
+	client *http.Client
+	mutex  sync.Mutex
+	// Number of spooled reports by job
+	pending map[string]int
+	// Sequence number of the next spooled report, naming its file
+	next uint64
+}
+
+// WithResultSpool spools the results and the logs of the jobs that can't be
+// delivered to the dispatcher in the given directory, delivering them again
+// until they arrive, even across runner restarts
+func WithResultSpool(dir string) RunnerOption {
+	return func(r *Runner) {
+		spool, err := openResultSpool(dir)
+		if err != nil {
+			log.Fatalf("Unable to open the result spool: %v", err)
+		}
+		r.spool = spool
+	}
+}
+
+// openResultSpool opens the spool directory, counting the reports left by a
+// previous run
+func openResultSpool(dir string) (*resultSpool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &resultSpool{dir: dir, client: &http.Client{Timeout: 10 * time.Second}, pending: map[string]int{}}
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		report, err := s.read(file)
+		if err != nil {
+			return nil, err
+		}
+		s.pending[report.JobId]++
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(file), ".json"), 10, 64)
+		if err == nil && seq >= s.next {
+			s.next = seq + 1
+		}
+	}
+	return s, nil
+}
+
+// files returns the spooled reports, oldest first
+func (s *resultSpool) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	sort.Strings(files)
+	return files, err
+}
+
+func (s *resultSpool) read(file string) (dispatcherReport, error) {
+	var report dispatcherReport
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(data, &report)
+	}
+	report.spooled = true
+	return report, err
+}
+
+// Pending tells if a job has reports waiting in the spool
+func (s *resultSpool) Pending(jobId string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.pending[jobId] > 0
+}
+
+// Add writes a report to the spool, named after its sequence number to
+// preserve the order, the clock may go backwards
+func (s *resultSpool) Add(report dispatcherReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	name := fmt.Sprintf("%020d.json", s.next)
+	tmp := filepath.Join(s.dir, "."+name)
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		return err
+	}
+	s.pending[report.JobId]++
+	s.next++
+	return nil
+}
+
+// Flush delivers the spooled reports in order, stopping at the first one
+// that can't be delivered. Rejected reports are dropped.
+func (s *resultSpool) Flush() error {
+	files, err := s.files()
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	delivered := 0
+	for _, file := range files {
+		report, err := s.read(file)
+		if err == nil {
+			err = report.send(s.client)
+		}
+		if errors.Is(err, errReportRejected) {
+			log.Printf("Dropping spooled report %s of job %s: %v\n", file, report.JobId, err)
+		} else if err != nil {
+			return err
+		} else {
+			delivered++
+		}
+		s.mutex.Lock()
+		err = os.Remove(file)
+		if s.pending[report.JobId]--; s.pending[report.JobId] <= 0 {
+			delete(s.pending, report.JobId)
+		}
+		s.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Delivered %d spooled reports\n", delivered)
+	return nil
+}
+
+// flushLoop flushes the spool forever, backing off while the dispatcher is
+// unreachable
+func (s *resultSpool) flushLoop() {
+	backoff := minSpoolBackoff
+	for {
+		if err := s.Flush(); err != nil {
+			log.Printf("Error delivering spooled reports, retrying in %s: %v\n", backoff, err)
+			if backoff *= 2; backoff > maxSpoolBackoff {
+				backoff = maxSpoolBackoff
+			}
+		} else {
+			backoff = minSpoolBackoff
+		}
+		time.Sleep(backoff)
+	}
+}
+
+// deliver posts a report to the dispatcher, retrying up to attempts times
+// with a linear backoff, and spools it if it still can't be delivered. The
+// reports of a job with others already spooled are spooled right away.
+func (r *Runner) deliver(report dispatcherReport, attempts int) error {
+	if r.spool != nil && r.spool.Pending(report.JobId) {
+		return r.spool.Add(report)
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = report.send(client); err == nil || errors.Is(err, errReportRejected) {
+			return err
+		}
+		if attempt < attempts {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	if r.spool == nil {
+		return err
+	}
+	log.Printf("Spooling report of job %s, delivery failed: %v\n", report.JobId, err)
+	return r.spool.Add(report)
+}
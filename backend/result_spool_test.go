@@ -0,0 +1,134 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResultSpool(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil)
+	jobId := d.enqueue(Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "dev"}})
+	var down atomic.Bool
+	down.Store(true)
+	handler := jobsHandler(d)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		handler(w, r)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	spool, err := openResultSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := &Runner{streamLogs: true, spool: spool}
+	req := RunnerRequest{JobId: jobId, JobToken: d.jobTokens.Issue(jobId), APIURL: server.URL}
+	logs := newDispatcherLogWriter(runner, req)
+	logs.Write([]byte("partitioned\n"))
+	logs.Close()
+	down.Store(false)
+	// Queued behind the spooled logs even though the dispatcher is back
+	runner.reportStep(req, StepResult{Name: "build", Status: StepSuccess})
+	if files, _ := spool.files(); len(files) != 2 {
+		t.Fatalf("resultSpool failed: expected 2 spooled reports got %d", len(files))
+	}
+	// Rejected reports are dropped
+	spool.Add(newDispatcherReport(RunnerRequest{JobId: "other", JobToken: "invalid", APIURL: server.URL},
+		"result", "application/json", []byte("{}")))
+
+	// The job is over by the time the spool is flushed after a restart
+	d.cancelJob(jobId)
+	spool, err = openResultSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !spool.Pending(jobId) || !spool.Pending("other") {
+		t.Fatalf("openResultSpool failed: expected pending reports")
+	}
+	if err := spool.Flush(); err != nil {
+		t.Fatalf("resultSpool.Flush failed: %v", err)
+	}
+	if files, _ := spool.files(); len(files) != 0 || spool.Pending(jobId) || spool.Pending("other") {
+		t.Errorf("resultSpool.Flush failed: expected an empty spool got %v", files)
+	}
+	data, err := d.store.Get(jobLogsBucket, jobId)
+	if err != nil || string(data) != "partitioned\n" {
+		t.Errorf("resultSpool.Flush failed: unexpected stored logs %q %v", data, err)
+	}
+	if logs, _ := d.logs.Read(jobId, 0); string(logs) != "partitioned\n" {
+		t.Errorf("resultSpool.Flush failed: unexpected logs %q", logs)
+	}
+}
+
+func TestResultSpoolOrder(t *testing.T) {
+	var limited atomic.Bool
+	limited.Store(true)
+	received := make(chan string, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Rate limited reports are kept for later
+		if limited.Load() {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		received <- r.URL.Path
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	spool, err := openResultSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, jobId := range []string{"a", "b"} {
+		spool.Add(newDispatcherReport(RunnerRequest{JobId: jobId, APIURL: server.URL}, "result", "", nil))
+	}
+	if err := spool.Flush(); err == nil {
+		t.Errorf("resultSpool.Flush failed: expected an error while rate limited")
+	}
+	// Reopened after a restart, the next reports go after the spooled ones
+	if spool, err = openResultSpool(dir); err != nil {
+		t.Fatal(err)
+	}
+	spool.Add(newDispatcherReport(RunnerRequest{JobId: "c", APIURL: server.URL}, "result", "", nil))
+	limited.Store(false)
+	if err := spool.Flush(); err != nil {
+		t.Fatalf("resultSpool.Flush failed: %v", err)
+	}
+	for _, expected := range []string{"/jobs/a/result", "/jobs/b/result", "/jobs/c/result"} {
+		if path := <-received; path != expected {
+			t.Errorf("resultSpool.Flush failed: expected %s got %s", expected, path)
+		}
+	}
+}
@@ -27,7 +27,6 @@
 package backend
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"github.com/docker/docker/api/types"
@@ -35,6 +34,9 @@ import (
 	docker "github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"io"
 	"io/ioutil"
 	"log"
@@ -42,134 +44,834 @@ import (
 	"net/rpc"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const TEMPDIR string = "/tmp/"
 
 type RunnerRequest struct {
+	JobId     string
 	CommitJob Commit
+	// Token scoped to the job and URL of the dispatcher API, exposed to the
+	// steps so they can call back, e.g. to annotate their job
+	JobToken string
+	APIURL   string
+	// Variables of the repository set through the API, overriding the ones
+	// of the CI configuration
+	Env map[string]string
+	// Whether the repository has secrets, fetched from the dispatcher API
+	// at the start of the job
+	Secrets bool
 }
 
 type RunnerResponse struct {
 	Response string
+	// Error of the failing step, if any
+	Error string
+	Steps []StepResult
+	// Effective CI configuration the job ran with, and its hash
+	Config     string
+	ConfigHash string
+	// Percentage covered by the tests, if the pipeline reads a report
+	Coverage *float64
+	// Why the job failed when no step did
+	Category FailureCategory
+	// Image the steps ran in, pre-pulled by the runners when enabled
+	Image string
+	// Runner labels and executor required by the pipeline, and whether the
+	// runner doesn't satisfy them, handing the job back without running it
+	RunsOn    map[string]string
+	Executor  string
+	Unmatched bool
+	// Whether the pipeline opted out of being interrupted
+	Uninterruptible bool
+	// Output of the job, unless streamed to the dispatcher as it ran
+	Logs []byte
+}
+
+type StepStatus string
+
+const (
+	StepSuccess StepStatus = "success"
+	StepFailure StepStatus = "failure"
+	StepSkipped StepStatus = "skipped"
+)
+
+// Outcome and timings of the execution of a single step
+type StepResult struct {
+	Name       string     `json:"name"`
+	Status     StepStatus `json:"status"`
+	StartedAt  time.Time  `json:"started_at,omitempty"`
+	FinishedAt time.Time  `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	ExitCode   int        `json:"exit_code,omitempty"`
+	// Why the step failed, only on failures
+	Category FailureCategory `json:"category,omitempty"`
+	// Results of the tests run, if the step declares their format
+	Tests *TestSummary `json:"tests,omitempty"`
 }
 
 type HeartBeatRequest struct{}
 
 type HeartBeatResponse struct {
 	Alive bool
+	// Repositories the runner accepts, nil for all of them
+	Policy *RepositoryPolicy
+	// Labels the pipelines may require to run on the runner
+	Labels map[string]string
+}
+
+type Runner struct {
+	id                 string
+	logSinks           []LogSink
+	user               string
+	credentials        *CredentialsCache
+	registrationSecret string
+	jobsMutex          sync.Mutex
+	cancelled          map[string]bool
+	active             map[string]bool
+	orphans            []OrphanResult
+	collecting         map[string]bool
+	journal            *JobJournal
+	reconcileInterval  time.Duration
+	streamLogs         bool
+	metrics            *Metrics
+	policy             *RepositoryPolicy
+	labels             map[string]string
+	maxJobs            int
+	executors          []string
+	maxStepLogSize     int64
+	chaos              *chaos
+	interruptible      map[string]bool
+	spool              *resultSpool
+	proxies            []dependencyProxy
+	proxiesMutex       sync.Mutex
+	dependencyCache    bool
+	// Results being reported to the dispatcher in the background
+	reports sync.WaitGroup
+	// Images pushed by the dispatcher to pull while idle, and when they were
+	// last pulled
+	prePullInterval time.Duration
+	prePullMutex    sync.Mutex
+	prePullImages   map[string]bool
+	prePulledAt     map[string]time.Time
+	// Dispatcher the runner registers to, see WithRegistration, its answer
+	// and the last heartbeat received
+	dispatcherURL        string
+	advertiseAddr        string
+	registrationInterval time.Duration
+	registrationMutex    sync.Mutex
+	registration         RegistrationResponse
+	lastHeartbeat        time.Time
+}
+
+// Repositories whose cached clone credentials must be dropped, all of them if
+// empty
+type RevokeCredentialsRequest struct {
+	Repositories []string
+}
+
+type RevokeCredentialsResponse struct{}
+
+type RunnerOption func(*Runner)
+
+// WithLogSinks ships the output of every step to the given remote sinks too
+func WithLogSinks(sinks ...LogSink) RunnerOption {
+	return func(r *Runner) {
+		r.logSinks = append(r.logSinks, sinks...)
+	}
+}
+
+// WithRunnerId sets the identifier the containers, volumes and networks of
+// the runner are labelled with, it must be unique among the runners sharing
+// a Docker daemon and stable across restarts
+func WithRunnerId(id string) RunnerOption {
+	return func(r *Runner) {
+		r.id = id
+	}
+}
+
+// WithContainerUser runs the steps as the given `uid[:gid]` instead of the
+// image default user, usually root. Repositories can override it through the
+// `user` field of their CI configuration.
+func WithContainerUser(user string) RunnerOption {
+	return func(r *Runner) {
+		r.user = user
+	}
+}
+
+// WithCredentials resolves the credentials to clone repositories through the
+// given provider, caching them for the TTL
+func WithCredentials(provider CredentialsProvider, ttl time.Duration) RunnerOption {
+	return func(r *Runner) {
+		r.credentials = NewCredentialsCache(provider, ttl)
+	}
 }
 
-type Runner struct{}
+// RevokeCredentials drops cached clone credentials, called by the dispatcher
+// when they're revoked
+func (r *Runner) RevokeCredentials(req RevokeCredentialsRequest, res *RevokeCredentialsResponse) error {
+	if r.credentials != nil {
+		r.credentials.Invalidate(req.Repositories...)
+	}
+	return nil
+}
 
 func (r *Runner) HeartBeat(req HeartBeatRequest, res *HeartBeatResponse) error {
-	res.Alive = true
+	r.registrationMutex.Lock()
+	r.lastHeartbeat = time.Now()
+	r.registrationMutex.Unlock()
+	res.Alive, res.Policy, res.Labels = true, r.policy, r.advertisedLabels()
 	return nil
 }
 
-func cloneRepository(name string) (string, error) {
+// cloneRepository clones the repository of a commit, checking out its tag or
+// the first of its refs that can be fetched if any, the default branch
+// otherwise
+func cloneRepository(commit Commit, credentials Credentials) (string, error) {
+	auth, err := credentials.AuthMethod()
+	if err != nil {
+		return "", err
+	}
+	name := commit.GetRepositoryName()
+	url := commit.cloneURL(credentials.SSHKey != "")
+
 	// Tempdir to clone the repository
-	dir, err := ioutil.TempDir(TEMPDIR, name)
+	dir, err := ioutil.TempDir(TEMPDIR, strings.Replace(name, "/", "-", -1))
 	if err != nil {
 		return "", err
 	}
 
 	// Clones the repository into the given dir, just as a normal git clone does
-	_, err = git.PlainClone(dir, false, &git.CloneOptions{
-		URL: path.Join("https://github.com", name),
-	})
+	options := &git.CloneOptions{URL: url, Auth: auth}
+	if commit.Tag != "" {
+		options.ReferenceName = plumbing.NewTagReferenceName(commit.Tag)
+	}
+	repo, err := git.PlainClone(dir, false, options)
+	var ref string
+	if err == nil && len(commit.checkoutRefs()) > 0 {
+		ref, err = checkoutRefs(repo, commit.checkoutRefs(), auth)
+	}
+	// The ref may have moved since the push, the commit built is checked out
+	// unless merged into its base
+	if err == nil && !(commit.mergedBuild() && ref == commit.PullRequest.MergeRef) {
+		err = checkoutCommit(repo, commit.Id)
+	}
 
 	if err != nil {
+		os.RemoveAll(dir)
 		return "", err
 	}
 
 	return dir, nil
 }
 
-func createDockerfile(dir, imageName, cmd string, deps []string) error {
-	f, err := os.Create(path.Join(dir, "Dockerfile"))
+// Local ref the refs checked out in place of a branch are fetched to
+const checkoutRef string = "refs/narwhal/checkout"
+
+// checkoutRefs fetches the first of the given refs the remote has, e.g. the
+// merge ref of a pull request falling back to its head, and checks it out,
+// returning the ref fetched
+func checkoutRefs(repo *git.Repository, refs []string, auth transport.AuthMethod) (string, error) {
+	var err error
+	var fetched string
+	for _, ref := range refs {
+		err = repo.Fetch(&git.FetchOptions{
+			RefSpecs: []config.RefSpec{config.RefSpec("+" + ref + ":" + checkoutRef)},
+			Auth:     auth,
+		})
+		if err == nil || err == git.NoErrAlreadyUpToDate {
+			fetched = ref
+			break
+		}
+		log.Printf("Unable to fetch %s: %v\n", ref, err)
+	}
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return "", err
+	}
+	head, err := repo.Reference(plumbing.ReferenceName(checkoutRef), true)
+	if err != nil {
+		return "", err
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return "", err
+	}
+	return fetched, worktree.Checkout(&git.CheckoutOptions{Hash: head.Hash(), Force: true})
+}
+
+// checkoutCommit checks out the given commit of a cloned repository, failing
+// if the remote no longer has it, e.g. after a force push
+func checkoutCommit(repo *git.Repository, id string) error {
+	hash, err := repo.ResolveRevision(plumbing.Revision(id))
 	if err != nil {
-		return err
+		return fmt.Errorf("commit %s not found: %v", id, err)
 	}
-	w := bufio.NewWriter(f)
-	dockerfile := fmt.Sprintf("FROM %s\nCOPY . /build\nRUN %s\nCMD %s",
-		imageName, cmd, strings.Join(deps[:], ","))
-	_, err = w.WriteString(dockerfile)
+	worktree, err := repo.Worktree()
 	if err != nil {
 		return err
 	}
-	w.Flush()
-	return nil
+	return worktree.Checkout(&git.CheckoutOptions{Hash: *hash, Force: true})
+}
+
+// clone clones the repository of a commit with its cached credentials, when
+// they're refused they're resolved again once, as they may have been rotated.
+// Pull requests from forks are cloned anonymously, their code must not get
+// hold of the credentials of the base repository.
+func (r *Runner) clone(commit Commit, jobToken string) (string, error) {
+	name := commit.GetRepositoryName()
+	if r.credentials == nil || commit.fromFork() {
+		return cloneRepository(commit, Credentials{})
+	}
+	credentials, err := r.credentials.Credentials(name, jobToken)
+	if err != nil {
+		return "", err
+	}
+	dir, err := cloneRepository(commit, credentials)
+	if err == transport.ErrAuthenticationRequired || err == transport.ErrAuthorizationFailed {
+		r.credentials.Invalidate(name)
+		if credentials, err = r.credentials.Credentials(name, jobToken); err != nil {
+			return "", err
+		}
+		dir, err = cloneRepository(commit, credentials)
+	}
+	return dir, err
+}
+
+// Installs the packages given as positional arguments, through apk on Alpine
+// based images and apt-get otherwise
+const installScript = `if [ "$#" -gt 0 ]; then if command -v apk >/dev/null; then apk add --no-cache "$@"; else apt-get update && apt-get install -y "$@"; fi || exit $?; fi`
+
+// Every step is executed by a shell inside the container: the step command is
+// never split or interpolated on our side, it's handed to the container through
+// the environment and evaluated by the shell as a whole. Likewise dependencies
+// are passed as positional arguments of the install script, preventing any
+// quoting issue or injection.
+const stepScript = `eval "$NARWHAL_STEP_CMD"`
+
+// Installing the dependencies takes root, whatever user the steps run as
+const rootUser string = "0"
+
+// Mount point of the cloned repository inside the step containers
+const workspaceDir string = "/build"
+
+// stepCommand returns the argv to run a step through the shell entrypoint
+func stepCommand(step Step) []string {
+	return []string{"/bin/sh", "-c", stepScript, "sh"}
+}
+
+// installCommand returns the argv installing the dependencies of a step, to
+// be run as root
+func installCommand(step Step) []string {
+	return append([]string{"/bin/sh", "-c", installScript, "sh"}, step.Dependencies...)
+}
+
+// stepEnv returns the environment of a step container in the KEY=VALUE form,
+// sorted by key, including the step command itself.
+func stepEnv(env map[string]string, step Step) []string {
+	vars := make([]string, 0, len(env)+2)
+	for k, v := range env {
+		vars = append(vars, k+"="+v)
+	}
+	sort.Strings(vars)
+	return append(vars, "NARWHAL_STEP_NAME="+step.Name, "NARWHAL_STEP_CMD="+step.Cmd)
 }
 
-func runContainer(ciConfig *CIConfig) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// runContainer executes a step in a new container with the given labels,
+// streaming its output to the given writer while it runs. The artifacts of
+// the step are handed to upload once it's over, if set. With cacheDependencies
+// the image with the dependencies of the step installed is kept for the next
+// runs.
+func runContainer(labels map[string]string, ciConfig *CIConfig, step Step, dir, user, network string,
+	cacheDependencies bool, logs io.Writer, upload func(p string, archive io.Reader) error) error {
+	ctx := context.Background()
 	cli, err := docker.NewEnvClient()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	reader, err := cli.ImagePull(ctx, "docker.io/library/alpine",
-		types.ImagePullOptions{})
+	reader, err := cli.ImagePull(ctx, ciConfig.ImageName, types.ImagePullOptions{})
 	if err != nil {
-		panic(err)
+		return err
+	}
+	io.Copy(ioutil.Discard, reader)
+	reader.Close()
+
+	// The dependencies are installed by root on top of the image the step
+	// runs in as its user, the image is dropped afterwards unless cached
+	image := ciConfig.ImageName
+	if len(step.Dependencies) > 0 {
+		var built bool
+		if image, built, err = dependencyImage(ctx, cli, image, step, logs); err != nil {
+			return err
+		}
+		if built && !cacheDependencies {
+			defer removeDependencyImage(ctx, cli, image)
+		}
 	}
-	io.Copy(os.Stdout, reader)
 
 	resp, err := cli.ContainerCreate(ctx, &container.Config{
-		Image: ciConfig.ImageName,
-		Cmd:   []string{"echo", "hello world"},
-		Tty:   false,
-	}, nil, nil, "")
+		Image:      image,
+		Cmd:        stepCommand(step),
+		Env:        stepEnv(ciConfig.Env, step),
+		WorkingDir: workspaceDir,
+		User:       user,
+		Tty:        false,
+		Labels:     labels,
+	}, &container.HostConfig{
+		Binds:       []string{dir + ":" + workspaceDir},
+		NetworkMode: container.NetworkMode(network),
+	}, nil, "")
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer cli.ContainerRemove(ctx, resp.ID, types.ContainerRemoveOptions{Force: true})
 
 	if err := cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
-		panic(err)
+		return err
 	}
 
-	_, err = cli.ContainerWait(ctx, resp.ID)
+	out, err := cli.ContainerLogs(ctx, resp.ID,
+		types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer out.Close()
+
+	// Following the logs returns as soon as the container stops
+	stdcopy.StdCopy(logs, logs, out)
 
-	out, err := cli.ContainerLogs(ctx, resp.ID, types.ContainerLogsOptions{ShowStdout: true})
+	exitCode, err := cli.ContainerWait(ctx, resp.ID)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if upload != nil {
+		collectArtifacts(ctx, cli, resp.ID, step, upload)
+	}
+	if exitCode != 0 {
+		// The container is new, it never ran out of memory before the step
+		return exitError(step.Name, int(exitCode), containerState{},
+			inspectContainerState(ctx, cli, resp.ID), false)
 	}
+	return nil
+}
 
-	stdcopy.StdCopy(os.Stdout, os.Stderr, out)
+// containerState is the state of the container of a step its exit is
+// categorized from
+type containerState struct {
+	// The container ran out of memory, it stays set once raised
+	oomKilled bool
+	// Memory limit of the container in bytes, 0 if unlimited
+	memoryLimit int64
+}
+
+// inspectContainerState reads the state of a container, a zero one if it
+// can't be inspected
+func inspectContainerState(ctx context.Context, cli *docker.Client, containerId string) containerState {
+	var state containerState
+	if info, err := cli.ContainerInspect(ctx, containerId); err == nil {
+		if info.State != nil {
+			state.oomKilled = info.State.OOMKilled
+		}
+		if info.HostConfig != nil {
+			state.memoryLimit = info.HostConfig.Memory
+		}
+	}
+	return state
+}
+
+// exitError returns the error of a step exiting with a non-zero code, given
+// the state of its container before and after the step ran. Only a step
+// raising the OOM killed flag ran out of memory, and in a container shared
+// with other processes, e.g. the job container in exec mode, only if killed
+// by SIGKILL, the kernel may have killed another process.
+func exitError(step string, code int, before, after containerState, shared bool) *ExitError {
+	oomKilled := after.oomKilled && !before.oomKilled
+	if shared {
+		oomKilled = oomKilled && code == sigkillExitCode
+	}
+	return &ExitError{Step: step, Code: code, OOMKilled: oomKilled, MemoryLimit: after.memoryLimit}
+}
+
+// ExitError is returned by a step whose container exited with a non-zero
+// code
+type ExitError struct {
+	Step string
+	Code int
+	// The container ran out of memory and was killed
+	OOMKilled bool
+	// Memory limit of the container in bytes, 0 if unlimited
+	MemoryLimit int64
+}
+
+// Exit code of a process killed by SIGKILL, e.g. by the kernel enforcing a
+// resource limit
+const sigkillExitCode int = 128 + 9
+
+// ResourceKilled tells if the step was killed by SIGKILL without running out
+// of memory, e.g. on reaching the pids limit
+func (e *ExitError) ResourceKilled() bool {
+	return !e.OOMKilled && e.Code == sigkillExitCode
+}
+
+func (e *ExitError) Error() string {
+	switch {
+	case e.OOMKilled && e.MemoryLimit > 0:
+		return fmt.Sprintf("step %s killed out of memory, exceeding the limit of %d MiB",
+			e.Step, e.MemoryLimit/(1024*1024))
+	case e.OOMKilled:
+		return fmt.Sprintf("step %s killed out of memory", e.Step)
+	case e.ResourceKilled():
+		return fmt.Sprintf("step %s killed with SIGKILL, likely on a resource limit", e.Step)
+	}
+	return fmt.Sprintf("step %s exited with code %d", e.Step, e.Code)
 }
 
 func (r *Runner) RunCommitJob(req RunnerRequest, res *RunnerResponse) error {
-	dir, err := cloneRepository(req.CommitJob.GetRepositoryName())
+	if r.chaos != nil {
+		if err := r.chaos.before(req.JobId); err != nil {
+			res.Response = "NOK"
+			return err
+		}
+	}
+	var logs *dispatcherLogWriter
+	if r.streamLogs && req.APIURL != "" {
+		logs = newDispatcherLogWriter(r, req)
+	}
+	startedAt := time.Now()
+	err := r.runCommitJob(req, res, logs)
+	elapsed := time.Since(startedAt)
+	// The dispatcher completes the logs of the job on the response, the ones
+	// still being posted must reach it first
+	if logs != nil {
+		logs.Close()
+	}
+	held := r.chaos != nil && r.chaos.hold(req.JobId)
+	// A job handed back is not over, another runner is going to run it
+	report := req.APIURL != "" && !res.Unmatched && !held
+	// The response doesn't wait for the result, retried in the background
+	if report {
+		r.reports.Add(1)
+		go func() {
+			defer r.reports.Done()
+			r.reportResult(req, r.jobResult(req, res, err, elapsed))
+		}()
+	}
+	if held {
+		return ErrChaosDropped
+	}
+	return err
+}
+
+// runCommitJob runs a job, streaming its output to logs if set, handing it
+// to the dispatcher with the response otherwise
+func (r *Runner) runCommitJob(req RunnerRequest, res *RunnerResponse, logs *dispatcherLogWriter) error {
+	if err := r.accepts(req); err != nil {
+		res.Response = "NOK"
+		return err
+	}
+	var stream *jobLogStream
+	if logs != nil {
+		stream = newJobLogStream(logs)
+	} else {
+		capture := &jobLogCapture{}
+		stream = newJobLogStream(capture)
+		defer func() { res.Logs = capture.data }()
+	}
+	dir, err := r.clone(req.CommitJob, req.JobToken)
 	if err != nil {
 		return err
 	}
 	// Delete temporary at the end of the execution
 	defer os.RemoveAll(dir)
 
-	// Read CI configuration
-	ciConfig, err := LoadCIConfigFromFile(dir)
+	// Read CI configuration, an inline pipeline takes precedence over the
+	// one committed in the repository
+	data := []byte(req.CommitJob.Pipeline)
+	if req.CommitJob.Pipeline == "" {
+		data, err = ioutil.ReadFile(path.Join(dir, CIConfigFile))
+	}
+	var ciConfig *CIConfig
+	if err == nil {
+		ciConfig, err = ParseCIConfig(data)
+	}
 	if err != nil {
 		res.Response = "NOK"
 		return err
 	}
-	// Create a Dockerfile in the tempdir
-	createDockerfile(dir, ciConfig.ImageName, ciConfig.Steps[0].Cmd, ciConfig.Steps[0].Dependencies)
+	effective, err := ciConfig.Effective()
+	if err != nil {
+		res.Response = "NOK"
+		return err
+	}
+	res.Config, res.ConfigHash = string(effective), configHash(effective)
+	res.RunsOn, res.Executor = ciConfig.RunsOn, ciConfig.Mode
+	res.Uninterruptible = !ciConfig.interruptible()
+	if err := r.satisfies(ciConfig.requirements()); err != nil {
+		res.Response, res.Unmatched, res.Error = "NOK", true, err.Error()
+		return nil
+	}
+	res.Image = ciConfig.ImageName
+	env := map[string]string{
+		"NARWHAL_JOB_ID":    req.JobId,
+		"NARWHAL_JOB_TOKEN": req.JobToken,
+		"NARWHAL_API_URL":   req.APIURL,
+		"NARWHAL_EVENT":     string(req.CommitJob.TriggeredBy()),
+		"NARWHAL_TAG":       req.CommitJob.Tag,
+	}
+	if pr := req.CommitJob.PullRequest; pr != nil {
+		env["NARWHAL_PULL_REQUEST"] = strconv.Itoa(pr.Number)
+		env["NARWHAL_BASE_BRANCH"] = pr.BaseBranch
+		env["NARWHAL_HEAD_SHA"] = pr.HeadSHA
+	}
+	for k, v := range ciConfig.Env {
+		env[k] = v
+	}
+	for k, v := range req.Env {
+		env[k] = v
+	}
+	if req.Secrets {
+		secrets, err := fetchSecrets(req)
+		if err != nil {
+			res.Response = "NOK"
+			return fmt.Errorf("fetching the secrets: %v", err)
+		}
+		for k, v := range secrets {
+			env[k] = v
+		}
+	}
+	ciConfig.Env = env
+	if err := chownWorkspace(dir, r.containerUser(ciConfig)); err != nil {
+		res.Response = "NOK"
+		return err
+	}
+	r.trackJob(req.JobId, req.CommitJob)
+	defer r.untrackJob(req.JobId)
+	r.setInterruptible(req.JobId, ciConfig.interruptible())
+	network := r.createJobNetwork(req.JobId, req.CommitJob)
+	defer r.removeJobResources(req.JobId)
+	proxyEnv(ciConfig.Env, r.attachProxies(network))
+	var jobContainer string
+	if ciConfig.execSteps() {
+		labels := r.containerLabels(req.JobId, req.CommitJob, Step{})
+		delete(labels, stepLabel)
+		jobContainer, err = startJobContainer(labels, ciConfig, dir, r.containerUser(ciConfig), network,
+			r.dependencyCache, stream)
+		if err != nil {
+			res.Response = "NOK"
+			return err
+		}
+		defer removeJobContainer(jobContainer)
+	}
+	// Failing steps are reported through the response rather than as an RPC
+	// error, which would discard it along with the results of the steps
+	if err := r.warmUp(req, ciConfig, dir, network, jobContainer, stream); err != nil {
+		res.Response, res.Error, res.Category = "NOK", err.Error(), FailureEnvironment
+		for _, step := range ciConfig.Steps {
+			res.Steps = append(res.Steps, StepResult{Name: step.Name, Status: StepSkipped})
+		}
+		return nil
+	}
 	res.Response = "OK"
+	for _, step := range ciConfig.Steps {
+		result := StepResult{Name: step.Name, Status: StepSkipped}
+		if !step.runsOn(req.CommitJob.TriggeredBy()) {
+			res.Steps = append(res.Steps, result)
+			continue
+		}
+		if res.Response == "OK" && !r.startStep(req.JobId, step) {
+			res.Response, res.Error = "NOK", "job cancelled"
+		}
+		if res.Response == "OK" {
+			result.StartedAt = time.Now()
+			var tests *goTestParser
+			var testsWriter io.Writer
+			if step.TestFormat == goTestJSONFormat {
+				tests = newGoTestParser()
+				testsWriter = tests
+			}
+			// The sinks get the markers and the stamped lines of the step too
+			sinks := r.openLogSinks(req.CommitJob, step.Name)
+			out := stream.step(sinks...)
+			out.StepStart(step.Name)
+			err := r.runStep(req, ciConfig, step, dir, network, jobContainer, out, testsWriter)
+			result.FinishedAt = time.Now()
+			if tests != nil {
+				result.Tests = tests.Summary()
+			}
+			result.Status = StepSuccess
+			if err != nil {
+				result.Status, result.Error = StepFailure, err.Error()
+				result.ExitCode = infraFailureExitCode
+				// Cancelled jobs have their containers killed
+				if !r.isCancelled(req.JobId) {
+					result.Category = step.categorize(err)
+				}
+				if exitErr, ok := err.(*ExitError); ok {
+					result.ExitCode = exitErr.Code
+				}
+				res.Response, res.Error = "NOK", err.Error()
+			}
+			out.StepEnd(result)
+			for _, sink := range sinks {
+				sink.Close()
+			}
+			if req.APIURL != "" {
+				r.reportStep(req, result)
+			}
+		}
+		res.Steps = append(res.Steps, result)
+	}
+	if ciConfig.Coverage != nil && res.Response == "OK" {
+		var err error
+		if res.Coverage, err = checkCoverage(dir, ciConfig.Coverage); err != nil {
+			res.Response, res.Error, res.Category = "NOK", err.Error(), FailureCoverage
+		}
+	}
 	return nil
 }
 
-func StartRunner(addr string) error {
+// openLogSinks opens the writers of every configured log sink for a step
+func (r *Runner) openLogSinks(commit Commit, step string) []io.WriteCloser {
+	sinks := make([]io.WriteCloser, 0, len(r.logSinks))
+	for _, sink := range r.logSinks {
+		sinks = append(sinks, sink.Open(commit, step))
+	}
+	return sinks
+}
+
+// runStep executes a single step, inside the job container if set or in a
+// new one otherwise. Its output goes to the runner stdout, to extra, if set,
+// e.g. the test results parser, and within the step log limit to the step log
+// stream, shared by the dispatcher and the log sinks
+func (r *Runner) runStep(req RunnerRequest, ciConfig *CIConfig, step Step, dir, network, jobContainer string,
+	stream *jobLogStream, extra io.Writer) error {
+	writers := []io.Writer{os.Stdout}
+	if extra != nil {
+		writers = append(writers, extra)
+	}
+	var limiter *stepLogLimiter
+	if r.maxStepLogSize > 0 {
+		limiter = newStepLogLimiter(stream, r.maxStepLogSize, artifactName(step.Name, stepLogArtifactPath))
+		defer limiter.Close()
+		writers = append(writers, limiter)
+	} else {
+		writers = append(writers, stream)
+	}
+	var upload func(string, io.Reader) error
+	if req.APIURL != "" && len(step.Artifacts) > 0 {
+		upload = func(p string, archive io.Reader) error {
+			return r.uploadArtifact(req, step.Name, p, archive)
+		}
+	}
+	var err error
+	if jobContainer != "" {
+		err = execStep(jobContainer, ciConfig, step, r.containerUser(ciConfig), !r.dependencyCache,
+			io.MultiWriter(writers...), upload)
+	} else {
+		err = runContainer(r.containerLabels(req.JobId, req.CommitJob, step), ciConfig, step, dir,
+			r.containerUser(ciConfig), network, r.dependencyCache, io.MultiWriter(writers...), upload)
+	}
+	if limiter != nil {
+		limiter.Flush()
+		if limiter.Truncated() && limiter.spool != nil && req.APIURL != "" {
+			if err := r.uploadArtifact(req, step.Name, stepLogArtifactPath, limiter.Archive()); err != nil {
+				log.Printf("Error uploading the output of step %s: %v\n", step.Name, err)
+			}
+		}
+	}
+	return err
+}
+
+// containerUser returns the user the steps of a pipeline run as, the one set
+// by the CI configuration takes precedence over the runner default
+func (r *Runner) containerUser(ciConfig *CIConfig) string {
+	if ciConfig.User != "" {
+		return ciConfig.User
+	}
+	return r.user
+}
+
+// chownWorkspace hands the ownership of the cloned repository to the user the
+// steps run as, so that files created in the mounted workspace are not owned
+// by root. Users given by name can't be resolved outside of the image, in that
+// case the workspace is left untouched.
+func chownWorkspace(dir, user string) error {
+	if user == "" {
+		return nil
+	}
+	parts := strings.SplitN(user, ":", 2)
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		log.Printf("Can't chown workspace to non numeric user %s\n", user)
+		return nil
+	}
+	gid := uid
+	if len(parts) == 2 {
+		if gid, err = strconv.Atoi(parts[1]); err != nil {
+			log.Printf("Can't chown workspace to non numeric group %s\n", parts[1])
+			return nil
+		}
+	}
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, uid, gid)
+	})
+}
+
+// defaultRunnerId identifies a runner by its host and listening port, unique
+// on a host and stable across restarts
+func defaultRunnerId(addr string) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		port = addr
+	}
+	return net.JoinHostPort(hostname, port)
+}
+
+func StartRunner(addr string, opts ...RunnerOption) error {
 	quit := make(chan interface{})
 	done := make(chan interface{})
 	listener, err := net.Listen("tcp", addr)
-	runnerProxy := &Runner{}
+	runnerProxy := &Runner{metrics: newRunnerMetrics(), maxStepLogSize: defaultMaxStepLogSize}
+	for _, opt := range opts {
+		opt(runnerProxy)
+	}
+	if runnerProxy.id == "" {
+		runnerProxy.id = defaultRunnerId(addr)
+	}
+	if runnerProxy.policy != nil {
+		if err := runnerProxy.policy.validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateExecutors(runnerProxy.executors); err != nil {
+		return err
+	}
+	if runnerProxy.journal != nil {
+		go runnerProxy.reconcileLoop()
+	}
+	if runnerProxy.spool != nil {
+		go runnerProxy.spool.flushLoop()
+	}
+	go runnerProxy.startProxies()
+	if runnerProxy.prePullInterval > 0 {
+		go runnerProxy.prePullLoop()
+	}
+	if runnerProxy.dependencyCache {
+		go runnerProxy.pruneDependencyImagesLoop()
+	}
 	rpcServer := rpc.NewServer()
 
 	// Publish Runner proxy object
@@ -178,6 +880,13 @@ func StartRunner(addr string) error {
 		log.Fatal(err)
 	}
 	log.Printf("Listening on %v\n", listener.Addr())
+	if runnerProxy.dispatcherURL != "" {
+		go func() {
+			if err := runnerProxy.keepRegistered(nil, registrationBackoff, maxRegistrationBackoff); err != nil {
+				log.Fatalf("Registration failed: %v", err)
+			}
+		}()
+	}
 
 	// Wait for incoming connections
 	go func() {
@@ -0,0 +1,251 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Bucket of what the pipeline of each ref of the repositories last required
+// of its runner, learnt from the runs as the dispatcher never reads the CI
+// configuration
+const requirementsBucket string = "pipeline_requirements"
+
+// Requirements of a pipeline on the runner running it
+type pipelineRequirements struct {
+	Labels map[string]string `json:"labels,omitempty"`
+	// Mode of execution of the steps, empty for the default one
+	Executor string `json:"executor,omitempty"`
+	// Set if the pipeline is not interruptible, its pending jobs are not
+	// superseded either
+	Uninterruptible bool `json:"uninterruptible,omitempty"`
+}
+
+func (c *CIConfig) requirements() pipelineRequirements {
+	return pipelineRequirements{c.RunsOn, c.Mode, !c.interruptible()}
+}
+
+func (r pipelineRequirements) empty() bool {
+	return len(r.Labels) == 0 && r.Executor == "" && !r.Uninterruptible
+}
+
+// String describes the requirements, e.g. labels gpu=true, executor exec
+func (r pipelineRequirements) String() string {
+	var parts []string
+	if len(r.Labels) > 0 {
+		parts = append(parts, "labels "+labelList(r.Labels))
+	}
+	if r.Executor != "" {
+		parts = append(parts, "executor "+r.Executor)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// WithLabels advertises labels to the dispatcher, e.g. gpu=true, routing to
+// the runner only the jobs whose pipeline requires a subset of them. The os
+// and arch labels are always set, from the platform unless given.
+func WithLabels(labels map[string]string) RunnerOption {
+	return func(r *Runner) {
+		r.labels = labels
+	}
+}
+
+// advertisedLabels returns the labels of the runner, os and arch included
+func (r *Runner) advertisedLabels() map[string]string {
+	labels := map[string]string{"os": runtime.GOOS, "arch": runtime.GOARCH}
+	for k, v := range r.labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// ParseRunnerLabels reads a comma separated list of key=value labels, a bare
+// key standing for key=true, e.g. gpu,docker=true,zone=eu
+func ParseRunnerLabels(list string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		key, value, found := strings.Cut(entry, "=")
+		if !found {
+			value = "true"
+		}
+		if key = strings.TrimSpace(key); key == "" {
+			return nil, fmt.Errorf("invalid label %q", entry)
+		}
+		labels[key] = strings.TrimSpace(value)
+	}
+	return labels, nil
+}
+
+// labelsSatisfy tells if labels include all the required ones with the same
+// values
+func labelsSatisfy(labels, required map[string]string) bool {
+	for k, v := range required {
+		if value, ok := labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// labelList renders labels sorted by key, e.g. arch=amd64,gpu=true
+func labelList(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Satisfies tells if the runner advertised all the labels required by a
+// pipeline and is able to run its steps
+func (p *RunnerProxy) Satisfies(required pipelineRequirements) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return labelsSatisfy(p.Labels, required.Labels) && p.capabilities.runs(required.Executor)
+}
+
+// satisfies returns an error if the runner can't run a pipeline, lacking some
+// of its required labels or its executor
+func (r *Runner) satisfies(required pipelineRequirements) error {
+	if !labelsSatisfy(r.advertisedLabels(), required.Labels) {
+		return fmt.Errorf("runner not matching the labels %s", labelList(required.Labels))
+	}
+	executor := required.Executor
+	if executor == "" {
+		executor = containerMode
+	}
+	if !containsString(r.supportedExecutors(), executor) {
+		return fmt.Errorf("runner not supporting the executor %s", executor)
+	}
+	return nil
+}
+
+// requirementsKey identifies the pipeline of a commit in the requirements
+// bucket, every branch, tag and pull request may change it
+func requirementsKey(commit Commit) string {
+	return commit.GetRepositoryName() + "@" + commit.ref()
+}
+
+// requirements returns what the pipeline of a commit requires of its runner,
+// read from an inline pipeline or learnt from the last run of its ref
+func (d *Dispatcher) requirements(commit Commit) pipelineRequirements {
+	var required pipelineRequirements
+	if commit.Pipeline != "" {
+		if config, err := ParseCIConfig([]byte(commit.Pipeline)); err == nil {
+			required = config.requirements()
+		}
+		return required
+	}
+	data, err := d.store.Get(requirementsBucket, requirementsKey(commit))
+	if err != nil {
+		if err != ErrNotFound {
+			log.Printf("Error reading the requirements of %s: %v\n", commit.GetRepositoryName(), err)
+		}
+		return required
+	}
+	if err := json.Unmarshal(data, &required); err != nil {
+		log.Printf("Error decoding the requirements of %s: %v\n", commit.GetRepositoryName(), err)
+	}
+	return required
+}
+
+// learnRequirements remembers what the committed pipeline of a ref requires
+// of its runner, as reported by the runner after reading it
+func (d *Dispatcher) learnRequirements(commit Commit, required pipelineRequirements) {
+	if commit.Pipeline != "" {
+		return
+	}
+	key := requirementsKey(commit)
+	var err error
+	if required.empty() {
+		err = d.store.Delete(requirementsBucket, key)
+	} else {
+		var data []byte
+		if data, err = json.Marshal(required); err == nil {
+			err = d.store.Put(requirementsBucket, key, data)
+		}
+	}
+	if err != nil && err != ErrNotFound {
+		log.Printf("Error storing the requirements of %s: %v\n", key, err)
+	}
+}
+
+// waitingReason explains why no runner picked a job, empty if some
+// registered runner satisfies its requirements and is just busy or down
+func (d *Dispatcher) waitingReason(required pipelineRequirements) string {
+	runners := d.runnerList()
+	for _, runner := range runners {
+		if runner.Satisfies(required) {
+			return ""
+		}
+	}
+	if len(runners) == 0 {
+		return "no runner registered"
+	}
+	if required.empty() {
+		return "no runner able to run containers"
+	}
+	return "no matching runner for " + required.String()
+}
+
+// setWaiting records on a pending job why it's not dispatched yet, writing
+// it only on change
+func (d *Dispatcher) setWaiting(jobId, reason string) {
+	job, err := d.jobs.Get(jobId)
+	if err != nil || job.Waiting == reason || job.State != JobPending {
+		return
+	}
+	d.updateJob(jobId, func(job *Job) error {
+		job.Waiting = reason
+		return nil
+	})
+}
+
+// handBack puts back in the queue a job its runner refused to run as it
+// doesn't satisfy the requirements of the pipeline
+func (d *Dispatcher) handBack(runner *RunnerProxy, jobId string, commit Commit, required pipelineRequirements) {
+	log.Printf("Runner %s not matching the %s required by commit %s, requeueing\n",
+		runner.Addr, required, commit.Id)
+	d.finishJob(runner, commit, "unmatched requirements")
+	if d.updateJob(jobId, func(job *Job) error {
+		job.Runner = ""
+		return job.TransitionAt(JobPending, d.clock.Now())
+	}) {
+		d.aggregator.Progress(commit.Id, StatusPending)
+		d.queue.Push(jobId, commit)
+		d.events.Append(JobEvent{Type: JobEnqueued, JobId: jobId, Commit: commit})
+	}
+}
@@ -0,0 +1,153 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"net"
+	"net/rpc"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestParseRunnerLabels(t *testing.T) {
+	labels, err := ParseRunnerLabels("gpu, docker=true,zone=eu")
+	expected := map[string]string{"gpu": "true", "docker": "true", "zone": "eu"}
+	if err != nil || !reflect.DeepEqual(labels, expected) {
+		t.Errorf("ParseRunnerLabels failed: expected %v got %v %v", expected, labels, err)
+	}
+	if _, err := ParseRunnerLabels("=true"); err == nil {
+		t.Errorf("ParseRunnerLabels failed: expected an error on a missing key")
+	}
+}
+
+func TestRunnerAdvertisedLabels(t *testing.T) {
+	r := &Runner{labels: map[string]string{"gpu": "true", "os": "custom"}}
+	var res HeartBeatResponse
+	r.HeartBeat(HeartBeatRequest{}, &res)
+	expected := map[string]string{"gpu": "true", "os": "custom", "arch": runtime.GOARCH}
+	if !reflect.DeepEqual(res.Labels, expected) {
+		t.Errorf("Runner.HeartBeat failed: expected labels %v got %v", expected, res.Labels)
+	}
+}
+
+func TestPickRunnerLabels(t *testing.T) {
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	cpu := &RunnerProxy{Id: "cpu", Alive: true, RpcClient: rpc.NewClient(conn),
+		Labels: map[string]string{"os": "linux"}}
+	gpu := &RunnerProxy{Id: "gpu", Alive: true, RpcClient: rpc.NewClient(conn),
+		Labels:      map[string]string{"os": "linux", "gpu": "true"},
+		currentJobs: map[string]Commit{"a": {}}}
+	d := NewDispatcher("commits", time.Second, []*RunnerProxy{cpu, gpu})
+	if runner := d.pickRunner("octocat/test", pipelineRequirements{}); runner != cpu {
+		t.Errorf("pickRunner expected the least busy runner without labels")
+	}
+	if runner := d.pickRunner("octocat/test", pipelineRequirements{Labels: map[string]string{"gpu": "true"}}); runner != gpu {
+		t.Errorf("pickRunner expected the gpu runner")
+	}
+	required := pipelineRequirements{Labels: map[string]string{"os": "windows"}}
+	if runner := d.pickRunner("octocat/test", required); runner != nil {
+		t.Errorf("pickRunner expected no runner for os=windows, got %s", runner.Id)
+	}
+	if reason := d.waitingReason(required); reason != "no matching runner for labels os=windows" {
+		t.Errorf("waitingReason failed: unexpected %q", reason)
+	}
+}
+
+// unmatchedRunner hands back every job, requiring the gpu label
+type unmatchedRunner struct{}
+
+func (unmatchedRunner) RunCommitJob(req RunnerRequest, res *RunnerResponse) error {
+	res.Response, res.Unmatched = "NOK", true
+	res.RunsOn = map[string]string{"gpu": "true"}
+	return nil
+}
+
+func TestHandBackUnmatchedJob(t *testing.T) {
+	server := rpc.NewServer()
+	server.RegisterName("Runner", unmatchedRunner{})
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go server.ServeConn(serverConn)
+	proxy := NewRunnerProxy("r1")
+	proxy.Alive, proxy.RpcClient = true, rpc.NewClient(clientConn)
+	d := NewDispatcher("commits", time.Second, []*RunnerProxy{proxy})
+
+	commit := Commit{Id: "a", Repository: Repository{GitHub, "octocat/test", "master"}}
+	job := NewJob("job-a", commit)
+	d.jobs.Create(job)
+	d.forwardToRunner(proxy, job.Id, commit)
+	if job, _ = d.jobs.Get(job.Id); job.State != JobPending || job.Runner != "" || job.StartedAt != nil {
+		t.Errorf("Dispatcher.forwardToRunner failed: expected the job handed back got %v", job)
+	}
+	if d.queue.Len() != 1 {
+		t.Errorf("Dispatcher.forwardToRunner failed: expected the job requeued")
+	}
+	if required := d.requirements(commit); !reflect.DeepEqual(required.Labels, map[string]string{"gpu": "true"}) {
+		t.Errorf("requirements failed: expected the learnt labels got %v", required)
+	}
+	if runner := d.pickRunner("octocat/test", d.requirements(commit)); runner != nil {
+		t.Errorf("pickRunner expected no runner for the gpu pipeline")
+	}
+	// Other branches may not require it
+	other := Commit{Id: "c", Repository: Repository{GitHub, "octocat/test", "feature"}}
+	if required := d.requirements(other); !required.empty() {
+		t.Errorf("requirements failed: expected none learnt for another branch got %v", required)
+	}
+	// Nor do they wait behind it
+	otherJob := d.enqueue(other)
+	if item, runner := d.dispatchable(); item.JobId != otherJob || runner != proxy {
+		t.Errorf("dispatchable failed: expected %s dispatched past the gpu job got %s", otherJob, item.JobId)
+	}
+	inline := Commit{Id: "b", Repository: commit.Repository, Pipeline: "mode: exec\nruns_on:\n  os: linux\n"}
+	expected := pipelineRequirements{map[string]string{"os": "linux"}, execMode, false}
+	if required := d.requirements(inline); !reflect.DeepEqual(required, expected) {
+		t.Errorf("requirements failed: expected the inline pipeline ones got %v", required)
+	}
+}
+
+func TestForwardToDisconnectedRunner(t *testing.T) {
+	proxy := NewRunnerProxy("r1")
+	proxy.Alive = true
+	d := NewDispatcher("commits", time.Second, []*RunnerProxy{proxy})
+
+	commit := Commit{Id: "a", Repository: Repository{GitHub, "octocat/test", "master"}}
+	job := NewJob("job-a", commit)
+	d.jobs.Create(job)
+	d.forwardToRunner(proxy, job.Id, commit)
+	if job, _ = d.jobs.Get(job.Id); job.State != JobPending || job.Runner != "" {
+		t.Errorf("Dispatcher.forwardToRunner failed: expected the job pending got %v", job)
+	}
+	if proxy.jobsCount() != 0 {
+		t.Errorf("Dispatcher.forwardToRunner failed: expected no job on the runner got %d", proxy.jobsCount())
+	}
+	if item := d.queue.Pop(); item.JobId != job.Id || item.Commit.Id != commit.Id {
+		t.Errorf("Dispatcher.forwardToRunner failed: expected the commit requeued got %v", item)
+	}
+}
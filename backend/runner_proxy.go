@@ -27,23 +27,254 @@
 package backend
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"net/rpc"
+	"sync"
+	"time"
 )
 
+// Max number of dispatches remembered for each runner
+const dispatchHistorySize int = 20
+
+// A record of a commit pushed to a runner, FinishedAt is zero and Result is
+// empty as long as the runner is still working on it
+type DispatchRecord struct {
+	CommitId     string    `json:"commit_id"`
+	Repository   string    `json:"repository"`
+	DispatchedAt time.Time `json:"dispatched_at"`
+	FinishedAt   time.Time `json:"finished_at,omitempty"`
+	Result       string    `json:"result,omitempty"`
+}
+
+// Point-in-time view of a runner, suitable to be served through the API
+type RunnerInfo struct {
+	Id            string            `json:"id"`
+	Addr          string            `json:"addr"`
+	Labels        map[string]string `json:"labels"`
+	Alive         bool              `json:"alive"`
+	Draining      bool              `json:"draining"`
+	LastHeartbeat time.Time         `json:"last_heartbeat"`
+	CurrentJobs   []Commit          `json:"current_jobs"`
+	History       []DispatchRecord  `json:"history,omitempty"`
+	// Reported on registration, unknown for the runners of the configuration
+	Capabilities *RunnerCapabilities `json:"capabilities,omitempty"`
+}
+
 type RunnerProxy struct {
-	Addr      string
-	Alive     bool
-	RpcClient *rpc.Client
+	mutex         sync.RWMutex
+	Id            string
+	Addr          string
+	Labels        map[string]string
+	Alive         bool
+	Draining      bool
+	LastHeartbeat time.Time
+	RpcClient     *rpc.Client
+	Transport     TransportConfig
+	currentJobs   map[string]Commit
+	history       []DispatchRecord
+	// Repositories the runner accepts, as advertised on the last heartbeat
+	policy *RepositoryPolicy
+	// Capabilities reported on the last registration, nil if unknown
+	capabilities *RunnerCapabilities
+	// Source of the heartbeat and dispatch times, the system clock if nil
+	clock Clock
+	// Images last pushed to pre-pull, and the connection they went through
+	prePullImages string
+	prePullClient *rpc.Client
 }
 
-func (p RunnerProxy) String() string {
+func (p *RunnerProxy) String() string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
 	if p.Alive == true {
 		return fmt.Sprintf("%s: alive", p.Addr)
 	}
 	return fmt.Sprintf("%s: dead", p.Addr)
 }
 
+// The runner ID is derived from its address, so it's stable across restarts
+// of the dispatcher
 func NewRunnerProxy(addr string) *RunnerProxy {
-	return &RunnerProxy{addr, false, nil}
+	sum := sha1.Sum([]byte(addr))
+	return &RunnerProxy{
+		Id:          hex.EncodeToString(sum[:6]),
+		Addr:        addr,
+		Labels:      map[string]string{},
+		Transport:   DefaultTransportConfig,
+		currentJobs: map[string]Commit{},
+		history:     []DispatchRecord{},
+	}
+}
+
+// Dial connects to the RPC server of the runner, replacing any previous
+// connection
+func (p *RunnerProxy) Dial() error {
+	transport := p.Transport.merge(DefaultTransportConfig)
+	dialer := net.Dialer{Timeout: transport.DialTimeout, KeepAlive: transport.KeepAlive}
+	conn, err := dialer.Dial("tcp", p.Addr)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.RpcClient != nil {
+		p.RpcClient.Close()
+	}
+	p.RpcClient = rpc.NewClient(conn)
+	return nil
+}
+
+func (p *RunnerProxy) client() *rpc.Client {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.RpcClient
+}
+
+// HeartBeat probes the runner, which is considered alive only if it answers
+// within the call timeout. A broken connection is dialed again on the
+// following heartbeat.
+func (p *RunnerProxy) HeartBeat() bool {
+	client := p.client()
+	if client == nil {
+		if err := p.Dial(); err != nil {
+			return false
+		}
+		client = p.client()
+	}
+	var res HeartBeatResponse
+	call := client.Go("Runner.HeartBeat", HeartBeatRequest{}, &res, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error == rpc.ErrShutdown {
+			p.mutex.Lock()
+			if p.RpcClient == client {
+				p.RpcClient = nil
+			}
+			p.mutex.Unlock()
+		}
+		if call.Error == nil && res.Alive {
+			p.mutex.Lock()
+			p.policy = res.Policy
+			if res.Labels != nil {
+				p.Labels = res.Labels
+			}
+			p.mutex.Unlock()
+		}
+		return call.Error == nil && res.Alive
+	case <-time.After(p.Transport.merge(DefaultTransportConfig).CallTimeout):
+		return false
+	}
+}
+
+// SetAlive updates the health of the runner after an heartbeat, returning the
+// lifecycle event triggered by the change if any, an empty string otherwise
+func (p *RunnerProxy) SetAlive(alive bool) RunnerEventType {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var event RunnerEventType
+	switch {
+	case alive && p.LastHeartbeat.IsZero():
+		event = RunnerRegistered
+	case alive && !p.Alive:
+		event = RunnerRecovered
+	case !alive && p.Alive:
+		event = RunnerDied
+	}
+	p.Alive = alive
+	if alive {
+		p.LastHeartbeat = clockOrSystem(p.clock).Now()
+	}
+	return event
+}
+
+// Drain stops the runner from accepting new commits, the ones already running
+// are left to complete
+func (p *RunnerProxy) Drain() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.Draining = true
+}
+
+func (p *RunnerProxy) IsDraining() bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.Draining
+}
+
+func (p *RunnerProxy) IsAlive() bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.Alive
+}
+
+// Accepts tells if the runner builds the given repository
+func (p *RunnerProxy) Accepts(repository string) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.policy.Permits(repository)
+}
+
+// jobsCount returns the number of jobs currently running on the runner
+func (p *RunnerProxy) jobsCount() int {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return len(p.currentJobs)
+}
+
+// startJob tracks a commit as currently running on the runner
+func (p *RunnerProxy) startJob(commit Commit) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.currentJobs[commit.Id] = commit
+	p.history = append(p.history, DispatchRecord{
+		CommitId:     commit.Id,
+		Repository:   commit.GetRepositoryName(),
+		DispatchedAt: clockOrSystem(p.clock).Now(),
+	})
+	if len(p.history) > dispatchHistorySize {
+		p.history = p.history[len(p.history)-dispatchHistorySize:]
+	}
+}
+
+// finishJob removes a commit from the ones currently running, recording the
+// outcome in the dispatch history
+func (p *RunnerProxy) finishJob(commit Commit, result string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.currentJobs, commit.Id)
+	for i := len(p.history) - 1; i >= 0; i-- {
+		if p.history[i].CommitId == commit.Id && p.history[i].Result == "" {
+			p.history[i].FinishedAt = clockOrSystem(p.clock).Now()
+			p.history[i].Result = result
+			break
+		}
+	}
+}
+
+// Info returns a snapshot of the runner state, the dispatch history is
+// included only when withHistory is true
+func (p *RunnerProxy) Info(withHistory bool) RunnerInfo {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	info := RunnerInfo{
+		Id:            p.Id,
+		Addr:          p.Addr,
+		Labels:        p.Labels,
+		Capabilities:  p.capabilities,
+		Alive:         p.Alive,
+		Draining:      p.Draining,
+		LastHeartbeat: p.LastHeartbeat,
+		CurrentJobs:   make([]Commit, 0, len(p.currentJobs)),
+	}
+	for _, commit := range p.currentJobs {
+		info.CurrentJobs = append(info.CurrentJobs, commit)
+	}
+	if withHistory {
+		info.History = make([]DispatchRecord, len(p.history))
+		copy(info.History, p.history)
+	}
+	return info
 }
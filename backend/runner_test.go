@@ -0,0 +1,206 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func TestStepCommand(t *testing.T) {
+	step := Step{
+		Name:         "test",
+		Dependencies: []string{"make", "gcc"},
+		Cmd:          `echo "hello; world" && make test`,
+	}
+	expected := []string{"/bin/sh", "-c", stepScript, "sh"}
+	if cmd := stepCommand(step); !reflect.DeepEqual(cmd, expected) {
+		t.Errorf("stepCommand failed: expected %v got %v", expected, cmd)
+	}
+	// The dependencies are installed apart, as root
+	expected = []string{"/bin/sh", "-c", installScript, "sh", "make", "gcc"}
+	if cmd := installCommand(step); !reflect.DeepEqual(cmd, expected) {
+		t.Errorf("installCommand failed: expected %v got %v", expected, cmd)
+	}
+	if config := installExecConfig(step); config.User != rootUser || !reflect.DeepEqual(config.Cmd, expected) {
+		t.Errorf("installExecConfig failed: expected %v as root got %v as %q", expected, config.Cmd, config.User)
+	}
+	expectedEnv := []string{
+		"A=1",
+		"B=x y",
+		"NARWHAL_STEP_NAME=test",
+		`NARWHAL_STEP_CMD=echo "hello; world" && make test`,
+	}
+	env := stepEnv(map[string]string{"B": "x y", "A": "1"}, step)
+	if !reflect.DeepEqual(env, expectedEnv) {
+		t.Errorf("stepEnv failed: expected %v got %v", expectedEnv, env)
+	}
+}
+
+func TestInstallScript(t *testing.T) {
+	// A fake apk records the packages it's asked to add
+	dir := t.TempDir()
+	apk := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "installed") + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "apk"), []byte(apk), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("/bin/sh", installCommand(Step{Dependencies: []string{"make", "gcc; rm -rf /"}})[1:]...)
+	cmd.Env = []string{"PATH=" + dir + ":/usr/bin:/bin"}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("installScript failed: %v %s", err, out)
+	}
+	installed, _ := ioutil.ReadFile(filepath.Join(dir, "installed"))
+	if string(installed) != "add --no-cache make gcc; rm -rf /\n" {
+		t.Errorf("installScript failed: expected the dependencies as arguments got %q", installed)
+	}
+	// Without dependencies nothing is installed
+	if err := exec.Command("/bin/sh", installCommand(Step{})[1:]...).Run(); err != nil {
+		t.Errorf("installScript failed: unexpected %v without dependencies", err)
+	}
+}
+
+func TestContainerLabels(t *testing.T) {
+	commit := Commit{Id: "abc", Repository: Repository{GitHub, "octocat/test", "master"}}
+	labels := (&Runner{id: "runner-1"}).containerLabels("job-1", commit, Step{Name: "test"})
+	if labels[runnerIdLabel] != "runner-1" || labels[jobIdLabel] != "job-1" || labels[repositoryLabel] != "octocat/test" ||
+		labels[commitLabel] != "abc" || labels[stepLabel] != "test" || labels[versionLabel] != Version {
+		t.Errorf("containerLabels failed: unexpected %v", labels)
+	}
+}
+
+func TestDefaultRunnerId(t *testing.T) {
+	hostname, _ := os.Hostname()
+	for _, addr := range []string{":9898", "0.0.0.0:9898", "[::]:9898"} {
+		if id := defaultRunnerId(addr); id != net.JoinHostPort(hostname, "9898") {
+			t.Errorf("defaultRunnerId failed: expected %s:9898 got %s", hostname, id)
+		}
+	}
+}
+
+func TestCheckoutCommit(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, _ := repo.Worktree()
+	signature := &object.Signature{Name: "narwhal", Email: "narwhal@example.com", When: time.Now()}
+	var commits []string
+	for _, content := range []string{"first", "second"} {
+		os.WriteFile(filepath.Join(dir, "file"), []byte(content), 0644)
+		worktree.Add("file")
+		hash, err := worktree.Commit(content, &git.CommitOptions{Author: signature})
+		if err != nil {
+			t.Fatal(err)
+		}
+		commits = append(commits, hash.String())
+	}
+	if err := checkoutCommit(repo, commits[0]); err != nil {
+		t.Fatalf("checkoutCommit failed: expected nil got %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "file")); string(content) != "first" {
+		t.Errorf("checkoutCommit failed: expected first got %s", content)
+	}
+	if err := checkoutCommit(repo, strings.Repeat("a", 40)); err == nil {
+		t.Errorf("checkoutCommit failed: expected an error on an unknown commit got nil")
+	}
+}
+
+func TestStepCategorize(t *testing.T) {
+	ciConfig, err := ParseCIConfig([]byte("steps:\n  - name: lint\n    command: make lint\n    failures:\n      3: lint\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := ciConfig.Steps[0]
+	cases := []struct {
+		err      error
+		expected FailureCategory
+	}{
+		{nil, ""},
+		{errors.New("image pull failed"), FailureInfra},
+		{&ExitError{Step: "lint", Code: 1}, FailureTest},
+		{&ExitError{Step: "lint", Code: 3}, "lint"},
+		{&ExitError{Step: "lint", Code: 137, OOMKilled: true}, FailureOOMKilled},
+		{&ExitError{Step: "lint", Code: 137}, FailureResourceKilled},
+	}
+	for _, c := range cases {
+		if category := step.categorize(c.err); category != c.expected {
+			t.Errorf("Step.categorize failed: expected %q got %q for %v", c.expected, category, c.err)
+		}
+	}
+}
+
+func TestExitError(t *testing.T) {
+	fresh, oom := containerState{memoryLimit: 512 << 20}, containerState{oomKilled: true, memoryLimit: 512 << 20}
+	cases := []struct {
+		code          int
+		before, after containerState
+		shared        bool
+		expected      bool
+	}{
+		{137, fresh, oom, false, true},
+		{1, fresh, oom, false, true},
+		{137, fresh, fresh, false, false},
+		{137, fresh, oom, true, true},
+		// The job container stays flagged after a previous step ran out of memory
+		{137, oom, oom, true, false},
+		{1, oom, oom, true, false},
+		// Another process of the job container was killed
+		{1, fresh, oom, true, false},
+	}
+	for _, c := range cases {
+		err := exitError("test", c.code, c.before, c.after, c.shared)
+		if err.OOMKilled != c.expected || err.Code != c.code || err.MemoryLimit != 512<<20 {
+			t.Errorf("exitError failed: expected OOM killed %v got %v for %+v", c.expected, err, c)
+		}
+	}
+}
+
+func TestForgetCancel(t *testing.T) {
+	r := &Runner{cancelled: map[string]bool{"job-a": true, "job-b": true}}
+	r.trackJob("job-a", Commit{})
+	r.forgetCancel("job-a")
+	r.forgetCancel("job-b")
+	if !r.isCancelled("job-a") || r.isCancelled("job-b") {
+		t.Errorf("Runner.forgetCancel failed: expected only the cancel of the running job kept got %v", r.cancelled)
+	}
+	r.untrackJob("job-a")
+	if len(r.cancelled) != 0 {
+		t.Errorf("Runner.untrackJob failed: expected no cancel left got %v", r.cancelled)
+	}
+}
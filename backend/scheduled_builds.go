@@ -0,0 +1,192 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// ScheduledBuild builds the head of a branch on a cron schedule, e.g.
+//
+//	schedules:
+//	  - name: nightly
+//	    url: https://github.com/octocat/hello-world
+//	    branch: main
+//	    cron: "@nightly"
+//	    timezone: Europe/Rome
+type ScheduledBuild struct {
+	Name   string `yaml:"name"`
+	URL    string `yaml:"url"`
+	Branch string `yaml:"branch"`
+	Cron   string `yaml:"cron"`
+	// Location of the cron expression, UTC if empty
+	Timezone string `yaml:"timezone,omitempty"`
+}
+
+// scheduledBuild is a validated scheduled build ready to be triggered
+type scheduledBuild struct {
+	ScheduledBuild
+	repository Repository
+	cron       *CronSchedule
+	location   *time.Location
+}
+
+// parse validates the scheduled build
+func (s ScheduledBuild) parse() (scheduledBuild, error) {
+	parsed := scheduledBuild{ScheduledBuild: s, location: time.UTC}
+	if s.Name == "" || s.Branch == "" {
+		return parsed, fmt.Errorf("scheduled build %q: name and branch are required", s.Name)
+	}
+	var err error
+	if parsed.repository, err = ParseRepositoryURL(s.URL); err != nil {
+		return parsed, fmt.Errorf("scheduled build %s: %v", s.Name, err)
+	}
+	parsed.repository.Branch = s.Branch
+	if parsed.cron, err = ParseCronSchedule(s.Cron); err != nil {
+		return parsed, fmt.Errorf("scheduled build %s: %v", s.Name, err)
+	}
+	if s.Timezone != "" {
+		if parsed.location, err = time.LoadLocation(s.Timezone); err != nil {
+			return parsed, fmt.Errorf("scheduled build %s: %v", s.Name, err)
+		}
+	}
+	return parsed, nil
+}
+
+// next returns the first trigger of the schedule after t
+func (s scheduledBuild) next(t time.Time) time.Time {
+	return s.cron.Next(t.In(s.location))
+}
+
+// WithScheduledBuilds triggers a build of the head of each branch on its cron
+// schedule, regardless of it being already built
+func WithScheduledBuilds(builds ...ScheduledBuild) DispatcherOption {
+	return func(d *Dispatcher) {
+		for _, build := range builds {
+			parsed, err := build.parse()
+			if err != nil {
+				log.Fatalf("Invalid scheduled build: %v", err)
+			}
+			d.schedules = append(d.schedules, parsed)
+		}
+	}
+}
+
+// Longest wait for a remote to list its references, an unresponsive one must
+// not hold back the other schedules
+const resolveHeadTimeout time.Duration = 30 * time.Second
+
+// ResolveBranchHead returns the commit at the head of a branch without
+// cloning the repository
+func ResolveBranchHead(url, branch string, credentials Credentials) (string, error) {
+	auth, err := credentials.AuthMethod()
+	if err != nil {
+		return "", err
+	}
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{url},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), resolveHeadTimeout)
+	defer cancel()
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
+	if err != nil {
+		return "", err
+	}
+	for _, ref := range refs {
+		if ref.Name() == plumbing.NewBranchReferenceName(branch) {
+			return ref.Hash().String(), nil
+		}
+	}
+	return "", fmt.Errorf("branch %s not found in %s", branch, url)
+}
+
+// runSchedules triggers the scheduled builds as they come due until stop is
+// closed, a trigger missed while the dispatcher was down is not recovered
+func (d *Dispatcher) runSchedules(stop <-chan interface{}) {
+	if len(d.schedules) == 0 {
+		return
+	}
+	now := d.clock.Now()
+	next := make([]time.Time, len(d.schedules))
+	for i, s := range d.schedules {
+		next[i] = s.next(now)
+	}
+	for {
+		var earliest time.Time
+		for _, t := range next {
+			if !t.IsZero() && (earliest.IsZero() || t.Before(earliest)) {
+				earliest = t
+			}
+		}
+		if earliest.IsZero() {
+			return
+		}
+		select {
+		case <-d.clock.After(earliest.Sub(now)):
+		case <-stop:
+			return
+		}
+		now = d.clock.Now()
+		for i, s := range d.schedules {
+			if next[i].IsZero() || next[i].After(now) {
+				continue
+			}
+			d.triggerSchedule(s)
+			next[i] = s.next(now)
+		}
+	}
+}
+
+// triggerSchedule builds the current head of the branch of a schedule as a
+// new job, bypassing the check on commits already executed and the result
+// cache
+func (d *Dispatcher) triggerSchedule(s scheduledBuild) {
+	credentials, _ := d.repositoryCredentials(s.repository.Name)
+	head, err := d.resolveHead(s.URL, s.Branch, credentials)
+	if err != nil {
+		log.Printf("Error resolving the head of scheduled build %s: %v\n", s.Name, err)
+		return
+	}
+	log.Printf("Triggering scheduled build %s of %s@%s\n", s.Name, s.repository.Name, head)
+	job := d.newJob(Commit{
+		Id:            head,
+		Timestamp:     d.clock.Now(),
+		Repository:    s.repository,
+		PushedCommits: []string{head},
+	})
+	job.Schedule = s.Name
+	d.schedule(job)
+}
@@ -0,0 +1,122 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestScheduledBuilds(t *testing.T) {
+	clock := newFakeClock()
+	d := NewDispatcher("commits", time.Second, nil, WithClock(clock),
+		WithResultCache("*"),
+		WithScheduledBuilds(ScheduledBuild{
+			Name:   "nightly",
+			URL:    "https://github.com/octocat/hello-world",
+			Branch: "main",
+			Cron:   "0 2 * * *",
+		}))
+	heads := make(chan string, 1)
+	d.resolveHead = func(url, branch string, credentials Credentials) (string, error) {
+		if branch != "main" {
+			t.Errorf("runSchedules failed: expected the head of main resolved got %s", branch)
+		}
+		head := <-heads
+		if head == "" {
+			return "", errors.New("unreachable")
+		}
+		return head, nil
+	}
+	stop := make(chan interface{})
+	defer close(stop)
+	go d.runSchedules(stop)
+
+	if wait := <-clock.requested; wait != 2*time.Hour {
+		t.Fatalf("runSchedules failed: expected to wait for 2h got %v", wait)
+	}
+	// An unreachable repository skips the run
+	heads <- ""
+	clock.Advance(2 * time.Hour)
+	if wait := <-clock.requested; wait != 24*time.Hour {
+		t.Fatalf("runSchedules failed: expected to wait for 24h got %v", wait)
+	}
+	if d.queue.Len() != 0 {
+		t.Fatalf("runSchedules failed: expected no job scheduled got %d", d.queue.Len())
+	}
+
+	// The same head is built every night, bypassing the result cache
+	for night := 1; night <= 2; night++ {
+		heads <- "abc"
+		clock.Advance(24 * time.Hour)
+		<-clock.requested
+		if d.queue.Len() != night {
+			t.Fatalf("runSchedules failed: expected %d jobs scheduled got %d", night, d.queue.Len())
+		}
+	}
+	jobs, _, err := d.jobs.List(JobFilter{}, "", 10)
+	if err != nil || len(jobs) != 2 {
+		t.Fatalf("runSchedules failed: expected 2 jobs stored got %v %v", jobs, err)
+	}
+	for _, job := range jobs {
+		if job.Schedule != "nightly" || job.Commit.Id != "abc" ||
+			job.Commit.Repository.Name != "octocat/hello-world" ||
+			job.Commit.Repository.Branch != "main" || job.CachedFrom != "" {
+			t.Errorf("runSchedules failed: expected a nightly job of abc got %+v", job)
+		}
+	}
+}
+
+func TestScheduledBuildParse(t *testing.T) {
+	valid := ScheduledBuild{
+		Name:     "nightly",
+		URL:      "git@github.com:octocat/hello-world.git",
+		Branch:   "main",
+		Cron:     "@nightly",
+		Timezone: "Europe/Rome",
+	}
+	s, err := valid.parse()
+	if err != nil {
+		t.Fatalf("ScheduledBuild.parse failed: expected no error got %v", err)
+	}
+	// Midnight in Rome is 23:00 UTC in winter
+	next := s.next(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	if !next.Equal(time.Date(2020, 1, 1, 23, 0, 0, 0, time.UTC)) {
+		t.Errorf("scheduledBuild.next failed: expected the midnight of Rome got %v", next.UTC())
+	}
+	for _, invalid := range []ScheduledBuild{
+		{URL: valid.URL, Branch: "main", Cron: "@daily"},
+		{Name: "a", URL: "https://example.com/a/b", Branch: "main", Cron: "@daily"},
+		{Name: "a", URL: valid.URL, Branch: "main", Cron: "0 0 *"},
+		{Name: "a", URL: valid.URL, Branch: "main", Cron: "@daily", Timezone: "Mars/Olympus"},
+	} {
+		if _, err := invalid.parse(); err == nil {
+			t.Errorf("ScheduledBuild.parse failed: expected an error got none for %+v", invalid)
+		}
+	}
+}
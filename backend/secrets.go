@@ -0,0 +1,286 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Bucket of the sealed secrets, keyed by {repository}:{name}
+const secretsBucket string = "secrets"
+
+// Secret is a variable of a repository stored encrypted, its value is never
+// served back by the API, only handed to the runners of its jobs
+type Secret struct {
+	Name      string    `json:"name"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type storedSecret struct {
+	Secret
+	Sealed []byte `json:"sealed"`
+}
+
+// Plaintext of a sealed secret, naming its repository so that a sealed value
+// can't be moved to another one
+type secretValue struct {
+	Repository string `json:"repository"`
+	Name       string `json:"name"`
+	Value      string `json:"value"`
+}
+
+// WithSecrets enables the secrets of the repositories, sealed at rest with
+// the current key of the keyring
+func WithSecrets(keyring *Keyring) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.secretsKeyring = keyring
+	}
+}
+
+func secretKey(repository, name string) string {
+	return repository + ":" + name
+}
+
+// putSecret seals and stores the value of a secret of a repository
+func (d *Dispatcher) putSecret(repository, name, value string) (Secret, error) {
+	secret := Secret{name, d.clock.Now().UTC()}
+	if err := validateEnv(map[string]string{name: ""}); err != nil {
+		return secret, err
+	}
+	plaintext, err := json.Marshal(secretValue{repository, name, value})
+	if err != nil {
+		return secret, err
+	}
+	sealed, err := d.secretsKeyring.Seal(plaintext)
+	if err != nil {
+		return secret, err
+	}
+	stored, err := json.Marshal(storedSecret{secret, sealed})
+	if err != nil {
+		return secret, err
+	}
+	return secret, d.store.Put(secretsBucket, secretKey(repository, name), stored)
+}
+
+// listSecrets returns the secrets of a repository sorted by name, sealed
+func (d *Dispatcher) listSecrets(repository string) ([]storedSecret, error) {
+	values, err := d.store.List(secretsBucket, secretKey(repository, ""))
+	if err != nil {
+		return nil, err
+	}
+	secrets := make([]storedSecret, 0, len(values))
+	for _, value := range values {
+		var secret storedSecret
+		if err := json.Unmarshal(value, &secret); err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
+
+// hasSecrets tells if the jobs of a repository have secrets to fetch
+func (d *Dispatcher) hasSecrets(repository string) bool {
+	if d.secretsKeyring == nil {
+		return false
+	}
+	secrets, err := d.listSecrets(repository)
+	if err != nil {
+		log.Printf("Error listing the secrets of %s: %v\n", repository, err)
+	}
+	return len(secrets) > 0
+}
+
+// openSecrets returns the values of the secrets of a repository
+func (d *Dispatcher) openSecrets(repository string) (map[string]string, error) {
+	secrets, err := d.listSecrets(repository)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	for _, secret := range secrets {
+		plaintext, err := d.secretsKeyring.Open(secret.Sealed)
+		if err != nil {
+			return nil, fmt.Errorf("secret %s: %v", secret.Name, err)
+		}
+		var value secretValue
+		if err := json.Unmarshal(plaintext, &value); err != nil {
+			return nil, fmt.Errorf("secret %s: %v", secret.Name, err)
+		}
+		if value.Repository != repository || value.Name != secret.Name {
+			return nil, fmt.Errorf("secret %s: sealed for %s", secret.Name, secretKey(value.Repository, value.Name))
+		}
+		values[secret.Name] = value.Value
+	}
+	return values, nil
+}
+
+// deleteSecrets removes every secret of a repository
+func (d *Dispatcher) deleteSecrets(repository string) error {
+	secrets, err := d.listSecrets(repository)
+	if err != nil {
+		return err
+	}
+	for _, secret := range secrets {
+		if err := d.store.Delete(secretsBucket, secretKey(repository, secret.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// secretsHandler manages the secrets of a repository on
+// /repositories/{owner}/{name}/secrets: GET lists their names and POST
+// {"name": "NPM_TOKEN", "value": "..."} sets one, DELETE
+// /repositories/{owner}/{name}/secrets/{NAME} removes it. Listing requires
+// the view permission, the rest the manage_secrets one.
+func secretsHandler(d *Dispatcher, repository, name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if d.secretsKeyring == nil {
+			http.Error(w, "secrets disabled", http.StatusNotFound)
+			return
+		}
+		permission := PermissionManageSecrets
+		if r.Method == http.MethodGet {
+			permission = PermissionView
+		}
+		if !d.authorize(w, r, permission, repository) {
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && name == "":
+			secrets, err := d.listSecrets(repository)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			names := make([]Secret, len(secrets))
+			for i, secret := range secrets {
+				names[i] = secret.Secret
+			}
+			writeJSON(w, http.StatusOK, names)
+		case r.Method == http.MethodPost && name == "":
+			var req secretValue
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid secret", http.StatusBadRequest)
+				return
+			}
+			defer r.Body.Close()
+			secret, err := d.putSecret(repository, req.Name, req.Value)
+			if errors.Is(err, ErrInvalidSettings) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusCreated, secret)
+		case r.Method == http.MethodDelete && name != "":
+			if _, err := d.store.Get(secretsBucket, secretKey(repository, name)); err == ErrNotFound {
+				http.Error(w, "no secret "+name, http.StatusNotFound)
+				return
+			}
+			if err := d.store.Delete(secretsBucket, secretKey(repository, name)); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// jobSecretsHandler serves the secrets of the repository of a running job to
+// its runner on GET /jobs/{id}/secrets, authenticated with the job token
+func jobSecretsHandler(d *Dispatcher, jobId string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		tokenJobId, ok := d.jobTokens.Verify(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if !ok || tokenJobId != jobId {
+			http.Error(w, "invalid job token", http.StatusForbidden)
+			return
+		}
+		job, err := d.jobs.Get(jobId)
+		if err == ErrNotFound {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if job.State != JobRunning {
+			http.Error(w, "job not running", http.StatusConflict)
+			return
+		}
+		if job.Commit.fromFork() {
+			http.Error(w, "no secrets for the pull requests from forks", http.StatusForbidden)
+			return
+		}
+		secrets := map[string]string{}
+		if d.secretsKeyring != nil {
+			if secrets, err = d.openSecrets(job.Commit.GetRepositoryName()); err != nil {
+				log.Printf("Error opening the secrets of job %s: %v\n", jobId, err)
+				http.Error(w, "secrets not available", http.StatusInternalServerError)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, secrets)
+	}
+}
+
+// fetchSecrets requests the secrets of the repository of a job from the
+// dispatcher API, authenticated with the job token
+func fetchSecrets(req RunnerRequest) (map[string]string, error) {
+	url := strings.TrimRight(req.APIURL, "/") + "/jobs/" + req.JobId + "/secrets"
+	httpReq, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+req.JobToken)
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dispatcher answered with status %d", res.StatusCode)
+	}
+	secrets := map[string]string{}
+	err = json.NewDecoder(res.Body).Decode(&secrets)
+	return secrets, err
+}
@@ -0,0 +1,127 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecretsHandler(t *testing.T) {
+	keyring, _ := ParseKeyring("k1:" + strings.Repeat("A", 43) + "=")
+	d := NewDispatcher("commits", time.Second, nil, WithAdminToken("admin"), WithSecrets(keyring))
+	handler := repositoriesHandler(d)
+	call := func(method, path, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	for _, test := range []struct {
+		method, path, body, token string
+		expected                  int
+	}{
+		{http.MethodPost, "/repositories/octocat/test/secrets", `{"name":"NPM_TOKEN","value":"s3cr3t"}`, "", http.StatusForbidden},
+		{http.MethodPost, "/repositories/octocat/test/secrets", `{"name":"NPM-TOKEN","value":"s3cr3t"}`, "admin", http.StatusBadRequest},
+		{http.MethodPost, "/repositories/octocat/test/secrets", `{"name":"NPM_TOKEN","value":"s3cr3t"}`, "admin", http.StatusCreated},
+		{http.MethodPost, "/repositories/octocat/test/secrets", `{"name":"DOCKER_PASSWORD","value":"hunter2"}`, "admin", http.StatusCreated},
+		{http.MethodPost, "/repositories/octocat/other/secrets", `{"name":"NPM_TOKEN","value":"other"}`, "admin", http.StatusCreated},
+		{http.MethodDelete, "/repositories/octocat/test/secrets/MISSING", "", "admin", http.StatusNotFound},
+		{http.MethodDelete, "/repositories/octocat/test/secrets/DOCKER_PASSWORD", "", "admin", http.StatusNoContent},
+	} {
+		if rec := call(test.method, test.path, test.body, test.token); rec.Code != test.expected {
+			t.Errorf("secretsHandler failed: expected %d got %d for %s %s %s",
+				test.expected, rec.Code, test.method, test.path, test.body)
+		}
+	}
+	rec := call(http.MethodGet, "/repositories/octocat/test/secrets", "", "")
+	var secrets []Secret
+	json.NewDecoder(rec.Body).Decode(&secrets)
+	if len(secrets) != 1 || secrets[0].Name != "NPM_TOKEN" {
+		t.Errorf("secretsHandler failed: expected NPM_TOKEN listed got %+v", secrets)
+	}
+	// Values are sealed at rest
+	value, _ := d.store.Get(secretsBucket, "octocat/test:NPM_TOKEN")
+	if strings.Contains(string(value), "s3cr3t") {
+		t.Errorf("Dispatcher.putSecret failed: value stored in the clear")
+	}
+
+	// Only the runner of a running job of the repository gets them
+	job := NewJob("job-a", Commit{Id: "a", Repository: Repository{GitHub, "octocat/test", "main"}})
+	d.jobs.Create(job)
+	fetch := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/jobs/job-a/secrets", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		jobsHandler(d)(rec, req)
+		return rec
+	}
+	if rec := fetch("admin"); rec.Code != http.StatusForbidden {
+		t.Errorf("jobSecretsHandler failed: expected 403 got %d", rec.Code)
+	}
+	if rec := fetch(d.jobTokens.Issue("job-a")); rec.Code != http.StatusConflict {
+		t.Errorf("jobSecretsHandler failed: expected 409 got %d", rec.Code)
+	}
+	d.jobs.Update("job-a", func(job *Job) error { return job.Transition(JobRunning) })
+	if !d.hasSecrets("octocat/test") {
+		t.Errorf("Dispatcher.hasSecrets failed: expected octocat/test to have secrets")
+	}
+	server := httptest.NewServer(jobsHandler(d))
+	defer server.Close()
+	values, err := fetchSecrets(RunnerRequest{JobId: "job-a", JobToken: d.jobTokens.Issue("job-a"), APIURL: server.URL})
+	if err != nil || !reflect.DeepEqual(values, map[string]string{"NPM_TOKEN": "s3cr3t"}) {
+		t.Errorf("fetchSecrets failed: unexpected %v %v", values, err)
+	}
+
+	// Nor do the pull requests from forks
+	fork := NewJob("job-b", Commit{Id: "b", Repository: Repository{GitHub, "octocat/test", "feature"},
+		Event: PullRequestTrigger, PullRequest: &PullRequest{Number: 1, HeadRef: "refs/pull/1/head", Fork: true}})
+	fork.Transition(JobRunning)
+	d.jobs.Create(fork)
+	req := httptest.NewRequest(http.MethodGet, "/jobs/job-b/secrets", nil)
+	req.Header.Set("Authorization", "Bearer "+d.jobTokens.Issue("job-b"))
+	rec = httptest.NewRecorder()
+	jobsHandler(d)(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("jobSecretsHandler failed: expected 403 for a fork got %d", rec.Code)
+	}
+
+	// A sealed value moved to another repository is refused
+	d.store.Put(secretsBucket, "octocat/test:NPM_TOKEN", func() []byte {
+		value, _ := d.store.Get(secretsBucket, "octocat/other:NPM_TOKEN")
+		return value
+	}())
+	if _, err := d.openSecrets("octocat/test"); err == nil {
+		t.Errorf("Dispatcher.openSecrets failed: expected the moved secret refused")
+	}
+}
@@ -0,0 +1,512 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Cookie carrying the session of the dashboard
+	sessionCookie string = "narwhal_session"
+	// Cookie carrying the state of an OAuth login until the callback
+	oauthStateCookie string = "narwhal_oauth_state"
+	// Bucket of the sessions logged out before their expiration
+	revokedSessionsBucket string = "revoked_sessions"
+
+	DefaultSessionTTL = 12 * time.Hour
+)
+
+// User of the dashboard logging in with a password or a hosting service
+// account, e.g.
+//
+//	name: alice
+//	password: $2a$10$...
+//	identities:
+//	  github: alice-gh
+//	grants:
+//	  - repositories: [octocat/*]
+//	    permissions: [view, trigger, cancel]
+type User struct {
+	Name string `yaml:"name"`
+	// Bcrypt hash of the password, no password login if empty
+	Password string `yaml:"password,omitempty"`
+	// Accounts of the user on the hosting services
+	Identities map[HostingService]string `yaml:"identities,omitempty"`
+	Grants     []AccessGrant             `yaml:"grants"`
+}
+
+// GitHubOAuthConfig is the OAuth app the users log in with their GitHub
+// account through
+type GitHubOAuthConfig struct {
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+}
+
+// LoginConfig sets the users of the dashboard and how they log in, e.g.
+//
+//	session_ttl: 8h
+//	github:
+//	  client_id: Iv1.abc
+//	  client_secret: s3cr3t
+//	users:
+//	  - name: alice
+//	    ...
+type LoginConfig struct {
+	SessionTTL time.Duration      `yaml:"session_ttl,omitempty"`
+	GitHub     *GitHubOAuthConfig `yaml:"github,omitempty"`
+	Users      []User             `yaml:"users,omitempty"`
+}
+
+// Sessions logs the users in, issuing them a JWT signed with HS256 carried
+// as bearer token or cookie. Removing a user from the configuration ends its
+// sessions, logging out ends one, recording it as revoked until it expires.
+type Sessions struct {
+	secret     []byte
+	ttl        time.Duration
+	users      map[string]User
+	identities map[HostingService]map[string]string
+	github     *GitHubOAuthConfig
+	// GitHub endpoints, replaced in tests
+	githubURL    string
+	githubAPIURL string
+	// Revoked sessions, shared by the dispatchers sharing the store
+	revoked Store
+	// Source of the session IDs, the randomness of the dispatcher
+	random io.Reader
+}
+
+// NewSessions checks the users, their names and identities must be unique,
+// their passwords bcrypt hashes and their grants well formed
+func NewSessions(config LoginConfig, secret []byte) (*Sessions, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("sessions require a signing secret")
+	}
+	s := &Sessions{
+		secret:       secret,
+		ttl:          config.SessionTTL,
+		users:        map[string]User{},
+		identities:   map[HostingService]map[string]string{},
+		github:       config.GitHub,
+		githubURL:    "https://github.com",
+		githubAPIURL: "https://api.github.com",
+		random:       rand.Reader,
+	}
+	if s.ttl <= 0 {
+		s.ttl = DefaultSessionTTL
+	}
+	for _, user := range config.Users {
+		if user.Name == "" {
+			return nil, fmt.Errorf("users require a name")
+		}
+		if _, ok := s.users[user.Name]; ok {
+			return nil, fmt.Errorf("duplicate user %s", user.Name)
+		}
+		if user.Password != "" {
+			if _, err := bcrypt.Cost([]byte(user.Password)); err != nil {
+				return nil, fmt.Errorf("user %s: password is not a bcrypt hash", user.Name)
+			}
+		}
+		if err := validateGrants(user.Grants); err != nil {
+			return nil, fmt.Errorf("user %s: %v", user.Name, err)
+		}
+		for service, account := range user.Identities {
+			if s.identities[service] == nil {
+				s.identities[service] = map[string]string{}
+			}
+			account = strings.ToLower(account)
+			if other, ok := s.identities[service][account]; ok {
+				return nil, fmt.Errorf("%s account %s of both %s and %s", service, account, other, user.Name)
+			}
+			s.identities[service][account] = user.Name
+		}
+		s.users[user.Name] = user
+	}
+	return s, nil
+}
+
+// WithSessions lets the users log in, their sessions granted the permissions
+// of their user. Nothing is open to everyone anymore, without access tokens
+// the anonymous callers are denied every permission.
+func WithSessions(sessions *Sessions) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.sessions = sessions
+	}
+}
+
+// Claims of the session tokens
+type sessionClaims struct {
+	Id        string `json:"jti"`
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+var sessionHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func (s *Sessions) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns the session token of a user and its expiration
+func (s *Sessions) Issue(user string, now time.Time) (string, time.Time) {
+	expiresAt := now.Add(s.ttl)
+	claims, _ := json.Marshal(sessionClaims{randomId(s.random), user, now.Unix(), expiresAt.Unix()})
+	payload := sessionHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + s.sign(payload), expiresAt
+}
+
+// claims returns the claims of a session token, and false if the token is
+// not valid or expired
+func (s *Sessions) claims(token string, now time.Time) (sessionClaims, bool) {
+	var claims sessionClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != sessionHeader {
+		return claims, false
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(s.sign(parts[0]+"."+parts[1]))) {
+		return claims, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, false
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Id == "" || now.Unix() >= claims.ExpiresAt {
+		return claims, false
+	}
+	return claims, true
+}
+
+// Verify returns the user a session token was issued to, and false if the
+// token is not valid, expired, revoked or its user is gone
+func (s *Sessions) Verify(token string, now time.Time) (User, bool) {
+	claims, ok := s.claims(token, now)
+	if !ok {
+		return User{}, false
+	}
+	if s.revoked != nil {
+		if _, err := s.revoked.Get(revokedSessionsBucket, claims.Id); err != ErrNotFound {
+			// Revoked, or unknown if the store failed
+			return User{}, false
+		}
+	}
+	user, ok := s.users[claims.Subject]
+	return user, ok
+}
+
+// Revoke ends the session of a token before its expiration, pruning the
+// revocations of the sessions expired since
+func (s *Sessions) Revoke(token string, now time.Time) error {
+	claims, ok := s.claims(token, now)
+	if !ok || s.revoked == nil {
+		return nil
+	}
+	values, err := s.revoked.List(revokedSessionsBucket, "")
+	if err != nil {
+		return err
+	}
+	for _, value := range values {
+		var revoked sessionClaims
+		if json.Unmarshal(value, &revoked) == nil && now.Unix() >= revoked.ExpiresAt {
+			s.revoked.Delete(revokedSessionsBucket, revoked.Id)
+		}
+	}
+	value, err := json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+	return s.revoked.Put(revokedSessionsBucket, claims.Id, value)
+}
+
+// lookup returns the user whose session is presented by a request, as
+// bearer token or cookie
+func (s *Sessions) lookup(r *http.Request, now time.Time) (User, bool) {
+	if s == nil {
+		return User{}, false
+	}
+	for _, token := range sessionTokens(r) {
+		if user, ok := s.Verify(token, now); ok {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// sessionTokens returns the tokens a request presents, as bearer token or
+// cookie
+func sessionTokens(r *http.Request) []string {
+	var tokens []string
+	if bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); bearer != "" {
+		tokens = append(tokens, bearer)
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		tokens = append(tokens, cookie.Value)
+	}
+	return tokens
+}
+
+// Compared to the passwords of unknown users
+var dummyPasswordHash = []byte("$2a$10$mxfdTVQ9azkUPG/bs6SC9uL9Xv3nNcDuq0EemN5sK/3835bf1P67G")
+
+// authenticate returns the user owning the credentials
+func (s *Sessions) authenticate(name, password string) (User, bool) {
+	user, ok := s.users[name]
+	if !ok || user.Password == "" {
+		// Same work as a wrong password, not to tell the users apart
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return User{}, false
+	}
+	return user, bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil
+}
+
+// identity returns the user owning an account of a hosting service
+func (s *Sessions) identity(service HostingService, account string) (User, bool) {
+	name, ok := s.identities[service][strings.ToLower(account)]
+	if !ok {
+		return User{}, false
+	}
+	return s.users[name], true
+}
+
+// permits tells if any grant of the user gives the permission on the
+// repository
+func (u User) permits(permission Permission, repository string) bool {
+	return AccessToken{Name: u.Name, Grants: u.Grants}.permits(permission, repository)
+}
+
+// Session is the answer to a login and the description of the current one
+type Session struct {
+	User        string       `json:"user"`
+	Token       string       `json:"token,omitempty"`
+	ExpiresAt   *time.Time   `json:"expires_at,omitempty"`
+	Permissions []Permission `json:"permissions,omitempty"`
+}
+
+// startSession issues the session of a user setting its cookie
+func (d *Dispatcher) startSession(w http.ResponseWriter, r *http.Request, user User) Session {
+	token, expiresAt := d.sessions.Issue(user.Name, d.clock.Now())
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return Session{User: user.Name, Token: token, ExpiresAt: &expiresAt}
+}
+
+// loginHandler logs the users in, POST /login {"username": "alice",
+// "password": "..."} answers the session token and sets the session cookie.
+// GET /login/github redirects to GitHub, which redirects back to
+// /login/github/callback starting the session of the user owning the account.
+func loginHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if d.sessions == nil {
+			http.Error(w, "login disabled", http.StatusNotFound)
+			return
+		}
+		switch strings.TrimSuffix(r.URL.Path, "/") {
+		case "/login":
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			var credentials struct {
+				Username string `json:"username"`
+				Password string `json:"password"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+				http.Error(w, "invalid credentials", http.StatusBadRequest)
+				return
+			}
+			defer r.Body.Close()
+			user, ok := d.sessions.authenticate(credentials.Username, credentials.Password)
+			if !ok {
+				http.Error(w, "invalid username or password", http.StatusUnauthorized)
+				return
+			}
+			writeJSON(w, http.StatusOK, d.startSession(w, r, user))
+		case "/login/github":
+			if d.sessions.github == nil {
+				http.Error(w, "GitHub login disabled", http.StatusNotFound)
+				return
+			}
+			state := randomId(d.random)
+			http.SetCookie(w, &http.Cookie{
+				Name:     oauthStateCookie,
+				Value:    state,
+				Path:     "/login/github",
+				MaxAge:   600,
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			query := url.Values{
+				"client_id":    {d.sessions.github.ClientID},
+				"redirect_uri": {d.publicURL + "/login/github/callback"},
+				"scope":        {"read:user"},
+				"state":        {state},
+			}
+			http.Redirect(w, r, d.sessions.githubURL+"/login/oauth/authorize?"+query.Encode(), http.StatusFound)
+		case "/login/github/callback":
+			if d.sessions.github == nil {
+				http.Error(w, "GitHub login disabled", http.StatusNotFound)
+				return
+			}
+			cookie, err := r.Cookie(oauthStateCookie)
+			if err != nil || cookie.Value == "" || cookie.Value != r.URL.Query().Get("state") {
+				http.Error(w, "invalid OAuth state", http.StatusBadRequest)
+				return
+			}
+			account, err := d.sessions.gitHubAccount(r.URL.Query().Get("code"))
+			if err != nil {
+				log.Printf("Error logging in with GitHub: %v\n", err)
+				http.Error(w, "GitHub login failed", http.StatusBadGateway)
+				return
+			}
+			user, ok := d.sessions.identity(GitHub, account)
+			if !ok {
+				http.Error(w, "no user for GitHub account "+account, http.StatusForbidden)
+				return
+			}
+			d.startSession(w, r, user)
+			http.Redirect(w, r, "/", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// gitHubAccount exchanges an OAuth code for a token, returning the login of
+// the account it belongs to
+func (s *Sessions) gitHubAccount(code string) (string, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	form := url.Values{
+		"client_id":     {s.github.ClientID},
+		"client_secret": {s.github.ClientSecret},
+		"code":          {code},
+	}
+	req, err := http.NewRequest(http.MethodPost, s.githubURL+"/login/oauth/access_token",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("no access token: %s", token.Error)
+	}
+	req, err = http.NewRequest(http.MethodGet, s.githubAPIURL+"/user", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	res, err = client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("user lookup answered with status %d", res.StatusCode)
+	}
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&user); err != nil {
+		return "", err
+	}
+	return user.Login, nil
+}
+
+// sessionHandler describes the session of the caller on GET /session with
+// the global permissions of its user, DELETE logs out revoking the session
+// and clearing the cookie
+func sessionHandler(d *Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if d.sessions == nil {
+			http.Error(w, "login disabled", http.StatusNotFound)
+			return
+		}
+		user, ok := d.sessions.lookup(r, d.clock.Now())
+		switch r.Method {
+		case http.MethodGet:
+			if !ok {
+				http.Error(w, "not logged in", http.StatusUnauthorized)
+				return
+			}
+			session := Session{User: user.Name, Permissions: []Permission{}}
+			for _, permission := range []Permission{PermissionView, PermissionTrigger,
+				PermissionCancel, PermissionManageSecrets, PermissionManageRunners, PermissionManageRepositories} {
+				if d.permits(r, permission, "") {
+					session.Permissions = append(session.Permissions, permission)
+				}
+			}
+			writeJSON(w, http.StatusOK, session)
+		case http.MethodDelete:
+			for _, token := range sessionTokens(r) {
+				if err := d.sessions.Revoke(token, d.clock.Now()); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Bcrypt hash of s3cr3t
+const testPasswordHash = "$2a$04$cJ//HIMs80PdpxxgfpnhiuKaIxT0.lEq3kJT2.VUj5mZK0gb5PWqW"
+
+func newTestSessions(t *testing.T) *Sessions {
+	sessions, err := NewSessions(LoginConfig{
+		GitHub: &GitHubOAuthConfig{ClientID: "client", ClientSecret: "secret"},
+		Users: []User{
+			{Name: "alice", Password: testPasswordHash, Identities: map[HostingService]string{GitHub: "Alice-GH"},
+				Grants: []AccessGrant{{Repositories: []string{"octocat/*"}, Permissions: []Permission{PermissionManageRunners}}}},
+			{Name: "bob", Identities: map[HostingService]string{GitHub: "bob-gh"}},
+		},
+	}, []byte("signing-secret"))
+	if err != nil {
+		t.Fatalf("NewSessions failed: %v", err)
+	}
+	return sessions
+}
+
+func TestNewSessions(t *testing.T) {
+	for _, config := range []LoginConfig{
+		{Users: []User{{Name: ""}}},
+		{Users: []User{{Name: "alice"}, {Name: "alice"}}},
+		{Users: []User{{Name: "alice", Password: "s3cr3t"}}},
+		{Users: []User{{Name: "alice", Grants: []AccessGrant{{Permissions: []Permission{"deploy"}}}}}},
+		{Users: []User{{Name: "alice", Identities: map[HostingService]string{GitHub: "gh"}},
+			{Name: "bob", Identities: map[HostingService]string{GitHub: "GH"}}}},
+	} {
+		if _, err := NewSessions(config, []byte("secret")); err == nil {
+			t.Errorf("NewSessions failed: expected an error for %+v", config)
+		}
+	}
+	if _, err := NewSessions(LoginConfig{}, nil); err == nil {
+		t.Errorf("NewSessions failed: expected an error without secret")
+	}
+}
+
+func TestSessionsVerify(t *testing.T) {
+	sessions := newTestSessions(t)
+	now := time.Now()
+	token, expiresAt := sessions.Issue("alice", now)
+	if !expiresAt.Equal(now.Add(DefaultSessionTTL)) {
+		t.Errorf("Sessions.Issue failed: unexpected expiration %v", expiresAt)
+	}
+	if user, ok := sessions.Verify(token, now.Add(time.Hour)); !ok || user.Name != "alice" {
+		t.Errorf("Sessions.Verify failed: expected alice got %+v", user)
+	}
+	if _, ok := sessions.Verify(token, expiresAt); ok {
+		t.Errorf("Sessions.Verify failed: expected the expired session refused")
+	}
+	parts := strings.Split(token, ".")
+	forged, _ := sessions.Issue("mallory", now)
+	for _, token := range []string{
+		parts[0] + "." + strings.Split(forged, ".")[1] + "." + parts[2],
+		token[:len(token)-2],
+		forged,
+		"",
+	} {
+		if _, ok := sessions.Verify(token, now); ok {
+			t.Errorf("Sessions.Verify failed: expected %q refused", token)
+		}
+	}
+}
+
+func TestLoginHandler(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil, WithAdminToken("admin"), WithSessions(newTestSessions(t)))
+	login := loginHandler(d)
+	for body, expected := range map[string]int{
+		`{"username":"alice","password":"wrong"}`:  http.StatusUnauthorized,
+		`{"username":"bob","password":""}`:         http.StatusUnauthorized,
+		`{"username":"carol","password":"s3cr3t"}`: http.StatusUnauthorized,
+		`{"username":"alice","password":"s3cr3t"}`: http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		login(rec, httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body)))
+		if rec.Code != expected {
+			t.Errorf("loginHandler failed: expected %d got %d for %s", expected, rec.Code, body)
+		}
+	}
+	rec := httptest.NewRecorder()
+	login(rec, httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"alice","password":"s3cr3t"}`)))
+	var session Session
+	json.NewDecoder(rec.Body).Decode(&session)
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie || cookies[0].Value != session.Token {
+		t.Fatalf("loginHandler failed: expected the session cookie got %v", cookies)
+	}
+
+	// The session grants the permissions of its user, by cookie or bearer
+	req := httptest.NewRequest(http.MethodGet, "/session", nil)
+	req.AddCookie(cookies[0])
+	if !d.permits(req, PermissionManageRunners, "octocat/test") || d.permits(req, PermissionManageRunners, "acme/app") {
+		t.Errorf("Dispatcher.permits failed: expected the grants of alice")
+	}
+	req = httptest.NewRequest(http.MethodGet, "/session", nil)
+	req.Header.Set("Authorization", "Bearer "+session.Token)
+	rec = httptest.NewRecorder()
+	sessionHandler(d)(rec, req)
+	session = Session{}
+	json.NewDecoder(rec.Body).Decode(&session)
+	// Nothing is open to everyone once logging in is enabled, alice is only
+	// granted permissions on octocat/*
+	if rec.Code != http.StatusOK || session.User != "alice" || len(session.Permissions) != 0 {
+		t.Errorf("sessionHandler failed: unexpected %d %+v", rec.Code, session)
+	}
+	rec = httptest.NewRecorder()
+	sessionHandler(d)(rec, httptest.NewRequest(http.MethodGet, "/session", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("sessionHandler failed: expected 401 got %d", rec.Code)
+	}
+}
+
+func TestSessionsAnonymous(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/jobs", nil)
+	open := NewDispatcher("commits", time.Second, nil)
+	d := NewDispatcher("commits", time.Second, nil, WithSessions(newTestSessions(t)))
+	for _, permission := range []Permission{PermissionView, PermissionTrigger, PermissionCancel} {
+		if !open.permits(req, permission, "octocat/test") {
+			t.Errorf("Dispatcher.permits failed: expected %s open without sessions", permission)
+		}
+		if d.permits(req, permission, "octocat/test") {
+			t.Errorf("Dispatcher.permits failed: expected %s denied to anonymous callers", permission)
+		}
+	}
+}
+
+func TestSessionLogout(t *testing.T) {
+	clock := newFakeClock()
+	d := NewDispatcher("commits", time.Second, nil, WithClock(clock), WithSessions(newTestSessions(t)))
+	token, _ := d.sessions.Issue("alice", clock.Now())
+	other, _ := d.sessions.Issue("alice", clock.Now())
+	expired, _ := d.sessions.Issue("alice", clock.Now().Add(-DefaultSessionTTL))
+	d.store.Put(revokedSessionsBucket, "stale", []byte(`{"jti":"stale","exp":1}`))
+	req := httptest.NewRequest(http.MethodDelete, "/session", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: token})
+	rec := httptest.NewRecorder()
+	sessionHandler(d)(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("sessionHandler failed: expected 204 got %d", rec.Code)
+	}
+	if _, ok := d.sessions.Verify(token, clock.Now()); ok {
+		t.Errorf("Sessions.Verify failed: expected the logged out session refused")
+	}
+	if _, ok := d.sessions.Verify(other, clock.Now()); !ok {
+		t.Errorf("Sessions.Verify failed: expected the other sessions of the user kept")
+	}
+	if _, ok := d.sessions.Verify(expired, clock.Now()); ok {
+		t.Errorf("Sessions.Verify failed: expected the expired session refused")
+	}
+	if _, err := d.store.Get(revokedSessionsBucket, "stale"); err != ErrNotFound {
+		t.Errorf("Sessions.Revoke failed: expected the expired revocations pruned got %v", err)
+	}
+}
+
+func TestSessionWithoutLogin(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil)
+	token, _ := newTestSessions(t).Issue("alice", time.Now())
+	req := httptest.NewRequest(http.MethodDelete, "/session", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	d.router().ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("sessionHandler failed: expected 404 with login disabled got %d", rec.Code)
+	}
+}
+
+func TestSessionIdsFromRandomness(t *testing.T) {
+	random := bytes.NewReader([]byte{0xca, 0xfe, 0xba, 0xbe, 0xca, 0xfe, 0xba, 0xbe})
+	d := NewDispatcher("commits", time.Second, nil, WithSessions(newTestSessions(t)), WithRandomness(random))
+	token, _ := d.sessions.Issue("alice", time.Now())
+	if claims, ok := d.sessions.claims(token, time.Now()); !ok || claims.Id != "cafebabecafebabe" {
+		t.Errorf("Sessions.Issue failed: expected the id read from the randomness got %+v", claims)
+	}
+}
+
+func TestGitHubLogin(t *testing.T) {
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login/oauth/access_token":
+			r.ParseForm()
+			if r.Form.Get("code") != "good" || r.Form.Get("client_secret") != "secret" {
+				writeJSON(w, http.StatusOK, map[string]string{"error": "bad_verification_code"})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"access_token": "gh-token"})
+		case "/user":
+			if r.Header.Get("Authorization") != "Bearer gh-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"login": "alice-gh"})
+		}
+	}))
+	defer github.Close()
+	sessions := newTestSessions(t)
+	sessions.githubURL, sessions.githubAPIURL = github.URL, github.URL
+	d := NewDispatcher("commits", time.Second, nil, WithSessions(sessions), WithPublicURL("https://ci.example.com"))
+	login := loginHandler(d)
+
+	rec := httptest.NewRecorder()
+	login(rec, httptest.NewRequest(http.MethodGet, "/login/github", nil))
+	location, _ := url.Parse(rec.Header().Get("Location"))
+	state := location.Query().Get("state")
+	if rec.Code != http.StatusFound || state == "" ||
+		location.Query().Get("redirect_uri") != "https://ci.example.com/login/github/callback" {
+		t.Fatalf("loginHandler failed: unexpected redirect %d %s", rec.Code, location)
+	}
+	stateCookie := rec.Result().Cookies()[0]
+
+	callback := func(state, code string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/login/github/callback?state="+state+"&code="+code, nil)
+		req.AddCookie(stateCookie)
+		rec := httptest.NewRecorder()
+		login(rec, req)
+		return rec
+	}
+	if rec := callback("forged", "good"); rec.Code != http.StatusBadRequest {
+		t.Errorf("loginHandler failed: expected 400 got %d", rec.Code)
+	}
+	if rec := callback(state, "bad"); rec.Code != http.StatusBadGateway {
+		t.Errorf("loginHandler failed: expected 502 got %d", rec.Code)
+	}
+	rec = callback(state, "good")
+	if rec.Code != http.StatusFound {
+		t.Fatalf("loginHandler failed: expected 302 got %d", rec.Code)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("loginHandler failed: expected the session cookie got %v", cookies)
+	}
+	if user, ok := sessions.Verify(cookies[0].Value, time.Now()); !ok || user.Name != "alice" {
+		t.Errorf("loginHandler failed: expected the session of alice got %+v", user)
+	}
+}
@@ -0,0 +1,70 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"log"
+	"regexp"
+)
+
+// Markers of the commit messages whose build is skipped
+var skipCIMarkers = regexp.MustCompile(`(?i)\[(skip ci|ci skip)\]`)
+
+// WithSkipCIPattern skips the builds of the commits whose message matches the
+// pattern too, besides the [skip ci] and [ci skip] markers
+func WithSkipCIPattern(pattern *regexp.Regexp) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.skipCIPattern = pattern
+	}
+}
+
+// skipsCI tells if the message of a commit asks not to build it, honoured on
+// pushes and pull requests only, tags and releases are always built
+func (d *Dispatcher) skipsCI(commit Commit) bool {
+	switch commit.TriggeredBy() {
+	case PushTrigger, PullRequestTrigger:
+	default:
+		return false
+	}
+	return skipCIMarkers.MatchString(commit.Message) ||
+		(d.skipCIPattern != nil && d.skipCIPattern.MatchString(commit.Message))
+}
+
+// skip records a job skipped without running, returns its ID
+func (d *Dispatcher) skip(commit Commit) string {
+	log.Printf("Skipped commit %s of %s as asked by its message\n",
+		commit.Id, commit.GetRepositoryName())
+	job := d.newJob(commit)
+	job.TransitionAt(JobSkipped, d.clock.Now())
+	if err := d.jobs.Create(job); err != nil {
+		log.Printf("Error storing job %s: %v\n", job.Id, err)
+	}
+	d.completeClaim(commit)
+	d.reportJob(job.Id)
+	d.events.Append(JobEvent{Type: JobSkippedEvent, JobId: job.Id, Commit: commit})
+	return job.Id
+}
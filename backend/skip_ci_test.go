@@ -0,0 +1,66 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestSubmitSkipCI(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil, WithSkipCIPattern(regexp.MustCompile(`^wip:`)))
+	repository := Repository{GitHub, "octocat/test", "master"}
+	var skipped []string
+	for i, message := range []string{
+		"Fix the docs [skip ci]",
+		"Bump version\n\n[CI SKIP]",
+		"wip: half done",
+	} {
+		commit := Commit{Id: string(rune('a' + i)), Message: message, Repository: repository}
+		jobId, ok := d.submit(commit)
+		if !ok {
+			t.Fatalf("Dispatcher.submit failed: %q not accepted", message)
+		}
+		skipped = append(skipped, jobId)
+		if job, err := d.jobs.Get(jobId); err != nil || job.State != JobSkipped {
+			t.Errorf("Dispatcher.submit failed: expected %q skipped got %v %v", message, job.State, err)
+		}
+	}
+	if d.queue.Len() != 0 {
+		t.Errorf("Dispatcher.submit failed: expected no job enqueued got %d", d.queue.Len())
+	}
+	// Tags are built regardless of the message
+	tag := Commit{Id: "a", Message: "Release [skip ci]", Repository: repository, Event: TagTrigger, Tag: "v1.0.0"}
+	if jobId, _ := d.submit(tag); d.queue.Len() != 1 {
+		t.Errorf("Dispatcher.submit failed: expected the tag enqueued, job %s", jobId)
+	}
+	// Skipped jobs can be built on demand
+	if _, err := d.retryJob(skipped[0]); err != nil || d.queue.Len() != 2 {
+		t.Errorf("Dispatcher.retryJob failed: skipped job not rebuilt, err %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SlackConfig sets the Slack incoming webhooks notified of the job results,
+// a repository entry overrides the global webhook, an empty one mutes it
+//
+//	slack:
+//	  webhook: https://hooks.slack.com/services/T000/B000/XXXX
+//	  repositories:
+//	    octocat/hello-world: https://hooks.slack.com/services/T000/B001/YYYY
+//	    octocat/sandbox: ""
+type SlackConfig struct {
+	Webhook      string            `yaml:"webhook,omitempty"`
+	Repositories map[string]string `yaml:"repositories,omitempty"`
+}
+
+// webhook returns the webhook notified of the jobs of a repository, if any
+func (c SlackConfig) webhook(repository string) string {
+	if url, ok := c.Repositories[repository]; ok {
+		return url
+	}
+	return c.Webhook
+}
+
+// Payload of a Slack incoming webhook
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// SlackNotifier posts the results of the jobs to Slack, delivery is
+// best-effort and doesn't block the caller
+type SlackNotifier struct {
+	config SlackConfig
+	client *http.Client
+}
+
+func NewSlackNotifier(config SlackConfig) *SlackNotifier {
+	return &SlackNotifier{config, &http.Client{Timeout: 10 * time.Second}}
+}
+
+// WithSlackNotifications posts the result of every job to Slack
+func WithSlackNotifications(config SlackConfig) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.slack = NewSlackNotifier(config)
+	}
+}
+
+var slackStateEmoji = map[JobState]string{
+	JobSuccess:   ":white_check_mark:",
+	JobFailed:    ":x:",
+	JobCancelled: ":no_entry_sign:",
+}
+
+// message formats the result of a job, linking its logs on the dispatcher
+// API reachable at publicURL, e.g.
+// ":x: octocat/hello-world@master 1a2b3c4 FAILED in 1m12s (test_failure) <logs>"
+func (s *SlackNotifier) message(job Job, publicURL string) slackMessage {
+	commit := job.Commit
+	ref := commit.GetRepositoryName()
+	if commit.Repository.Branch != "" {
+		ref += "@" + commit.Repository.Branch
+	}
+	text := fmt.Sprintf("%s %s %s %s", slackStateEmoji[job.State], ref, shortId(commit.Id), job.State)
+	if job.StartedAt != nil && job.FinishedAt != nil {
+		text += " in " + job.FinishedAt.Sub(*job.StartedAt).Round(time.Second).String()
+	}
+	if job.Category != "" {
+		text += fmt.Sprintf(" (%s)", job.Category)
+	}
+	if publicURL != "" {
+		text += fmt.Sprintf(" <%s/jobs/%s/logs|logs>", strings.TrimRight(publicURL, "/"), job.Id)
+	}
+	return slackMessage{text}
+}
+
+// shortId abbreviates a commit ID the way git does
+func shortId(commitId string) string {
+	if len(commitId) > 7 {
+		return commitId[:7]
+	}
+	return commitId
+}
+
+// Notify posts the result of a finished job to the webhook of its repository
+func (s *SlackNotifier) Notify(job Job, publicURL string) {
+	if s == nil || !job.Done() {
+		return
+	}
+	url := s.config.webhook(job.Commit.GetRepositoryName())
+	if url == "" {
+		return
+	}
+	go func() {
+		if err := s.post(url, s.message(job, publicURL)); err != nil {
+			log.Printf("Error notifying Slack of job %s: %v\n", job.Id, err)
+		}
+	}()
+}
+
+func (s *SlackNotifier) post(url string, message slackMessage) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	res, err := s.client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// notifySlack posts the result of a finished job to Slack, if enabled or
+// registered as a notification target of its repository
+func (d *Dispatcher) notifySlack(jobId string) {
+	job, err := d.jobs.Get(jobId)
+	if err != nil {
+		log.Printf("Error notifying Slack of job %s: %v\n", jobId, err)
+		return
+	}
+	slack := d.slack
+	if webhook := d.notificationTargets(job.Commit.GetRepositoryName()).Slack; webhook != "" {
+		slack = NewSlackNotifier(SlackConfig{Webhook: webhook})
+	}
+	slack.Notify(job, d.publicURL)
+}
@@ -0,0 +1,104 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSlackConfigWebhook(t *testing.T) {
+	config := SlackConfig{
+		Webhook: "https://hooks.slack.com/global",
+		Repositories: map[string]string{
+			"octocat/hello-world": "https://hooks.slack.com/hello",
+			"octocat/sandbox":     "",
+		},
+	}
+	cases := map[string]string{
+		"octocat/hello-world": "https://hooks.slack.com/hello",
+		"octocat/sandbox":     "",
+		"octocat/other":       "https://hooks.slack.com/global",
+	}
+	for repository, expected := range cases {
+		if url := config.webhook(repository); url != expected {
+			t.Errorf("Expected webhook %q for %s, got %q", expected, repository, url)
+		}
+	}
+}
+
+func TestSlackNotifierMessage(t *testing.T) {
+	started := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	finished := started.Add(72 * time.Second)
+	job := Job{
+		Id:         "job-1",
+		Commit:     Commit{Id: "1a2b3c4d5e6f", Repository: Repository{Name: "octocat/hello-world", Branch: "master"}},
+		State:      JobFailed,
+		StartedAt:  &started,
+		FinishedAt: &finished,
+		Category:   FailureTest,
+	}
+	message := NewSlackNotifier(SlackConfig{}).message(job, "http://narwhal.local/")
+	expected := ":x: octocat/hello-world@master 1a2b3c4 FAILED in 1m12s (test_failure) " +
+		"<http://narwhal.local/jobs/job-1/logs|logs>"
+	if message.Text != expected {
+		t.Errorf("Expected message %q, got %q", expected, message.Text)
+	}
+}
+
+func TestSlackNotifierNotify(t *testing.T) {
+	received := make(chan slackMessage, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message slackMessage
+		json.NewDecoder(r.Body).Decode(&message)
+		received <- message
+	}))
+	defer server.Close()
+	notifier := NewSlackNotifier(SlackConfig{Webhook: server.URL})
+	job := Job{Id: "job-1", Commit: Commit{Id: "abc", Repository: Repository{Name: "octocat/test"}}}
+	// Jobs still running are not notified
+	job.State = JobRunning
+	notifier.Notify(job, "")
+	job.State = JobSuccess
+	notifier.Notify(job, "")
+	select {
+	case message := <-received:
+		if message.Text != ":white_check_mark: octocat/test abc SUCCESS" {
+			t.Errorf("Unexpected message %q", message.Text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Slack webhook not called")
+	}
+	select {
+	case message := <-received:
+		t.Errorf("Unexpected message %q", message.Text)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,184 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// Output of a step shipped to the dispatcher and the log sinks by default,
+// half of it from the head and half from the tail of the output
+const defaultMaxStepLogSize int64 = 1024 * 1024
+
+// Path the full output of a truncated step is uploaded as, the spooled
+// output is capped to fit in an artifact along with the tar headers
+const (
+	stepLogArtifactPath string = "output.log"
+	maxStepLogSpoolSize int64  = maxArtifactSize - 4096
+)
+
+// WithStepLogLimit caps the output of each step shipped to the dispatcher
+// and to the log sinks, 0 disables the limit. The head and the tail of an
+// oversized output are kept, with a marker in place of what's omitted, while
+// the full output is uploaded as an artifact of the step.
+func WithStepLogLimit(max int64) RunnerOption {
+	return func(r *Runner) {
+		r.maxStepLogSize = max
+	}
+}
+
+// stepLogLimiter forwards the head of the output of a step as it's written,
+// retaining only its tail once beyond the limit, written on flush after a
+// truncation marker. The output of a truncated step is spooled to a temporary
+// file, starting from the head kept in memory.
+type stepLogLimiter struct {
+	out         io.Writer
+	headSize    int64
+	tailSize    int64
+	written     int64
+	head        []byte
+	tail        []byte
+	spool       *os.File
+	spooled     int64
+	artifact    string
+	spoolFailed bool
+}
+
+func newStepLogLimiter(out io.Writer, max int64, artifact string) *stepLogLimiter {
+	return &stepLogLimiter{out: out, headSize: max / 2, tailSize: max - max/2, artifact: artifact}
+}
+
+func (l *stepLogLimiter) Write(p []byte) (int, error) {
+	n := len(p)
+	l.written += int64(n)
+	if room := l.headSize - int64(len(l.head)); room > 0 {
+		chunk := p
+		if int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		l.head = append(l.head, chunk...)
+		l.out.Write(chunk)
+		p = p[len(chunk):]
+	}
+	if len(p) == 0 {
+		return n, nil
+	}
+	if l.spool == nil && !l.spoolFailed {
+		l.startSpool()
+	}
+	l.spoolWrite(p)
+	l.tail = append(l.tail, p...)
+	// Compact once the buffer doubles the tail size, to copy it sparingly
+	if int64(len(l.tail)) > 2*l.tailSize {
+		l.tail = append([]byte(nil), l.tail[int64(len(l.tail))-l.tailSize:]...)
+	}
+	return n, nil
+}
+
+// startSpool creates the temporary file of the full output, failures are
+// logged and leave the step without its output artifact
+func (l *stepLogLimiter) startSpool() {
+	spool, err := ioutil.TempFile("", "narwhal-step-log")
+	if err != nil {
+		log.Printf("Error spooling the output of a step: %v\n", err)
+		l.spoolFailed = true
+		return
+	}
+	l.spool = spool
+	l.spoolWrite(l.head)
+}
+
+func (l *stepLogLimiter) spoolWrite(p []byte) {
+	if l.spool == nil {
+		return
+	}
+	if room := maxStepLogSpoolSize - l.spooled; int64(len(p)) > room {
+		p = p[:room]
+	}
+	n, _ := l.spool.Write(p)
+	l.spooled += int64(n)
+}
+
+// Truncated tells if the output exceeded the limit
+func (l *stepLogLimiter) Truncated() bool {
+	return l.written > l.headSize+l.tailSize
+}
+
+// Flush writes what's retained of the tail of the output, preceded by a
+// truncation marker if part of it was omitted
+func (l *stepLogLimiter) Flush() {
+	tail := l.tail
+	if int64(len(tail)) > l.tailSize {
+		tail = tail[int64(len(tail))-l.tailSize:]
+	}
+	if l.Truncated() {
+		omitted := l.written - int64(len(l.head)) - int64(len(tail))
+		marker := fmt.Sprintf("\n--- %d bytes of output omitted", omitted)
+		if l.spool != nil {
+			marker += ", full output in the " + l.artifact + " artifact"
+		}
+		fmt.Fprintln(l.out, marker+" ---")
+	}
+	l.out.Write(tail)
+}
+
+// Archive streams the spooled output as a tar archive
+func (l *stepLogLimiter) Archive() io.Reader {
+	reader, writer := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(writer)
+		header := &tar.Header{
+			Name:    stepLogArtifactPath,
+			Mode:    0644,
+			Size:    l.spooled,
+			ModTime: time.Now(),
+		}
+		err := tw.WriteHeader(header)
+		if err == nil {
+			_, err = io.Copy(tw, io.NewSectionReader(l.spool, 0, l.spooled))
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	return reader
+}
+
+// Close removes the spooled output
+func (l *stepLogLimiter) Close() {
+	if l.spool != nil {
+		l.spool.Close()
+		os.Remove(l.spool.Name())
+	}
+}
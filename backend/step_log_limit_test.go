@@ -0,0 +1,73 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestStepLogLimiter(t *testing.T) {
+	var out bytes.Buffer
+	limiter := newStepLogLimiter(&out, 8, "test-output.log.tar")
+	defer limiter.Close()
+	for _, chunk := range []string{"ab", "cdefgh", "ijkl", "mnop"} {
+		limiter.Write([]byte(chunk))
+	}
+	limiter.Flush()
+	if !limiter.Truncated() {
+		t.Fatalf("Expected the output to be truncated")
+	}
+	expected := "abcd\n--- 8 bytes of output omitted, full output in the test-output.log.tar artifact ---\nmnop"
+	if out.String() != expected {
+		t.Errorf("Expected %q got %q", expected, out.String())
+	}
+	tr := tar.NewReader(limiter.Archive())
+	header, err := tr.Next()
+	if err != nil || header.Name != stepLogArtifactPath {
+		t.Fatalf("Expected the archive of the output, got %v %v", header, err)
+	}
+	full, _ := ioutil.ReadAll(tr)
+	if string(full) != "abcdefghijklmnop" {
+		t.Errorf("Expected the full output in the archive, got %q", full)
+	}
+}
+
+func TestStepLogLimiterWithinLimit(t *testing.T) {
+	var out bytes.Buffer
+	limiter := newStepLogLimiter(&out, 8, "test-output.log.tar")
+	defer limiter.Close()
+	limiter.Write([]byte("abc"))
+	limiter.Write([]byte("defgh"))
+	limiter.Flush()
+	if limiter.Truncated() || out.String() != "abcdefgh" || strings.Contains(out.String(), "omitted") {
+		t.Errorf("Expected the whole output, got %q", out.String())
+	}
+}
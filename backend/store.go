@@ -0,0 +1,304 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by stores looking up a missing key
+var ErrNotFound = errors.New("not found")
+
+// Store is the persistence layer of the dispatcher, a simple key-value
+// storage of JSON encoded records grouped in buckets (commits, jobs, ...).
+// Implementations must be safe for concurrent use.
+type Store interface {
+	Put(bucket, key string, value []byte) error
+	Get(bucket, key string) ([]byte, error)
+	// List returns the values of the bucket whose key starts with prefix,
+	// ordered by key
+	List(bucket, prefix string) ([][]byte, error)
+	Delete(bucket, key string) error
+	Close() error
+}
+
+// AtomicStore is implemented by the stores shared by several dispatchers,
+// PutIfAbsent stores the value only if the key is missing, returning false
+// otherwise
+type AtomicStore interface {
+	PutIfAbsent(bucket, key string, value []byte) (bool, error)
+}
+
+// Store backend selection, e.g.
+//
+//	store:
+//	  backend: sqlite
+//	  path: /var/lib/narwhal/narwhal.db
+//
+// or, for the embedded bolt store
+//
+//	store:
+//	  backend: bolt
+//	  data_dir: /var/lib/narwhal
+//	  compact_interval: 24h
+//
+// or, to share the state between multiple dispatchers
+//
+//	store:
+//	  backend: postgres
+//	  url: postgres://narwhal:secret@db:5432/narwhal?sslmode=disable
+//	  pool:
+//	    max_open_conns: 20
+//	    conn_max_lifetime: 30m
+//
+// or Redis, whose commit deduplication claims expire after ttl
+//
+//	store:
+//	  backend: redis
+//	  url: redis://redis:6379/0
+//	  ttl: 720h
+type StoreConfig struct {
+	Backend         string             `yaml:"backend"`
+	Path            string             `yaml:"path,omitempty"`
+	DataDir         string             `yaml:"data_dir,omitempty"`
+	CompactInterval time.Duration      `yaml:"compact_interval,omitempty"`
+	URL             string             `yaml:"url,omitempty"`
+	Pool            PostgresPoolConfig `yaml:"pool,omitempty"`
+	TTL             time.Duration      `yaml:"ttl,omitempty"`
+}
+
+// OpenStore creates the store described by the configuration, an in-memory
+// one if no backend is set
+func OpenStore(config StoreConfig) (Store, error) {
+	switch config.Backend {
+	case "", "memory":
+		return NewMemoryStore(), nil
+	case "sqlite":
+		return NewSQLiteStore(config.Path)
+	case "bolt":
+		return NewBoltStore(config.DataDir, config.CompactInterval)
+	case "postgres":
+		return NewPostgresStore(config.URL, config.Pool)
+	case "redis":
+		return NewRedisStore(config.URL, config.TTL)
+	}
+	return nil, fmt.Errorf("%s store backend not supported", config.Backend)
+}
+
+// MemoryStore keeps everything in memory, all data is lost on restart
+type MemoryStore struct {
+	mutex   sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]map[string][]byte{}}
+}
+
+func (s *MemoryStore) Put(bucket, key string, value []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	b, ok := s.buckets[bucket]
+	if !ok {
+		b = map[string][]byte{}
+		s.buckets[bucket] = b
+	}
+	b[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (s *MemoryStore) Get(bucket, key string) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	value, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (s *MemoryStore) List(bucket, prefix string) ([][]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	keys := []string{}
+	for key := range s.buckets[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = append([]byte(nil), s.buckets[bucket][key]...)
+	}
+	return values, nil
+}
+
+func (s *MemoryStore) Delete(bucket, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.buckets[bucket], key)
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// Bucket of the processed commits
+const commitsBucket string = "commits"
+
+// CommitStore tracks the commits already processed by the dispatcher, per
+// repository, on top of a Store
+type CommitStore struct {
+	mutex sync.Mutex
+	store Store
+}
+
+func NewCommitStore(store Store) *CommitStore {
+	return &CommitStore{store: store}
+}
+
+func commitKey(repository, id string) string {
+	return repository + "@" + id
+}
+
+func (c *CommitStore) PutCommit(commit Commit) error {
+	value, err := json.Marshal(commit)
+	if err != nil {
+		return err
+	}
+	return c.store.Put(commitsBucket, commitKey(commit.GetRepositoryName(), commit.buildKey()), value)
+}
+
+func (c *CommitStore) GetCommit(repository, id string) (Commit, error) {
+	var commit Commit
+	value, err := c.store.Get(commitsBucket, commitKey(repository, id))
+	if err != nil {
+		return commit, err
+	}
+	err = json.Unmarshal(value, &commit)
+	return commit, err
+}
+
+// ListCommits returns the processed commits of a repository
+func (c *CommitStore) ListCommits(repository string) ([]Commit, error) {
+	values, err := c.store.List(commitsBucket, repository+"@")
+	if err != nil {
+		return nil, err
+	}
+	commits := make([]Commit, len(values))
+	for i, value := range values {
+		if err := json.Unmarshal(value, &commits[i]); err != nil {
+			return nil, err
+		}
+	}
+	return commits, nil
+}
+
+func (c *CommitStore) DeleteCommit(repository, id string) error {
+	return c.store.Delete(commitsBucket, commitKey(repository, id))
+}
+
+// Claims of the commits whose job doesn't complete in time expire, e.g.
+// lost with the queue of a crashed dispatcher, so that a redelivery builds
+// them again
+const claimTimeout = 24 * time.Hour
+
+// Claim of a commit, stored in place of the commit itself
+type commitClaim struct {
+	Commit
+	ClaimedAt time.Time `json:"claimed_at"`
+	Done      bool      `json:"done,omitempty"`
+}
+
+// expired tells if the claim timed out, the commits stored before the
+// claims are taken as done
+func (c commitClaim) expired(now time.Time) bool {
+	return !c.Done && !c.ClaimedAt.IsZero() && now.Sub(c.ClaimedAt) >= claimTimeout
+}
+
+// Claim records a commit as being processed, returning false if it already
+// was, unless its claim expired without the processing completing
+func (c *CommitStore) Claim(commit Commit, now time.Time) (bool, error) {
+	key := commitKey(commit.GetRepositoryName(), commit.buildKey())
+	value, err := json.Marshal(commitClaim{Commit: commit, ClaimedAt: now})
+	if err != nil {
+		return false, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if atomic, ok := c.store.(AtomicStore); ok {
+		claimed, err := atomic.PutIfAbsent(commitsBucket, key, value)
+		if err != nil || claimed {
+			return claimed, err
+		}
+	}
+	previous, err := c.store.Get(commitsBucket, key)
+	if err != nil && err != ErrNotFound {
+		return false, err
+	}
+	if err == nil {
+		var claim commitClaim
+		if json.Unmarshal(previous, &claim) == nil && !claim.expired(now) {
+			return false, nil
+		}
+	}
+	return true, c.store.Put(commitsBucket, key, value)
+}
+
+// Complete marks the claim of a commit as done, for good, the commits not
+// claimed are left alone
+func (c *CommitStore) Complete(commit Commit) error {
+	key := commitKey(commit.GetRepositoryName(), commit.buildKey())
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	value, err := c.store.Get(commitsBucket, key)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var claim commitClaim
+	if err := json.Unmarshal(value, &claim); err != nil {
+		return err
+	}
+	if claim.Done {
+		return nil
+	}
+	claim.Done = true
+	if value, err = json.Marshal(claim); err != nil {
+		return err
+	}
+	return c.store.Put(commitsBucket, key, value)
+}
@@ -0,0 +1,197 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Name of the database file inside the data directory
+const boltFile string = "narwhal.bolt"
+
+// Max size of the transactions used to copy the data while compacting
+const boltCompactTxSize int64 = 64 * 1024 * 1024
+
+// BoltStore is an embedded store keeping everything in a single bbolt file
+// inside the data directory, no external database required. Each Store
+// bucket maps to a bolt bucket.
+type BoltStore struct {
+	mutex sync.RWMutex
+	dir   string
+	db    *bolt.DB
+	stop  chan struct{}
+	// Swaps the compacted file with the current one
+	rename func(string, string) error
+}
+
+// NewBoltStore opens or creates the database in the given directory, with a
+// positive compactInterval the file is periodically compacted to reclaim the
+// space freed by deleted records
+func NewBoltStore(dir string, compactInterval time.Duration) (*BoltStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dir, boltFile), 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &BoltStore{dir: dir, db: db, stop: make(chan struct{}), rename: os.Rename}
+	if compactInterval > 0 {
+		go s.compactPeriodically(compactInterval)
+	}
+	return s, nil
+}
+
+func (s *BoltStore) Put(bucket, key string, value []byte) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+func (s *BoltStore) Get(bucket, key string) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return ErrNotFound
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+		// Values are only valid during the transaction
+		value = append([]byte(nil), v...)
+		return nil
+	})
+	return value, err
+}
+
+func (s *BoltStore) List(bucket, prefix string) ([][]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	values := [][]byte{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		c, p := b.Cursor(), []byte(prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			values = append(values, append([]byte(nil), v...))
+		}
+		return nil
+	})
+	return values, err
+}
+
+func (s *BoltStore) Delete(bucket, key string) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// Compact rewrites the database into a new file, dropping the free pages
+// bolt never gives back to the file system, then swaps it with the current
+// one. The store is unavailable while compacting.
+func (s *BoltStore) Compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	path := filepath.Join(s.dir, boltFile)
+	tmpPath := path + ".compact"
+	os.Remove(tmpPath)
+	dst, err := bolt.Open(tmpPath, 0600, nil)
+	if err != nil {
+		return err
+	}
+	if err := bolt.Compact(dst, s.db, boltCompactTxSize); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	// Once closed the store is reopened whatever happens, on the original
+	// file if the compacted one can't replace it
+	err = s.db.Close()
+	if err == nil {
+		err = s.rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	db, openErr := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if openErr != nil {
+		return openErr
+	}
+	s.db = db
+	return err
+}
+
+func (s *BoltStore) compactPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Compact(); err != nil {
+				log.Printf("Error compacting store: %v\n", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *BoltStore) Close() error {
+	close(s.stop)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.db.Close()
+}
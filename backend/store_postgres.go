@@ -0,0 +1,156 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// Schema migrations of the PostgreSQL store, applied in order at startup, new
+// ones must only be appended
+var postgresMigrations = []string{
+	`CREATE TABLE records (
+		bucket TEXT NOT NULL,
+		key    TEXT NOT NULL,
+		value  BYTEA NOT NULL,
+		PRIMARY KEY (bucket, key)
+	)`,
+}
+
+// Arbitrary key of the advisory lock serializing the schema bootstrap of
+// dispatchers starting at the same time
+const postgresMigrationLock int64 = 0x6e617277
+
+// Connection pool settings of the PostgreSQL store
+type PostgresPoolConfig struct {
+	MaxOpenConns    int           `yaml:"max_open_conns,omitempty"`
+	MaxIdleConns    int           `yaml:"max_idle_conns,omitempty"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime,omitempty"`
+}
+
+// PostgresStore persists the records in a PostgreSQL database, allowing
+// multiple dispatchers to share the same state
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(url string, pool PostgresPoolConfig) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	if pool.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(pool.MaxOpenConns)
+	}
+	if pool.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(pool.MaxIdleConns)
+	}
+	if pool.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	}
+	if err := bootstrapPostgres(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &PostgresStore{db}, nil
+}
+
+// bootstrapPostgres applies the migrations holding a session advisory lock,
+// so that only one dispatcher at a time creates the schema. The lock belongs
+// to the session, the migrations run on the same connection.
+func bootstrapPostgres(db *sql.DB) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, postgresMigrationLock); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, postgresMigrationLock)
+	return migrate(ctx, conn, postgresMigrations)
+}
+
+func (s *PostgresStore) Put(bucket, key string, value []byte) error {
+	_, err := s.db.Exec(`INSERT INTO records (bucket, key, value) VALUES ($1, $2, $3)
+		ON CONFLICT (bucket, key) DO UPDATE SET value = EXCLUDED.value`, bucket, key, value)
+	return err
+}
+
+// PutIfAbsent inserts the record only if the key is missing, atomically
+// across all the dispatchers sharing the database
+func (s *PostgresStore) PutIfAbsent(bucket, key string, value []byte) (bool, error) {
+	res, err := s.db.Exec(`INSERT INTO records (bucket, key, value) VALUES ($1, $2, $3)
+		ON CONFLICT (bucket, key) DO NOTHING`, bucket, key, value)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *PostgresStore) Get(bucket, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRow(`SELECT value FROM records WHERE bucket = $1 AND key = $2`,
+		bucket, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (s *PostgresStore) List(bucket, prefix string) ([][]byte, error) {
+	rows, err := s.db.Query(`SELECT value FROM records
+		WHERE bucket = $1 AND left(key, length($2)) = $2 ORDER BY key COLLATE "C"`, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := [][]byte{}
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+func (s *PostgresStore) Delete(bucket, key string) error {
+	_, err := s.db.Exec(`DELETE FROM records WHERE bucket = $1 AND key = $2`, bucket, key)
+	return err
+}
+
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
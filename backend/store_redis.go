@@ -0,0 +1,128 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Prefix of every key written by the Redis store
+const redisKeyPrefix string = "narwhal:"
+
+// RedisStore persists the records in Redis, allowing multiple dispatchers to
+// share the same state. The claims of PutIfAbsent, i.e. the deduplication of
+// the commits, expire after TTL, zero keeps them forever; the other records
+// never expire.
+type RedisStore struct {
+	client *redis.Client
+	TTL    time.Duration
+}
+
+func NewRedisStore(url string, ttl time.Duration) (*RedisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &RedisStore{client, ttl}, nil
+}
+
+func redisKey(bucket, key string) string {
+	return redisKeyPrefix + bucket + ":" + key
+}
+
+// escapeGlob quotes the characters with special meaning in SCAN patterns
+func escapeGlob(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(s)
+}
+
+func (s *RedisStore) Put(bucket, key string, value []byte) error {
+	return s.client.Set(redisKey(bucket, key), value, 0).Err()
+}
+
+// PutIfAbsent relies on SETNX, atomic across all the dispatchers sharing the
+// Redis instance
+func (s *RedisStore) PutIfAbsent(bucket, key string, value []byte) (bool, error) {
+	return s.client.SetNX(redisKey(bucket, key), value, s.TTL).Result()
+}
+
+func (s *RedisStore) Get(bucket, key string) ([]byte, error) {
+	value, err := s.client.Get(redisKey(bucket, key)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+// List scans the keyspace, meant for the small buckets of the dispatcher
+func (s *RedisStore) List(bucket, prefix string) ([][]byte, error) {
+	match := escapeGlob(redisKey(bucket, prefix)) + "*"
+	keys := []string{}
+	var cursor uint64
+	for {
+		batch, next, err := s.client.Scan(cursor, match, 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	values := [][]byte{}
+	if len(keys) == 0 {
+		return values, nil
+	}
+	sort.Strings(keys)
+	res, err := s.client.MGet(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range res {
+		// Expired or deleted in the meantime
+		if value, ok := value.(string); ok {
+			values = append(values, []byte(value))
+		}
+	}
+	return values, nil
+}
+
+func (s *RedisStore) Delete(bucket, key string) error {
+	return s.client.Del(redisKey(bucket, key)).Err()
+}
+
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,146 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Layout of the month keys used to bucket build usage
+const usageMonthLayout string = "2006-01"
+
+const usageBucket string = "usage"
+
+// Build minutes consumed by a repository in a month
+type RepositoryUsage struct {
+	Repository   string  `json:"repository"`
+	Organization string  `json:"organization"`
+	Builds       int     `json:"builds"`
+	Minutes      float64 `json:"minutes"`
+}
+
+// Usage report of a month, per repository and per organization
+type UsageReport struct {
+	Month         string             `json:"month"`
+	Repositories  []RepositoryUsage  `json:"repositories"`
+	Organizations map[string]float64 `json:"organizations"`
+	TotalMinutes  float64            `json:"total_minutes"`
+}
+
+// UsageTracker accounts the time spent executing builds by each repository,
+// bucketed by month and persisted in the store under `<month>/<repository>`
+type UsageTracker struct {
+	mutex sync.Mutex
+	store Store
+}
+
+func NewUsageTracker(store Store) *UsageTracker {
+	return &UsageTracker{store: store}
+}
+
+// organization returns the owner part of a repository full name
+func organization(repository string) string {
+	if i := strings.Index(repository, "/"); i >= 0 {
+		return repository[:i]
+	}
+	return repository
+}
+
+// Record accounts a build of the repository started at the given time
+func (u *UsageTracker) Record(repository string, startedAt time.Time, elapsed time.Duration) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	key := startedAt.UTC().Format(usageMonthLayout) + "/" + repository
+	usage := RepositoryUsage{Repository: repository, Organization: organization(repository)}
+	value, err := u.store.Get(usageBucket, key)
+	if err == nil {
+		if err := json.Unmarshal(value, &usage); err != nil {
+			return err
+		}
+	} else if err != ErrNotFound {
+		return err
+	}
+	usage.Builds++
+	usage.Minutes += elapsed.Minutes()
+	if value, err = json.Marshal(usage); err != nil {
+		return err
+	}
+	return u.store.Put(usageBucket, key, value)
+}
+
+// restrict leaves out of the report the repositories not matched by the
+// filter
+func (r UsageReport) restrict(visible func(string) bool) UsageReport {
+	restricted := UsageReport{
+		Month:         r.Month,
+		Repositories:  []RepositoryUsage{},
+		Organizations: map[string]float64{},
+	}
+	for _, usage := range r.Repositories {
+		if !visible(usage.Repository) {
+			continue
+		}
+		restricted.Repositories = append(restricted.Repositories, usage)
+		restricted.Organizations[usage.Organization] += usage.Minutes
+		restricted.TotalMinutes += usage.Minutes
+	}
+	return restricted
+}
+
+// Report returns the usage of a month, optionally restricted to a single
+// organization when org is not empty
+func (u *UsageTracker) Report(month, org string) (UsageReport, error) {
+	report := UsageReport{
+		Month:         month,
+		Repositories:  []RepositoryUsage{},
+		Organizations: map[string]float64{},
+	}
+	values, err := u.store.List(usageBucket, month+"/")
+	if err != nil {
+		return report, err
+	}
+	for _, value := range values {
+		var usage RepositoryUsage
+		if err := json.Unmarshal(value, &usage); err != nil {
+			return report, err
+		}
+		if org != "" && usage.Organization != org {
+			continue
+		}
+		report.Repositories = append(report.Repositories, usage)
+		report.Organizations[usage.Organization] += usage.Minutes
+		report.TotalMinutes += usage.Minutes
+	}
+	sort.Slice(report.Repositories, func(i, j int) bool {
+		return report.Repositories[i].Repository < report.Repositories[j].Repository
+	})
+	return report, nil
+}
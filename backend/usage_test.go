@@ -0,0 +1,58 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUsageTrackerPersisted(t *testing.T) {
+	store := NewMemoryStore()
+	usage := NewUsageTracker(store)
+	october := time.Date(2020, 10, 31, 23, 0, 0, 0, time.UTC)
+	usage.Record("octocat/test", october, 2*time.Minute)
+	usage.Record("octocat/test", october, time.Minute)
+	usage.Record("infra/deploy", october, time.Minute)
+	usage.Record("octocat/test", october.Add(2*time.Hour), time.Minute)
+
+	// A restarted dispatcher reports the usage recorded so far
+	report, err := NewUsageTracker(store).Report("2020-10", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Repositories) != 2 || report.Repositories[1].Repository != "octocat/test" ||
+		report.Repositories[1].Builds != 2 || report.TotalMinutes != 4 {
+		t.Errorf("UsageTracker.Report failed: unexpected report %+v", report)
+	}
+	if report, _ := usage.Report("2020-10", "octocat"); len(report.Repositories) != 1 || report.TotalMinutes != 3 {
+		t.Errorf("UsageTracker.Report failed: expected only octocat got %+v", report)
+	}
+	if report, _ := usage.Report("2020-11", ""); report.Organizations["octocat"] != 1 {
+		t.Errorf("UsageTracker.Report failed: expected 1 minute in November got %+v", report)
+	}
+}
@@ -0,0 +1,104 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FailureEnvironment is the category of the jobs failed on the warm-up
+// command, their image or toolchain being broken rather than their tests
+const FailureEnvironment FailureCategory = "environment_broken"
+
+// Name the warm-up command runs under, e.g. in the container labels
+const warmupStepName string = "warmup"
+
+// Bytes of the warm-up output kept in the error, the last ones
+const warmupOutputSize int = 1024
+
+// EnvironmentError is returned when the warm-up command of a pipeline fails,
+// with the tail of its output
+type EnvironmentError struct {
+	Cmd    string
+	Err    error
+	Output string
+}
+
+func (e *EnvironmentError) Error() string {
+	msg := fmt.Sprintf("environment broken: warm-up %q failed: %v", e.Cmd, e.Err)
+	if e.Output != "" {
+		msg += ": " + e.Output
+	}
+	return msg
+}
+
+// tailWriter keeps the last max bytes written to it
+type tailWriter struct {
+	max int
+	buf []byte
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if len(w.buf) > w.max {
+		w.buf = w.buf[len(w.buf)-w.max:]
+	}
+	return len(p), nil
+}
+
+// warmUp runs the warm-up command of the pipeline, if any, where its steps
+// run: inside the job container in exec mode, in a new container of the image
+// otherwise. Its output goes to the job log stream as the one of a step does.
+// Returns an EnvironmentError if it fails.
+func (r *Runner) warmUp(req RunnerRequest, ciConfig *CIConfig, dir, network, jobContainer string,
+	stream *jobLogStream) error {
+	if ciConfig.Warmup == "" {
+		return nil
+	}
+	step := Step{Name: warmupStepName, Cmd: ciConfig.Warmup}
+	output := &tailWriter{max: warmupOutputSize}
+	sinks := r.openLogSinks(req.CommitJob, step.Name)
+	out := stream.step(sinks...)
+	out.StepStart(step.Name)
+	err := r.runStep(req, ciConfig, step, dir, network, jobContainer, out, output)
+	result := StepResult{Name: step.Name, Status: StepSuccess}
+	if err != nil {
+		result.Status, result.ExitCode = StepFailure, infraFailureExitCode
+		if exitErr, ok := err.(*ExitError); ok {
+			result.ExitCode = exitErr.Code
+		}
+	}
+	out.StepEnd(result)
+	for _, sink := range sinks {
+		sink.Close()
+	}
+	if err != nil {
+		return &EnvironmentError{ciConfig.Warmup, err, strings.TrimSpace(string(output.buf))}
+	}
+	return nil
+}
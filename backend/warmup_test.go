@@ -0,0 +1,63 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseWarmup(t *testing.T) {
+	config, err := ParseCIConfig([]byte("image: golang\nwarmup: go version\nsteps:\n  - name: test\n    command: go test ./...\n"))
+	if err != nil || config.Warmup != "go version" {
+		t.Errorf("ParseCIConfig failed: expected the warm-up command got %v %v", config, err)
+	}
+}
+
+func TestEnvironmentError(t *testing.T) {
+	output := &tailWriter{max: 8}
+	output.Write([]byte("sh: go: "))
+	output.Write([]byte("not found"))
+	if string(output.buf) != "ot found" {
+		t.Errorf("tailWriter failed: expected the last bytes got %q", output.buf)
+	}
+	err := &EnvironmentError{"go version", &ExitError{Step: warmupStepName, Code: 127}, "go: not found"}
+	expected := `environment broken: warm-up "go version" failed: step warmup exited with code 127: go: not found`
+	if err.Error() != expected {
+		t.Errorf("EnvironmentError failed: expected %q got %q", expected, err.Error())
+	}
+	if !strings.HasPrefix((&EnvironmentError{Cmd: "true", Err: err.Err}).Error(), "environment broken") {
+		t.Errorf("EnvironmentError failed: unexpected message without output")
+	}
+}
+
+func TestWarmUpSkipped(t *testing.T) {
+	r := &Runner{}
+	if err := r.warmUp(RunnerRequest{}, &CIConfig{}, "", "", "", nil); err != nil {
+		t.Errorf("warmUp failed: expected nothing to run without command got %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"sync"
+	"time"
+)
+
+// Default upper bound of the size of the dispatching workers pool settable
+// through the admin API
+const DefaultWorkersLimit int = 256
+
+// WorkerPool runs a resizable set of goroutines executing the same work
+// function, which must return as soon as its stop channel is closed. With
+// autoscaling enabled the size follows the value of a load function, clamped
+// between min and max.
+type WorkerPool struct {
+	mutex     sync.Mutex
+	work      func(stop <-chan struct{})
+	stops     []chan struct{}
+	autoscale bool
+	min, max  int
+}
+
+// Size settings of the pool, as exposed by the admin API
+type WorkerPoolSettings struct {
+	Size      int  `json:"size"`
+	Autoscale bool `json:"autoscale"`
+	Min       int  `json:"min"`
+	Max       int  `json:"max"`
+}
+
+func NewWorkerPool(work func(stop <-chan struct{})) *WorkerPool {
+	return &WorkerPool{work: work, stops: []chan struct{}{}, min: 1, max: 1}
+}
+
+// Resize starts or stops workers to reach the given size
+func (p *WorkerPool) Resize(size int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.resize(size)
+}
+
+func (p *WorkerPool) resize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	for len(p.stops) < size {
+		stop := make(chan struct{})
+		p.stops = append(p.stops, stop)
+		go p.work(stop)
+	}
+	for len(p.stops) > size {
+		last := len(p.stops) - 1
+		close(p.stops[last])
+		p.stops = p.stops[:last]
+	}
+}
+
+func (p *WorkerPool) Settings() WorkerPoolSettings {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return WorkerPoolSettings{len(p.stops), p.autoscale, p.min, p.max}
+}
+
+// SetAutoscale enables or disables autoscaling between min and max workers
+func (p *WorkerPool) SetAutoscale(enabled bool, min, max int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	p.autoscale, p.min, p.max = enabled, min, max
+}
+
+// Autoscale periodically resizes the pool to match the load, as long as
+// autoscaling is enabled
+func (p *WorkerPool) Autoscale(load func() int, interval time.Duration, clock Clock) {
+	for {
+		<-clock.After(interval)
+		p.mutex.Lock()
+		if p.autoscale {
+			size := load()
+			if size < p.min {
+				size = p.min
+			}
+			if size > p.max {
+				size = p.max
+			}
+			p.resize(size)
+		}
+		p.mutex.Unlock()
+	}
+}
@@ -0,0 +1,209 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatchWorkerStops(t *testing.T) {
+	clock := newFakeClock()
+	d := NewDispatcher("commits", time.Second, nil, WithClock(clock))
+	run := func(stop chan struct{}) <-chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			d.dispatchWorker(stop)
+			close(done)
+		}()
+		return done
+	}
+
+	// Waiting for a commit
+	stop := make(chan struct{})
+	done := run(stop)
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("dispatchWorker failed: expected to return on an empty queue once stopped")
+	}
+
+	// Parked waiting for a runner
+	d.enqueue(Commit{Id: "a", Repository: Repository{GitHub, "octocat/test", "master"}})
+	stop = make(chan struct{})
+	done = run(stop)
+	<-clock.requested
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("dispatchWorker failed: expected to return while parked once stopped")
+	}
+	if d.queue.Len() != 1 {
+		t.Errorf("dispatchWorker failed: expected the commit left queued got %d", d.queue.Len())
+	}
+}
+
+func closed(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestWorkerPoolResize(t *testing.T) {
+	started := make(chan (<-chan struct{}), 8)
+	pool := NewWorkerPool(func(stop <-chan struct{}) { started <- stop })
+	pool.Resize(3)
+	stops := []<-chan struct{}{<-started, <-started, <-started}
+	if size := pool.Settings().Size; size != 3 {
+		t.Errorf("WorkerPool.Resize failed: expected 3 workers got %d", size)
+	}
+	pool.Resize(1)
+	stopped := 0
+	for _, stop := range stops {
+		if closed(stop) {
+			stopped++
+		}
+	}
+	if size := pool.Settings().Size; size != 1 || stopped != 2 {
+		t.Errorf("WorkerPool.Resize failed: expected 1 worker left and 2 stopped got %d and %d", size, stopped)
+	}
+	pool.Resize(2)
+	<-started
+	if size := pool.Settings().Size; size != 2 {
+		t.Errorf("WorkerPool.Resize failed: expected 2 workers got %d", size)
+	}
+	pool.Resize(-1)
+	if size := pool.Settings().Size; size != 0 {
+		t.Errorf("WorkerPool.Resize failed: expected no worker got %d", size)
+	}
+}
+
+func TestWorkerPoolSetAutoscale(t *testing.T) {
+	pool := NewWorkerPool(func(stop <-chan struct{}) {})
+	for _, c := range []struct {
+		min, max, expectedMin, expectedMax int
+	}{
+		{0, -1, 1, 1},
+		{4, 2, 4, 4},
+		{2, 16, 2, 16},
+	} {
+		pool.SetAutoscale(true, c.min, c.max)
+		if settings := pool.Settings(); !settings.Autoscale ||
+			settings.Min != c.expectedMin || settings.Max != c.expectedMax {
+			t.Errorf("WorkerPool.SetAutoscale failed: expected [%d, %d] got %+v",
+				c.expectedMin, c.expectedMax, settings)
+		}
+	}
+}
+
+func TestWorkerPoolAutoscale(t *testing.T) {
+	clock := newFakeClock()
+	pool := NewWorkerPool(func(stop <-chan struct{}) { <-stop })
+	defer pool.Resize(0)
+	pool.SetAutoscale(true, 2, 5)
+	var mutex sync.Mutex
+	load := 0
+	go pool.Autoscale(func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return load
+	}, time.Second, clock)
+	<-clock.requested
+	for _, c := range []struct{ load, expected int }{{10, 5}, {0, 2}, {3, 3}} {
+		mutex.Lock()
+		load = c.load
+		mutex.Unlock()
+		clock.Advance(time.Second)
+		<-clock.requested
+		if size := pool.Settings().Size; size != c.expected {
+			t.Errorf("WorkerPool.Autoscale failed: expected %d workers for a load of %d got %d",
+				c.expected, c.load, size)
+		}
+	}
+	// Left alone once disabled
+	pool.SetAutoscale(false, 2, 5)
+	mutex.Lock()
+	load = 10
+	mutex.Unlock()
+	clock.Advance(time.Second)
+	<-clock.requested
+	if size := pool.Settings().Size; size != 3 {
+		t.Errorf("WorkerPool.Autoscale failed: expected 3 workers with autoscaling disabled got %d", size)
+	}
+}
+
+func TestWorkersHandler(t *testing.T) {
+	d := NewDispatcher("commits", time.Second, nil, WithAdminToken("secret"), WithWorkersLimit(8))
+	defer d.workers.Resize(0)
+	handler := workersHandler(d)
+	call := func(method, token, body string) (int, WorkerPoolSettings) {
+		req := httptest.NewRequest(method, "/admin/workers", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		var settings WorkerPoolSettings
+		json.NewDecoder(rec.Body).Decode(&settings)
+		return rec.Code, settings
+	}
+	for _, c := range []struct {
+		method, token, body string
+		expected            int
+	}{
+		{http.MethodPut, "", `{"size": 2}`, http.StatusForbidden},
+		{http.MethodPut, "secret", `{"size":`, http.StatusBadRequest},
+		{http.MethodPut, "secret", `{"size": 0}`, http.StatusBadRequest},
+		{http.MethodPut, "secret", `{"size": 9}`, http.StatusBadRequest},
+		{http.MethodPut, "secret", `{"autoscale": true, "min": 1, "max": 100}`, http.StatusBadRequest},
+		{http.MethodDelete, "secret", "", http.StatusMethodNotAllowed},
+	} {
+		if code, _ := call(c.method, c.token, c.body); code != c.expected {
+			t.Errorf("workersHandler failed: expected %d got %d for %s %s", c.expected, code, c.method, c.body)
+		}
+	}
+	if code, settings := call(http.MethodPut, "secret", `{"size": 3}`); code != http.StatusOK || settings.Size != 3 {
+		t.Errorf("workersHandler failed: expected 3 workers got %d %+v", code, settings)
+	}
+	code, settings := call(http.MethodPut, "secret", `{"autoscale": true, "min": 2, "max": 8}`)
+	if code != http.StatusOK || !settings.Autoscale || settings.Min != 2 || settings.Max != 8 || settings.Size != 3 {
+		t.Errorf("workersHandler failed: expected autoscaling between 2 and 8 got %d %+v", code, settings)
+	}
+	if code, settings := call(http.MethodGet, "secret", ""); code != http.StatusOK || settings.Max != 8 {
+		t.Errorf("workersHandler failed: expected the settings got %d %+v", code, settings)
+	}
+}
@@ -29,14 +29,63 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
+	"os"
+	"strings"
+
 	. "github.com/codepr/narwhal/agent"
+	. "github.com/codepr/narwhal/backend"
 )
 
 func main() {
-	var configPath string
+	var configPath, webhookURL, dispatchers, spoolDir, allowlistPath string
 	flag.StringVar(&configPath, "conf", "", "Configuration YAML path")
+	flag.StringVar(&webhookURL, "webhook-url", "",
+		"Public URL of the commit endpoint, used to onboard repositories")
+	flag.StringVar(&dispatchers, "dispatchers", "",
+		"Comma separated dispatcher URLs the commits are submitted to when the queue is down")
+	flag.StringVar(&spoolDir, "spool-dir", "",
+		"Directory keeping the commits that could not be delivered, retried later")
+	flag.StringVar(&allowlistPath, "allowlist", "",
+		"File persisting the allowlist of the onboarded repositories, kept in memory if empty")
 	flag.Parse()
-	agent := NewAgent("commits")
+	opts := []AgentOption{WithWebhookURL(webhookURL), WithSpoolDir(spoolDir),
+		WithManagementToken(os.Getenv("NARWHAL_AGENT_TOKEN")),
+		WithReplySigningKey(os.Getenv("NARWHAL_REPLY_SIGNING_KEY")),
+		WithGitHubToken(os.Getenv("NARWHAL_GITHUB_TOKEN"))}
+	if allowlistPath != "" {
+		opts = append(opts, WithAllowlistFile(allowlistPath))
+	}
+	if dispatchers != "" {
+		opts = append(opts, WithDispatchers(os.Getenv("NARWHAL_SUBMIT_TOKEN"),
+			strings.Split(dispatchers, ",")...))
+	}
+	if keys := os.Getenv("NARWHAL_EVENT_KEYS"); keys != "" {
+		keyring, err := ParseKeyring(keys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, WithEventEncryption(keyring))
+	}
+	if configPath != "" {
+		config, err := LoadAgentConfig(configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, WithWebhookSecret(config.Secret), WithRepositorySecrets(config.Secrets))
+		if config.GenericHook != nil {
+			opts = append(opts, WithGenericHook(*config.GenericHook))
+		}
+		if config.Poll != nil {
+			opts = append(opts, WithPolling(*config.Poll))
+		}
+		if len(config.Allowlist) > 0 {
+			opts = append(opts, WithAllowlist(config.Allowlist...))
+		}
+	}
+	// The environment takes precedence over the configuration file
+	opts = append(opts, WithWebhookSecret(os.Getenv("NARWHAL_WEBHOOK_SECRET")))
+	agent := NewAgent("commits", opts...)
 	fmt.Println("Agent start")
 	agent.Run()
 }
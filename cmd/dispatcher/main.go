@@ -27,18 +27,262 @@
 package main
 
 import (
+	"crypto/rand"
 	"flag"
 	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
 	. "github.com/codepr/narwhal/backend"
 )
 
+// Default public URL, only reachable from the build containers of a runner
+// sharing the network of the dispatcher
+const defaultPublicURL string = "http://localhost:28919"
+
+// remoteRunners returns the addresses of the runners not on this host, they
+// can't post the logs and results of the jobs to the default public URL
+func remoteRunners(runners []*RunnerProxy) []string {
+	var remote []string
+	for _, runner := range runners {
+		host, _, err := net.SplitHostPort(runner.Addr)
+		if err != nil {
+			host = runner.Addr
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			remote = append(remote, runner.Addr)
+		}
+	}
+	return remote
+}
+
 func main() {
-	var configPath string
+	var configPath, addr, runnerWebhooks, blameWebhooks, authorsPath string
+	var publicURL, skipCIPattern string
+	var bisect, requeueZombies, githubChecks, autoCancel, readReplica, requireRegistration bool
+	var workers, maxWorkers, workersLimit, maxEventSize int
+	var suppressionWindow, zombieLimit, prePullWindow time.Duration
 	flag.StringVar(&configPath, "conf", "", "Configuration YAML path")
+	flag.StringVar(&addr, "addr", ":28919",
+		"HTTP API listening address, all the IPv4 and IPv6 interfaces if the host is empty")
+	flag.StringVar(&runnerWebhooks, "runner-webhooks", "",
+		"Comma separated URLs notified on runner lifecycle events")
+	flag.StringVar(&blameWebhooks, "blame-webhooks", "",
+		"Comma separated URLs notified, targeting the authors, when a branch breaks")
+	flag.StringVar(&authorsPath, "authors", "",
+		"YAML mapping of commit authors to notification recipients, blamed or emailed")
+	flag.BoolVar(&bisect, "bisect", false, "Automatically bisect broken branches")
+	flag.BoolVar(&autoCancel, "auto-cancel", false,
+		"Cancel the jobs of a branch superseded by a newer commit, unless not interruptible")
+	flag.BoolVar(&readReplica, "read-replica", false,
+		"Only serve the jobs, logs and badges from the shared store, without consuming nor dispatching")
+	flag.BoolVar(&requireRegistration, "require-registration", false,
+		"Only build the repositories registered through the /repositories API")
+	flag.DurationVar(&suppressionWindow, "suppression-window", 0,
+		"Reject commits already submitted within this window")
+	flag.DurationVar(&zombieLimit, "zombie-limit", 0,
+		"Fail the jobs still running after this long, cleaning their containers")
+	flag.DurationVar(&prePullWindow, "prepull-window", 0,
+		"Have the runners pull while idle the images of the repositories built within this window")
+	flag.BoolVar(&requeueZombies, "requeue-zombies", false,
+		"Schedule again the commits of the failed zombie jobs")
+	flag.IntVar(&workers, "workers", 0, "Dispatching workers, defaults to the number of runners")
+	flag.IntVar(&maxWorkers, "max-workers", 0,
+		"Autoscale the dispatching workers up to this number following the queue depth")
+	flag.IntVar(&workersLimit, "workers-limit", DefaultWorkersLimit,
+		"Largest number of dispatching workers settable through the admin API")
+	flag.IntVar(&maxEventSize, "max-event-size", DefaultMaxEventSize,
+		"Max size in bytes of the commit events, bigger ones go to the poison queue")
+	flag.StringVar(&publicURL, "public-url", defaultPublicURL,
+		"URL the dispatcher API is reachable at from the build containers")
+	flag.StringVar(&skipCIPattern, "skip-ci-pattern", "",
+		"Skip the commits whose message matches this regexp, besides [skip ci] and [ci skip]")
+	flag.BoolVar(&githubChecks, "github-checks", false,
+		"Create a check run for every job, requires the GitHub App credentials NARWHAL_GITHUB_APP_ID, "+
+			"NARWHAL_GITHUB_APP_INSTALLATION_ID and NARWHAL_GITHUB_APP_KEY, the path of its private key")
 	flag.Parse()
-	dispatcher := NewDispatcher("commits", 5000,
-		[]RunnerProxy{*NewRunnerProxy("127.0.0.1:9898")})
+	opts := []DispatcherOption{
+		WithAdminToken(os.Getenv("NARWHAL_ADMIN_TOKEN")),
+		WithPublicURL(publicURL),
+		WithMaxEventSize(maxEventSize),
+		WithSubmitToken(os.Getenv("NARWHAL_SUBMIT_TOKEN")),
+	}
+	if keys := os.Getenv("NARWHAL_EVENT_KEYS"); keys != "" {
+		keyring, err := ParseKeyring(keys)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, WithEventDecryption(keyring))
+	}
+	if keys := os.Getenv("NARWHAL_SECRET_KEYS"); keys != "" {
+		// The runners fetch the secrets of the jobs from the public URL
+		if publicURL == defaultPublicURL {
+			log.Fatal("Secrets require -public-url, the URL the runners reach the dispatcher at")
+		}
+		keyring, err := ParseKeyring(keys)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, WithSecrets(keyring))
+	}
+	reporters := HostingReporter{}
+	if token := os.Getenv("NARWHAL_GITHUB_TOKEN"); token != "" {
+		reporters[GitHub] = NewGitHubStatusReporter(token, publicURL)
+	}
+	if githubChecks {
+		appId, installationId := os.Getenv("NARWHAL_GITHUB_APP_ID"), os.Getenv("NARWHAL_GITHUB_APP_INSTALLATION_ID")
+		keyPath := os.Getenv("NARWHAL_GITHUB_APP_KEY")
+		if appId == "" || installationId == "" || keyPath == "" {
+			log.Fatal("Check runs require a GitHub App, personal access tokens are refused by the Checks API")
+		}
+		app, err := NewGitHubApp(appId, installationId, keyPath)
+		if err != nil {
+			log.Fatalf("Unable to load the GitHub App key: %v", err)
+		}
+		opts = append(opts, WithJobReporter(NewGitHubChecksReporter(app, publicURL)))
+	}
+	if token := os.Getenv("NARWHAL_GITLAB_TOKEN"); token != "" {
+		reporters[GitLab] = NewGitLabStatusReporter(os.Getenv("NARWHAL_GITLAB_URL"), token, publicURL)
+	}
+	if token := os.Getenv("NARWHAL_BITBUCKET_TOKEN"); token != "" {
+		reporters[BitBucket] = NewBitbucketStatusReporter(token, publicURL)
+	}
+	if len(reporters) > 0 {
+		opts = append(opts, WithAggregation(AggregateAll, reporters))
+	}
+	if secret := os.Getenv("NARWHAL_REGISTRATION_SECRET"); secret != "" {
+		opts = append(opts, WithRunnerRegistration(secret))
+	}
+	if runnerWebhooks != "" {
+		opts = append(opts, WithRunnerWebhooks(strings.Split(runnerWebhooks, ",")...))
+	}
+	authors := map[string]Recipient{}
+	if authorsPath != "" {
+		var err error
+		if authors, err = LoadAuthorsMapping(authorsPath); err != nil {
+			panic(err)
+		}
+	}
+	if blameWebhooks != "" {
+		opts = append(opts, WithBlameNotifications(authors, strings.Split(blameWebhooks, ",")...))
+	}
+	if requireRegistration {
+		opts = append(opts, WithRepositoryRegistration())
+	}
+	if suppressionWindow > 0 {
+		opts = append(opts, WithSuppressionWindow(suppressionWindow))
+	}
+	if zombieLimit > 0 {
+		opts = append(opts, WithZombieReaper(zombieLimit, requeueZombies))
+	}
+	if skipCIPattern != "" {
+		pattern, err := regexp.Compile(skipCIPattern)
+		if err != nil {
+			log.Fatalf("Invalid -skip-ci-pattern: %v", err)
+		}
+		opts = append(opts, WithSkipCIPattern(pattern))
+	}
+	if prePullWindow > 0 {
+		opts = append(opts, WithImagePrePull(prePullWindow))
+	}
+	if workers > 0 {
+		opts = append(opts, WithWorkers(workers))
+	}
+	if maxWorkers > 0 {
+		opts = append(opts, WithAutoscaling(1, maxWorkers))
+	}
+	opts = append(opts, WithWorkersLimit(workersLimit))
+	if bisect {
+		opts = append(opts, WithAutoBisect())
+	}
+	if autoCancel {
+		opts = append(opts, WithAutoCancel())
+	}
+	if readReplica {
+		opts = append(opts, WithReadReplica())
+	}
+	interval := 5 * time.Second
+	runners := []*RunnerProxy{NewRunnerProxy("127.0.0.1:9898")}
+	if configPath != "" {
+		config, err := LoadDispatcherConfig(configPath)
+		if err != nil {
+			panic(err)
+		}
+		interval, runners = config.HeartbeatInterval, config.RunnerProxies()
+		store, err := OpenStore(config.Store)
+		if err != nil {
+			panic(err)
+		}
+		defer store.Close()
+		opts = append(opts, WithStore(store))
+		if config.Credentials != nil {
+			opts = append(opts, WithRepositoryCredentials(config.Credentials))
+		}
+		if len(config.ResultCache) > 0 {
+			opts = append(opts, WithResultCache(config.ResultCache...))
+		}
+		if config.Slack.Webhook != "" || len(config.Slack.Repositories) > 0 {
+			opts = append(opts, WithSlackNotifications(config.Slack))
+		}
+		if config.Email != nil {
+			notifier, err := NewEmailNotifier(*config.Email, authors)
+			if err != nil {
+				panic(err)
+			}
+			opts = append(opts, WithEmailNotifications(notifier))
+		}
+		if len(config.Schedules) > 0 {
+			opts = append(opts, WithScheduledBuilds(config.Schedules...))
+		}
+		if len(config.Access) > 0 {
+			access, err := NewAccessControl(config.Access...)
+			if err != nil {
+				panic(err)
+			}
+			opts = append(opts, WithAccessControl(access))
+		}
+		if len(config.Login.Users) > 0 {
+			// Shared by the replicas to accept the sessions of each other,
+			// random otherwise, ending the sessions on restart
+			secret := []byte(os.Getenv("NARWHAL_SESSION_SECRET"))
+			if len(secret) == 0 {
+				secret = make([]byte, 32)
+				rand.Read(secret)
+			}
+			sessions, err := NewSessions(config.Login, secret)
+			if err != nil {
+				panic(err)
+			}
+			opts = append(opts, WithSessions(sessions))
+		}
+	}
+	if publicURL == defaultPublicURL {
+		if remote := remoteRunners(runners); len(remote) > 0 {
+			log.Printf("Warning: runners %s can't reach the dispatcher at %s, set -public-url\n",
+				strings.Join(remote, ", "), defaultPublicURL)
+		}
+		if os.Getenv("NARWHAL_REGISTRATION_SECRET") != "" {
+			log.Printf("Warning: registered runners on other hosts can't reach the dispatcher at %s, set -public-url\n",
+				defaultPublicURL)
+		}
+	}
+	dispatcher := NewDispatcher("commits", interval, runners, opts...)
 	fmt.Println("Dispatcher start")
+	if readReplica {
+		if err := dispatcher.ListenAndServe(addr); err != nil {
+			panic(err)
+		}
+		return
+	}
+	go func() {
+		if err := dispatcher.ListenAndServe(addr); err != nil {
+			panic(err)
+		}
+	}()
 	if err := dispatcher.Consume(); err != nil {
 		panic(err)
 	}
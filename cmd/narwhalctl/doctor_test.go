@@ -0,0 +1,118 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/codepr/narwhal/backend"
+)
+
+func TestWaitListening(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	if err := waitListening(addr, time.Second, nil); err != nil {
+		t.Errorf("waitListening failed: expected nil got %v", err)
+	}
+	listener.Close()
+	exited := make(chan error, 1)
+	exited <- errors.New("address already in use")
+	if err := waitListening(addr, time.Minute, exited); err == nil {
+		t.Errorf("waitListening failed: expected the runner exit reported")
+	}
+	if err := waitListening(addr, 0, nil); err == nil {
+		t.Errorf("waitListening failed: expected error on timeout")
+	}
+}
+
+func TestRemoveRunner(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method != http.MethodDelete || r.Header.Get("Authorization") != "Bearer admin":
+			w.WriteHeader(http.StatusForbidden)
+		case r.URL.Path == "/runners/busy":
+			w.WriteHeader(http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+	if err := removeRunner(server.URL, "admin", "idle"); err != nil {
+		t.Errorf("removeRunner failed: expected nil got %v", err)
+	}
+	if err := removeRunner(server.URL, "admin", "busy"); err == nil {
+		t.Errorf("removeRunner failed: expected error for a busy runner")
+	}
+	if err := removeRunner(server.URL, "viewer", "idle"); err == nil {
+		t.Errorf("removeRunner failed: expected error when refused")
+	}
+}
+
+// Commit built in the body of POST /builds
+type buildRequestBody struct {
+	CommitId string `json:"commit_id"`
+}
+
+func TestSmokeJob(t *testing.T) {
+	const head = "2d3c5e5c8fd2bd6a2f9d3c0e4b1f9e8c7a6b5d4e"
+	var polls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/builds":
+			var req buildRequestBody
+			json.NewDecoder(r.Body).Decode(&req)
+			if r.Header.Get("Authorization") != "Bearer admin" || req.CommitId != head {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(backend.QueuedCommit{JobId: "job-1"})
+		case r.URL.Path == "/jobs/job-1":
+			polls++
+			json.NewEncoder(w).Encode(map[string]string{"state": "SUCCESS"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	state, _, err := smokeJob(server.URL, "admin", "octocat/test", "main", head, time.Minute)
+	if err != nil || state != "SUCCESS" || polls != 1 {
+		t.Errorf("smokeJob failed: expected SUCCESS after 1 poll got %s after %d %v", state, polls, err)
+	}
+	if _, _, err := smokeJob(server.URL, "admin", "octocat/test", "main", "doctor-1", time.Minute); err == nil {
+		t.Errorf("smokeJob failed: expected error for a refused build")
+	}
+}
@@ -0,0 +1,241 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codepr/narwhal/backend"
+)
+
+const usage = `Usage: narwhalctl [-dispatcher url] <command> [args]
+
+Commands:
+  logs [-f] [-plain] [-steps] <job>
+                    print the output of a job, following it until the job
+                    is done with -f, exiting with the status of the job,
+                    without ANSI escape sequences with -plain, only the
+                    steps and their durations with -steps
+  search <query>    list the jobs matching a query, newest first, e.g.
+                    narwhalctl search repo:octocat/hello status:failed
+  release [flags] <repository> <branch> <commit>
+                    cross-compile the Go project at a commit for every
+                    target through a release pipeline, waiting for it and
+                    listing the binaries, see narwhalctl release -h
+  doctor [flags]    check the broker, the store, Docker and the dispatcher,
+                    register a temporary runner and run a smoke job, see
+                    narwhalctl doctor -h
+
+Environment:
+  NARWHAL_TOKEN     access token presented to the dispatcher, the admin
+                    token NARWHAL_ADMIN_TOKEN if not set
+`
+
+// Exit codes of a followed job, by final state
+var exitCodes = map[string]int{
+	"SUCCESS":   0,
+	"FAILED":    1,
+	"CANCELLED": 2,
+}
+
+// Exit code when the state of the job can't be determined
+const exitUnknown int = 3
+
+func main() {
+	dispatcherURL := os.Getenv("NARWHAL_DISPATCHER_URL")
+	if dispatcherURL == "" {
+		dispatcherURL = "http://localhost:28919"
+	}
+	flag.StringVar(&dispatcherURL, "dispatcher", dispatcherURL, "Dispatcher API URL")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(exitUnknown)
+	}
+	api := strings.TrimRight(dispatcherURL, "/")
+	switch flag.Arg(0) {
+	case "logs":
+		os.Exit(logs(api, flag.Args()[1:]))
+	case "search":
+		os.Exit(search(api, flag.Args()[1:]))
+	case "release":
+		os.Exit(release(api, flag.Args()[1:]))
+	case "doctor", "smoke":
+		os.Exit(doctor(api, flag.Args()[1:]))
+	default:
+		flag.Usage()
+		os.Exit(exitUnknown)
+	}
+}
+
+// printSteps prints the steps delimited by the markers of the logs as they
+// end, timed with the timestamps of the lines
+func printSteps(logs io.Reader) error {
+	started := map[string]time.Duration{}
+	reader := bufio.NewReader(logs)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			parsed := backend.ParseLogLine(line)
+			switch marker := parsed.Marker; {
+			case marker == nil:
+			case marker.Kind == backend.StepStartMarker:
+				started[marker.Step] = parsed.Elapsed
+			case marker.Kind == backend.StepEndMarker:
+				fmt.Printf("%-24s %-8s %s\n", marker.Step, marker.Status,
+					(parsed.Elapsed - started[marker.Step]).Round(time.Millisecond))
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// logs copies the output of a job to stdout, ANSI sequences included unless
+// plain output is asked for
+func logs(api string, args []string) int {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := flags.Bool("f", false, "Follow the output until the job is done")
+	plain := flags.Bool("plain", false, "Strip the ANSI escape sequences")
+	steps := flags.Bool("steps", false, "Print the steps and their durations only")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flag.Usage()
+		return exitUnknown
+	}
+	jobId := flags.Arg(0)
+	query := url.Values{}
+	if *follow {
+		query.Set("follow", "true")
+	}
+	if *plain {
+		query.Set("plain", "true")
+	}
+	endpoint := fmt.Sprintf("%s/jobs/%s/logs", api, jobId)
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	res, err := apiCall(http.MethodGet, endpoint, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUnknown
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "dispatcher answered with status %d\n", res.StatusCode)
+		return exitUnknown
+	}
+	if *steps {
+		err = printSteps(res.Body)
+	} else {
+		_, err = io.Copy(os.Stdout, res.Body)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUnknown
+	}
+	if !*follow {
+		return 0
+	}
+	state, err := jobState(api, jobId)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUnknown
+	}
+	if code, ok := exitCodes[state]; ok {
+		return code
+	}
+	return exitUnknown
+}
+
+func jobState(api, jobId string) (string, error) {
+	res, err := apiCall(http.MethodGet, fmt.Sprintf("%s/jobs/%s", api, jobId), nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("dispatcher answered with status %d", res.StatusCode)
+	}
+	var job struct {
+		State string `json:"state"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&job)
+	return job.State, err
+}
+
+// search prints a line per job matching the query, joining the arguments
+func search(api string, args []string) int {
+	flags := flag.NewFlagSet("search", flag.ExitOnError)
+	limit := flags.Int("n", 20, "Max number of jobs to list")
+	flags.Parse(args)
+	var res struct {
+		Jobs []backend.Job `json:"jobs"`
+	}
+	query := url.Values{"q": {strings.Join(flags.Args(), " ")}, "limit": {strconv.Itoa(*limit)}}
+	if err := getJSON(api+"/jobs/search?"+query.Encode(), &res); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUnknown
+	}
+	for _, job := range res.Jobs {
+		commit := job.Commit
+		fmt.Printf("%s  %-9s  %s@%s  %.7s  %s\n", job.Id, job.State, commit.GetRepositoryName(),
+			commit.Repository.Branch, commit.Id, job.CreatedAt.Format(time.RFC3339))
+	}
+	return 0
+}
+
+// apiCall sends a request to the dispatcher API with the access token, if
+// any, see the environment in the usage
+func apiCall(method, url string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	token := os.Getenv("NARWHAL_TOKEN")
+	if token == "" {
+		token = os.Getenv("NARWHAL_ADMIN_TOKEN")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return http.DefaultClient.Do(req)
+}
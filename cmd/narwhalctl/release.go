@@ -0,0 +1,105 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/codepr/narwhal/backend"
+	"gopkg.in/yaml.v2"
+)
+
+// release builds the binaries of a Go project through an inline release
+// pipeline, printing the download URLs of the artifacts once it's done
+func release(api string, args []string) int {
+	flags := flag.NewFlagSet("release", flag.ExitOnError)
+	name := flags.String("name", "release", "Name of the pipeline")
+	packages := flags.String("packages", ".", "Comma separated main packages to build")
+	targets := flags.String("targets", "", "Comma separated GOOS/GOARCH targets, all the common ones by default")
+	goVersion := flags.String("go", "", "Version of the golang image to build with")
+	ldflags := flags.String("ldflags", "", "Additional linker flags, e.g. -X main.version=1.0.0")
+	timeout := flags.Duration("timeout", 30*time.Minute, "How long to wait for the release")
+	flags.Parse(args)
+	if flags.NArg() != 3 {
+		flag.Usage()
+		return exitUnknown
+	}
+	token := os.Getenv("NARWHAL_ADMIN_TOKEN")
+	if token == "" {
+		fmt.Fprintln(os.Stderr, "NARWHAL_ADMIN_TOKEN not set")
+		return exitUnknown
+	}
+	config := backend.CIConfig{
+		Name: *name,
+		Release: &backend.ReleaseConfig{
+			Packages:  strings.Split(*packages, ","),
+			GoVersion: *goVersion,
+			LDFlags:   *ldflags,
+		},
+	}
+	if *targets != "" {
+		config.Release.Targets = strings.Split(*targets, ",")
+	}
+	pipeline, err := yaml.Marshal(config)
+	if err == nil {
+		// Catch the invalid targets before submitting
+		_, err = backend.ParseCIConfig(pipeline)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUnknown
+	}
+
+	jobId, err := submitBuild(api, token, flags.Arg(0), flags.Arg(1), flags.Arg(2), string(pipeline))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUnknown
+	}
+	fmt.Fprintf(os.Stderr, "Release job %s submitted\n", jobId)
+	state, elapsed, err := waitJob(api, jobId, *timeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUnknown
+	}
+	fmt.Fprintf(os.Stderr, "Release job %s %s in %s\n", jobId, state, elapsed.Round(time.Second))
+	if state != "SUCCESS" {
+		return exitCodes[state]
+	}
+	var artifacts []backend.Artifact
+	if err := getJSON(api+"/jobs/"+jobId+"/artifacts", &artifacts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUnknown
+	}
+	for _, artifact := range artifacts {
+		fmt.Printf("%s/jobs/%s/artifacts/%s\n", api, jobId, artifact.Name)
+	}
+	return 0
+}
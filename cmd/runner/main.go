@@ -29,14 +29,178 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
 	. "github.com/codepr/narwhal/backend"
 )
 
 func main() {
-	var configPath, addr string
+	var configPath, addr, logSinks, user, tokenHelper, dispatcherURL, advertiseAddr, runnerId string
+	var register, streamLogs, dependencyCache bool
+	var journalPath, metricsAddr, spoolDir string
+	var allowRepos, denyRepos, dependencyProxies, labels, executors string
+	var maxJobs int
+	var maxStepLogSize int64
+	var chaos ChaosConfig
+	var reconcileInterval time.Duration
+	var credentialsTTL, prePullInterval, registrationInterval time.Duration
 	flag.StringVar(&configPath, "conf", "", "Configuration YAML path")
-	flag.StringVar(&addr, "addr", ":9898", "RPC Server listening address")
+	flag.StringVar(&addr, "addr", ":9898",
+		"RPC Server listening address, all the IPv4 and IPv6 interfaces if the host is empty")
+	flag.StringVar(&runnerId, "id", "",
+		"Identifier of the runner its containers are labelled with, unique among the runners sharing a Docker daemon, "+
+			"the host and listening port if empty")
+	flag.StringVar(&logSinks, "log-sinks", "",
+		"Comma separated kind=url remote log sinks (loki, elasticsearch, s3)")
+	flag.StringVar(&user, "user", "", "Default uid[:gid] to run the steps as")
+	flag.StringVar(&tokenHelper, "token-helper", "",
+		"Command printing the clone token of the repository given as argument")
+	flag.StringVar(&dispatcherURL, "dispatcher", "",
+		"Dispatcher URL to fetch clone credentials from")
+	flag.StringVar(&journalPath, "journal", "",
+		"Job journal path, enables the reconciliation of the job containers")
+	flag.StringVar(&spoolDir, "spool-dir", "",
+		"Directory keeping the results and logs that could not be delivered to the dispatcher, retried later")
+	flag.DurationVar(&reconcileInterval, "reconcile-interval", time.Minute,
+		"How often the job containers are reconciled with the journal")
+	flag.BoolVar(&streamLogs, "stream-logs", false,
+		"Ship the output of the steps to the dispatcher as they run, to follow it through its API, "+
+			"otherwise it's handed over once the job is over")
+	flag.BoolVar(&register, "register", false,
+		"Register to the dispatcher, requires NARWHAL_REGISTRATION_SECRET")
+	flag.DurationVar(&registrationInterval, "registration-interval", time.Minute,
+		"How often the registration is confirmed, registering again to a restarted dispatcher")
+	flag.StringVar(&advertiseAddr, "advertise-addr", "",
+		"RPC address the dispatcher reaches the runner at, IPv6 hosts in brackets, e.g. [2001:db8::1]:9898, "+
+			"detected from the interface routing to the dispatcher if empty")
+	flag.DurationVar(&credentialsTTL, "credentials-ttl", 5*time.Minute,
+		"How long clone credentials are cached")
+	flag.StringVar(&metricsAddr, "metrics-addr", "",
+		"HTTP address serving the runner metrics, disabled if empty")
+	flag.StringVar(&allowRepos, "allow-repos", "",
+		"Comma separated repository patterns the runner only accepts, e.g. org/infra")
+	flag.StringVar(&denyRepos, "deny-repos", "",
+		"Comma separated repository patterns the runner rejects, e.g. org/*")
+	flag.StringVar(&labels, "labels", "",
+		"Comma separated key=value labels the pipelines may require, e.g. gpu=true,docker=true, os and arch are always set")
+	flag.IntVar(&maxJobs, "max-jobs", 0,
+		"Jobs the dispatcher routes to the runner at once, 0 for no limit")
+	flag.StringVar(&executors, "executors", "",
+		"Comma separated modes of execution of the pipelines run, container and exec, all of them if empty")
+	flag.BoolVar(&dependencyCache, "dependency-cache", false,
+		"Cache the dependencies installed by the steps as images, skipping the install when unchanged")
+	flag.StringVar(&dependencyProxies, "dependency-proxies", "",
+		"Comma separated caching proxies to run for the jobs, go and npm")
+	flag.DurationVar(&prePullInterval, "prepull-interval", 0,
+		"Pull while idle the images pushed by the dispatcher, refreshing each of them at this interval")
+	flag.Int64Var(&maxStepLogSize, "max-step-log-size", 1024*1024,
+		"Bytes of output of each step shipped to the dispatcher and the log sinks, 0 for no limit")
+	flag.Float64Var(&chaos.FailureRate, "chaos-failure-rate", 0,
+		"Testing only, rate of the jobs failed before running them")
+	flag.Float64Var(&chaos.LatencyRate, "chaos-latency-rate", 0,
+		"Testing only, rate of the jobs delayed by up to -chaos-max-latency")
+	flag.DurationVar(&chaos.MaxLatency, "chaos-max-latency", 30*time.Second,
+		"Testing only, longest delay injected in the jobs")
+	flag.Float64Var(&chaos.DropRate, "chaos-drop-rate", 0,
+		"Testing only, rate of the jobs whose result is withheld until cleaned up")
+	flag.Int64Var(&chaos.Seed, "chaos-seed", time.Now().UnixNano(),
+		"Testing only, seed of the injected faults, to reproduce a run")
 	flag.Parse()
+	var opts []RunnerOption
+	if runnerId != "" {
+		opts = append(opts, WithRunnerId(runnerId))
+	}
+	if logSinks != "" {
+		credentials := S3Credentials{
+			AccessKeyId:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			Region:          os.Getenv("AWS_REGION"),
+		}
+		for _, spec := range strings.Split(logSinks, ",") {
+			sink, err := NewLogSink(spec, credentials)
+			if err != nil {
+				log.Fatal(err)
+			}
+			opts = append(opts, WithLogSinks(sink))
+		}
+	}
+	switch {
+	case tokenHelper != "":
+		opts = append(opts, WithCredentials(TokenHelper(tokenHelper), credentialsTTL))
+	case dispatcherURL != "":
+		provider := NewDispatcherCredentials(dispatcherURL)
+		opts = append(opts, WithCredentials(provider, credentialsTTL))
+	}
+	if streamLogs {
+		opts = append(opts, WithLogStreaming())
+	}
+	if spoolDir != "" {
+		opts = append(opts, WithResultSpool(spoolDir))
+	}
+	if journalPath != "" {
+		opts = append(opts, WithJournal(journalPath, reconcileInterval))
+	}
+	if user != "" {
+		opts = append(opts, WithContainerUser(user))
+	}
+	if metricsAddr != "" {
+		opts = append(opts, WithMetrics(metricsAddr))
+	}
+	opts = append(opts, WithStepLogLimit(maxStepLogSize))
+	if chaos.FailureRate > 0 || chaos.LatencyRate > 0 || chaos.DropRate > 0 {
+		log.Printf("Chaos mode enabled with seed %d\n", chaos.Seed)
+		opts = append(opts, WithChaos(chaos))
+	}
+	if allowRepos != "" || denyRepos != "" {
+		opts = append(opts, WithRepositoryPolicy(splitPatterns(allowRepos), splitPatterns(denyRepos)))
+	}
+	if labels != "" {
+		runnerLabels, err := ParseRunnerLabels(labels)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, WithLabels(runnerLabels))
+	}
+	if maxJobs > 0 {
+		opts = append(opts, WithMaxJobs(maxJobs))
+	}
+	if executors != "" {
+		opts = append(opts, WithExecutors(splitPatterns(executors)...))
+	}
+	if dependencyCache {
+		opts = append(opts, WithDependencyCache())
+	}
+	if dependencyProxies != "" {
+		opts = append(opts, WithDependencyProxies(splitPatterns(dependencyProxies)...))
+	}
+	if prePullInterval > 0 {
+		opts = append(opts, WithIdlePrePull(prePullInterval))
+	}
+	if register {
+		if advertiseAddr == "" {
+			var err error
+			if advertiseAddr, err = DetectAdvertiseAddr(dispatcherURL, addr); err != nil {
+				log.Fatalf("Registration failed: %v", err)
+			}
+			log.Printf("Advertising %s to the dispatcher\n", advertiseAddr)
+		}
+		opts = append(opts, WithRegistrationSecret(os.Getenv("NARWHAL_REGISTRATION_SECRET")),
+			WithRegistration(dispatcherURL, advertiseAddr, registrationInterval))
+	}
 	fmt.Println("Start runner")
-	StartRunner("127.0.0.1:9898")
+	if err := StartRunner(addr, opts...); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// splitPatterns parses a comma separated list of repository patterns
+func splitPatterns(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
 }
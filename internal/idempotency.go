@@ -0,0 +1,142 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package internal
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Header carrying the client supplied key identifying a request across
+// retries
+const IdempotencyHeader string = "Idempotency-Key"
+
+type idempotentResponse struct {
+	done    bool
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// IdempotencyCache remembers the responses given to requests carrying an
+// Idempotency-Key header for a while, so retries can be answered with the
+// original response without executing them twice
+type IdempotencyCache struct {
+	mutex     sync.Mutex
+	ttl       time.Duration
+	responses map[string]*idempotentResponse
+}
+
+func NewIdempotencyCache(ttl time.Duration) *IdempotencyCache {
+	return &IdempotencyCache{ttl: ttl, responses: map[string]*idempotentResponse{}}
+}
+
+// recordingWriter captures the response while writing it to the client
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// Idempotent is a middleware replaying the stored response of POST requests
+// already served with the same Idempotency-Key, requests still in flight with
+// the same key are refused with a 409 Conflict. Server errors and panics are
+// not stored so the request can be retried.
+func Idempotent(cache *IdempotencyCache) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyHeader)
+			if key == "" || r.Method != http.MethodPost {
+				next.ServeHTTP(w, r)
+				return
+			}
+			key = r.URL.Path + " " + key
+			now := time.Now()
+			cache.mutex.Lock()
+			for k, res := range cache.responses {
+				if res.done && now.After(res.expires) {
+					delete(cache.responses, k)
+				}
+			}
+			if res, ok := cache.responses[key]; ok {
+				cache.mutex.Unlock()
+				if !res.done {
+					http.Error(w, "request already in progress", http.StatusConflict)
+					return
+				}
+				for k, v := range res.header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(res.status)
+				w.Write(res.body)
+				return
+			}
+			cache.responses[key] = &idempotentResponse{}
+			cache.mutex.Unlock()
+
+			defer func() {
+				// A panicking handler releases the key for the retries,
+				// the panic is then left to the server
+				if err := recover(); err != nil {
+					cache.mutex.Lock()
+					delete(cache.responses, key)
+					cache.mutex.Unlock()
+					panic(err)
+				}
+			}()
+			rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			cache.mutex.Lock()
+			defer cache.mutex.Unlock()
+			if rec.status >= 500 {
+				delete(cache.responses, key)
+				return
+			}
+			cache.responses[key] = &idempotentResponse{
+				done:    true,
+				status:  rec.status,
+				header:  w.Header().Clone(),
+				body:    rec.body.Bytes(),
+				expires: time.Now().Add(cache.ttl),
+			}
+		})
+	}
+}
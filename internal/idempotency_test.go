@@ -0,0 +1,82 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIdempotentReplaysResponse(t *testing.T) {
+	calls := 0
+	handler := Idempotent(NewIdempotencyCache(time.Minute))(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte("job-1"))
+		}))
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/builds", nil)
+		req.Header.Set(IdempotencyHeader, "abc")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusAccepted || rec.Body.String() != "job-1" {
+			t.Errorf("Idempotent failed: unexpected response %d %s", rec.Code, rec.Body)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Idempotent failed: expected 1 call got %d", calls)
+	}
+}
+
+func TestIdempotentReleasesKeyOnPanic(t *testing.T) {
+	calls := 0
+	handler := Idempotent(NewIdempotencyCache(time.Minute))(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls == 1 {
+				panic("boom")
+			}
+			w.WriteHeader(http.StatusAccepted)
+		}))
+	serve := func() (code int, panicked bool) {
+		defer func() { panicked = recover() != nil }()
+		req := httptest.NewRequest(http.MethodPost, "/builds", nil)
+		req.Header.Set(IdempotencyHeader, "abc")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code, false
+	}
+	if _, panicked := serve(); !panicked {
+		t.Errorf("Idempotent failed: expected the panic propagated")
+	}
+	if code, _ := serve(); code != http.StatusAccepted || calls != 2 {
+		t.Errorf("Idempotent failed: expected the retry executed got %d after %d calls", code, calls)
+	}
+}
@@ -145,3 +145,21 @@ func (q AmqpQueue) Consume(itemChan chan []byte) error {
 	<-forever
 	return nil
 }
+
+// Ping checks that the broker is reachable and the queue can be declared
+func (q AmqpQueue) Ping() error {
+	conn, err := amqp.Dial(q.url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	_, err = ch.QueueDeclare(q.queue, q.durable, q.deleteUnused, q.exclusive, q.noWait, nil)
+	return err
+}
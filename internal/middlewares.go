@@ -31,7 +31,8 @@ import (
 	"net/http"
 )
 
-func logging(logger *log.Logger) func(http.Handler) http.Handler {
+// Logging is a middleware tracing every request served by the wrapped handler
+func Logging(logger *log.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			defer func() {